@@ -3,27 +3,35 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/spf13/cobra"
 
 	"github.com/vonshlovens/obsync-pg/internal/config"
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
 	"github.com/vonshlovens/obsync-pg/internal/db"
 	"github.com/vonshlovens/obsync-pg/internal/sync"
 	"github.com/vonshlovens/obsync-pg/internal/watcher"
 )
 
 var (
-	cfgFile string
-	verbose bool
-	version = "dev"
+	cfgFile   string
+	vaultName string
+	verbose   bool
+	version   = "dev"
 )
 
 func main() {
@@ -45,6 +53,7 @@ func main() {
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file path")
+	rootCmd.PersistentFlags().StringVar(&vaultName, "vault", "", "name of the vault to work on (default: every configured vault)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose logging")
 
 	rootCmd.AddCommand(
@@ -54,6 +63,12 @@ func main() {
 		migrateCmd(),
 		initCmd(),
 		pullCmd(),
+		historyCmd(),
+		restoreCmd(),
+		trashCmd(),
+		verifyKeyCmd(),
+		rotateKeyCmd(),
+		generateKeyCmd(),
 	)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -61,105 +76,279 @@ func main() {
 	}
 }
 
+// maxReconnectDelay caps the backoff between attempts to reach the database while offline
+const maxReconnectDelay = time.Minute
+
 func daemonCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "daemon",
 		Short: "Start the background watcher/sync process",
-		Long:  `Starts a daemon that watches the Obsidian vault for changes and syncs them to the database in real-time.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
+		Long:  `Starts a daemon that watches the Obsidian vault for changes and syncs them to the database in real-time. With a vaults list in the config, one daemon serves every vault (or the one chosen with --vault), and vaults in the same database share its connections. Changes made on other devices are written back to the vault as they happen. If the database is unreachable, the daemon keeps running offline: local changes are journaled to disk and synced once the connection returns. Files whose modification time and size haven't changed since the last sync aren't rehashed at startup; use --paranoid to hash every file.`,
+	}
 
-			cfg, err := config.Load(cfgFile)
-			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
-			}
+	paranoid := false
+	cmd.Flags().BoolVar(&paranoid, "paranoid", false, "hash every file instead of trusting unchanged modification times")
 
-			database, err := db.New(ctx, &cfg.Database)
-			if err != nil {
-				return fmt.Errorf("failed to connect to database: %w", err)
-			}
-			defer database.Close()
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		vaults, err := loadVaults()
+		if err != nil {
+			return err
+		}
 
-			engine, err := sync.NewEngine(database, cfg)
-			if err != nil {
-				return fmt.Errorf("failed to create sync engine: %w", err)
-			}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Handle graceful shutdown
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigCh
+			slog.Info("shutting down...")
+			cancel()
+		}()
+
+		// Each vault runs under its own context, so one that fails leaves
+		// the others running
+		errs := make(chan error, len(vaults))
+		for _, cfg := range vaults {
+			go func() {
+				vaultCtx, cancelVault := context.WithCancel(ctx)
+				defer cancelVault()
+
+				err := runDaemon(vaultCtx, cfg, paranoid)
+				if err != nil && len(vaults) > 1 {
+					slog.Error("vault stopped", "vault", cfg.Name, "error", err)
+					err = fmt.Errorf("vault %s: %w", cfg.Name, err)
+				}
+				errs <- err
+			}()
+		}
 
-			// Perform initial full sync
-			slog.Info("performing initial sync")
-			if err := engine.FullReconcile(ctx); err != nil {
-				slog.Error("initial sync failed", "error", err)
-			}
+		if len(vaults) == 1 {
+			fmt.Println("Watching vault for changes. Press Ctrl+C to stop.")
+		} else {
+			fmt.Printf("Watching %d vaults for changes. Press Ctrl+C to stop.\n", len(vaults))
+		}
 
-			// Start file watcher
-			w, err := watcher.NewWatcher(cfg.VaultPath, cfg.Sync.DebounceMs, cfg.IgnorePatterns, cfg.IncludePatterns)
-			if err != nil {
-				return fmt.Errorf("failed to create watcher: %w", err)
+		// The daemon exits once every vault has stopped, reporting those
+		// that failed
+		var failed []error
+		for range vaults {
+			if err := <-errs; err != nil {
+				failed = append(failed, err)
 			}
+		}
+		return errors.Join(failed...)
+	}
 
-			if err := w.Start(ctx); err != nil {
-				return fmt.Errorf("failed to start watcher: %w", err)
-			}
+	return cmd
+}
+
+// runDaemon watches and syncs one vault until ctx is cancelled
+func runDaemon(ctx context.Context, cfg *config.Config, paranoid bool) error {
+	// The daemon starts even if the database is down, and syncs once it's back
+	database, err := db.OpenStore(ctx, &cfg.Database)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer database.Close()
 
-			// Handle graceful shutdown
-			sigCh := make(chan os.Signal, 1)
-			signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	engine, err := sync.NewEngine(database, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create sync engine: %w", err)
+	}
 
-			slog.Info("daemon started", "vault", cfg.VaultPath)
-			fmt.Println("Watching vault for changes. Press Ctrl+C to stop.")
+	engine.SetParanoid(paranoid)
 
-			// Periodic state save and retry ticker
-			saveTicker := time.NewTicker(30 * time.Second)
-			defer saveTicker.Stop()
-
-			for {
-				select {
-				case <-sigCh:
-					slog.Info("shutting down...")
-					w.Stop()
-					w.Flush()
-					engine.SaveState()
-					return nil
+	// Subscribe before the initial sync so no remote change is missed
+	changes := database.Listen(ctx)
+
+	// While offline, local changes go to the outbox and reconnect fires
+	// with exponential backoff
+	online := false
+	var reconnect <-chan time.Time
+	reconnectAttempt := 0
+	retryDelay := time.Duration(cfg.Sync.RetryDelayMs) * time.Millisecond
+
+	goOffline := func() {
+		if reconnectAttempt == 0 {
+			slog.Warn("database unreachable, working offline", "vault", cfg.Name, "host", cfg.Database.Host)
+		}
+		online = false
+		reconnectAttempt++
+		reconnect = time.After(sync.Backoff(retryDelay, maxReconnectDelay, reconnectAttempt, rand.Float64()))
+	}
+
+	// goOnline replays the outbox and catches up with a full sync
+	goOnline := func() {
+		if !database.Reachable(ctx) {
+			goOffline()
+			return
+		}
+		if err := engine.ReplayOutbox(ctx); err != nil {
+			slog.Error("failed to replay offline changes", "vault", cfg.Name, "error", err)
+			goOffline()
+			return
+		}
+
+		online, reconnect, reconnectAttempt = true, nil, 0
+		slog.Info("performing full sync", "vault", cfg.Name)
+		if err := engine.FullReconcile(ctx); err != nil {
+			slog.Error("full sync failed", "vault", cfg.Name, "error", err)
+		}
+	}
+
+	// Perform initial full sync
+	goOnline()
+
+	// Start file watcher
+	w, err := watcher.NewWatcher(cfg.VaultPath, cfg.Sync.DebounceMs, cfg.IgnorePatterns, cfg.IncludePatterns)
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	if err := w.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start watcher: %w", err)
+	}
+
+	slog.Info("daemon started", "vault", cfg.VaultPath)
 
-				case event := <-w.Events():
-					slog.Debug("file event", "path", event.Path, "type", event.EventType)
-					if err := engine.SyncFile(ctx, event.Path, event.EventType); err != nil {
-						slog.Error("sync failed", "path", event.Path, "error", err)
-					}
+	// Periodic state save
+	saveTicker := time.NewTicker(30 * time.Second)
+	defer saveTicker.Stop()
+
+	// Failed operations are retried once their backoff has passed
+	retryTicker := time.NewTicker(time.Second)
+	defer retryTicker.Stop()
+
+	// Note history retention
+	pruneTicker := time.NewTicker(time.Hour)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.Stop()
+			w.Flush()
+			engine.SaveState()
+			return nil
 
-				case <-saveTicker.C:
-					engine.SaveState()
-					engine.RetryFailed(ctx)
+		case event := <-w.Events():
+			slog.Debug("file event", "path", event.Path, "type", event.EventType)
+			if online {
+				err := engine.HandleEvent(ctx, event)
+				if err == nil {
+					continue
 				}
+				if database.Reachable(ctx) {
+					slog.Error("sync failed", "path", event.Path, "old_path", event.OldPath, "error", err)
+					continue
+				}
+				goOffline()
 			}
-		},
+			if err := engine.Journal(event); err != nil {
+				slog.Error("failed to journal offline change", "path", event.Path, "error", err)
+			}
+
+		case change, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			if !online {
+				// The listener got through, so the database is back; the
+				// full sync after reconnecting covers the change
+				goOnline()
+				continue
+			}
+			slog.Debug("remote change", "path", change.Path, "op", change.Op)
+			if err := engine.ApplyRemoteChange(ctx, change); err != nil {
+				slog.Error("failed to apply remote change", "path", change.Path, "error", err)
+			}
+
+		case <-reconnect:
+			goOnline()
+
+		case <-saveTicker.C:
+			engine.SaveState()
+
+		case <-retryTicker.C:
+			if online {
+				engine.RetryFailed(ctx)
+			}
+
+		case <-pruneTicker.C:
+			engine.PruneRevisions(ctx)
+			engine.PruneBlobs(ctx)
+		}
 	}
 }
 
 func syncCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "sync",
 		Short: "One-time full sync, then exit",
-		Long:  `Performs a full synchronization of the vault to the database and exits.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := context.Background()
+		Long:  `Performs a full synchronization of the vault with the database and exits. With a vaults list in the config, every vault is synced unless one is chosen with --vault. Local changes are uploaded, remote changes are downloaded, and files changed on both sides are kept as conflict copies. If an unusually large number of files is missing from the vault (for example because its drive isn't mounted), they are not deleted from the database. Use --allow-mass-delete once you've checked that the deletions are intended. Use --dry-run to see what would change without touching the database or the vault. Use --paranoid to hash every file instead of trusting unchanged modification times and sizes.`,
+	}
+
+	allowMassDelete := false
+	dryRun := false
+	jsonOutput := false
+	paranoid := false
+	cmd.Flags().BoolVar(&allowMassDelete, "allow-mass-delete", false, "delete files even if more are missing than the configured limits")
+	cmd.Flags().BoolVar(&paranoid, "paranoid", false, "hash every file instead of trusting unchanged modification times")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "show what would change without syncing")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the dry-run plan as JSON")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+
+		vaults, err := loadVaults()
+		if err != nil {
+			return err
+		}
 
-			cfg, err := config.Load(cfgFile)
+		// openEngine connects the sync engine of one vault; close the
+		// returned store when done
+		openEngine := func(cfg *config.Config) (db.Store, *sync.Engine, error) {
+			database, err := db.NewStore(ctx, &cfg.Database)
 			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
+				return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
 			}
 
-			database, err := db.New(ctx, &cfg.Database)
+			engine, err := sync.NewEngine(database, cfg)
 			if err != nil {
-				return fmt.Errorf("failed to connect to database: %w", err)
+				database.Close()
+				return nil, nil, fmt.Errorf("failed to create sync engine: %w", err)
 			}
-			defer database.Close()
 
-			engine, err := sync.NewEngine(database, cfg)
+			engine.SetAllowMassDelete(allowMassDelete)
+			engine.SetParanoid(paranoid)
+			return database, engine, nil
+		}
+
+		if dryRun {
+			return printPlans(vaults, jsonOutput, func(cfg *config.Config) (*sync.Plan, error) {
+				database, engine, err := openEngine(cfg)
+				if err != nil {
+					return nil, err
+				}
+				defer database.Close()
+
+				plan, err := engine.PlanSync(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("failed to plan sync: %w", err)
+				}
+				return plan, nil
+			})
+		}
+
+		return forEachVault(vaults, func(cfg *config.Config) error {
+			database, engine, err := openEngine(cfg)
 			if err != nil {
-				return fmt.Errorf("failed to create sync engine: %w", err)
+				return err
 			}
+			defer database.Close()
 
 			if err := engine.FullReconcile(ctx); err != nil {
 				return fmt.Errorf("sync failed: %w", err)
@@ -171,53 +360,134 @@ func syncCmd() *cobra.Command {
 
 			fmt.Println("Sync completed successfully.")
 			return nil
-		},
+		})
 	}
+
+	return cmd
 }
 
 func statusCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "status",
 		Short: "Show connection status and sync info",
-		Long:  `Shows the current database connection status, last sync time, and file counts.`,
+		Long:  `Shows the current database connection status, last sync time, and file counts of each vault, or of the vault chosen with --vault.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := context.Background()
 
-			cfg, err := config.Load(cfgFile)
+			vaults, err := loadVaults()
 			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
+				return err
 			}
 
-			database, err := db.New(ctx, &cfg.Database)
-			if err != nil {
-				fmt.Printf("Database Status: Disconnected\n")
-				fmt.Printf("Error: %v\n", err)
-				return nil
-			}
-			defer database.Close()
+			fmt.Println("=== Obsync-PG Status ===")
+			return forEachVault(vaults, func(cfg *config.Config) error {
+				return printStatus(ctx, cfg)
+			})
+		},
+	}
+}
 
-			status, err := database.GetStatus(ctx)
-			if err != nil {
-				return fmt.Errorf("failed to get status: %w", err)
-			}
+// printStatus shows the status of one vault
+func printStatus(ctx context.Context, cfg *config.Config) error {
+	database, err := db.NewStore(ctx, &cfg.Database)
+	if err != nil {
+		fmt.Printf("Database Status: Disconnected\n")
+		fmt.Printf("Error: %v\n", err)
+		printOutbox(cfg)
+		return nil
+	}
+	defer database.Close()
 
-			fmt.Println("=== Obsync-PG Status ===")
-			fmt.Printf("Database Status: Connected\n")
-			fmt.Printf("  Host: %s\n", cfg.Database.Host)
-			fmt.Printf("  Database: %s\n", cfg.Database.Database)
-			fmt.Printf("  Schema: %s\n", cfg.Database.Schema)
-			fmt.Println()
-			fmt.Printf("Vault Path: %s\n", cfg.VaultPath)
+	status, err := database.GetStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get status: %w", err)
+	}
+
+	fmt.Printf("Database Status: Connected\n")
+	if cfg.Database.Driver == config.DriverSQLite {
+		fmt.Printf("  File: %s\n", cfg.Database.Path)
+	} else {
+		fmt.Printf("  Host: %s\n", cfg.Database.Host)
+		fmt.Printf("  Database: %s\n", cfg.Database.Database)
+		fmt.Printf("  Schema: %s\n", cfg.Database.Schema)
+	}
+	fmt.Println()
+	fmt.Printf("Vault Path: %s\n", cfg.VaultPath)
+	fmt.Println()
+	fmt.Printf("Synced Files:\n")
+	fmt.Printf("  Notes: %d\n", status.TotalNotes)
+	fmt.Printf("  Attachments: %d\n", status.TotalAttach)
+	if status.LastSyncTime != nil {
+		fmt.Printf("  Last Sync: %s\n", status.LastSyncTime.Format(time.RFC3339))
+	}
+	if state, err := sync.NewStateTracker(cfg.VaultPath, cfg.StateFile); err == nil {
+		if blocked := state.GetBlockedDeletes(); blocked != nil {
 			fmt.Println()
-			fmt.Printf("Synced Files:\n")
-			fmt.Printf("  Notes: %d\n", status.TotalNotes)
-			fmt.Printf("  Attachments: %d\n", status.TotalAttach)
-			if status.LastSyncTime != nil {
-				fmt.Printf("  Last Sync: %s\n", status.LastSyncTime.Format(time.RFC3339))
-			}
+			fmt.Printf("WARNING: Deletions Blocked (%s)\n", blocked.DetectedAt.Format(time.RFC3339))
+			fmt.Printf("  %d of %d files are missing from the vault and were not deleted.\n", blocked.Count, blocked.Tracked)
+			fmt.Println("  Check that the vault is available. To delete them, run: obsync-pg sync --allow-mass-delete")
+		}
+	}
 
-			return nil
-		},
+	if status.Trashed > 0 {
+		fmt.Printf("  In Trash: %d (see obsync-pg trash list)\n", status.Trashed)
+	}
+
+	if status.Conflicts > 0 {
+		conflicts, err := database.GetUnresolvedConflicts(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get conflicts: %w", err)
+		}
+
+		fmt.Println()
+		fmt.Printf("Unresolved Conflicts: %d\n", len(conflicts))
+		for _, c := range conflicts {
+			fmt.Printf("  %s\n", c.Path)
+			fmt.Printf("    copy: %s (%s)\n", c.ConflictPath, c.DetectedAt.Format(time.RFC3339))
+		}
+		fmt.Println("Merge each copy into the original and delete it to resolve the conflict.")
+	}
+
+	retryDelay := time.Duration(cfg.Sync.RetryDelayMs) * time.Millisecond
+	if retries, err := sync.NewRetryQueue(cfg.VaultPath, cfg.StateFile, retryDelay, cfg.Sync.RetryAttempts); err == nil {
+		printRetries(retries)
+	}
+	printOutbox(cfg)
+
+	return nil
+}
+
+// printOutbox shows how many local changes are waiting for the database to come back
+func printOutbox(cfg *config.Config) {
+	outbox, err := sync.NewOutbox(cfg.VaultPath, cfg.StateFile)
+	if err != nil {
+		return
+	}
+	if n := outbox.Len(); n > 0 {
+		fmt.Println()
+		fmt.Printf("Offline Changes: %d (synced when the daemon reconnects)\n", n)
+	}
+}
+
+// printRetries lists failed operations waiting to be retried and those given up on
+func printRetries(retries *sync.RetryQueue) {
+	if pending := retries.Pending(); len(pending) > 0 {
+		fmt.Println()
+		fmt.Printf("Pending Retries: %d\n", len(pending))
+		for _, r := range pending {
+			fmt.Printf("  %s (%s, attempt %d, next %s)\n", r.Path, r.Op, r.Attempts, r.NextRetry.Format(time.RFC3339))
+			fmt.Printf("    error: %s\n", r.LastError)
+		}
+	}
+
+	if dead := retries.Dead(); len(dead) > 0 {
+		fmt.Println()
+		fmt.Printf("WARNING: Failed Files: %d\n", len(dead))
+		for _, r := range dead {
+			fmt.Printf("  %s (%s, failed %d times since %s)\n", r.Path, r.Op, r.Attempts, r.FirstFailed.Format(time.RFC3339))
+			fmt.Printf("    error: %s\n", r.LastError)
+		}
+		fmt.Println("These are no longer retried automatically. Fix the cause, then run: obsync-pg sync")
 	}
 }
 
@@ -225,7 +495,7 @@ func migrateCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "migrate",
 		Short: "Run database migrations",
-		Long:  `Runs all pending database migrations.`,
+		Long:  `Runs all pending database migrations in the schema of each vault, or of the vault chosen with --vault.`,
 	}
 
 	migrationsDir := ""
@@ -234,17 +504,11 @@ func migrateCmd() *cobra.Command {
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
 		ctx := context.Background()
 
-		cfg, err := config.Load(cfgFile)
+		vaults, err := loadVaults()
 		if err != nil {
-			return fmt.Errorf("failed to load config: %w", err)
+			return err
 		}
 
-		database, err := db.New(ctx, &cfg.Database)
-		if err != nil {
-			return fmt.Errorf("failed to connect to database: %w", err)
-		}
-		defer database.Close()
-
 		// Resolve migrations directory
 		if !filepath.IsAbs(migrationsDir) {
 			// Try relative to executable first
@@ -259,12 +523,25 @@ func migrateCmd() *cobra.Command {
 			}
 		}
 
-		if err := database.RunMigrations(ctx, migrationsDir); err != nil {
-			return fmt.Errorf("migration failed: %w", err)
-		}
+		return forEachVault(vaults, func(cfg *config.Config) error {
+			if cfg.Database.Driver == config.DriverSQLite {
+				fmt.Println("SQLite databases are set up when they are opened, there is nothing to migrate.")
+				return nil
+			}
 
-		fmt.Println("Migrations completed successfully.")
-		return nil
+			database, err := db.New(ctx, &cfg.Database)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer database.Close()
+
+			if err := database.RunMigrations(ctx, migrationsDir); err != nil {
+				return fmt.Errorf("migration failed: %w", err)
+			}
+
+			fmt.Println("Migrations completed successfully.")
+			return nil
+		})
 	}
 
 	return cmd
@@ -385,16 +662,103 @@ ignore_patterns:
 }
 
 func pullCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "pull",
 		Short: "Download files from database to local vault",
-		Long:  `Downloads all files from the database to the local vault. Use this to set up a new device with existing vault data.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := context.Background()
+		Long: `Downloads all files from the database to the local vault, or to every configured vault unless one is chosen with --vault. Use this to set up a new device with existing vault data. Use --dry-run to see what would change without touching the vault. Use --paranoid to hash every local file instead of trusting unchanged modification times and sizes.
+
+Limit the pull with --include (folders or glob patterns, repeatable), --since (files synced to the database since a time) and --only (notes or attachments).
+
+--overwrite decides what happens to files changed locally since the last sync: skip-local-changes (the default) leaves them for the next sync, backup saves the local version as <file>.bak (or as a conflict copy if the file also changed in the database) before downloading, and overwrite replaces them.`,
+	}
+
+	dryRun := false
+	jsonOutput := false
+	paranoid := false
+	var include []string
+	since := ""
+	only := ""
+	overwrite := string(sync.OverwriteSkip)
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "show what would change without pulling")
+	cmd.Flags().BoolVar(&paranoid, "paranoid", false, "hash every file instead of trusting unchanged modification times")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the dry-run plan as JSON")
+	cmd.Flags().StringArrayVar(&include, "include", nil, `only pull files in this folder or matching this glob pattern (e.g. "Projects/**")`)
+	cmd.Flags().StringVar(&since, "since", "", `only pull files synced since this time (e.g. "2026-01-01" or "7d" ago)`)
+	cmd.Flags().StringVar(&only, "only", "", `only pull "notes" or "attachments"`)
+	cmd.Flags().StringVar(&overwrite, "overwrite", overwrite, "what to do with local changes: skip-local-changes, backup or overwrite")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+
+		vaults, err := loadVaults()
+		if err != nil {
+			return err
+		}
+
+		var sinceTime time.Time
+		if since != "" {
+			if sinceTime, err = parseTime(since, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		// pullOptions returns the options of a pull into one vault, with
+		// --include paths relative to it
+		pullOptions := func(cfg *config.Config) (sync.PullOptions, error) {
+			opts := sync.PullOptions{Only: only, Overwrite: sync.OverwritePolicy(overwrite), Since: sinceTime}
+			for _, pattern := range include {
+				relPath, err := vaultRelPath(cfg.VaultPath, pattern)
+				if err != nil {
+					return opts, err
+				}
+				opts.Include = append(opts.Include, relPath)
+			}
+			return opts, opts.Validate()
+		}
+
+		// openEngine connects the sync engine of one vault; close the
+		// returned store when done
+		openEngine := func(cfg *config.Config) (db.Store, *sync.Engine, error) {
+			database, err := db.NewStore(ctx, &cfg.Database)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+			}
+
+			engine, err := sync.NewEngine(database, cfg)
+			if err != nil {
+				database.Close()
+				return nil, nil, fmt.Errorf("failed to create sync engine: %w", err)
+			}
+
+			engine.SetParanoid(paranoid)
+			return database, engine, nil
+		}
+
+		if dryRun {
+			return printPlans(vaults, jsonOutput, func(cfg *config.Config) (*sync.Plan, error) {
+				opts, err := pullOptions(cfg)
+				if err != nil {
+					return nil, err
+				}
+
+				database, engine, err := openEngine(cfg)
+				if err != nil {
+					return nil, err
+				}
+				defer database.Close()
+
+				plan, err := engine.PlanPull(ctx, opts)
+				if err != nil {
+					return nil, fmt.Errorf("failed to plan pull: %w", err)
+				}
+				return plan, nil
+			})
+		}
 
-			cfg, err := config.Load(cfgFile)
+		return forEachVault(vaults, func(cfg *config.Config) error {
+			opts, err := pullOptions(cfg)
 			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
+				return err
 			}
 
 			// Check if vault directory exists, create if not
@@ -405,23 +769,690 @@ func pullCmd() *cobra.Command {
 				}
 			}
 
-			database, err := db.New(ctx, &cfg.Database)
+			database, engine, err := openEngine(cfg)
 			if err != nil {
-				return fmt.Errorf("failed to connect to database: %w", err)
+				return err
 			}
 			defer database.Close()
 
-			engine, err := sync.NewEngine(database, cfg)
-			if err != nil {
-				return fmt.Errorf("failed to create sync engine: %w", err)
-			}
-
-			if err := engine.PullFromDB(ctx); err != nil {
+			if err := engine.PullFromDB(ctx, opts); err != nil {
 				return fmt.Errorf("pull failed: %w", err)
 			}
 
 			fmt.Println("Pull completed successfully.")
 			return nil
+		})
+	}
+
+	return cmd
+}
+
+// loadVaults loads the config and returns the vault chosen with --vault, or
+// every configured vault
+func loadVaults() ([]*config.Config, error) {
+	cfg, err := config.Load(cfgFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return cfg.SelectVaults(vaultName)
+}
+
+// loadVault loads the config of the vault chosen with --vault, for commands
+// that work on a single vault
+func loadVault() (*config.Config, error) {
+	cfg, err := config.Load(cfgFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return cfg.SelectVault(vaultName)
+}
+
+// forEachVault runs fn for each vault, carrying on with the others if one
+// fails. With several vaults, each one's output is headed by its name.
+func forEachVault(vaults []*config.Config, fn func(cfg *config.Config) error) error {
+	if len(vaults) == 1 {
+		return fn(vaults[0])
+	}
+
+	var failed []string
+	for i, cfg := range vaults {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("--- Vault: %s ---\n", cfg.Name)
+		if err := fn(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed = append(failed, cfg.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed for %d of %d vaults: %s", len(failed), len(vaults), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// printPlans prints the dry run of each vault. As JSON, the plans of several
+// vaults are printed as one object keyed by vault name.
+func printPlans(vaults []*config.Config, asJSON bool, plan func(cfg *config.Config) (*sync.Plan, error)) error {
+	if !asJSON || len(vaults) == 1 {
+		return forEachVault(vaults, func(cfg *config.Config) error {
+			p, err := plan(cfg)
+			if err != nil {
+				return err
+			}
+			return printPlan(p, asJSON)
+		})
+	}
+
+	plans := make(map[string]*sync.Plan, len(vaults))
+	for _, cfg := range vaults {
+		p, err := plan(cfg)
+		if err != nil {
+			return fmt.Errorf("vault %s: %w", cfg.Name, err)
+		}
+		plans[cfg.Name] = p
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plans)
+}
+
+// printPlan shows the changes of a dry run as a table, or as JSON
+func printPlan(plan *sync.Plan, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+
+	if len(plan.Entries) == 0 {
+		fmt.Println("Nothing to do, the vault is up to date.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, entry := range plan.Entries {
+		path := entry.Path
+		if entry.OldPath != "" {
+			path = entry.OldPath + " -> " + entry.Path
+		}
+		size := "-"
+		if entry.Bytes > 0 {
+			size = formatBytes(entry.Bytes)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", entry.Op, size, path, entry.Reason)
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Println("Summary (dry run, nothing was changed):")
+	for _, op := range sync.PlanOps {
+		if n := plan.Count(op); n > 0 {
+			fmt.Printf("  %-13s %d file(s), %s\n", op+":", n, formatBytes(plan.Bytes(op)))
+		}
+	}
+	if plan.Blocked != nil {
+		fmt.Println()
+		fmt.Printf("WARNING: %d of %d files are missing from the vault; they would not be deleted.\n", plan.Blocked.Count, plan.Blocked.Tracked)
+		fmt.Println("  Check that the vault is available. To delete them, run: obsync-pg sync --allow-mass-delete")
+	}
+	return nil
+}
+
+// formatBytes formats a size in bytes for display
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func historyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "history <path>",
+		Short: "List previous versions of a note",
+		Long:  `Lists the stored revisions of a note, newest first. Each time a note is changed or deleted, the version it replaces is kept as a revision that can be brought back with the restore command.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			cfg, err := loadVault()
+			if err != nil {
+				return err
+			}
+
+			relPath, err := vaultRelPath(cfg.VaultPath, args[0])
+			if err != nil {
+				return err
+			}
+
+			database, err := db.NewStore(ctx, &cfg.Database)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer database.Close()
+
+			if err := setCipher(database, cfg); err != nil {
+				return err
+			}
+
+			note, err := database.GetNoteByPath(ctx, relPath)
+			if err != nil {
+				return fmt.Errorf("failed to get note: %w", err)
+			}
+
+			revisions, err := database.GetNoteRevisions(ctx, relPath)
+			if err != nil {
+				return fmt.Errorf("failed to get revisions: %w", err)
+			}
+
+			if note == nil && len(revisions) == 0 {
+				return fmt.Errorf("no history found for %s", relPath)
+			}
+
+			fmt.Printf("History of %s\n", relPath)
+			if note != nil {
+				printRevision("current", &note.SyncedAt, note.SyncedBy, note.ContentHash, "")
+			}
+			for _, r := range revisions {
+				suffix := ""
+				if r.Path != relPath {
+					suffix = fmt.Sprintf("(at %s)", r.Path)
+				}
+				if r.Deleted {
+					suffix += " (deleted after this version)"
+				}
+				printRevision(fmt.Sprintf("%d", r.Revision), r.SyncedAt, r.SyncedBy, r.ContentHash, suffix)
+			}
+
+			if len(revisions) > 0 {
+				fmt.Printf("\nRestore a version with: obsync-pg restore %q --revision N\n", relPath)
+			}
+			return nil
+		},
+	}
+}
+
+func restoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <path>",
+		Short: "Restore a previous version of a note",
+		Long:  `Writes a previous version of a note back into the vault and syncs it to the database. Choose the version by its revision number (see the history command) or by a point in time. The version being replaced is kept in the history, so a restore can itself be undone.`,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	revision := 0
+	at := ""
+	cmd.Flags().IntVar(&revision, "revision", 0, "revision number to restore")
+	cmd.Flags().StringVar(&at, "at", "", `restore the version current at this time (e.g. "2026-01-02 15:04", "2026-01-02" or "36h" ago)`)
+	cmd.MarkFlagsOneRequired("revision", "at")
+	cmd.MarkFlagsMutuallyExclusive("revision", "at")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+
+		cfg, err := loadVault()
+		if err != nil {
+			return err
+		}
+
+		relPath, err := vaultRelPath(cfg.VaultPath, args[0])
+		if err != nil {
+			return err
+		}
+
+		database, err := db.NewStore(ctx, &cfg.Database)
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		}
+		defer database.Close()
+
+		// The engine decrypts the revision's content
+		engine, err := sync.NewEngine(database, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create sync engine: %w", err)
+		}
+
+		var rev *db.VaultNoteRevision
+		if at != "" {
+			t, err := parseTime(at, time.Now())
+			if err != nil {
+				return err
+			}
+
+			rev, err = database.GetNoteRevisionAt(ctx, relPath, t)
+			if err != nil {
+				return fmt.Errorf("failed to get revision: %w", err)
+			}
+			if rev == nil {
+				note, err := database.GetNoteByPath(ctx, relPath)
+				if err != nil {
+					return fmt.Errorf("failed to get note: %w", err)
+				}
+				if note != nil && !note.SyncedAt.After(t) {
+					fmt.Println("The current version was already in place at that time, nothing to restore.")
+					return nil
+				}
+				return fmt.Errorf("no version of %s found at %s", relPath, t.Format(time.RFC3339))
+			}
+		} else {
+			rev, err = database.GetNoteRevision(ctx, relPath, revision)
+			if err != nil {
+				return fmt.Errorf("failed to get revision: %w", err)
+			}
+			if rev == nil {
+				return fmt.Errorf("revision %d of %s not found", revision, relPath)
+			}
+		}
+
+		if err := engine.RestoreNote(ctx, relPath, []byte(rev.RawContent)); err != nil {
+			return fmt.Errorf("restore failed: %w", err)
+		}
+
+		if err := engine.SaveState(); err != nil {
+			slog.Warn("failed to save state", "error", err)
+		}
+
+		fmt.Printf("Restored %s to revision %d.\n", relPath, rev.Revision)
+		return nil
+	}
+
+	return cmd
+}
+
+// printRevision prints one line of the history listing
+func printRevision(label string, syncedAt *time.Time, device *string, hash, suffix string) {
+	when := "-"
+	if syncedAt != nil {
+		when = syncedAt.Local().Format("2006-01-02 15:04:05")
+	}
+	by := "-"
+	if device != nil {
+		by = *device
+	}
+	fmt.Printf("  %-8s %s  %-16s %s %s\n", label, when, by, hash[:8], suffix)
+}
+
+// vaultRelPath converts a path given on the command line to the vault-relative
+// form stored in the database
+func vaultRelPath(vaultPath, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(vaultPath, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", fmt.Errorf("path is outside the vault: %s", path)
+		}
+		path = rel
+	}
+	return filepath.ToSlash(filepath.Clean(path)), nil
+}
+
+// parseTime parses an absolute time in local time, or a duration before now
+// such as "36h" or "30d"
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+func trashCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trash",
+		Short: "List, restore or purge deleted files",
+		Long:  `Deleted notes and attachments are kept in the database trash until they are purged. Files in the trash are hidden from sync and pull, and can be restored on any device.`,
+	}
+
+	cmd.AddCommand(trashListCmd(), trashRestoreCmd(), trashPurgeCmd())
+	return cmd
+}
+
+func trashListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List files in the trash",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			cfg, err := loadVault()
+			if err != nil {
+				return err
+			}
+
+			database, err := db.NewStore(ctx, &cfg.Database)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer database.Close()
+
+			files, err := database.GetTrash(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get trash: %w", err)
+			}
+
+			if len(files) == 0 {
+				fmt.Println("Trash is empty.")
+				return nil
+			}
+
+			for _, f := range files {
+				by := "-"
+				if f.DeletedBy != nil {
+					by = *f.DeletedBy
+				}
+				fmt.Printf("  %s  %-16s %s\n", f.DeletedAt.Local().Format("2006-01-02 15:04:05"), by, f.Path)
+			}
+			fmt.Printf("\n%d file(s) in trash.\n", len(files))
+			return nil
+		},
+	}
+}
+
+func trashRestoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore [path|pattern]...",
+		Short: "Restore files from the trash",
+		Long:  `Restores files from the trash and writes them back into the vault. Files can be given as paths, folders or glob patterns (e.g. "Projects/**").`,
+	}
+
+	all := false
+	cmd.Flags().BoolVar(&all, "all", false, "restore everything in the trash")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && !all {
+			return fmt.Errorf("specify files to restore or use --all")
+		}
+
+		ctx := context.Background()
+
+		cfg, err := loadVault()
+		if err != nil {
+			return err
+		}
+
+		database, err := db.NewStore(ctx, &cfg.Database)
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		}
+		defer database.Close()
+
+		files, err := database.GetTrash(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get trash: %w", err)
+		}
+
+		paths := selectTrash(files, cfg.VaultPath, args, time.Time{})
+		if len(paths) == 0 {
+			fmt.Println("No matching files in trash.")
+			return nil
+		}
+
+		engine, err := sync.NewEngine(database, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create sync engine: %w", err)
+		}
+
+		if err := engine.RestoreFromTrash(ctx, paths); err != nil {
+			return err
+		}
+
+		if err := engine.SaveState(); err != nil {
+			slog.Warn("failed to save state", "error", err)
+		}
+
+		fmt.Printf("Restored %d file(s).\n", len(paths))
+		return nil
+	}
+
+	return cmd
+}
+
+func trashPurgeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "purge [path|pattern]...",
+		Short: "Permanently delete files from the trash",
+		Long:  `Permanently deletes files from the trash, including the version history of purged notes. This cannot be undone.`,
+	}
+
+	all := false
+	olderThan := ""
+	cmd.Flags().BoolVar(&all, "all", false, "purge everything in the trash")
+	cmd.Flags().StringVar(&olderThan, "older-than", "", `only purge files deleted before this time (e.g. "30d" or "2026-01-02")`)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && !all && olderThan == "" {
+			return fmt.Errorf("specify files to purge, --older-than or --all")
+		}
+
+		var before time.Time
+		if olderThan != "" {
+			t, err := parseTime(olderThan, time.Now())
+			if err != nil {
+				return err
+			}
+			before = t
+		}
+
+		ctx := context.Background()
+
+		cfg, err := loadVault()
+		if err != nil {
+			return err
+		}
+
+		database, err := db.NewStore(ctx, &cfg.Database)
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		}
+		defer database.Close()
+
+		files, err := database.GetTrash(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get trash: %w", err)
+		}
+
+		paths := selectTrash(files, cfg.VaultPath, args, before)
+		if len(paths) == 0 {
+			fmt.Println("No matching files in trash.")
+			return nil
+		}
+
+		purged, err := database.PurgeTrash(ctx, paths)
+		if err != nil {
+			return fmt.Errorf("purge failed: %w", err)
+		}
+
+		fmt.Printf("Permanently deleted %d file(s).\n", purged)
+		return nil
+	}
+
+	return cmd
+}
+
+// selectTrash returns the paths of trashed files matching any of the given
+// paths, folders or glob patterns (all files if none are given) that were
+// deleted before the given time (if set)
+func selectTrash(files []*db.TrashedFile, vaultPath string, patterns []string, before time.Time) []string {
+	var paths []string
+	for _, f := range files {
+		if !before.IsZero() && !f.DeletedAt.Before(before) {
+			continue
+		}
+		if len(patterns) > 0 && !matchAny(f.Path, vaultPath, patterns) {
+			continue
+		}
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+// matchAny reports whether relPath is, or is inside, one of the patterns
+func matchAny(relPath, vaultPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern, err := vaultRelPath(vaultPath, pattern)
+		if err != nil {
+			continue
+		}
+		if relPath == pattern || strings.HasPrefix(relPath, pattern+"/") {
+			return true
+		}
+		if ok, _ := doublestar.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setCipher makes the database decrypt content with the configured key, for
+// commands that read from the database without a sync engine
+func setCipher(database db.Store, cfg *config.Config) error {
+	cipher, err := crypt.Load(cfg.Encryption, cfg.Database.Schema)
+	if err != nil {
+		return fmt.Errorf("failed to load encryption key: %w", err)
+	}
+	database.SetCipher(cipher, cfg.Encryption.Plaintext)
+	return nil
+}
+
+func verifyKeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify-key",
+		Short: "Check the encryption key against the vault",
+		Long:  `Compares the fingerprint of the configured encryption key with the fingerprint stored in the database. Devices refuse to sync with a key that doesn't match, so they can't write content other devices can't read.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			cfg, err := loadVault()
+			if err != nil {
+				return err
+			}
+
+			database, err := db.NewStore(ctx, &cfg.Database)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer database.Close()
+
+			engine, err := sync.NewEngine(database, cfg)
+			if err != nil {
+				return fmt.Errorf("failed to create sync engine: %w", err)
+			}
+
+			stored, err := engine.VerifyKey(ctx)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case stored != "":
+				fmt.Printf("The configured key matches the vault key (fingerprint %s).\n", stored[:16])
+			case database.Cipher() != nil:
+				fmt.Println("The vault is not encrypted yet. The configured key is registered on the next sync.")
+				fmt.Println("Encrypt existing content with: obsync-pg rotate-key")
+			default:
+				fmt.Println("The vault is not encrypted, and encryption is not enabled in the config.")
+			}
+			return nil
+		},
+	}
+}
+
+func rotateKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Re-encrypt the vault with the configured key",
+		Long:  `Re-encrypts all notes, revisions and attachments, including those in an external blob store, with the key in the config. Give the key the vault is encrypted with now using --old-key-file or --old-passphrase-env. Without an old key, content stored in plaintext is encrypted, which is how an existing vault is encrypted for the first time. Other devices stop syncing until their config has the new key. An interrupted rotation can be run again.`,
+	}
+
+	oldKeyFile := ""
+	oldPassphraseEnv := ""
+	cmd.Flags().StringVar(&oldKeyFile, "old-key-file", "", "key file the vault is encrypted with now")
+	cmd.Flags().StringVar(&oldPassphraseEnv, "old-passphrase-env", "", "environment variable holding the passphrase the vault is encrypted with now")
+	cmd.MarkFlagsMutuallyExclusive("old-key-file", "old-passphrase-env")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+
+		cfg, err := loadVault()
+		if err != nil {
+			return err
+		}
+
+		var old *crypt.Cipher
+		switch {
+		case oldKeyFile != "":
+			old, err = crypt.FromKeyFile(oldKeyFile)
+		case oldPassphraseEnv != "":
+			passphrase := os.Getenv(oldPassphraseEnv)
+			if passphrase == "" {
+				return fmt.Errorf("environment variable %s is not set", oldPassphraseEnv)
+			}
+			old, err = crypt.FromPassphrase(passphrase, cfg.Database.Schema)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load old key: %w", err)
+		}
+
+		database, err := db.NewStore(ctx, &cfg.Database)
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		}
+		defer database.Close()
+
+		engine, err := sync.NewEngine(database, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create sync engine: %w", err)
+		}
+
+		if err := engine.RotateKey(ctx, old); err != nil {
+			return fmt.Errorf("key rotation failed: %w", err)
+		}
+
+		fmt.Printf("Vault re-encrypted with key %s.\n", database.Cipher().Fingerprint()[:16])
+		fmt.Println("Update the encryption settings on your other devices to the new key.")
+		return nil
+	}
+
+	return cmd
+}
+
+func generateKeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "generate-key <file>",
+		Short: "Write a new random encryption key file",
+		Long:  `Writes a new random key to a file readable only by you, for use as encryption.key_file. Copy the file to every device syncing the vault, and keep a backup: content can't be recovered without it.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := crypt.GenerateKeyFile(args[0]); err != nil {
+				return fmt.Errorf("failed to write key file: %w", err)
+			}
+			fmt.Printf("Wrote a new key to %s.\n", args[0])
+			return nil
 		},
 	}
 }
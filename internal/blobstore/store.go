@@ -0,0 +1,48 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+)
+
+// ErrNotFound is returned when a key has no stored content
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps attachment content outside the database. The database row of
+// an attachment records the key its content is stored under.
+type Store interface {
+	// Put stores size bytes read from r under key, replacing any previous content
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the content stored under key, or returns ErrNotFound
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the content stored under key. Missing keys are not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// New creates the store configured for the vault, or returns nil if no
+// external store is configured
+func New(cfg config.BlobStoreConfig) (Store, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "local":
+		return NewLocalStore(cfg.Path)
+	case "s3":
+		return NewS3Store(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob store type %q (expected \"local\" or \"s3\")", cfg.Type)
+	}
+}
+
+// Key returns the key content with the given hash is stored under. The
+// first two characters of the hash spread keys over subdirectories.
+func Key(hash string) string {
+	if len(hash) < 2 {
+		return hash
+	}
+	return hash[:2] + "/" + hash
+}
@@ -0,0 +1,107 @@
+// Package chunker splits content into content-defined chunks. Chunk
+// boundaries depend on the bytes around them rather than their offset, so
+// an edit to a large file only changes the chunks it touches and the rest
+// are deduplicated against the previous version.
+package chunker
+
+import "io"
+
+// Chunk size limits. Chunks average about AvgSize bytes.
+const (
+	MinSize = 256 * 1024
+	AvgSize = 1024 * 1024
+	MaxSize = 4 * 1024 * 1024
+)
+
+// Cut-point masks for normalized chunking (FastCDC): cuts before AvgSize
+// need more matching bits than cuts after it, which narrows the spread of
+// chunk sizes around the average. The gear hash mixes new bytes into the
+// low bits, so the masks test the high bits, which depend on the last 64
+// bytes.
+const (
+	maskSmall = uint64(1<<22-1) << (64 - 22)
+	maskLarge = uint64(1<<18-1) << (64 - 18)
+)
+
+// gear maps every byte to a pseudo-random value. It must never change:
+// chunks stored by one version are deduplicated against chunks of the next.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	x := uint64(0x6f6273796e632d70)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker reads content from a reader and returns it chunk by chunk,
+// holding at most MaxSize bytes in memory
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int // Start of the data not yet returned
+	end   int // End of the data read so far
+	eof   bool
+}
+
+// New creates a chunker reading from r
+func New(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, MaxSize)}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+
+	if !c.eof && c.end < len(c.buf) {
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+	}
+
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+
+	c.start = cutPoint(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
+
+// cutPoint returns the length of the first chunk of data
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+
+	var h uint64
+	i := MinSize
+	for normal := min(n, AvgSize); i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,88 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand/v2"
+	"testing"
+)
+
+// randomData returns deterministic pseudo-random content
+func randomData(n int, seed uint64) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+// split returns the chunks of data
+func split(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	c := New(bytes.NewReader(data))
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestChunker_Reassembles(t *testing.T) {
+	for _, n := range []int{0, 1, MinSize, MaxSize + 1, 10*AvgSize + 12345} {
+		data := randomData(n, 1)
+		chunks := split(t, data)
+
+		if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+			t.Errorf("size %d: chunks don't reassemble to the input", n)
+		}
+		for i, chunk := range chunks {
+			if len(chunk) > MaxSize {
+				t.Errorf("size %d: chunk %d has %d bytes, more than MaxSize", n, i, len(chunk))
+			}
+			if len(chunk) < MinSize && i != len(chunks)-1 {
+				t.Errorf("size %d: chunk %d has %d bytes, less than MinSize", n, i, len(chunk))
+			}
+		}
+	}
+}
+
+func TestChunker_Zeros(t *testing.T) {
+	// No content-defined cut points; chunks are cut at MaxSize
+	chunks := split(t, make([]byte, 2*MaxSize+1))
+	if len(chunks) != 3 || len(chunks[0]) != MaxSize || len(chunks[2]) != 1 {
+		t.Errorf("got %d chunks", len(chunks))
+	}
+}
+
+func TestChunker_LocalEdit(t *testing.T) {
+	data := randomData(20*AvgSize, 2)
+	edited := append(bytes.Clone(data[:5*AvgSize]), []byte("inserted text")...)
+	edited = append(edited, data[5*AvgSize:]...)
+
+	before := make(map[[32]byte]bool)
+	for _, chunk := range split(t, data) {
+		before[sha256.Sum256(chunk)] = true
+	}
+
+	after := split(t, edited)
+	changed := 0
+	for _, chunk := range after {
+		if !before[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+
+	// The boundaries resynchronize after the edit, so only the chunks
+	// around it change
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after a small insert", changed, len(after))
+	}
+}
@@ -15,31 +15,114 @@ import (
 
 // Config holds all application configuration
 type Config struct {
-	VaultPath       string         `mapstructure:"vault_path" validate:"required,dir"`
-	Database        DatabaseConfig `mapstructure:"database" validate:"required"`
-	Sync            SyncConfig     `mapstructure:"sync"`
-	IgnorePatterns  []string       `mapstructure:"ignore_patterns"`
-	IncludePatterns []string       `mapstructure:"include_patterns"`
+	VaultPath       string           `mapstructure:"vault_path" validate:"required_without=Vaults,excluded_with=Vaults,omitempty,dir"`
+	Vaults          []VaultConfig    `mapstructure:"vaults" validate:"unique=Name,dive"` // Used instead of vault_path to sync several vaults
+	StateFile       string           `mapstructure:"state_file"`                         // Optional: defaults to a file in the config directory
+	DeviceName      string           `mapstructure:"device_name"`                        // Optional: defaults to the hostname
+	Database        DatabaseConfig   `mapstructure:"database" validate:"required"`
+	Sync            SyncConfig       `mapstructure:"sync"`
+	History         HistoryConfig    `mapstructure:"history"`
+	BlobStore       BlobStoreConfig  `mapstructure:"blob_store"`
+	Encryption      EncryptionConfig `mapstructure:"encryption"`
+	IgnorePatterns  []string         `mapstructure:"ignore_patterns"`
+	IncludePatterns []string         `mapstructure:"include_patterns"`
+
+	// Name of the vault, chosen with --vault. Set from vaults[].name, or to
+	// the schema without a vaults list.
+	Name string `mapstructure:"-"`
+}
+
+// VaultConfig is one entry of the vaults list. Settings other than these are
+// shared by all vaults.
+type VaultConfig struct {
+	Name     string          `mapstructure:"name"` // Optional: defaults to the schema
+	Path     string          `mapstructure:"path" validate:"required,dir"`
+	Schema   string          `mapstructure:"schema"`   // Optional: derived from the folder name
+	Database *DatabaseConfig `mapstructure:"database"` // Optional: used instead of the top-level database
+
+	// Optional: used instead of the top-level patterns
+	IgnorePatterns  []string `mapstructure:"ignore_patterns"`
+	IncludePatterns []string `mapstructure:"include_patterns"`
+
+	StateFile string `mapstructure:"state_file"` // Optional: defaults to a file in the config directory
 }
 
+// Database drivers
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite" // A local file; needs a build with cgo
+)
+
 // DatabaseConfig holds database connection settings
 type DatabaseConfig struct {
-	Host     string `mapstructure:"host" validate:"required"`
+	Driver   string `mapstructure:"driver" validate:"omitempty,oneof=postgres sqlite"`
+	Path     string `mapstructure:"path" validate:"required_if=Driver sqlite"` // File of the sqlite driver
+	Host     string `mapstructure:"host" validate:"required_unless=Driver sqlite"`
 	Port     int    `mapstructure:"port" validate:"required,min=1,max=65535"`
-	User     string `mapstructure:"user" validate:"required"`
-	Password string `mapstructure:"password" validate:"required"`
-	Database string `mapstructure:"database" validate:"required"`
+	User     string `mapstructure:"user" validate:"required_unless=Driver sqlite"`
+	Password string `mapstructure:"password" validate:"required_unless=Driver sqlite"`
+	Database string `mapstructure:"database" validate:"required_unless=Driver sqlite"`
 	Schema   string `mapstructure:"schema"` // Optional: derived from vault name if not specified
 	SSLMode  string `mapstructure:"sslmode"`
+
+	// Compression of note content and attachment data written by this device
+	Compression string `mapstructure:"compression" validate:"omitempty,oneof=none zstd"`
 }
 
 // SyncConfig holds sync behavior settings
 type SyncConfig struct {
-	DebounceMs       int `mapstructure:"debounce_ms"`
-	MaxBinarySizeMB  int `mapstructure:"max_binary_size_mb"`
-	BatchSize        int `mapstructure:"batch_size"`
-	RetryAttempts    int `mapstructure:"retry_attempts"`
-	RetryDelayMs     int `mapstructure:"retry_delay_ms"`
+	DebounceMs      int  `mapstructure:"debounce_ms"`
+	MaxBinarySizeMB int  `mapstructure:"max_binary_size_mb"`
+	BatchSize       int  `mapstructure:"batch_size"`
+	RetryAttempts   int  `mapstructure:"retry_attempts"`
+	RetryDelayMs    int  `mapstructure:"retry_delay_ms"`
+	AutoMerge       bool `mapstructure:"auto_merge"`    // Merge non-overlapping edits instead of creating conflict copies
+	Workers         int  `mapstructure:"workers"`       // Files hashed and uploaded in parallel during a full sync
+	PreserveMode    bool `mapstructure:"preserve_mode"` // Store permission bits and restore them on download
+
+	// A full sync refuses to delete more files than this (0 disables the limit)
+	MassDeleteCount   int `mapstructure:"mass_delete_count"`
+	MassDeletePercent int `mapstructure:"mass_delete_percent"` // Percentage of tracked files
+}
+
+// HistoryConfig controls how long previous versions of notes are kept
+type HistoryConfig struct {
+	KeepRevisions int `mapstructure:"keep_revisions"` // Per note; 0 keeps all
+	MaxAgeDays    int `mapstructure:"max_age_days"`   // 0 keeps revisions forever
+}
+
+// BlobStoreConfig configures an external store for attachments too large to
+// keep in the database
+type BlobStoreConfig struct {
+	Type string   `mapstructure:"type" validate:"omitempty,oneof=local s3"` // Empty keeps all attachments in the database
+	Path string   `mapstructure:"path"`                                     // Directory of a local store
+	S3   S3Config `mapstructure:"s3"`
+
+	// Attachments larger than this go to the store; 0 uses sync.max_binary_size_mb
+	MinSizeMB  int      `mapstructure:"min_size_mb"`
+	Extensions []string `mapstructure:"extensions"` // Attachments with these extensions always go to the store
+}
+
+// EncryptionConfig turns on client-side encryption of note content and
+// attachment data. Every device syncing the vault needs the same key.
+type EncryptionConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	Passphrase string `mapstructure:"passphrase"` // Stretched into a key with the schema name as salt
+	KeyFile    string `mapstructure:"key_file"`   // Used instead of the passphrase if set
+
+	// Metadata columns stored in plaintext, so they can be queried in SQL.
+	// Note content and body are always encrypted.
+	Plaintext []string `mapstructure:"plaintext" validate:"dive,oneof=title tags aliases links frontmatter"`
+}
+
+// S3Config holds the settings of an S3-compatible bucket
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint"` // e.g. https://s3.amazonaws.com or http://localhost:9000
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	Prefix    string `mapstructure:"prefix"` // Optional: key prefix within the bucket
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
 }
 
 // ConnectionString returns the PostgreSQL connection string
@@ -59,10 +142,86 @@ func (d *DatabaseConfig) ConnectionString() string {
 	return connStr
 }
 
+// VaultConfigs returns the configuration of each vault, with the settings
+// shared by all vaults filled in. Without a vaults list, the config itself is
+// the only vault.
+func (c *Config) VaultConfigs() []*Config {
+	if len(c.Vaults) == 0 {
+		return []*Config{c}
+	}
+
+	configs := make([]*Config, 0, len(c.Vaults))
+	for _, v := range c.Vaults {
+		vc := *c
+		vc.Vaults = nil
+		vc.Name = v.Name
+		vc.VaultPath = v.Path
+		vc.StateFile = v.StateFile
+		if v.Database != nil {
+			vc.Database = *v.Database
+		}
+		vc.Database.Schema = v.Schema
+		if v.IgnorePatterns != nil {
+			vc.IgnorePatterns = v.IgnorePatterns
+		}
+		if v.IncludePatterns != nil {
+			vc.IncludePatterns = v.IncludePatterns
+		}
+
+		// Vaults sharing a blob store keep their content apart, so pruning
+		// one vault never removes content another one uses
+		switch vc.BlobStore.Type {
+		case "local":
+			vc.BlobStore.Path = filepath.Join(vc.BlobStore.Path, v.Schema)
+		case "s3":
+			vc.BlobStore.S3.Prefix = strings.TrimPrefix(strings.Trim(vc.BlobStore.S3.Prefix, "/")+"/"+v.Schema, "/")
+		}
+
+		configs = append(configs, &vc)
+	}
+	return configs
+}
+
+// SelectVaults returns the configuration of the named vault, or of every
+// vault if name is empty
+func (c *Config) SelectVaults(name string) ([]*Config, error) {
+	configs := c.VaultConfigs()
+	if name == "" {
+		return configs, nil
+	}
+
+	names := make([]string, 0, len(configs))
+	for _, vc := range configs {
+		if vc.Name == name {
+			return []*Config{vc}, nil
+		}
+		names = append(names, vc.Name)
+	}
+	return nil, fmt.Errorf("no vault named %q (configured: %s)", name, strings.Join(names, ", "))
+}
+
+// SelectVault returns the configuration of the named vault. The name can be
+// left empty if only one vault is configured.
+func (c *Config) SelectVault(name string) (*Config, error) {
+	configs, err := c.SelectVaults(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) > 1 {
+		names := make([]string, len(configs))
+		for i, vc := range configs {
+			names[i] = vc.Name
+		}
+		return nil, fmt.Errorf("several vaults are configured, choose one with --vault (%s)", strings.Join(names, ", "))
+	}
+	return configs[0], nil
+}
+
 // DefaultConfig returns a Config with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
 		Database: DatabaseConfig{
+			Driver:  DriverPostgres,
 			Port:    5432,
 			SSLMode: "require",
 		},
@@ -72,6 +231,15 @@ func DefaultConfig() *Config {
 			BatchSize:       100,
 			RetryAttempts:   3,
 			RetryDelayMs:    1000,
+			AutoMerge:       true,
+			Workers:         4,
+
+			MassDeleteCount:   50,
+			MassDeletePercent: 25,
+		},
+		History: HistoryConfig{
+			KeepRevisions: 50,
+			MaxAgeDays:    365,
 		},
 		IgnorePatterns: []string{
 			".obsidian/**",
@@ -89,6 +257,7 @@ func Load(configPath string) (*Config, error) {
 
 	// Set defaults
 	defaults := DefaultConfig()
+	v.SetDefault("database.driver", defaults.Database.Driver)
 	v.SetDefault("database.port", defaults.Database.Port)
 	v.SetDefault("database.sslmode", defaults.Database.SSLMode)
 	v.SetDefault("sync.debounce_ms", defaults.Sync.DebounceMs)
@@ -96,6 +265,13 @@ func Load(configPath string) (*Config, error) {
 	v.SetDefault("sync.batch_size", defaults.Sync.BatchSize)
 	v.SetDefault("sync.retry_attempts", defaults.Sync.RetryAttempts)
 	v.SetDefault("sync.retry_delay_ms", defaults.Sync.RetryDelayMs)
+	v.SetDefault("sync.auto_merge", defaults.Sync.AutoMerge)
+	v.SetDefault("sync.workers", defaults.Sync.Workers)
+	v.SetDefault("sync.preserve_mode", defaults.Sync.PreserveMode)
+	v.SetDefault("sync.mass_delete_count", defaults.Sync.MassDeleteCount)
+	v.SetDefault("sync.mass_delete_percent", defaults.Sync.MassDeletePercent)
+	v.SetDefault("history.keep_revisions", defaults.History.KeepRevisions)
+	v.SetDefault("history.max_age_days", defaults.History.MaxAgeDays)
 	v.SetDefault("ignore_patterns", defaults.IgnorePatterns)
 
 	// Configure config file
@@ -133,11 +309,53 @@ func Load(configPath string) (*Config, error) {
 
 	// Expand vault path
 	cfg.VaultPath = expandPath(cfg.VaultPath)
+	cfg.StateFile = expandPath(cfg.StateFile)
+	cfg.Database.Path = expandPath(cfg.Database.Path)
+
+	// Blob store credentials can come from the environment too
+	cfg.BlobStore.Path = expandPath(cfg.BlobStore.Path)
+	cfg.BlobStore.S3.AccessKey = os.ExpandEnv(cfg.BlobStore.S3.AccessKey)
+	cfg.BlobStore.S3.SecretKey = os.ExpandEnv(cfg.BlobStore.S3.SecretKey)
+
+	// Keep the encryption key out of the config file
+	cfg.Encryption.Passphrase = os.ExpandEnv(cfg.Encryption.Passphrase)
+	cfg.Encryption.KeyFile = expandPath(cfg.Encryption.KeyFile)
+
+	// Identify this device in conflict copies and the database
+	if cfg.DeviceName == "" {
+		cfg.DeviceName = DefaultDeviceName()
+	}
 
 	// Derive schema name from vault folder if not specified
-	if cfg.Database.Schema == "" {
+	if cfg.Database.Schema == "" && cfg.VaultPath != "" {
 		cfg.Database.Schema = SanitizeIdentifier(filepath.Base(cfg.VaultPath))
 	}
+	cfg.Name = cfg.Database.Schema
+
+	for i := range cfg.Vaults {
+		v := &cfg.Vaults[i]
+		v.Path = expandPath(v.Path)
+		v.StateFile = expandPath(v.StateFile)
+		if v.Schema == "" {
+			v.Schema = SanitizeIdentifier(filepath.Base(v.Path))
+		}
+		if v.Name == "" {
+			v.Name = v.Schema
+		}
+		if d := v.Database; d != nil {
+			if d.Driver == "" {
+				d.Driver = defaults.Database.Driver
+			}
+			if d.Port == 0 {
+				d.Port = defaults.Database.Port
+			}
+			if d.SSLMode == "" {
+				d.SSLMode = defaults.Database.SSLMode
+			}
+			d.Password = os.ExpandEnv(d.Password)
+			d.Path = expandPath(d.Path)
+		}
+	}
 
 	// Validate
 	validate := validator.New()
@@ -159,9 +377,38 @@ func Load(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
 
+	if err := checkVaultsApart(cfg.VaultConfigs()); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+
 	return cfg, nil
 }
 
+// checkVaultsApart returns an error if two vaults are the same folder, or
+// would be stored in the same tables: the same schema of a PostgreSQL
+// database, or the same SQLite file
+func checkVaultsApart(configs []*Config) error {
+	seen := make(map[string]string, len(configs))
+	paths := make(map[string]string, len(configs))
+	for _, vc := range configs {
+		path := filepath.Clean(vc.VaultPath)
+		if other, ok := paths[path]; ok {
+			return fmt.Errorf("vaults %q and %q have the same path %s", other, vc.Name, vc.VaultPath)
+		}
+		paths[path] = vc.Name
+
+		where := vc.Database.ConnectionString()
+		if vc.Database.Driver == DriverSQLite {
+			where = "sqlite:" + vc.Database.Path
+		}
+		if other, ok := seen[where]; ok {
+			return fmt.Errorf("vaults %q and %q are stored in the same database tables; give them different schemas (or database paths with sqlite)", other, vc.Name)
+		}
+		seen[where] = vc.Name
+	}
+	return nil
+}
+
 // getConfigDir returns the appropriate config directory for the OS
 func getConfigDir() string {
 	switch runtime.GOOS {
@@ -179,6 +426,19 @@ func getConfigDir() string {
 	}
 }
 
+// DefaultDeviceName returns the hostname, or "unknown" if it can't be determined
+func DefaultDeviceName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	// Drop the domain part, e.g. "laptop.local" -> "laptop"
+	if idx := strings.Index(host, "."); idx > 0 {
+		host = host[:idx]
+	}
+	return host
+}
+
 // GetStateDir returns the directory for storing state files
 func GetStateDir() (string, error) {
 	dir := getConfigDir()
@@ -1,6 +1,10 @@
 package config
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestSanitizeIdentifier(t *testing.T) {
 	tests := []struct {
@@ -107,3 +111,166 @@ func TestSanitizeIdentifier_ValidIdentifier(t *testing.T) {
 		}
 	}
 }
+
+// writeConfig writes a config file to a temporary directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadVaults(t *testing.T) {
+	work := filepath.Join(t.TempDir(), "Work Notes")
+	personal := filepath.Join(t.TempDir(), "Personal")
+	for _, dir := range []string{work, personal} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := Load(writeConfig(t, `
+database:
+  host: localhost
+  user: postgres
+  password: secret
+  database: obsidian
+blob_store:
+  type: local
+  path: /srv/blobs
+ignore_patterns: [".obsidian/**"]
+vaults:
+  - path: "`+work+`"
+  - name: home
+    path: "`+personal+`"
+    schema: private
+    ignore_patterns: ["Drafts/**"]
+    state_file: /tmp/home-state.json
+    database:
+      driver: sqlite
+      path: /tmp/home.db
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vaults := cfg.VaultConfigs()
+	if len(vaults) != 2 {
+		t.Fatalf("%d vaults, want 2", len(vaults))
+	}
+
+	w, h := vaults[0], vaults[1]
+	if w.Name != "work_notes" || w.VaultPath != work || w.Database.Schema != "work_notes" || w.Database.Host != "localhost" {
+		t.Errorf("work vault = name %q, path %q, schema %q, host %q", w.Name, w.VaultPath, w.Database.Schema, w.Database.Host)
+	}
+	if w.IgnorePatterns[0] != ".obsidian/**" || w.BlobStore.Path != filepath.Join("/srv/blobs", "work_notes") {
+		t.Errorf("work vault = ignore %v, blob store %q", w.IgnorePatterns, w.BlobStore.Path)
+	}
+	if h.Name != "home" || h.Database.Schema != "private" || h.Database.Driver != DriverSQLite || h.Database.Port != 5432 {
+		t.Errorf("home vault = name %q, schema %q, driver %q, port %d", h.Name, h.Database.Schema, h.Database.Driver, h.Database.Port)
+	}
+	if h.IgnorePatterns[0] != "Drafts/**" || h.StateFile != "/tmp/home-state.json" {
+		t.Errorf("home vault = ignore %v, state file %q", h.IgnorePatterns, h.StateFile)
+	}
+
+	if _, err := cfg.SelectVault(""); err == nil {
+		t.Error("SelectVault without a name succeeded with two vaults")
+	}
+	if vc, err := cfg.SelectVault("home"); err != nil || vc.VaultPath != personal {
+		t.Errorf("SelectVault(home) = %v, %v", vc, err)
+	}
+	if _, err := cfg.SelectVaults("nope"); err == nil {
+		t.Error("SelectVaults(nope) succeeded")
+	}
+}
+
+func TestLoadVaultsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	// Two folders named alike, which get the same schema
+	one, two := filepath.Join(dir, "one", "Notes"), filepath.Join(dir, "two", "Notes")
+	for _, d := range []string{one, two} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database := `
+database:
+  host: localhost
+  user: postgres
+  password: secret
+  database: obsidian
+`
+	tests := map[string]string{
+		"both vault_path and vaults": `
+vault_path: "` + dir + `"
+vaults:
+  - path: "` + dir + `"
+`,
+		"duplicate name": `
+vaults:
+  - name: a
+    path: "` + dir + `"
+    schema: one
+  - name: a
+    path: "` + dir + `"
+    schema: two
+`,
+		"same schema": `
+vaults:
+  - name: a
+    path: "` + one + `"
+  - name: b
+    path: "` + two + `"
+`,
+		"same path": `
+vaults:
+  - name: a
+    path: "` + dir + `"
+    schema: one
+  - name: b
+    path: "` + dir + `/"
+    schema: two
+`,
+		"missing path": `
+vaults:
+  - name: a
+`,
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(writeConfig(t, database+content)); err == nil {
+				t.Error("Load succeeded")
+			}
+		})
+	}
+}
+
+func TestLoadSingleVault(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "My Vault")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(writeConfig(t, `
+vault_path: "`+dir+`"
+database:
+  host: localhost
+  user: postgres
+  password: secret
+  database: obsidian
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vc, err := cfg.SelectVault("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vc != cfg || vc.Name != "my_vault" {
+		t.Errorf("SelectVault = %+v, want the config itself named my_vault", vc)
+	}
+}
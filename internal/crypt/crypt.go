@@ -0,0 +1,231 @@
+// Package crypt encrypts vault content on the client, so the database only
+// ever sees ciphertext. Content is sealed with AES-256-GCM under a key
+// derived from a passphrase or a key file. Every sealed value names the key
+// it was sealed with, so rows written before a key rotation can still be
+// told apart from current ones.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+)
+
+const (
+	keySize   = 32
+	keyIDSize = 8
+	nonceSize = 12
+
+	// versionValue marks a value sealed in one piece by Seal
+	versionValue byte = 1
+
+	// headerSize is the version byte and key id in front of sealed content
+	headerSize = 1 + keyIDSize
+
+	// stringPrefix marks a sealed string, so plaintext and encrypted values
+	// can be stored in the same column
+	stringPrefix = "enc:"
+)
+
+// scrypt parameters for passphrases. They must never change: every device
+// has to derive the same key.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// minKeyFileSize rejects key files too short to hold a random key
+const minKeyFileSize = 16
+
+// ErrUnknownKey is returned for content sealed with a key the cipher doesn't have
+var ErrUnknownKey = errors.New("content was encrypted with a different key")
+
+// Cipher seals content with the current key and opens content sealed with
+// it or with any previous key it was given
+type Cipher struct {
+	current string // Key id of the current key
+	keys    map[string]cipher.AEAD
+	fp      string
+}
+
+// Load returns the cipher configured for the vault, or nil if encryption is
+// disabled. Passphrases are stretched with the vault's schema as salt, so
+// every device syncing the vault derives the same key.
+func Load(cfg config.EncryptionConfig, schema string) (*Cipher, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	switch {
+	case cfg.KeyFile != "":
+		return FromKeyFile(cfg.KeyFile)
+	case cfg.Passphrase != "":
+		return FromPassphrase(cfg.Passphrase, schema)
+	default:
+		return nil, fmt.Errorf("encryption is enabled but neither a passphrase nor a key_file is set")
+	}
+}
+
+// FromPassphrase derives a key from a passphrase
+func FromPassphrase(passphrase, salt string) (*Cipher, error) {
+	key, err := scrypt.Key([]byte(passphrase), []byte("obsync-pg:"+salt), scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return New(key)
+}
+
+// FromKeyFile derives a key from the content of a key file. Surrounding
+// whitespace is ignored, so the file can hold a key typed in as text.
+func FromKeyFile(path string) (*Cipher, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) < minKeyFileSize {
+		return nil, fmt.Errorf("key file %s is too short: it needs at least %d bytes", path, minKeyFileSize)
+	}
+	key := sha256.Sum256(data)
+	return New(key[:])
+}
+
+// GenerateKeyFile writes a new random key to path. An existing file is not
+// overwritten.
+func GenerateKeyFile(path string) error {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// New creates a cipher for a 32-byte key
+func New(key []byte) (*Cipher, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("obsync-pg key fingerprint"))
+	sum := mac.Sum(nil)
+	id := string(sum[:keyIDSize])
+
+	return &Cipher{
+		current: id,
+		keys:    map[string]cipher.AEAD{id: aead},
+		fp:      hex.EncodeToString(sum),
+	}, nil
+}
+
+// Fingerprint identifies the current key without revealing it. Devices
+// compare it with the fingerprint stored in the database before writing.
+func (c *Cipher) Fingerprint() string {
+	return c.fp
+}
+
+// Accept lets the cipher open content sealed with the current key of old,
+// for re-encrypting content after a key rotation
+func (c *Cipher) Accept(old *Cipher) {
+	for id, aead := range old.keys {
+		if _, ok := c.keys[id]; !ok {
+			c.keys[id] = aead
+		}
+	}
+}
+
+// header returns the version byte and key id sealed content starts with
+func (c *Cipher) header(version byte) []byte {
+	return append([]byte{version}, c.current...)
+}
+
+// Seal encrypts data with the current key
+func (c *Cipher) Seal(data []byte) []byte {
+	out := make([]byte, 0, headerSize+nonceSize+len(data)+c.keys[c.current].Overhead())
+	out = append(out, c.header(versionValue)...)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic("crypt: failed to read random nonce: " + err.Error())
+	}
+	out = append(out, nonce...)
+
+	// The header is authenticated, so the key id can't be swapped
+	return c.keys[c.current].Seal(out, nonce, data, out[:headerSize])
+}
+
+// Open decrypts data sealed by Seal
+func (c *Cipher) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < headerSize+nonceSize || sealed[0] != versionValue {
+		return nil, fmt.Errorf("content is not encrypted by obsync-pg or is damaged")
+	}
+	aead, ok := c.keys[string(sealed[1:headerSize])]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	nonce := sealed[headerSize : headerSize+nonceSize]
+	data, err := aead.Open(nil, nonce, sealed[headerSize+nonceSize:], sealed[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content: %w", err)
+	}
+	return data, nil
+}
+
+// SealString encrypts a string into printable text that can be stored in a
+// text column
+func (c *Cipher) SealString(s string) string {
+	return stringPrefix + base64.RawStdEncoding.EncodeToString(c.Seal([]byte(s)))
+}
+
+// OpenString decrypts a string sealed by SealString. Strings that aren't
+// sealed are returned as they are.
+func (c *Cipher) OpenString(s string) (string, error) {
+	if !IsSealedString(s) {
+		return s, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(s[len(stringPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("encrypted value is damaged: %w", err)
+	}
+	data, err := c.Open(sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// IsSealedString reports whether a string was sealed by SealString
+func IsSealedString(s string) bool {
+	return strings.HasPrefix(s, stringPrefix)
+}
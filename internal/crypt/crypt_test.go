@@ -0,0 +1,168 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newCipher(t *testing.T, b byte) *Cipher {
+	t.Helper()
+	c, err := New(bytes.Repeat([]byte{b}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSealOpen(t *testing.T) {
+	c := newCipher(t, 1)
+	data := []byte("private journal")
+
+	sealed := c.Seal(data)
+	if bytes.Contains(sealed, data) {
+		t.Error("sealed content contains the plaintext")
+	}
+	if bytes.Equal(sealed, c.Seal(data)) {
+		t.Error("sealing twice gave the same output")
+	}
+
+	got, err := c.Open(sealed)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := c.Open(sealed); err == nil {
+		t.Error("Open of tampered content succeeded")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	a, b := newCipher(t, 1), newCipher(t, 2)
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Fatal("different keys have the same fingerprint")
+	}
+
+	sealed := a.Seal([]byte("x"))
+	if _, err := b.Open(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open with another key: err = %v, want ErrUnknownKey", err)
+	}
+
+	// After a rotation the new cipher still opens old content
+	b.Accept(a)
+	if got, err := b.Open(sealed); err != nil || string(got) != "x" {
+		t.Errorf("Open after Accept = %q, %v", got, err)
+	}
+	if b.Fingerprint() == a.Fingerprint() {
+		t.Error("Accept changed the current key")
+	}
+}
+
+func TestSealString(t *testing.T) {
+	c := newCipher(t, 1)
+
+	s := c.SealString("tag")
+	if !IsSealedString(s) {
+		t.Fatalf("SealString = %q, not marked as sealed", s)
+	}
+	if got, err := c.OpenString(s); err != nil || got != "tag" {
+		t.Errorf("OpenString = %q, %v", got, err)
+	}
+	if got, err := c.OpenString("plain"); err != nil || got != "plain" {
+		t.Errorf("OpenString(plaintext) = %q, %v", got, err)
+	}
+}
+
+func TestFromPassphrase(t *testing.T) {
+	a, err := FromPassphrase("correct horse", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := FromPassphrase("correct horse", "vault")
+	other, _ := FromPassphrase("correct horse", "other_vault")
+
+	if a.Fingerprint() != b.Fingerprint() {
+		t.Error("the same passphrase gave different keys")
+	}
+	if a.Fingerprint() == other.Fingerprint() {
+		t.Error("different salts gave the same key")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.key")
+	if err := GenerateKeyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateKeyFile(path); err == nil {
+		t.Error("GenerateKeyFile overwrote an existing file")
+	}
+	if _, err := FromKeyFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	short := filepath.Join(t.TempDir(), "short.key")
+	os.WriteFile(short, []byte("abc\n"), 0600)
+	if _, err := FromKeyFile(short); err == nil {
+		t.Error("FromKeyFile accepted a short key")
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	c := newCipher(t, 1)
+
+	for _, n := range []int{0, 1, segmentSize - 1, segmentSize, 2 * segmentSize, 2*segmentSize + 7} {
+		data := bytes.Repeat([]byte("0123456789"), n/10+1)[:n]
+
+		var buf bytes.Buffer
+		w, err := c.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) != SealedSize(int64(n)) {
+			t.Errorf("n=%d: sealed size %d, SealedSize %d", n, buf.Len(), SealedSize(int64(n)))
+		}
+
+		r, err := c.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("n=%d: opened content differs from the original", n)
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	c := newCipher(t, 1)
+
+	var buf bytes.Buffer
+	w, _ := c.NewWriter(&buf)
+	w.Write([]byte(strings.Repeat("x", 3*segmentSize)))
+	w.Close()
+
+	// Cut off exactly after the second segment, so it looks complete
+	cut := streamHeaderSize + 2*(segmentSize+16)
+	r, err := c.NewReader(bytes.NewReader(buf.Bytes()[:cut]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("reading truncated content succeeded")
+	}
+}
@@ -0,0 +1,195 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streams are sealed in segments, so content too large to hold in memory can
+// be encrypted on its way to the blob store. Each segment's nonce holds its
+// number and whether it is the last one, so segments can't be reordered,
+// dropped or cut off at the end without failing to open.
+const (
+	// versionStream marks content sealed by NewWriter
+	versionStream byte = 2
+
+	segmentSize = 64 * 1024
+	prefixSize  = nonceSize - 5 // Random part of the segment nonces
+
+	streamHeaderSize = headerSize + prefixSize
+)
+
+// SealedSize returns the size of n bytes of content once sealed by NewWriter
+func SealedSize(n int64) int64 {
+	segments := (n + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return streamHeaderSize + n + segments*16
+}
+
+// segmentNonce returns the nonce of a segment
+func segmentNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], n)
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+var errClosed = errors.New("crypt: writer is closed")
+
+// sealWriter encrypts what is written to it in segments
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	header []byte
+	buf    []byte
+	n      uint32
+	err    error
+}
+
+// NewWriter returns a writer that seals content with the current key and
+// writes it to w. Close must be called to write the last segment.
+func (c *Cipher) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := append(c.header(versionStream), prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		w:      w,
+		aead:   c.keys[c.current],
+		prefix: prefix,
+		header: header,
+		buf:    make([]byte, 0, segmentSize),
+	}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only written once more content follows, as the
+		// last segment has to be marked
+		if len(s.buf) == segmentSize {
+			if s.err = s.flush(false); s.err != nil {
+				return written, s.err
+			}
+		}
+		n := copy(s.buf[len(s.buf):segmentSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last segment
+func (s *sealWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	err := s.flush(true)
+	s.err = errClosed
+	return err
+}
+
+func (s *sealWriter) flush(last bool) error {
+	nonce := segmentNonce(s.prefix, s.n, last)
+	out := s.aead.Seal(nil, nonce, s.buf, s.header)
+	s.buf = s.buf[:0]
+	s.n++
+	_, err := s.w.Write(out)
+	return err
+}
+
+// openReader decrypts content sealed by NewWriter
+type openReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	header []byte
+	seg    []byte // Ciphertext of the current segment
+	out    []byte // Decrypted content not read yet
+	n      uint32
+	done   bool
+}
+
+// NewReader returns a reader that opens content sealed by NewWriter
+func (c *Cipher) NewReader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("content is not encrypted by obsync-pg or is damaged: %w", err)
+	}
+	if header[0] != versionStream {
+		return nil, fmt.Errorf("content is not encrypted by obsync-pg or is damaged")
+	}
+	aead, ok := c.keys[string(header[1:headerSize])]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return &openReader{
+		r:      bufio.NewReaderSize(r, segmentSize+aead.Overhead()+1),
+		aead:   aead,
+		prefix: header[headerSize:],
+		header: header,
+		seg:    make([]byte, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
+
+// next decrypts the next segment
+func (o *openReader) next() error {
+	n, err := io.ReadFull(o.r, o.seg)
+	last := false
+	switch err {
+	case nil:
+		// A full segment is the last one if nothing follows it
+		if _, err := o.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF, io.EOF:
+		last = true
+	default:
+		return err
+	}
+
+	out, err := o.aead.Open(o.seg[:0:0], segmentNonce(o.prefix, o.n, last), o.seg[:n], o.header)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt content: it is damaged or incomplete")
+	}
+	o.out = out
+	o.n++
+	o.done = last
+	return nil
+}
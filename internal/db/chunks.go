@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// pruneChunksSQL deletes chunks no blob uses. Recent chunks are kept, as
+// they may belong to an upload that hasn't stored its blob yet.
+const pruneChunksSQL = `
+	DELETE FROM vault_chunks c
+	WHERE c.created_at < NOW() - INTERVAL '1 hour'
+		AND NOT EXISTS (
+			SELECT 1 FROM vault_blob_chunks bc WHERE bc.chunk_hash = c.chunk_hash
+		)
+`
+
+// PutChunks stores chunks of attachment content in one round trip. Chunks
+// that are already stored are not sent again. The MIME type of the attachment
+// decides whether the chunks are compressed.
+func (db *DB) PutChunks(ctx context.Context, chunks []Chunk, mimeType *string) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hashes[i] = chunk.Hash
+	}
+
+	rows, err := db.Pool.Query(ctx, "SELECT chunk_hash FROM vault_chunks WHERE chunk_hash = ANY($1)", hashes)
+	if err != nil {
+		return fmt.Errorf("failed to check stored chunks: %w", err)
+	}
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[hash] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check stored chunks: %w", err)
+	}
+
+	batch := &pgx.Batch{}
+	for _, chunk := range chunks {
+		if stored[chunk.Hash] {
+			continue
+		}
+		data, codec := db.encodeData(chunk.Data, mimeType)
+		batch.Queue(`
+			INSERT INTO vault_chunks (chunk_hash, data, codec, size_bytes)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (chunk_hash) DO NOTHING
+		`, chunk.Hash, data, codec, len(chunk.Data))
+		stored[chunk.Hash] = true
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return db.Pool.SendBatch(ctx, batch).Close()
+}
+
+// PutChunkedBlob records the content with the given hash as the given
+// chunks, in order. The chunks must have been stored with PutChunks.
+func (db *DB) PutChunkedBlob(ctx context.Context, hash string, size int64, chunks []string) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO vault_blobs (content_hash, size_bytes, chunk_count)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (content_hash) DO NOTHING
+	`, hash, size, len(chunks))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil // Stored by another device in the meantime
+	}
+
+	rows := make([][]any, len(chunks))
+	for i, chunk := range chunks {
+		rows[i] = []any{hash, i, chunk}
+	}
+	if _, err := tx.CopyFrom(ctx,
+		pgx.Identifier{"vault_blob_chunks"},
+		[]string{"content_hash", "seq", "chunk_hash"},
+		pgx.CopyFromRows(rows),
+	); err != nil {
+		return fmt.Errorf("failed to store chunk list: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ReadBlob writes the content stored in the database under a hash to w, one
+// chunk at a time
+func (db *DB) ReadBlob(ctx context.Context, hash string, w io.Writer) error {
+	var data []byte
+	var codec string
+	var storageKey *string
+	var chunkCount *int
+	err := db.Pool.QueryRow(ctx,
+		"SELECT data, codec, storage_key, chunk_count FROM vault_blobs WHERE content_hash = $1", hash,
+	).Scan(&data, &codec, &storageKey, &chunkCount)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("content %s is missing from the database", hash)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case chunkCount != nil:
+	case data != nil:
+		data, err := db.decodeBytes(codec, data)
+		if err != nil {
+			return fmt.Errorf("content %s: %w", hash, err)
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		return fmt.Errorf("content %s is in the external blob store", hash)
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT c.data, c.codec
+		FROM vault_blob_chunks bc
+		JOIN vault_chunks c ON c.chunk_hash = bc.chunk_hash
+		WHERE bc.content_hash = $1
+		ORDER BY bc.seq
+	`, hash)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	var chunk []byte
+	for rows.Next() {
+		if err := rows.Scan(&chunk, &codec); err != nil {
+			return err
+		}
+		chunk, err := db.decodeBytes(codec, chunk)
+		if err != nil {
+			return fmt.Errorf("content %s: %w", hash, err)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n != *chunkCount {
+		return fmt.Errorf("content %s is incomplete: found %d of %d chunks", hash, n, *chunkCount)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
+)
+
+// Codecs record how note content and attachment data are stored, so rows
+// written with and without compression or encryption can be read side by
+// side. Encrypted content is compressed first, e.g. "zstd+aes-gcm".
+const (
+	CodecNone   = "none"
+	CodecZstd   = "zstd"
+	CodecAESGCM = "aes-gcm"
+)
+
+// ErrEncrypted is returned when reading encrypted content without a key
+var ErrEncrypted = errors.New("content is encrypted; configure encryption to read it")
+
+// codecs holds how a store writes content: the compression codec, and the
+// cipher and plaintext fields if it is encrypted. It is shared by the
+// Postgres and SQLite stores.
+type codecs struct {
+	codec string // Codec new content is written with
+
+	cipher    *crypt.Cipher   // nil unless content is encrypted
+	plaintext map[string]bool // Metadata fields not encrypted
+}
+
+// incompressibleTypes are MIME types, as reported by http.DetectContentType,
+// whose content is already compressed
+var incompressibleTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"audio/mpeg",
+	"audio/aac",
+	"video/mp4",
+	"video/webm",
+	"application/ogg",
+	"application/zip",
+	"application/x-gzip",
+	"application/x-rar-compressed",
+	"font/woff",
+	"font/woff2",
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Compressible reports whether content of the given MIME type is worth
+// compressing
+func Compressible(mimeType *string) bool {
+	if mimeType == nil {
+		return true
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(*mimeType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeData compresses attachment data with the configured codec, unless
+// its MIME type is already compressed, and encrypts it if a cipher is set
+func (c *codecs) encodeData(data []byte, mimeType *string) ([]byte, string) {
+	return c.encodeBytes(data, Compressible(mimeType))
+}
+
+// encodeBytes returns content as it is stored, and its codec
+func (c *codecs) encodeBytes(data []byte, compress bool) ([]byte, string) {
+	codec := CodecNone
+	if compress {
+		data, codec = encode(c.codec, data)
+	}
+	if c.cipher == nil {
+		return data, codec
+	}
+	return c.cipher.Seal(data), sealedCodec(codec)
+}
+
+// decodeBytes returns the original content of data stored with a codec
+func (c *codecs) decodeBytes(codec string, data []byte) ([]byte, error) {
+	codec, sealed := splitCodec(codec)
+	if sealed {
+		if c.cipher == nil {
+			return nil, ErrEncrypted
+		}
+		var err error
+		if data, err = c.cipher.Open(data); err != nil {
+			return nil, err
+		}
+	}
+	return decode(codec, data)
+}
+
+// resealBytes encrypts stored content with the current key, leaving its
+// compression as it is
+func (c *codecs) resealBytes(codec string, data []byte) ([]byte, string, error) {
+	codec, sealed := splitCodec(codec)
+	if sealed {
+		var err error
+		if data, err = c.cipher.Open(data); err != nil {
+			return nil, "", err
+		}
+	}
+	return c.cipher.Seal(data), sealedCodec(codec), nil
+}
+
+// sealedCodec returns the codec of content compressed with codec, then encrypted
+func sealedCodec(codec string) string {
+	if codec == CodecNone || codec == "" {
+		return CodecAESGCM
+	}
+	return codec + "+" + CodecAESGCM
+}
+
+// splitCodec returns the compression codec of stored content, and whether
+// it is encrypted
+func splitCodec(codec string) (string, bool) {
+	if codec == CodecAESGCM {
+		return CodecNone, true
+	}
+	if inner, ok := strings.CutSuffix(codec, "+"+CodecAESGCM); ok {
+		return inner, true
+	}
+	return codec, false
+}
+
+// encode compresses data with the codec, returning the data to store and the
+// codec it is stored with. Data that doesn't get smaller is stored as-is.
+func encode(codec string, data []byte) ([]byte, string) {
+	if codec != CodecZstd || len(data) == 0 {
+		return data, CodecNone
+	}
+	compressed := zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if len(compressed) >= len(data) {
+		return data, CodecNone
+	}
+	return compressed, CodecZstd
+}
+
+// decode returns the original content of compressed data
+func decode(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecZstd:
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress content: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown content codec %q", codec)
+	}
+}
+
+// encodeText returns the raw_content and compressed_content columns of note
+// content, and its codec
+func (c *codecs) encodeText(content string) (*string, []byte, string) {
+	data, codec := c.encodeBytes([]byte(content), true)
+	if codec == CodecNone {
+		return &content, nil, CodecNone
+	}
+	return nil, data, codec
+}
+
+// decodeText returns note content from its raw_content and
+// compressed_content columns
+func (c *codecs) decodeText(codec string, raw *string, compressed []byte) (string, error) {
+	if codec == "" || codec == CodecNone {
+		if raw == nil {
+			return "", nil
+		}
+		return *raw, nil
+	}
+	data, err := c.decodeBytes(codec, compressed)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
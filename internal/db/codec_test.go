@@ -0,0 +1,132 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("# Heading\n\nSome markdown text that repeats.\n", 50))
+
+	data, codec := encode(CodecZstd, content)
+	if codec != CodecZstd {
+		t.Fatalf("codec = %q, want %q", codec, CodecZstd)
+	}
+	if len(data) >= len(content) {
+		t.Errorf("compressed size %d, want less than %d", len(data), len(content))
+	}
+
+	got, err := decode(codec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("decoded content differs from the original")
+	}
+}
+
+func TestEncodeKeepsIncompressibleData(t *testing.T) {
+	content := []byte("ab")
+
+	data, codec := encode(CodecZstd, content)
+	if codec != CodecNone || !bytes.Equal(data, content) {
+		t.Errorf("encode(%q) = %q, %q; want it stored as-is", content, data, codec)
+	}
+
+	data, codec = encode(CodecNone, []byte(strings.Repeat("a", 1000)))
+	if codec != CodecNone || len(data) != 1000 {
+		t.Errorf("encode with compression off = %d bytes, %q", len(data), codec)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	content := strings.Repeat("line of a note\n", 100)
+	db := &DB{codecs: codecs{codec: CodecZstd}}
+	raw, compressed, codec := db.encodeText(content)
+	if raw != nil || compressed == nil {
+		t.Fatalf("encodeText: raw = %v, compressed = %d bytes", raw, len(compressed))
+	}
+
+	got, err := db.decodeText(codec, raw, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != content {
+		t.Error("decoded note differs from the original")
+	}
+
+	// Rows written before compression existed
+	old := "old note"
+	if got, err := db.decodeText(CodecNone, &old, nil); err != nil || got != old {
+		t.Errorf("db.decodeText(none) = %q, %v", got, err)
+	}
+
+	if _, err := db.decodeText("lz4", nil, []byte("x")); err == nil {
+		t.Error("decodeText with an unknown codec succeeded")
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	c, err := crypt.New(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DB{codecs: codecs{codec: CodecZstd}}
+	db.SetCipher(c, nil)
+
+	content := strings.Repeat("a private journal entry\n", 100)
+	raw, sealed, codec := db.encodeText(content)
+	if raw != nil || codec != "zstd+aes-gcm" {
+		t.Fatalf("encodeText: raw = %v, codec = %q", raw, codec)
+	}
+	if bytes.Contains(sealed, []byte("journal")) {
+		t.Error("encrypted content contains plaintext")
+	}
+
+	got, err := db.decodeText(codec, raw, sealed)
+	if err != nil || got != content {
+		t.Fatalf("decodeText = %d bytes, %v", len(got), err)
+	}
+
+	// Without the key the content can't be read
+	plain := &DB{codecs: codecs{codec: CodecZstd}}
+	if _, err := plain.decodeText(codec, raw, sealed); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("decodeText without a key: err = %v, want ErrEncrypted", err)
+	}
+
+	// Short content is encrypted even though it isn't compressed
+	raw, sealed, codec = db.encodeText("hi")
+	if raw != nil || codec != CodecAESGCM {
+		t.Errorf("encodeText(short): raw = %v, codec = %q", raw, codec)
+	}
+	if got, err := db.decodeText(codec, raw, sealed); err != nil || got != "hi" {
+		t.Errorf("decodeText(short) = %q, %v", got, err)
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		mime string
+		want bool
+	}{
+		{"text/plain; charset=utf-8", true},
+		{"application/pdf", true},
+		{"application/octet-stream", true},
+		{"image/jpeg", false},
+		{"image/png", false},
+		{"application/zip", false},
+		{"video/mp4", false},
+	}
+	for _, tt := range tests {
+		if got := Compressible(&tt.mime); got != tt.want {
+			t.Errorf("Compressible(%q) = %v, want %v", tt.mime, got, tt.want)
+		}
+	}
+	if !Compressible(nil) {
+		t.Error("Compressible(nil) = false, want true")
+	}
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+)
+
+// InsertConflict records a conflict between local and remote edits
+func (db *DB) InsertConflict(ctx context.Context, c *VaultConflict) error {
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO vault_conflicts (
+			path, conflict_path, device, remote_device, base_hash,
+			local_hash, remote_hash
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7
+		)
+	`,
+		c.Path, c.ConflictPath, c.Device, c.RemoteDevice, c.BaseHash,
+		c.LocalHash, c.RemoteHash,
+	)
+	return err
+}
+
+// GetUnresolvedConflicts returns all conflicts whose copy still exists, newest first
+func (db *DB) GetUnresolvedConflicts(ctx context.Context) ([]*VaultConflict, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, path, conflict_path, device, remote_device, base_hash,
+			local_hash, remote_hash, detected_at, resolved_at
+		FROM vault_conflicts
+		WHERE resolved_at IS NULL
+		ORDER BY detected_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []*VaultConflict
+	for rows.Next() {
+		c := &VaultConflict{}
+		if err := rows.Scan(
+			&c.ID, &c.Path, &c.ConflictPath, &c.Device, &c.RemoteDevice,
+			&c.BaseHash, &c.LocalHash, &c.RemoteHash, &c.DetectedAt, &c.ResolvedAt,
+		); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, c)
+	}
+
+	return conflicts, rows.Err()
+}
+
+// ResolveConflicts marks conflicts as resolved once their conflict copies are deleted
+func (db *DB) ResolveConflicts(ctx context.Context, conflictPaths []string) error {
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE vault_conflicts SET resolved_at = NOW()
+		WHERE conflict_path = ANY($1) AND resolved_at IS NULL
+	`, conflictPaths)
+	return err
+}
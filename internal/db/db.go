@@ -7,42 +7,34 @@ import (
 	"log/slog"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/pressly/goose/v3"
 
 	"github.com/vonshlovens/obsync-pg/internal/config"
 )
 
+// reachableTimeout bounds the ping used to tell whether the database is up
+const reachableTimeout = 5 * time.Second
+
 // DB wraps the database connection pool
 type DB struct {
-	Pool   *pgxpool.Pool
+	Pool   *Pool
 	config *config.DatabaseConfig
 	Schema string
+
+	codecs
 }
 
-// New creates a new database connection pool
+// New creates a new database connection pool and checks that the database is reachable
 func New(ctx context.Context, cfg *config.DatabaseConfig) (*DB, error) {
-	poolConfig, err := pgxpool.ParseConfig(cfg.ConnectionString())
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse connection string: %w", err)
-	}
-
-	// Configure pool settings
-	poolConfig.MaxConns = 10
-	poolConfig.MinConns = 2
-	poolConfig.MaxConnLifetime = time.Hour
-	poolConfig.MaxConnIdleTime = 30 * time.Minute
-	poolConfig.HealthCheckPeriod = time.Minute
-
-	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	db, err := Open(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create connection pool: %w", err)
+		return nil, err
 	}
 
 	// Test connection
-	if err := pool.Ping(ctx); err != nil {
-		pool.Close()
+	if err := db.Pool.Ping(ctx); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
@@ -51,26 +43,52 @@ func New(ctx context.Context, cfg *config.DatabaseConfig) (*DB, error) {
 		"database", cfg.Database,
 		"schema", cfg.Schema)
 
+	return db, nil
+}
+
+// Open creates a new database connection pool without connecting. Connections
+// are made as they are needed, so this succeeds while the database is down.
+// Vaults opened in the same database share their connections.
+func Open(ctx context.Context, cfg *config.DatabaseConfig) (*DB, error) {
+	pool, err := acquirePool(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &DB{
 		Pool:   pool,
 		config: cfg,
 		Schema: cfg.Schema,
+		codecs: codecs{codec: cfg.Compression},
 	}, nil
 }
 
-// Close closes the database connection pool
+// Close releases the database connection pool, closing it once no other
+// vault uses it
 func (db *DB) Close() {
 	if db.Pool != nil {
-		db.Pool.Close()
-		slog.Info("database connection closed")
+		releasePool(db.Pool)
+		db.Pool = nil
 	}
 }
 
+// MaxConns returns the size of the connection pool
+func (db *DB) MaxConns() int {
+	return int(db.Pool.Config().MaxConns)
+}
+
 // Ping checks if the database is reachable
 func (db *DB) Ping(ctx context.Context) error {
 	return db.Pool.Ping(ctx)
 }
 
+// Reachable reports whether the database answers a ping within a few seconds
+func (db *DB) Reachable(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, reachableTimeout)
+	defer cancel()
+	return db.Pool.Ping(ctx) == nil
+}
+
 // EnsureSchema creates the schema if it doesn't exist
 func (db *DB) EnsureSchema(ctx context.Context) error {
 	if db.Schema == "" {
@@ -145,7 +163,7 @@ func (db *DB) GetStatus(ctx context.Context) (*SyncStatus, error) {
 
 	// Count notes
 	var noteCount int
-	err := db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM vault_notes").Scan(&noteCount)
+	err := db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM vault_notes WHERE deleted_at IS NULL").Scan(&noteCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to count notes: %w", err)
 	}
@@ -153,12 +171,31 @@ func (db *DB) GetStatus(ctx context.Context) (*SyncStatus, error) {
 
 	// Count attachments
 	var attachCount int
-	err = db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM vault_attachments").Scan(&attachCount)
+	err = db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM vault_attachments WHERE deleted_at IS NULL").Scan(&attachCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to count attachments: %w", err)
 	}
 	status.TotalAttach = attachCount
 
+	// Count unresolved conflicts
+	var conflictCount int
+	err = db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM vault_conflicts WHERE resolved_at IS NULL").Scan(&conflictCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count conflicts: %w", err)
+	}
+	status.Conflicts = conflictCount
+
+	// Count files in the trash
+	var trashCount int
+	err = db.Pool.QueryRow(ctx, `
+		SELECT (SELECT COUNT(*) FROM vault_notes WHERE deleted_at IS NOT NULL) +
+			(SELECT COUNT(*) FROM vault_attachments WHERE deleted_at IS NOT NULL)
+	`).Scan(&trashCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count trash: %w", err)
+	}
+	status.Trashed = trashCount
+
 	// Get last sync time
 	var lastSync *time.Time
 	err = db.Pool.QueryRow(ctx, `
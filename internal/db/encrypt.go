@@ -0,0 +1,186 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
+)
+
+// Metadata fields that can be kept in plaintext when encryption is on
+const (
+	FieldTitle       = "title"
+	FieldTags        = "tags"
+	FieldAliases     = "aliases"
+	FieldLinks       = "links"
+	FieldFrontmatter = "frontmatter"
+
+	// fieldBody is always encrypted, as it holds the note's content
+	fieldBody = "body"
+)
+
+// sealedFrontmatterKey holds the encrypted frontmatter in the frontmatter
+// column, which has to stay valid JSON
+const sealedFrontmatterKey = "$encrypted"
+
+// SetCipher makes the database encrypt note content, attachment data and
+// metadata with cipher before writing them, and decrypt them when reading.
+// Metadata fields listed in plaintext are written unencrypted. A nil cipher
+// turns encryption off; encrypted rows then can't be read.
+func (c *codecs) SetCipher(cipher *crypt.Cipher, plaintext []string) {
+	c.cipher = cipher
+	c.plaintext = make(map[string]bool, len(plaintext))
+	for _, field := range plaintext {
+		c.plaintext[field] = true
+	}
+}
+
+// Cipher returns the cipher content is encrypted with, or nil
+func (c *codecs) Cipher() *crypt.Cipher {
+	return c.cipher
+}
+
+// externalCodec returns the codec of content this device writes to the
+// external blob store. It is encrypted by the engine on its way there.
+func (c *codecs) externalCodec() string {
+	if c.cipher != nil {
+		return CodecAESGCM
+	}
+	return CodecNone
+}
+
+// sealed reports whether a metadata field is encrypted
+func (c *codecs) sealed(field string) bool {
+	return c.cipher != nil && !c.plaintext[field]
+}
+
+// sealString encrypts the value of a metadata field, if it is encrypted
+func (c *codecs) sealString(field, s string) string {
+	if !c.sealed(field) {
+		return s
+	}
+	return c.cipher.SealString(s)
+}
+
+// sealTitle encrypts a title, if titles are encrypted
+func (c *codecs) sealTitle(title *string) *string {
+	return c.sealOptional(FieldTitle, title)
+}
+
+// sealOptional encrypts an optional value of a metadata field, if it is encrypted
+func (c *codecs) sealOptional(field string, s *string) *string {
+	if s == nil {
+		return nil
+	}
+	sealed := c.sealString(field, *s)
+	return &sealed
+}
+
+// sealStrings encrypts each value of a metadata field, if it is encrypted
+func (c *codecs) sealStrings(field string, values []string) []string {
+	if !c.sealed(field) || values == nil {
+		return values
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = c.cipher.SealString(v)
+	}
+	return out
+}
+
+// sealFrontmatter replaces the frontmatter with a single encrypted value, if
+// frontmatter is encrypted
+func (c *codecs) sealFrontmatter(fm map[string]interface{}) (map[string]interface{}, error) {
+	if !c.sealed(FieldFrontmatter) || len(fm) == 0 {
+		return fm, nil
+	}
+	data, err := json.Marshal(fm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal frontmatter: %w", err)
+	}
+	return map[string]interface{}{sealedFrontmatterKey: c.cipher.SealString(string(data))}, nil
+}
+
+// openString decrypts a value if it is encrypted
+func (c *codecs) openString(s string) (string, error) {
+	if !crypt.IsSealedString(s) {
+		return s, nil
+	}
+	if c.cipher == nil {
+		return "", ErrEncrypted
+	}
+	return c.cipher.OpenString(s)
+}
+
+// openOptional decrypts an optional value if it is encrypted
+func (c *codecs) openOptional(s *string) (*string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	opened, err := c.openString(*s)
+	if err != nil {
+		return nil, err
+	}
+	return &opened, nil
+}
+
+// openStrings decrypts the values that are encrypted
+func (c *codecs) openStrings(values []string) ([]string, error) {
+	for i, v := range values {
+		opened, err := c.openString(v)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = opened
+	}
+	return values, nil
+}
+
+// openNote decrypts the encrypted metadata of a note read from the database.
+// Fields stored in plaintext are left as they are, whatever this device's
+// settings, so devices can differ in what they keep in plaintext.
+func (c *codecs) openNote(note *VaultNote) error {
+	var err error
+	if note.Title, err = c.openOptional(note.Title); err != nil {
+		return err
+	}
+	if note.Body, err = c.openString(note.Body); err != nil {
+		return err
+	}
+	if note.Tags, err = c.openStrings(note.Tags); err != nil {
+		return err
+	}
+	if note.Aliases, err = c.openStrings(note.Aliases); err != nil {
+		return err
+	}
+	if note.OutgoingLinks, err = c.openStrings(note.OutgoingLinks); err != nil {
+		return err
+	}
+
+	sealed, ok := note.Frontmatter[sealedFrontmatterKey].(string)
+	if !ok || len(note.Frontmatter) != 1 {
+		return nil
+	}
+	data, err := c.openString(sealed)
+	if err != nil {
+		return err
+	}
+	note.Frontmatter = nil
+	if err := json.Unmarshal([]byte(data), &note.Frontmatter); err != nil {
+		return fmt.Errorf("failed to unmarshal frontmatter: %w", err)
+	}
+	return nil
+}
+
+// openLink decrypts the text of a link read from the database
+func (c *codecs) openLink(link *VaultLink) error {
+	var err error
+	if link.Target, err = c.openString(link.Target); err != nil {
+		return err
+	}
+	if link.Anchor, err = c.openOptional(link.Anchor); err != nil {
+		return err
+	}
+	link.Alias, err = c.openOptional(link.Alias)
+	return err
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
+)
+
+func testCipher(t *testing.T) *crypt.Cipher {
+	t.Helper()
+	c, err := crypt.New(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNoteMetadataRoundTrip(t *testing.T) {
+	db := &DB{codecs: codecs{codec: CodecNone}}
+	db.SetCipher(testCipher(t), []string{FieldTags})
+
+	title := "Diary"
+	note := &VaultNote{
+		Title:         &title,
+		Tags:          []string{"private"},
+		Aliases:       []string{"journal"},
+		Frontmatter:   map[string]interface{}{"mood": "good"},
+		Body:          "Dear diary",
+		OutgoingLinks: []string{"Other note"},
+	}
+	args, err := db.noteArgs(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tags are kept in plaintext, everything else is sealed
+	if tags := args[3].([]string); tags[0] != "private" {
+		t.Errorf("tags = %v, want plaintext", tags)
+	}
+	for i, arg := range []any{*args[2].(*string), args[4].([]string)[0], args[9], args[13].([]string)[0]} {
+		if !crypt.IsSealedString(arg.(string)) {
+			t.Errorf("arg %d = %q, want it encrypted", i, arg)
+		}
+	}
+	if strings.Contains(string(args[8].([]byte)), "good") {
+		t.Errorf("frontmatter = %s, want it encrypted", args[8])
+	}
+
+	// Read back the way scanNote does
+	stored := &VaultNote{
+		Title:         args[2].(*string),
+		Tags:          args[3].([]string),
+		Aliases:       args[4].([]string),
+		Body:          args[9].(string),
+		OutgoingLinks: args[13].([]string),
+	}
+	if err := json.Unmarshal(args[8].([]byte), &stored.Frontmatter); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.openNote(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if *stored.Title != title || stored.Body != note.Body ||
+		!reflect.DeepEqual(stored.Tags, note.Tags) ||
+		!reflect.DeepEqual(stored.Aliases, note.Aliases) ||
+		!reflect.DeepEqual(stored.OutgoingLinks, note.OutgoingLinks) ||
+		!reflect.DeepEqual(stored.Frontmatter, note.Frontmatter) {
+		t.Errorf("opened note = %+v, want %+v", stored, note)
+	}
+}
+
+func TestOpenNoteWithoutKey(t *testing.T) {
+	db := &DB{codecs: codecs{codec: CodecNone}}
+	db.SetCipher(testCipher(t), nil)
+	note := &VaultNote{Body: db.sealString(fieldBody, "secret")}
+
+	plain := &DB{codecs: codecs{codec: CodecNone}}
+	if err := plain.openNote(note); err != ErrEncrypted {
+		t.Errorf("openNote without a key: err = %v, want ErrEncrypted", err)
+	}
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// ExternalBlob is attachment content kept in the external blob store
+type ExternalBlob struct {
+	Hash       string
+	StorageKey string
+	Codec      string
+	Size       int64
+}
+
+// GetKeyFingerprint returns the fingerprint of the key the vault is
+// encrypted with, or "" if it isn't encrypted
+func (db *DB) GetKeyFingerprint(ctx context.Context) (string, error) {
+	var fingerprint string
+	err := db.Pool.QueryRow(ctx,
+		"SELECT fingerprint FROM vault_keys WHERE retired_at IS NULL",
+	).Scan(&fingerprint)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return fingerprint, err
+}
+
+// ClaimKeyFingerprint records the fingerprint of the vault's key, unless
+// another one is already recorded. It returns the fingerprint in use.
+func (db *DB) ClaimKeyFingerprint(ctx context.Context, fingerprint, device string) (string, error) {
+	if _, err := db.Pool.Exec(ctx, `
+		INSERT INTO vault_keys (fingerprint, created_by)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, fingerprint, device); err != nil {
+		return "", err
+	}
+	return db.GetKeyFingerprint(ctx)
+}
+
+// SetKeyFingerprint makes fingerprint the key the vault is encrypted with,
+// retiring the previous one
+func (db *DB) SetKeyFingerprint(ctx context.Context, fingerprint, device string) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE vault_keys SET retired_at = NOW()
+		WHERE retired_at IS NULL AND fingerprint <> $1
+	`, fingerprint); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO vault_keys (fingerprint, created_by)
+		VALUES ($1, $2)
+		ON CONFLICT (fingerprint) DO UPDATE SET retired_at = NULL
+	`, fingerprint, device); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Reseal rewrites all notes, including those in the trash, note revisions,
+// links and attachment content stored in the database with the current key.
+// Rows in plaintext are encrypted; rows encrypted with a key the cipher
+// accepts are encrypted again. Content in the external blob store is left to the
+// caller. It returns the number of rows rewritten.
+func (db *DB) Reseal(ctx context.Context) (int64, error) {
+	if db.cipher == nil {
+		return 0, fmt.Errorf("no encryption key is set")
+	}
+
+	var total int64
+	steps := []struct {
+		name string
+		fn   func(context.Context) (int64, error)
+	}{
+		{"notes", db.resealNotes},
+		{"note revisions", db.resealRevisions},
+		{"links", db.resealLinks},
+		{"external links", db.resealExternalLinks},
+		{"blobs", db.resealBlobs},
+		{"chunks", db.resealChunks},
+	}
+	for _, step := range steps {
+		n, err := step.fn(ctx)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to re-encrypt %s: %w", step.name, err)
+		}
+	}
+	return total, nil
+}
+
+// resealNotes rewrites the content and metadata of every note
+func (db *DB) resealNotes(ctx context.Context) (int64, error) {
+	rows, err := db.Pool.Query(ctx, "SELECT"+noteColumns+"FROM vault_notes")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		note, err := db.scanNote(rows)
+		if err != nil {
+			return n, err
+		}
+		args, err := db.noteArgs(note)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", note.Path, err)
+		}
+
+		// Same order as upsertNoteSQL; the content hash is unchanged, so no
+		// revision is archived
+		if _, err := db.Pool.Exec(ctx, `
+			UPDATE vault_notes SET
+				title = $2, tags = $3, aliases = $4, frontmatter = $5, body = $6,
+				raw_content = $7, outgoing_links = $8, content_codec = $9,
+				compressed_content = $10
+			WHERE id = $1
+		`, note.ID, args[2], args[3], args[4], args[8], args[9], args[10], args[13], args[15], args[16]); err != nil {
+			return n, fmt.Errorf("%s: %w", note.Path, err)
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+// resealRevisions rewrites the content of every note revision
+func (db *DB) resealRevisions(ctx context.Context) (int64, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, path, revision, raw_content, content_codec, compressed_content
+		FROM vault_note_revisions
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var id uuid.UUID
+		var path string
+		var revision int
+		var raw *string
+		var codec string
+		var compressed []byte
+		if err := rows.Scan(&id, &path, &revision, &raw, &codec, &compressed); err != nil {
+			return n, err
+		}
+
+		content, err := db.decodeText(codec, raw, compressed)
+		if err != nil {
+			return n, fmt.Errorf("%s revision %d: %w", path, revision, err)
+		}
+		raw, compressed, codec = db.encodeText(content)
+
+		if _, err := db.Pool.Exec(ctx, `
+			UPDATE vault_note_revisions
+			SET raw_content = $2, content_codec = $3, compressed_content = $4
+			WHERE id = $1
+		`, id, raw, codec, compressed); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+// resealBlobs rewrites attachment content stored whole in vault_blobs
+func (db *DB) resealBlobs(ctx context.Context) (int64, error) {
+	return db.resealData(ctx, "vault_blobs", "content_hash")
+}
+
+// resealChunks rewrites every stored chunk of attachment content
+func (db *DB) resealChunks(ctx context.Context) (int64, error) {
+	return db.resealData(ctx, "vault_chunks", "chunk_hash")
+}
+
+// resealData rewrites the data column of a content table, keeping the
+// compression each row was stored with
+func (db *DB) resealData(ctx context.Context, table, key string) (int64, error) {
+	rows, err := db.Pool.Query(ctx,
+		fmt.Sprintf("SELECT %s, data, codec FROM %s WHERE data IS NOT NULL", key, table),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	update := fmt.Sprintf("UPDATE %s SET data = $2, codec = $3 WHERE %s = $1", table, key)
+
+	var n int64
+	for rows.Next() {
+		var hash, codec string
+		var data []byte
+		if err := rows.Scan(&hash, &data, &codec); err != nil {
+			return n, err
+		}
+
+		data, codec, err := db.resealBytes(codec, data)
+		if err != nil {
+			return n, fmt.Errorf("content %s: %w", hash, err)
+		}
+		if _, err := db.Pool.Exec(ctx, update, hash, data, codec); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+// GetExternalBlobs returns all content kept in the external blob store
+func (db *DB) GetExternalBlobs(ctx context.Context) ([]ExternalBlob, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT content_hash, storage_key, codec, size_bytes
+		FROM vault_blobs WHERE storage_key IS NOT NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []ExternalBlob
+	for rows.Next() {
+		var b ExternalBlob
+		if err := rows.Scan(&b.Hash, &b.StorageKey, &b.Codec, &b.Size); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+
+	return blobs, rows.Err()
+}
+
+// MoveExternalBlob records that content in the external blob store was
+// stored again under a new key, with the codec this device writes
+func (db *DB) MoveExternalBlob(ctx context.Context, hash, storageKey string) error {
+	_, err := db.Pool.Exec(ctx,
+		"UPDATE vault_blobs SET storage_key = $2, codec = $3 WHERE content_hash = $1",
+		hash, storageKey, db.externalCodec(),
+	)
+	return err
+}
@@ -0,0 +1,350 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// deleteLinksSQL removes the links of the note at $1, before its current
+// links are inserted
+const deleteLinksSQL = `
+	DELETE FROM vault_links
+	WHERE source_note_id = (SELECT id FROM vault_notes WHERE path = $1)
+`
+
+// deleteExternalLinksSQL removes the external links of the note at $1
+const deleteExternalLinksSQL = `
+	DELETE FROM vault_external_links
+	WHERE source_note_id = (SELECT id FROM vault_notes WHERE path = $1)
+`
+
+// insertLinksSQL inserts the links of the note at $1, given as one array per
+// column, in the order of linkArgs
+const insertLinksSQL = `
+	INSERT INTO vault_links (
+		source_note_id, target, link_type, anchor, alias, position, line,
+		target_note_id, target_attachment_id
+	)
+	SELECT n.id, l.target, l.link_type, l.anchor, l.alias, l.position, l.line,
+		l.target_note_id::uuid, l.target_attachment_id::uuid
+	FROM vault_notes n, unnest(
+		$2::text[], $3::text[], $4::text[], $5::text[], $6::int[], $7::int[],
+		$8::text[], $9::text[]
+	) AS l (
+		target, link_type, anchor, alias, position, line,
+		target_note_id, target_attachment_id
+	)
+	WHERE n.path = $1
+`
+
+// insertExternalLinksSQL inserts the external links of the note at $1, in
+// the order of externalLinkArgs
+const insertExternalLinksSQL = `
+	INSERT INTO vault_external_links (source_note_id, url, host, alias, position, line)
+	SELECT n.id, l.url, l.host, l.alias, l.position, l.line
+	FROM vault_notes n, unnest(
+		$2::text[], $3::text[], $4::text[], $5::int[], $6::int[]
+	) AS l (url, host, alias, position, line)
+	WHERE n.path = $1
+`
+
+// linkTargetsSQL selects every note and attachment outside the trash, with
+// the aliases of notes
+const linkTargetsSQL = `
+	SELECT id, path, TRUE, aliases FROM vault_notes WHERE deleted_at IS NULL
+	UNION ALL
+	SELECT id, path, FALSE, NULL FROM vault_attachments WHERE deleted_at IS NULL
+`
+
+// linkTargetsAtSQL selects the notes and attachments outside the trash at
+// the paths in $1
+const linkTargetsAtSQL = `
+	SELECT id, path, TRUE, aliases FROM vault_notes
+	WHERE deleted_at IS NULL AND path = ANY($1)
+	UNION ALL
+	SELECT id, path, FALSE, NULL FROM vault_attachments
+	WHERE deleted_at IS NULL AND path = ANY($1)
+`
+
+// linkColumns are the columns read by scanLink, from vault_links l joined
+// with the linking note n
+const linkColumns = `
+	l.id, l.source_note_id, n.path, l.target, l.link_type, l.anchor, l.alias,
+	l.position, l.line, l.target_note_id, l.target_attachment_id
+`
+
+// linksSQL selects the links of every note outside the trash
+const linksSQL = `
+	SELECT` + linkColumns + `
+	FROM vault_links l JOIN vault_notes n ON n.id = l.source_note_id
+	WHERE n.deleted_at IS NULL
+	ORDER BY n.path, l.position
+`
+
+// unresolvedLinksSQL selects the links of every note outside the trash that
+// don't resolve to a file
+const unresolvedLinksSQL = `
+	SELECT` + linkColumns + `
+	FROM vault_links l JOIN vault_notes n ON n.id = l.source_note_id
+	WHERE n.deleted_at IS NULL
+		AND l.target_note_id IS NULL AND l.target_attachment_id IS NULL
+	ORDER BY n.path, l.position
+`
+
+// sealLink returns the text of a link, encrypted if links are encrypted
+func (c *codecs) sealLink(link *VaultLink) (target string, anchor, alias *string) {
+	return c.sealString(FieldLinks, link.Target),
+		c.sealOptional(FieldLinks, link.Anchor),
+		c.sealOptional(FieldLinks, link.Alias)
+}
+
+// linkArgs returns the parameters of insertLinksSQL for a note
+func (c *codecs) linkArgs(note *VaultNote) []any {
+	n := len(note.Links)
+	targets, types := make([]string, n), make([]string, n)
+	anchors, aliases := make([]*string, n), make([]*string, n)
+	positions, lines := make([]*int, n), make([]*int, n)
+	targetNotes, targetAttachments := make([]*string, n), make([]*string, n)
+
+	for i, link := range note.Links {
+		targets[i], anchors[i], aliases[i] = c.sealLink(link)
+		types[i] = link.LinkType
+		positions[i], lines[i] = link.Position, link.Line
+		if link.TargetNoteID != nil {
+			id := link.TargetNoteID.String()
+			targetNotes[i] = &id
+		}
+		if link.TargetAttachmentID != nil {
+			id := link.TargetAttachmentID.String()
+			targetAttachments[i] = &id
+		}
+	}
+
+	return []any{
+		note.Path, targets, types, anchors, aliases, positions, lines,
+		targetNotes, targetAttachments,
+	}
+}
+
+// sealExternalLink returns the text of an external link, encrypted if links
+// are encrypted
+func (c *codecs) sealExternalLink(link *VaultExternalLink) (url string, host, alias *string) {
+	return c.sealString(FieldLinks, link.URL),
+		c.sealOptional(FieldLinks, link.Host),
+		c.sealOptional(FieldLinks, link.Alias)
+}
+
+// externalLinkArgs returns the parameters of insertExternalLinksSQL for a note
+func (c *codecs) externalLinkArgs(note *VaultNote) []any {
+	n := len(note.ExternalLinks)
+	urls := make([]string, n)
+	hosts, aliases := make([]*string, n), make([]*string, n)
+	positions, lines := make([]*int, n), make([]*int, n)
+
+	for i, link := range note.ExternalLinks {
+		urls[i], hosts[i], aliases[i] = c.sealExternalLink(link)
+		positions[i], lines[i] = link.Position, link.Line
+	}
+
+	return []any{note.Path, urls, hosts, aliases, positions, lines}
+}
+
+// openExternalLink decrypts the text of an external link read from the database
+func (c *codecs) openExternalLink(link *VaultExternalLink) error {
+	var err error
+	if link.URL, err = c.openString(link.URL); err != nil {
+		return err
+	}
+	if link.Host, err = c.openOptional(link.Host); err != nil {
+		return err
+	}
+	link.Alias, err = c.openOptional(link.Alias)
+	return err
+}
+
+// scanLink scans a link row selected with linkColumns and decrypts it
+func (c *codecs) scanLink(row interface{ Scan(...any) error }) (*VaultLink, error) {
+	link := &VaultLink{}
+	err := row.Scan(
+		&link.ID, &link.SourceNoteID, &link.SourcePath, &link.Target,
+		&link.LinkType, &link.Anchor, &link.Alias, &link.Position, &link.Line,
+		&link.TargetNoteID, &link.TargetAttachmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.openLink(link); err != nil {
+		return nil, fmt.Errorf("%s: %w", link.SourcePath, err)
+	}
+	return link, nil
+}
+
+// queueNoteLinks queues the statements replacing the links of a note with
+// note.Links and note.ExternalLinks, after the note itself
+func (db *DB) queueNoteLinks(batch *pgx.Batch, note *VaultNote) {
+	batch.Queue(deleteLinksSQL, note.Path)
+	if len(note.Links) > 0 {
+		batch.Queue(insertLinksSQL, db.linkArgs(note)...)
+	}
+	batch.Queue(deleteExternalLinksSQL, note.Path)
+	if len(note.ExternalLinks) > 0 {
+		batch.Queue(insertExternalLinksSQL, db.externalLinkArgs(note)...)
+	}
+}
+
+// GetLinkTargets returns the notes and attachments outside the trash, which
+// links resolve to
+func (db *DB) GetLinkTargets(ctx context.Context) ([]*LinkTarget, error) {
+	return db.queryLinkTargets(ctx, linkTargetsSQL)
+}
+
+// GetLinkTargetsAt returns the notes and attachments outside the trash at
+// the given paths
+func (db *DB) GetLinkTargetsAt(ctx context.Context, paths []string) ([]*LinkTarget, error) {
+	return db.queryLinkTargets(ctx, linkTargetsAtSQL, paths)
+}
+
+// queryLinkTargets returns the link targets selected by a query
+func (db *DB) queryLinkTargets(ctx context.Context, query string, args ...any) ([]*LinkTarget, error) {
+	rows, err := db.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []*LinkTarget
+	for rows.Next() {
+		t := &LinkTarget{}
+		if err := rows.Scan(&t.ID, &t.Path, &t.IsNote, &t.Aliases); err != nil {
+			return nil, err
+		}
+		if t.Aliases, err = db.openStrings(t.Aliases); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Path, err)
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, rows.Err()
+}
+
+// GetLinks returns the links of every note outside the trash
+func (db *DB) GetLinks(ctx context.Context) ([]*VaultLink, error) {
+	return db.queryLinks(ctx, linksSQL)
+}
+
+// GetUnresolvedLinks returns the links of every note outside the trash that
+// don't resolve to a file
+func (db *DB) GetUnresolvedLinks(ctx context.Context) ([]*VaultLink, error) {
+	return db.queryLinks(ctx, unresolvedLinksSQL)
+}
+
+// queryLinks returns the links selected by a query on linkColumns
+func (db *DB) queryLinks(ctx context.Context, query string) ([]*VaultLink, error) {
+	rows, err := db.Pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []*VaultLink
+	for rows.Next() {
+		link, err := db.scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// SetLinkTargets records the note or attachment each link resolves to, or
+// that it is unresolved
+func (db *DB) SetLinkTargets(ctx context.Context, links []*VaultLink) error {
+	if len(links) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(links))
+	notes, attachments := make([]*string, len(links)), make([]*string, len(links))
+	for i, link := range links {
+		ids[i] = link.ID.String()
+		if link.TargetNoteID != nil {
+			id := link.TargetNoteID.String()
+			notes[i] = &id
+		}
+		if link.TargetAttachmentID != nil {
+			id := link.TargetAttachmentID.String()
+			attachments[i] = &id
+		}
+	}
+
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE vault_links l SET
+			target_note_id = u.target_note_id::uuid,
+			target_attachment_id = u.target_attachment_id::uuid
+		FROM unnest($1::text[], $2::text[], $3::text[])
+			AS u (id, target_note_id, target_attachment_id)
+		WHERE l.id = u.id::uuid
+	`, ids, notes, attachments)
+	return err
+}
+
+// resealLinks rewrites the text of every link
+func (db *DB) resealLinks(ctx context.Context) (int64, error) {
+	rows, err := db.Pool.Query(ctx, "SELECT"+linkColumns+"FROM vault_links l JOIN vault_notes n ON n.id = l.source_note_id")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		link, err := db.scanLink(rows)
+		if err != nil {
+			return n, err
+		}
+		target, anchor, alias := db.sealLink(link)
+		if _, err := db.Pool.Exec(ctx, `
+			UPDATE vault_links SET target = $2, anchor = $3, alias = $4
+			WHERE id = $1
+		`, link.ID, target, anchor, alias); err != nil {
+			return n, fmt.Errorf("%s: %w", link.SourcePath, err)
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+// resealExternalLinks rewrites the text of every external link
+func (db *DB) resealExternalLinks(ctx context.Context) (int64, error) {
+	rows, err := db.Pool.Query(ctx, "SELECT id, url, host, alias FROM vault_external_links")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		link := &VaultExternalLink{}
+		if err := rows.Scan(&link.ID, &link.URL, &link.Host, &link.Alias); err != nil {
+			return n, err
+		}
+		if err := db.openExternalLink(link); err != nil {
+			return n, err
+		}
+		url, host, alias := db.sealExternalLink(link)
+		if _, err := db.Pool.Exec(ctx, `
+			UPDATE vault_external_links SET url = $2, host = $3, alias = $4
+			WHERE id = $1
+		`, link.ID, url, host, alias); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
@@ -23,20 +23,117 @@ type VaultNote struct {
 	ContentHash   string                 `db:"content_hash"`
 	FileSizeBytes int64                  `db:"file_size_bytes"`
 	SyncedAt      time.Time              `db:"synced_at"`
+	SyncedBy      *string                `db:"synced_by"`
 	OutgoingLinks []string               `db:"outgoing_links"`
+	FileMode      *int32                 `db:"file_mode"`        // Permission bits, if recorded
+	FileModTime   *time.Time             `db:"file_modified_at"` // Modification time of the file, if recorded
+	Links         []*VaultLink           `db:"-"`                // Written to vault_links with the note
+	ExternalLinks []*VaultExternalLink   `db:"-"`                // Written to vault_external_links with the note
+}
+
+// Link types in vault_links
+const (
+	LinkTypeWiki     = "wikilink" // [[Note]]
+	LinkTypeMarkdown = "markdown" // [text](Note.md)
+	LinkTypeEmbed    = "embed"    // ![[image.png]] or ![alt](image.png)
+)
+
+// VaultLink is a link in a note, to another note, an attachment, or a file
+// that doesn't exist yet
+type VaultLink struct {
+	ID                 uuid.UUID  `db:"id"`
+	SourceNoteID       uuid.UUID  `db:"source_note_id"`
+	SourcePath         string     `db:"-"`      // Path of the linking note, set by GetLinks
+	Target             string     `db:"target"` // Path or name as written, without the anchor
+	LinkType           string     `db:"link_type"`
+	Anchor             *string    `db:"anchor"` // Heading or ^block id
+	Alias              *string    `db:"alias"`  // Display text
+	Position           *int       `db:"position"`
+	Line               *int       `db:"line"`
+	TargetNoteID       *uuid.UUID `db:"target_note_id"`       // Set when the link resolves to a note
+	TargetAttachmentID *uuid.UUID `db:"target_attachment_id"` // Set when it resolves to an attachment
+}
+
+// VaultExternalLink is a link in a note to a URL outside the vault
+type VaultExternalLink struct {
+	ID           uuid.UUID `db:"id"`
+	SourceNoteID uuid.UUID `db:"source_note_id"`
+	URL          string    `db:"url"`
+	Host         *string   `db:"host"`  // Lowercased; nil for URLs without one, such as mailto:
+	Alias        *string   `db:"alias"` // Link text
+	Position     *int      `db:"position"`
+	Line         *int      `db:"line"`
+}
+
+// LinkTarget is a note or attachment that links can resolve to
+type LinkTarget struct {
+	ID      uuid.UUID
+	Path    string
+	IsNote  bool
+	Aliases []string
 }
 
 // VaultAttachment represents a non-markdown file in the vault
 type VaultAttachment struct {
-	ID            uuid.UUID `db:"id"`
+	ID            uuid.UUID  `db:"id"`
+	Path          string     `db:"path"`
+	Filename      string     `db:"filename"`
+	Extension     *string    `db:"extension"`
+	MimeType      *string    `db:"mime_type"`
+	FileSizeBytes int64      `db:"file_size_bytes"`
+	ContentHash   string     `db:"content_hash"`
+	Data          []byte     `db:"data"`        // Optional: content stored with the row, instead of PutChunkedBlob
+	StorageKey    *string    `db:"storage_key"` // Set when the content is in the external blob store
+	StorageCodec  string     `db:"codec"`       // How content in the external blob store is stored
+	ModifiedAt    *time.Time `db:"modified_at"`
+	FileMode      *int32     `db:"file_mode"` // Permission bits, if recorded
+	SyncedAt      time.Time  `db:"synced_at"`
+	SyncedBy      *string    `db:"synced_by"`
+}
+
+// VaultConflict records a file that was changed on two devices since they last synced
+type VaultConflict struct {
+	ID           uuid.UUID  `db:"id"`
+	Path         string     `db:"path"`
+	ConflictPath string     `db:"conflict_path"`
+	Device       *string    `db:"device"`
+	RemoteDevice *string    `db:"remote_device"`
+	BaseHash     *string    `db:"base_hash"`
+	LocalHash    string     `db:"local_hash"`
+	RemoteHash   string     `db:"remote_hash"`
+	DetectedAt   time.Time  `db:"detected_at"`
+	ResolvedAt   *time.Time `db:"resolved_at"`
+}
+
+// VaultNoteRevision is a previous version of a note, kept when it was
+// overwritten or deleted
+type VaultNoteRevision struct {
+	ID          uuid.UUID  `db:"id"`
+	NoteID      *uuid.UUID `db:"note_id"`
+	Path        string     `db:"path"` // Path of the note at the time
+	Revision    int        `db:"revision"`
+	RawContent  string     `db:"raw_content"`
+	ContentHash string     `db:"content_hash"`
+	SyncedBy    *string    `db:"synced_by"`
+	SyncedAt    *time.Time `db:"synced_at"`
+	ReplacedAt  time.Time  `db:"replaced_at"`
+	Deleted     bool       `db:"deleted"`
+}
+
+// Chunk is a piece of attachment content, stored once per hash
+type Chunk struct {
+	Hash string
+	Data []byte
+}
+
+// TrashedFile is a deleted note or attachment that can still be restored
+type TrashedFile struct {
 	Path          string    `db:"path"`
-	Filename      string    `db:"filename"`
-	Extension     *string   `db:"extension"`
-	MimeType      *string   `db:"mime_type"`
-	FileSizeBytes int64     `db:"file_size_bytes"`
+	IsNote        bool      `db:"is_note"`
 	ContentHash   string    `db:"content_hash"`
-	Data          []byte    `db:"data"`
-	SyncedAt      time.Time `db:"synced_at"`
+	FileSizeBytes int64     `db:"file_size_bytes"`
+	DeletedAt     time.Time `db:"deleted_at"`
+	DeletedBy     *string   `db:"deleted_by"`
 }
 
 // SyncStatus represents the current sync status
@@ -46,4 +143,6 @@ type SyncStatus struct {
 	TotalNotes     int
 	TotalAttach    int
 	PendingChanges int
+	Conflicts      int
+	Trashed        int
 }
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// changeChannel is the NOTIFY channel used by the notify_vault_change trigger
+	changeChannel = "obsync_changes"
+
+	// listenRetryDelay is how long to wait before re-establishing a lost listener
+	listenRetryDelay = 5 * time.Second
+)
+
+// Change operations reported by the notify_vault_change trigger
+const (
+	ChangeInsert = "INSERT"
+	ChangeUpdate = "UPDATE"
+	ChangeDelete = "DELETE"
+	ChangeRename = "RENAME" // Path changed; OldPath holds the previous path
+
+	// ChangeResync is emitted after the listener reconnects, since any
+	// notifications sent while it was disconnected have been lost
+	ChangeResync = "RESYNC"
+)
+
+// Change represents a row change in vault_notes or vault_attachments
+type Change struct {
+	Schema      string `json:"schema"`
+	Table       string `json:"table"`
+	Op          string `json:"op"`
+	Path        string `json:"path"`
+	OldPath     string `json:"old_path,omitempty"`
+	ContentHash string `json:"content_hash"`
+}
+
+// IsNote reports whether the change affects a note rather than an attachment
+func (c Change) IsNote() bool {
+	return c.Table == "vault_notes"
+}
+
+// Listen subscribes to change notifications for this schema. Changes are
+// delivered on the returned channel until ctx is cancelled. The listener uses
+// a dedicated connection outside the pool and reconnects if it is lost.
+func (db *DB) Listen(ctx context.Context) <-chan Change {
+	out := make(chan Change, 100)
+
+	go func() {
+		defer close(out)
+
+		connected := false
+		for {
+			err := db.listen(ctx, out, connected)
+			if ctx.Err() != nil {
+				return
+			}
+			connected = true
+
+			slog.Warn("change listener disconnected, reconnecting",
+				"error", err,
+				"delay_s", listenRetryDelay.Seconds())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(listenRetryDelay):
+			}
+		}
+	}()
+
+	return out
+}
+
+// listen runs a single LISTEN session until it fails or ctx is cancelled
+func (db *DB) listen(ctx context.Context, out chan<- Change, reconnect bool) error {
+	conn, err := pgx.ConnectConfig(ctx, db.Pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changeChannel); err != nil {
+		return err
+	}
+
+	slog.Info("listening for remote changes", "schema", db.Schema)
+
+	if reconnect {
+		select {
+		case out <- Change{Schema: db.Schema, Op: ChangeResync}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change Change
+		if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			slog.Warn("invalid change notification", "payload", notification.Payload, "error", err)
+			continue
+		}
+
+		// All vault schemas share one channel
+		if change.Schema != db.Schema {
+			continue
+		}
+
+		select {
+		case out <- change:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
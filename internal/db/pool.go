@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+)
+
+// searchPathKey is the key in a connection's CustomData holding the schema
+// its search_path is set to
+const searchPathKey = "obsync_schema"
+
+// schemaKey is the context key carrying the schema a query runs in
+type schemaKey struct{}
+
+// Pool is a connection pool scoped to the schema of one vault. Vaults in the
+// same database share the underlying pgxpool.Pool; a connection's search_path
+// is switched to the vault's schema when the vault acquires it.
+type Pool struct {
+	pool   *pgxpool.Pool
+	schema string
+}
+
+// withSchema returns a context making acquired connections use the pool's schema
+func (p *Pool) withSchema(ctx context.Context) context.Context {
+	return context.WithValue(ctx, schemaKey{}, p.schema)
+}
+
+// Exec runs a statement in the vault's schema
+func (p *Pool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return p.pool.Exec(p.withSchema(ctx), sql, args...)
+}
+
+// Query runs a query in the vault's schema
+func (p *Pool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return p.pool.Query(p.withSchema(ctx), sql, args...)
+}
+
+// QueryRow runs a query returning at most one row in the vault's schema
+func (p *Pool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return p.pool.QueryRow(p.withSchema(ctx), sql, args...)
+}
+
+// Begin starts a transaction in the vault's schema
+func (p *Pool) Begin(ctx context.Context) (pgx.Tx, error) {
+	return p.pool.Begin(p.withSchema(ctx))
+}
+
+// SendBatch sends a batch of queries to run in the vault's schema
+func (p *Pool) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return p.pool.SendBatch(p.withSchema(ctx), b)
+}
+
+// Ping checks that a connection can be acquired and answers
+func (p *Pool) Ping(ctx context.Context) error {
+	return p.pool.Ping(ctx)
+}
+
+// Config returns the configuration of the shared pool
+func (p *Pool) Config() *pgxpool.Config {
+	return p.pool.Config()
+}
+
+// sharedPool is a pgxpool.Pool with the number of vaults using it
+type sharedPool struct {
+	pool *pgxpool.Pool
+	refs int
+}
+
+// pools holds the connection pool of each database opened by this process,
+// keyed by its connection string without a schema
+var pools = struct {
+	sync.Mutex
+	byConn map[string]*sharedPool
+}{byConn: make(map[string]*sharedPool)}
+
+// acquirePool returns a pool for the schema of cfg, sharing the connections
+// of any other vault open in the same database
+func acquirePool(ctx context.Context, cfg *config.DatabaseConfig) (*Pool, error) {
+	shared := *cfg
+	shared.Schema = ""
+	connStr := shared.ConnectionString()
+
+	pools.Lock()
+	defer pools.Unlock()
+
+	if sp, ok := pools.byConn[connStr]; ok {
+		sp.refs++
+		return &Pool{pool: sp.pool, schema: cfg.Schema}, nil
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse connection string: %w", err)
+	}
+
+	// Configure pool settings
+	poolConfig.MaxConns = 10
+	poolConfig.MinConns = 2
+	poolConfig.MaxConnLifetime = time.Hour
+	poolConfig.MaxConnIdleTime = 30 * time.Minute
+	poolConfig.HealthCheckPeriod = time.Minute
+	poolConfig.PrepareConn = setSearchPath
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection pool: %w", err)
+	}
+
+	pools.byConn[connStr] = &sharedPool{pool: pool, refs: 1}
+	return &Pool{pool: pool, schema: cfg.Schema}, nil
+}
+
+// releasePool closes the shared pool once no vault uses it any more
+func releasePool(p *Pool) {
+	pools.Lock()
+	defer pools.Unlock()
+
+	for connStr, sp := range pools.byConn {
+		if sp.pool != p.pool {
+			continue
+		}
+		if sp.refs--; sp.refs == 0 {
+			delete(pools.byConn, connStr)
+			sp.pool.Close()
+			slog.Info("database connection closed")
+		}
+		return
+	}
+}
+
+// setSearchPath points an acquired connection at the schema of the vault
+// acquiring it, unless it already is
+func setSearchPath(ctx context.Context, conn *pgx.Conn) (bool, error) {
+	schema, ok := ctx.Value(schemaKey{}).(string)
+	if !ok {
+		return true, nil
+	}
+
+	data := conn.PgConn().CustomData()
+	if data[searchPathKey] == schema {
+		return true, nil
+	}
+
+	// Unquoted, as in the search_path of ConnectionString
+	searchPath := schema + ",public"
+	if schema == "" {
+		searchPath = `"$user", public` // The server's default
+	}
+	if _, err := conn.Exec(ctx, "SELECT set_config('search_path', $1, false)", searchPath); err != nil {
+		// The connection's search_path is unknown now
+		return false, fmt.Errorf("failed to switch to schema %s: %w", schema, err)
+	}
+	data[searchPathKey] = schema
+	return true, nil
+}
@@ -4,131 +4,360 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 )
 
-// UpsertNote inserts or updates a note in the database
-func (db *DB) UpsertNote(ctx context.Context, note *VaultNote) error {
-	frontmatterJSON, err := json.Marshal(note.Frontmatter)
+const upsertNoteSQL = `
+	INSERT INTO vault_notes (
+		path, filename, title, tags, aliases, created_at, modified_at,
+		publish, frontmatter, body, raw_content, content_hash,
+		file_size_bytes, outgoing_links, synced_by, content_codec,
+		compressed_content, file_mode, file_modified_at
+	) VALUES (
+		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+		$17, $18, $19
+	)
+	ON CONFLICT (path) DO UPDATE SET
+		filename = EXCLUDED.filename,
+		title = EXCLUDED.title,
+		tags = EXCLUDED.tags,
+		aliases = EXCLUDED.aliases,
+		created_at = EXCLUDED.created_at,
+		modified_at = EXCLUDED.modified_at,
+		publish = EXCLUDED.publish,
+		frontmatter = EXCLUDED.frontmatter,
+		body = EXCLUDED.body,
+		raw_content = EXCLUDED.raw_content,
+		content_codec = EXCLUDED.content_codec,
+		compressed_content = EXCLUDED.compressed_content,
+		content_hash = EXCLUDED.content_hash,
+		file_size_bytes = EXCLUDED.file_size_bytes,
+		outgoing_links = EXCLUDED.outgoing_links,
+		file_mode = COALESCE(EXCLUDED.file_mode, vault_notes.file_mode),
+		file_modified_at = EXCLUDED.file_modified_at,
+		synced_by = EXCLUDED.synced_by,
+		synced_at = NOW(),
+		deleted_at = NULL,
+		deleted_by = NULL
+`
+
+const upsertAttachmentSQL = `
+	INSERT INTO vault_attachments (
+		path, filename, extension, mime_type, file_size_bytes,
+		content_hash, synced_by, modified_at, file_mode
+	) VALUES (
+		$1, $2, $3, $4, $5, $6, $7, $8, $9
+	)
+	ON CONFLICT (path) DO UPDATE SET
+		filename = EXCLUDED.filename,
+		extension = EXCLUDED.extension,
+		mime_type = EXCLUDED.mime_type,
+		file_size_bytes = EXCLUDED.file_size_bytes,
+		content_hash = EXCLUDED.content_hash,
+		modified_at = EXCLUDED.modified_at,
+		file_mode = COALESCE(EXCLUDED.file_mode, vault_attachments.file_mode),
+		synced_by = EXCLUDED.synced_by,
+		synced_at = NOW(),
+		deleted_at = NULL,
+		deleted_by = NULL
+`
+
+const insertBlobSQL = `
+	INSERT INTO vault_blobs (content_hash, data, codec, size_bytes, storage_key)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (content_hash) DO NOTHING
+`
+
+// unusedBlobsSQL matches blobs no attachment refers to. Attachments in the
+// trash keep their blob, so they can still be restored.
+const unusedBlobsSQL = `
+	NOT EXISTS (
+		SELECT 1 FROM vault_attachments a WHERE a.content_hash = b.content_hash
+	)
+`
+
+// pruneBlobsSQL deletes unused blobs stored in the database. Blobs in the
+// external store are left to PruneExternalBlobs, which returns their keys.
+const pruneBlobsSQL = `
+	DELETE FROM vault_blobs b WHERE storage_key IS NULL AND` + unusedBlobsSQL
+
+// noteColumns are the columns read by scanNote
+const noteColumns = `
+	id, path, filename, title, tags, aliases, created_at, modified_at,
+	publish, frontmatter, body, raw_content, content_codec, compressed_content,
+	content_hash, file_size_bytes, synced_at, synced_by, outgoing_links,
+	file_mode, file_modified_at
+`
+
+// noteArgs returns the parameters of upsertNoteSQL for a note, with its
+// content compressed and encrypted as configured
+func (c *codecs) noteArgs(note *VaultNote) ([]any, error) {
+	frontmatter, err := c.sealFrontmatter(note.Frontmatter)
+	if err != nil {
+		return nil, err
+	}
+	frontmatterJSON, err := json.Marshal(frontmatter)
 	if err != nil {
-		return fmt.Errorf("failed to marshal frontmatter: %w", err)
+		return nil, fmt.Errorf("failed to marshal frontmatter: %w", err)
 	}
+	raw, compressed, codec := c.encodeText(note.RawContent)
 
-	_, err = db.Pool.Exec(ctx, `
-		INSERT INTO vault_notes (
-			path, filename, title, tags, aliases, created_at, modified_at,
-			publish, frontmatter, body, raw_content, content_hash,
-			file_size_bytes, outgoing_links
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14
-		)
-		ON CONFLICT (path) DO UPDATE SET
-			filename = EXCLUDED.filename,
-			title = EXCLUDED.title,
-			tags = EXCLUDED.tags,
-			aliases = EXCLUDED.aliases,
-			created_at = EXCLUDED.created_at,
-			modified_at = EXCLUDED.modified_at,
-			publish = EXCLUDED.publish,
-			frontmatter = EXCLUDED.frontmatter,
-			body = EXCLUDED.body,
-			raw_content = EXCLUDED.raw_content,
-			content_hash = EXCLUDED.content_hash,
-			file_size_bytes = EXCLUDED.file_size_bytes,
-			outgoing_links = EXCLUDED.outgoing_links,
-			synced_at = NOW()
-	`,
-		note.Path, note.Filename, note.Title, note.Tags, note.Aliases,
+	return []any{
+		note.Path, note.Filename, c.sealTitle(note.Title),
+		c.sealStrings(FieldTags, note.Tags), c.sealStrings(FieldAliases, note.Aliases),
 		note.CreatedAt, note.ModifiedAt, note.Publish, frontmatterJSON,
-		note.Body, note.RawContent, note.ContentHash, note.FileSizeBytes,
-		note.OutgoingLinks,
+		c.sealString(fieldBody, note.Body), raw, note.ContentHash, note.FileSizeBytes,
+		c.sealStrings(FieldLinks, note.OutgoingLinks), note.SyncedBy, codec, compressed,
+		note.FileMode, note.FileModTime,
+	}, nil
+}
+
+// scanNote scans a single note row selected with noteColumns, returning nil
+// if there is none
+func (db *DB) scanNote(row pgx.Row) (*VaultNote, error) {
+	note := &VaultNote{}
+	var frontmatterJSON []byte
+	var raw *string
+	var codec string
+	var compressed []byte
+
+	err := row.Scan(
+		&note.ID, &note.Path, &note.Filename, &note.Title, &note.Tags,
+		&note.Aliases, &note.CreatedAt, &note.ModifiedAt, &note.Publish,
+		&frontmatterJSON, &note.Body, &raw, &codec, &compressed,
+		&note.ContentHash, &note.FileSizeBytes, &note.SyncedAt, &note.SyncedBy,
+		&note.OutgoingLinks, &note.FileMode, &note.FileModTime,
 	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	if err := db.loadNote(note, codec, raw, compressed, frontmatterJSON); err != nil {
+		return nil, err
+	}
+	return note, nil
 }
 
-// UpsertAttachment inserts or updates an attachment in the database
-func (db *DB) UpsertAttachment(ctx context.Context, att *VaultAttachment) error {
-	_, err := db.Pool.Exec(ctx, `
-		INSERT INTO vault_attachments (
-			path, filename, extension, mime_type, file_size_bytes,
-			content_hash, data
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7
-		)
-		ON CONFLICT (path) DO UPDATE SET
-			filename = EXCLUDED.filename,
-			extension = EXCLUDED.extension,
-			mime_type = EXCLUDED.mime_type,
-			file_size_bytes = EXCLUDED.file_size_bytes,
-			content_hash = EXCLUDED.content_hash,
-			data = EXCLUDED.data,
-			synced_at = NOW()
-	`,
+// loadNote fills in the content and frontmatter of a scanned note from their
+// stored form, and decrypts its metadata
+func (c *codecs) loadNote(note *VaultNote, codec string, raw *string, compressed, frontmatterJSON []byte) error {
+	var err error
+	if note.RawContent, err = c.decodeText(codec, raw, compressed); err != nil {
+		return fmt.Errorf("%s: %w", note.Path, err)
+	}
+
+	if len(frontmatterJSON) > 0 {
+		if err := json.Unmarshal(frontmatterJSON, &note.Frontmatter); err != nil {
+			return fmt.Errorf("failed to unmarshal frontmatter: %w", err)
+		}
+	}
+
+	if err := c.openNote(note); err != nil {
+		return fmt.Errorf("%s: %w", note.Path, err)
+	}
+	return nil
+}
+
+// attachmentArgs returns the parameters of upsertAttachmentSQL for an attachment
+func attachmentArgs(att *VaultAttachment) []any {
+	return []any{
 		att.Path, att.Filename, att.Extension, att.MimeType,
-		att.FileSizeBytes, att.ContentHash, att.Data,
-	)
+		att.FileSizeBytes, att.ContentHash, att.SyncedBy, att.ModifiedAt,
+		att.FileMode,
+	}
+}
 
-	return err
+// UpsertNote inserts or updates a note in the database, replacing its links
+func (db *DB) UpsertNote(ctx context.Context, note *VaultNote) error {
+	return db.UpsertNotes(ctx, []*VaultNote{note})
 }
 
-// DeleteNote removes a note from the database
-func (db *DB) DeleteNote(ctx context.Context, path string) error {
-	_, err := db.Pool.Exec(ctx, "DELETE FROM vault_notes WHERE path = $1", path)
-	return err
+// UpsertNotes inserts or updates several notes and their links in one round
+// trip. The batch runs as a single transaction, so either all notes are
+// written or none are.
+func (db *DB) UpsertNotes(ctx context.Context, notes []*VaultNote) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, note := range notes {
+		args, err := db.noteArgs(note)
+		if err != nil {
+			return fmt.Errorf("%s: %w", note.Path, err)
+		}
+		batch.Queue(upsertNoteSQL, args...)
+		db.queueNoteLinks(batch, note)
+	}
+
+	return db.Pool.SendBatch(ctx, batch).Close()
 }
 
-// DeleteAttachment removes an attachment from the database
-func (db *DB) DeleteAttachment(ctx context.Context, path string) error {
-	_, err := db.Pool.Exec(ctx, "DELETE FROM vault_attachments WHERE path = $1", path)
-	return err
+// UpsertAttachment inserts or updates an attachment in the database
+func (db *DB) UpsertAttachment(ctx context.Context, att *VaultAttachment) error {
+	return db.UpsertAttachments(ctx, []*VaultAttachment{att})
 }
 
-// GetNoteByPath retrieves a note by its path
-func (db *DB) GetNoteByPath(ctx context.Context, path string) (*VaultNote, error) {
-	note := &VaultNote{}
-	var frontmatterJSON []byte
+// UpsertAttachments inserts or updates several attachments in one round trip.
+// Content already stored under the same hash is not sent again. The batch
+// runs as a single transaction, so either all attachments are written or
+// none are.
+func (db *DB) UpsertAttachments(ctx context.Context, atts []*VaultAttachment) error {
+	if len(atts) == 0 {
+		return nil
+	}
 
-	err := db.Pool.QueryRow(ctx, `
-		SELECT id, path, filename, title, tags, aliases, created_at,
-			modified_at, publish, frontmatter, body, raw_content,
-			content_hash, file_size_bytes, synced_at, outgoing_links
-		FROM vault_notes WHERE path = $1
-	`, path).Scan(
-		&note.ID, &note.Path, &note.Filename, &note.Title, &note.Tags,
-		&note.Aliases, &note.CreatedAt, &note.ModifiedAt, &note.Publish,
-		&frontmatterJSON, &note.Body, &note.RawContent, &note.ContentHash,
-		&note.FileSizeBytes, &note.SyncedAt, &note.OutgoingLinks,
-	)
+	hashes := make([]string, len(atts))
+	for i, att := range atts {
+		hashes[i] = att.ContentHash
+	}
+	missing, err := db.missingBlobs(ctx, hashes)
+	if err != nil {
+		return fmt.Errorf("failed to check stored blobs: %w", err)
+	}
 
-	if err == pgx.ErrNoRows {
-		return nil, nil
+	batch := &pgx.Batch{}
+	for _, att := range atts {
+		if !missing[att.ContentHash] {
+			continue
+		}
+		switch {
+		case att.StorageKey != nil:
+			batch.Queue(insertBlobSQL, att.ContentHash, nil, db.externalCodec(), att.FileSizeBytes, att.StorageKey)
+		case att.Data != nil:
+			data, codec := db.encodeData(att.Data, att.MimeType)
+			batch.Queue(insertBlobSQL, att.ContentHash, data, codec, int64(len(att.Data)), nil)
+		default:
+			return fmt.Errorf("%s: content %s is not stored and no data was given", att.Path, att.ContentHash)
+		}
+		delete(missing, att.ContentHash)
+	}
+	for _, att := range atts {
+		batch.Queue(upsertAttachmentSQL, attachmentArgs(att)...)
+	}
+
+	return db.Pool.SendBatch(ctx, batch).Close()
+}
+
+// missingBlobs returns the set of hashes that have no stored blob
+func (db *DB) missingBlobs(ctx context.Context, hashes []string) (map[string]bool, error) {
+	missing := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		missing[hash] = true
 	}
+
+	rows, err := db.Pool.Query(ctx, "SELECT content_hash FROM vault_blobs WHERE content_hash = ANY($1)", hashes)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if len(frontmatterJSON) > 0 {
-		if err := json.Unmarshal(frontmatterJSON, &note.Frontmatter); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal frontmatter: %w", err)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
 		}
+		delete(missing, hash)
 	}
 
-	return note, nil
+	return missing, rows.Err()
 }
 
-// GetAttachmentByPath retrieves an attachment by its path
+// HasBlob reports whether content with the given hash is stored, in the
+// database or the external store
+func (db *DB) HasBlob(ctx context.Context, hash string) (bool, error) {
+	missing, err := db.missingBlobs(ctx, []string{hash})
+	if err != nil {
+		return false, err
+	}
+	return !missing[hash], nil
+}
+
+// PruneBlobs deletes blobs stored in the database that no attachment refers
+// to any more, and the chunks no blob uses
+func (db *DB) PruneBlobs(ctx context.Context) (int64, error) {
+	tag, err := db.Pool.Exec(ctx, pruneBlobsSQL)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Pool.Exec(ctx, pruneChunksSQL); err != nil {
+		return tag.RowsAffected(), fmt.Errorf("failed to prune chunks: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// PruneExternalBlobs deletes the rows of unused blobs in the external store
+// and returns their storage keys, so the caller can delete the content
+func (db *DB) PruneExternalBlobs(ctx context.Context) ([]string, error) {
+	rows, err := db.Pool.Query(ctx, `
+		DELETE FROM vault_blobs b WHERE storage_key IS NOT NULL AND`+unusedBlobsSQL+`
+		RETURNING storage_key
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteNote moves a note to the trash, recording the device that deleted it
+func (db *DB) DeleteNote(ctx context.Context, path, deletedBy string) error {
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE vault_notes SET deleted_at = NOW(), deleted_by = $2
+		WHERE path = $1 AND deleted_at IS NULL
+	`, path, deletedBy)
+	return err
+}
+
+// DeleteAttachment moves an attachment to the trash, recording the device that deleted it
+func (db *DB) DeleteAttachment(ctx context.Context, path, deletedBy string) error {
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE vault_attachments SET deleted_at = NOW(), deleted_by = $2
+		WHERE path = $1 AND deleted_at IS NULL
+	`, path, deletedBy)
+	return err
+}
+
+// GetNoteByPath retrieves a note by its path
+func (db *DB) GetNoteByPath(ctx context.Context, path string) (*VaultNote, error) {
+	return db.scanNote(db.Pool.QueryRow(ctx,
+		"SELECT"+noteColumns+"FROM vault_notes WHERE path = $1 AND deleted_at IS NULL",
+		path,
+	))
+}
+
+// GetAttachmentByPath retrieves an attachment by its path. Its content is
+// not loaded; use ReadBlob with its hash, or the blob store with its storage
+// key.
 func (db *DB) GetAttachmentByPath(ctx context.Context, path string) (*VaultAttachment, error) {
 	att := &VaultAttachment{}
 
 	err := db.Pool.QueryRow(ctx, `
-		SELECT id, path, filename, extension, mime_type, file_size_bytes,
-			content_hash, data, synced_at
-		FROM vault_attachments WHERE path = $1
+		SELECT a.id, a.path, a.filename, a.extension, a.mime_type, a.file_size_bytes,
+			a.content_hash, b.storage_key, COALESCE(b.codec, 'none'), a.synced_at, a.synced_by,
+			a.modified_at, a.file_mode
+		FROM vault_attachments a
+		LEFT JOIN vault_blobs b ON b.content_hash = a.content_hash
+		WHERE a.path = $1 AND a.deleted_at IS NULL
 	`, path).Scan(
 		&att.ID, &att.Path, &att.Filename, &att.Extension, &att.MimeType,
-		&att.FileSizeBytes, &att.ContentHash, &att.Data, &att.SyncedAt,
+		&att.FileSizeBytes, &att.ContentHash, &att.StorageKey, &att.StorageCodec,
+		&att.SyncedAt, &att.SyncedBy, &att.ModifiedAt, &att.FileMode,
 	)
 
 	if err == pgx.ErrNoRows {
@@ -141,9 +370,29 @@ func (db *DB) GetAttachmentByPath(ctx context.Context, path string) (*VaultAttac
 	return att, nil
 }
 
+// GetNoteHash returns the content hash of a note, or "" if it doesn't exist
+func (db *DB) GetNoteHash(ctx context.Context, path string) (string, error) {
+	var hash string
+	err := db.Pool.QueryRow(ctx, "SELECT content_hash FROM vault_notes WHERE path = $1 AND deleted_at IS NULL", path).Scan(&hash)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// GetAttachmentHash returns the content hash of an attachment, or "" if it doesn't exist
+func (db *DB) GetAttachmentHash(ctx context.Context, path string) (string, error) {
+	var hash string
+	err := db.Pool.QueryRow(ctx, "SELECT content_hash FROM vault_attachments WHERE path = $1 AND deleted_at IS NULL", path).Scan(&hash)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
 // GetAllNoteHashes returns a map of path -> content_hash for all notes
 func (db *DB) GetAllNoteHashes(ctx context.Context) (map[string]string, error) {
-	rows, err := db.Pool.Query(ctx, "SELECT path, content_hash FROM vault_notes")
+	rows, err := db.Pool.Query(ctx, "SELECT path, content_hash FROM vault_notes WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
@@ -163,7 +412,7 @@ func (db *DB) GetAllNoteHashes(ctx context.Context) (map[string]string, error) {
 
 // GetAllAttachmentHashes returns a map of path -> content_hash for all attachments
 func (db *DB) GetAllAttachmentHashes(ctx context.Context) (map[string]string, error) {
-	rows, err := db.Pool.Query(ctx, "SELECT path, content_hash FROM vault_attachments")
+	rows, err := db.Pool.Query(ctx, "SELECT path, content_hash FROM vault_attachments WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
@@ -181,9 +430,59 @@ func (db *DB) GetAllAttachmentHashes(ctx context.Context) (map[string]string, er
 	return hashes, rows.Err()
 }
 
+// GetAllFileSizes returns a map of path -> file_size_bytes for all notes and attachments
+func (db *DB) GetAllFileSizes(ctx context.Context) (map[string]int64, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT path, COALESCE(file_size_bytes, 0) FROM vault_notes WHERE deleted_at IS NULL
+		UNION ALL
+		SELECT path, COALESCE(file_size_bytes, 0) FROM vault_attachments WHERE deleted_at IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var path string
+		var size int64
+		if err := rows.Scan(&path, &size); err != nil {
+			return nil, err
+		}
+		sizes[path] = size
+	}
+
+	return sizes, rows.Err()
+}
+
+// GetChangedSince returns the paths of files that were last synced at or
+// after a given time
+func (db *DB) GetChangedSince(ctx context.Context, since time.Time) (map[string]bool, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT path FROM vault_notes WHERE deleted_at IS NULL AND synced_at >= $1
+		UNION ALL
+		SELECT path FROM vault_attachments WHERE deleted_at IS NULL AND synced_at >= $1
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths[path] = true
+	}
+
+	return paths, rows.Err()
+}
+
 // GetAllNotePaths returns all note paths in the database
 func (db *DB) GetAllNotePaths(ctx context.Context) ([]string, error) {
-	rows, err := db.Pool.Query(ctx, "SELECT path FROM vault_notes")
+	rows, err := db.Pool.Query(ctx, "SELECT path FROM vault_notes WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
@@ -203,7 +502,7 @@ func (db *DB) GetAllNotePaths(ctx context.Context) ([]string, error) {
 
 // GetAllAttachmentPaths returns all attachment paths in the database
 func (db *DB) GetAllAttachmentPaths(ctx context.Context) ([]string, error) {
-	rows, err := db.Pool.Query(ctx, "SELECT path FROM vault_attachments")
+	rows, err := db.Pool.Query(ctx, "SELECT path FROM vault_attachments WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
@@ -223,12 +522,7 @@ func (db *DB) GetAllAttachmentPaths(ctx context.Context) ([]string, error) {
 
 // GetAllNotes returns all notes from the database (for pull command)
 func (db *DB) GetAllNotes(ctx context.Context) ([]*VaultNote, error) {
-	rows, err := db.Pool.Query(ctx, `
-		SELECT id, path, filename, title, tags, aliases, created_at,
-			modified_at, publish, frontmatter, body, raw_content,
-			content_hash, file_size_bytes, synced_at, outgoing_links
-		FROM vault_notes
-	`)
+	rows, err := db.Pool.Query(ctx, "SELECT"+noteColumns+"FROM vault_notes WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
@@ -236,81 +530,151 @@ func (db *DB) GetAllNotes(ctx context.Context) ([]*VaultNote, error) {
 
 	var notes []*VaultNote
 	for rows.Next() {
-		note := &VaultNote{}
-		var frontmatterJSON []byte
-
-		if err := rows.Scan(
-			&note.ID, &note.Path, &note.Filename, &note.Title, &note.Tags,
-			&note.Aliases, &note.CreatedAt, &note.ModifiedAt, &note.Publish,
-			&frontmatterJSON, &note.Body, &note.RawContent, &note.ContentHash,
-			&note.FileSizeBytes, &note.SyncedAt, &note.OutgoingLinks,
-		); err != nil {
+		note, err := db.scanNote(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		if len(frontmatterJSON) > 0 {
-			if err := json.Unmarshal(frontmatterJSON, &note.Frontmatter); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal frontmatter: %w", err)
-			}
-		}
-
 		notes = append(notes, note)
 	}
 
 	return notes, rows.Err()
 }
 
-// GetAllAttachments returns all attachments from the database (for pull command)
-func (db *DB) GetAllAttachments(ctx context.Context) ([]*VaultAttachment, error) {
+// EachAttachment calls fn for every attachment, reading rows as it goes
+// instead of loading them all at once. Content is not loaded; use ReadBlob
+// or the blob store.
+func (db *DB) EachAttachment(ctx context.Context, fn func(*VaultAttachment) error) error {
 	rows, err := db.Pool.Query(ctx, `
-		SELECT id, path, filename, extension, mime_type, file_size_bytes,
-			content_hash, data, synced_at
-		FROM vault_attachments
+		SELECT a.id, a.path, a.filename, a.extension, a.mime_type, a.file_size_bytes,
+			a.content_hash, b.storage_key, COALESCE(b.codec, 'none'), a.synced_at, a.synced_by,
+			a.modified_at, a.file_mode
+		FROM vault_attachments a
+		LEFT JOIN vault_blobs b ON b.content_hash = a.content_hash
+		WHERE a.deleted_at IS NULL
 	`)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var attachments []*VaultAttachment
 	for rows.Next() {
 		att := &VaultAttachment{}
 
 		if err := rows.Scan(
 			&att.ID, &att.Path, &att.Filename, &att.Extension, &att.MimeType,
-			&att.FileSizeBytes, &att.ContentHash, &att.Data, &att.SyncedAt,
+			&att.FileSizeBytes, &att.ContentHash, &att.StorageKey, &att.StorageCodec,
+			&att.SyncedAt, &att.SyncedBy, &att.ModifiedAt, &att.FileMode,
 		); err != nil {
-			return nil, err
+			return err
 		}
 
-		attachments = append(attachments, att)
+		if err := fn(att); err != nil {
+			return err
+		}
 	}
 
-	return attachments, rows.Err()
+	return rows.Err()
 }
 
-// BatchDeleteNotes deletes multiple notes by path
-func (db *DB) BatchDeleteNotes(ctx context.Context, paths []string) error {
+// BatchDeleteNotes moves multiple notes to the trash by path
+func (db *DB) BatchDeleteNotes(ctx context.Context, paths []string, deletedBy string) error {
 	if len(paths) == 0 {
 		return nil
 	}
 
-	_, err := db.Pool.Exec(ctx,
-		"DELETE FROM vault_notes WHERE path = ANY($1)",
-		paths,
-	)
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE vault_notes SET deleted_at = NOW(), deleted_by = $2
+		WHERE path = ANY($1) AND deleted_at IS NULL
+	`, paths, deletedBy)
 	return err
 }
 
-// BatchDeleteAttachments deletes multiple attachments by path
-func (db *DB) BatchDeleteAttachments(ctx context.Context, paths []string) error {
+// BatchDeleteAttachments moves multiple attachments to the trash by path
+func (db *DB) BatchDeleteAttachments(ctx context.Context, paths []string, deletedBy string) error {
 	if len(paths) == 0 {
 		return nil
 	}
 
-	_, err := db.Pool.Exec(ctx,
-		"DELETE FROM vault_attachments WHERE path = ANY($1)",
-		paths,
-	)
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE vault_attachments SET deleted_at = NOW(), deleted_by = $2
+		WHERE path = ANY($1) AND deleted_at IS NULL
+	`, paths, deletedBy)
 	return err
 }
+
+// MoveNote changes the path of a note, keeping its id and history. A note in
+// the trash at the new path is purged to make room. It returns false if there
+// is no note at the old path.
+func (db *DB) MoveNote(ctx context.Context, oldPath, newPath, filename, movedBy string) (bool, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM vault_note_revisions WHERE note_id IN (
+			SELECT id FROM vault_notes WHERE path = $1 AND deleted_at IS NOT NULL
+		)
+	`, newPath); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx,
+		"DELETE FROM vault_notes WHERE path = $1 AND deleted_at IS NOT NULL",
+		newPath,
+	); err != nil {
+		return false, err
+	}
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE vault_notes SET
+			path = $2,
+			filename = $3,
+			synced_by = $4,
+			synced_at = NOW()
+		WHERE path = $1 AND deleted_at IS NULL
+	`, oldPath, newPath, filename, movedBy)
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// MoveAttachment changes the path of an attachment, keeping its id. An
+// attachment in the trash at the new path is purged to make room. It returns
+// false if there is no attachment at the old path.
+func (db *DB) MoveAttachment(ctx context.Context, oldPath, newPath, filename, movedBy string) (bool, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		"DELETE FROM vault_attachments WHERE path = $1 AND deleted_at IS NOT NULL",
+		newPath,
+	); err != nil {
+		return false, err
+	}
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE vault_attachments SET
+			path = $2,
+			filename = $3,
+			synced_by = $4,
+			synced_at = NOW()
+		WHERE path = $1 AND deleted_at IS NULL
+	`, oldPath, newPath, filename, movedBy)
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// scanRevision scans a single revision row, returning nil if there is none
+func (db *DB) scanRevision(row pgx.Row) (*VaultNoteRevision, error) {
+	r := &VaultNoteRevision{}
+	var raw *string
+	var codec string
+	var compressed []byte
+	err := row.Scan(
+		&r.ID, &r.NoteID, &r.Path, &r.Revision, &raw, &codec, &compressed,
+		&r.ContentHash, &r.SyncedBy, &r.SyncedAt, &r.ReplacedAt, &r.Deleted,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.RawContent, err = db.decodeText(codec, raw, compressed); err != nil {
+		return nil, fmt.Errorf("%s revision %d: %w", r.Path, r.Revision, err)
+	}
+	return r, nil
+}
+
+// GetNoteRevisions returns all stored revisions of a note, newest first.
+// Revisions stay with a note when it is moved, so older ones may have a
+// different path.
+func (db *DB) GetNoteRevisions(ctx context.Context, path string) ([]*VaultNoteRevision, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, note_id, path, revision, raw_content, content_codec,
+			compressed_content, content_hash, synced_by, synced_at, replaced_at,
+			deleted
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = $1)
+		ORDER BY revision DESC
+	`, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*VaultNoteRevision
+	for rows.Next() {
+		r, err := db.scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
+}
+
+// GetNoteRevision returns a single revision of a note, or nil if it doesn't exist
+func (db *DB) GetNoteRevision(ctx context.Context, path string, revision int) (*VaultNoteRevision, error) {
+	return db.scanRevision(db.Pool.QueryRow(ctx, `
+		SELECT id, note_id, path, revision, raw_content, content_codec,
+			compressed_content, content_hash, synced_by, synced_at, replaced_at,
+			deleted
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = $1)
+			AND revision = $2
+	`, path, revision))
+}
+
+// GetNoteRevisionAt returns the revision of a note that was current at the
+// given time, or nil if no stored revision covers it
+func (db *DB) GetNoteRevisionAt(ctx context.Context, path string, at time.Time) (*VaultNoteRevision, error) {
+	return db.scanRevision(db.Pool.QueryRow(ctx, `
+		SELECT id, note_id, path, revision, raw_content, content_codec,
+			compressed_content, content_hash, synced_by, synced_at, replaced_at,
+			deleted
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = $1)
+			AND replaced_at > $2 AND (synced_at IS NULL OR synced_at <= $2)
+		ORDER BY revision
+		LIMIT 1
+	`, path, at))
+}
+
+// GetNoteRevisionByHash returns the most recent revision of a note with the
+// given content hash, or nil if there is none
+func (db *DB) GetNoteRevisionByHash(ctx context.Context, path, hash string) (*VaultNoteRevision, error) {
+	return db.scanRevision(db.Pool.QueryRow(ctx, `
+		SELECT id, note_id, path, revision, raw_content, content_codec,
+			compressed_content, content_hash, synced_by, synced_at, replaced_at,
+			deleted
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = $1)
+			AND content_hash = $2
+		ORDER BY revision DESC
+		LIMIT 1
+	`, path, hash))
+}
+
+// PruneNoteRevisions deletes revisions beyond the newest keep per note and
+// revisions replaced longer than maxAge ago. A zero limit is not applied.
+func (db *DB) PruneNoteRevisions(ctx context.Context, keep int, maxAge time.Duration) (int64, error) {
+	if keep <= 0 && maxAge <= 0 {
+		return 0, nil
+	}
+
+	var cutoff *time.Time
+	if maxAge > 0 {
+		t := time.Now().Add(-maxAge)
+		cutoff = &t
+	}
+
+	tag, err := db.Pool.Exec(ctx, `
+		DELETE FROM vault_note_revisions
+		WHERE id IN (
+			SELECT id FROM (
+				SELECT id, replaced_at,
+					row_number() OVER (PARTITION BY note_id ORDER BY revision DESC) AS n
+				FROM vault_note_revisions
+			) r
+			WHERE ($1 > 0 AND r.n > $1) OR r.replaced_at < $2
+		)
+	`, keep, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,447 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+)
+
+// sqliteSchema creates the tables of a SQLite store that don't exist yet
+//
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+// sqliteTimeLayout is how times are stored as text in SQLite, the format the
+// driver writes and the archive triggers use
+const sqliteTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+// SQLite keeps the vault in a local SQLite file, for syncing without a
+// Postgres server or as a second copy on one machine. It has no change
+// notifications, so files written to it by another process are picked up by
+// the next full sync.
+type SQLite struct {
+	conn *sql.DB
+	Path string
+
+	codecs
+}
+
+// OpenSQLite opens the SQLite store at cfg.Path, creating the file and its
+// tables if they don't exist
+func OpenSQLite(ctx context.Context, cfg *config.DatabaseConfig) (*SQLite, error) {
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	conn, err := sql.Open(sqliteDriver, sqliteDSN(cfg.Path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cfg.Path, err)
+	}
+
+	// SQLite has a single writer; one connection avoids busy errors
+	conn.SetMaxOpenConns(1)
+
+	if _, err := conn.ExecContext(ctx, sqliteSchema); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create tables in %s: %w", cfg.Path, err)
+	}
+	if err := addSQLiteColumns(ctx, conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to upgrade tables in %s: %w", cfg.Path, err)
+	}
+
+	slog.Info("opened database", "path", cfg.Path)
+
+	return &SQLite{
+		conn:   conn,
+		Path:   cfg.Path,
+		codecs: codecs{codec: cfg.Compression},
+	}, nil
+}
+
+// sqliteColumns are the columns added to tables after they were first
+// created, which the schema's CREATE TABLE IF NOT EXISTS leaves out of
+// existing stores
+var sqliteColumns = []struct{ table, column, def string }{
+	{"vault_notes", "file_modified_at", "TIMESTAMP"},
+}
+
+// addSQLiteColumns adds the columns in sqliteColumns a store doesn't have yet
+func addSQLiteColumns(ctx context.Context, conn *sql.DB) error {
+	for _, c := range sqliteColumns {
+		var n int
+		if err := conn.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM pragma_table_info(?1) WHERE name = ?2", c.table, c.column,
+		).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx,
+			"ALTER TABLE "+c.table+" ADD COLUMN "+c.column+" "+c.def,
+		); err != nil {
+			return fmt.Errorf("%s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database file
+func (s *SQLite) Close() {
+	if s.conn != nil {
+		s.conn.Close()
+		slog.Info("database closed")
+	}
+}
+
+// MaxConns returns 1, as writes to SQLite are serialized
+func (s *SQLite) MaxConns() int {
+	return 1
+}
+
+// Reachable reports whether the database file can be read
+func (s *SQLite) Reachable(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, reachableTimeout)
+	defer cancel()
+	return s.conn.PingContext(ctx) == nil
+}
+
+// Listen returns a channel that is closed when ctx is cancelled. No other
+// device writes to a local store, so no changes are delivered.
+func (s *SQLite) Listen(ctx context.Context) <-chan Change {
+	out := make(chan Change)
+	go func() {
+		<-ctx.Done()
+		close(out)
+	}()
+	return out
+}
+
+// GetStatus returns the current sync status
+func (s *SQLite) GetStatus(ctx context.Context) (*SyncStatus, error) {
+	status := &SyncStatus{
+		Connected: true,
+	}
+
+	var lastSync time.Time
+	err := s.conn.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM vault_notes WHERE deleted_at IS NULL),
+			(SELECT COUNT(*) FROM vault_attachments WHERE deleted_at IS NULL),
+			(SELECT COUNT(*) FROM vault_conflicts WHERE resolved_at IS NULL),
+			(SELECT COUNT(*) FROM vault_notes WHERE deleted_at IS NOT NULL) +
+				(SELECT COUNT(*) FROM vault_attachments WHERE deleted_at IS NOT NULL),
+			(SELECT MAX(synced_at) FROM (
+				SELECT synced_at FROM vault_notes
+				UNION ALL
+				SELECT synced_at FROM vault_attachments
+			))
+	`).Scan(
+		&status.TotalNotes, &status.TotalAttach, &status.Conflicts, &status.Trashed,
+		sqliteTime{&lastSync},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status: %w", err)
+	}
+	if !lastSync.IsZero() {
+		status.LastSyncTime = &lastSync
+	}
+
+	return status, nil
+}
+
+// GetKeyFingerprint returns the fingerprint of the key the vault is
+// encrypted with, or "" if it isn't encrypted
+func (s *SQLite) GetKeyFingerprint(ctx context.Context) (string, error) {
+	var fingerprint string
+	err := s.conn.QueryRowContext(ctx,
+		"SELECT fingerprint FROM vault_keys WHERE retired_at IS NULL",
+	).Scan(&fingerprint)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return fingerprint, err
+}
+
+// ClaimKeyFingerprint records the fingerprint of the vault's key, unless
+// another one is already recorded. It returns the fingerprint in use.
+func (s *SQLite) ClaimKeyFingerprint(ctx context.Context, fingerprint, device string) (string, error) {
+	if _, err := s.conn.ExecContext(ctx, `
+		INSERT INTO vault_keys (fingerprint, created_by, created_at)
+		VALUES (?1, ?2, ?3)
+		ON CONFLICT DO NOTHING
+	`, fingerprint, device, sqliteNow()); err != nil {
+		return "", err
+	}
+	return s.GetKeyFingerprint(ctx)
+}
+
+// SetKeyFingerprint makes fingerprint the key the vault is encrypted with,
+// retiring the previous one
+func (s *SQLite) SetKeyFingerprint(ctx context.Context, fingerprint, device string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := sqliteNow()
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE vault_keys SET retired_at = ?2
+		WHERE retired_at IS NULL AND fingerprint <> ?1
+	`, fingerprint, now); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO vault_keys (fingerprint, created_by, created_at)
+		VALUES (?1, ?2, ?3)
+		ON CONFLICT (fingerprint) DO UPDATE SET retired_at = NULL
+	`, fingerprint, device, now); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Reseal rewrites all notes, including those in the trash, note revisions,
+// links and attachment content with the current key, like DB.Reseal
+func (s *SQLite) Reseal(ctx context.Context) (int64, error) {
+	if s.cipher == nil {
+		return 0, fmt.Errorf("no encryption key is set")
+	}
+
+	var total int64
+	steps := []struct {
+		name string
+		fn   func(context.Context) (int64, error)
+	}{
+		{"notes", s.resealNotes},
+		{"note revisions", s.resealRevisions},
+		{"links", s.resealLinks},
+		{"external links", s.resealExternalLinks},
+		{"blobs", func(ctx context.Context) (int64, error) { return s.resealData(ctx, "vault_blobs", "content_hash") }},
+		{"chunks", func(ctx context.Context) (int64, error) { return s.resealData(ctx, "vault_chunks", "chunk_hash") }},
+	}
+	for _, step := range steps {
+		n, err := step.fn(ctx)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to re-encrypt %s: %w", step.name, err)
+		}
+	}
+	return total, nil
+}
+
+// resealNotes rewrites the content and metadata of every note. The rows are
+// read before any is written, as the store has a single connection.
+func (s *SQLite) resealNotes(ctx context.Context) (int64, error) {
+	notes, err := s.queryNotes(ctx, "SELECT"+noteColumns+"FROM vault_notes")
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, note := range notes {
+		args, err := s.noteArgs(note)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", note.Path, err)
+		}
+		args = sqliteNoteArgs(args)
+
+		// Same order as upsertNoteSQL; the content hash is unchanged, so no
+		// revision is archived
+		if _, err := s.conn.ExecContext(ctx, `
+			UPDATE vault_notes SET
+				title = ?2, tags = ?3, aliases = ?4, frontmatter = ?5, body = ?6,
+				raw_content = ?7, outgoing_links = ?8, content_codec = ?9,
+				compressed_content = ?10
+			WHERE id = ?1
+		`, note.ID, args[2], args[3], args[4], args[8], args[9], args[10], args[13], args[15], args[16]); err != nil {
+			return n, fmt.Errorf("%s: %w", note.Path, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// resealRevisions rewrites the content of every note revision
+func (s *SQLite) resealRevisions(ctx context.Context) (int64, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT id, path, revision, raw_content, content_codec, compressed_content
+		FROM vault_note_revisions
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	type revision struct {
+		id, path   string
+		revision   int
+		raw        *string
+		codec      string
+		compressed []byte
+	}
+	var revisions []revision
+	for rows.Next() {
+		var r revision
+		if err := rows.Scan(&r.id, &r.path, &r.revision, &r.raw, &r.codec, &r.compressed); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		revisions = append(revisions, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, r := range revisions {
+		content, err := s.decodeText(r.codec, r.raw, r.compressed)
+		if err != nil {
+			return n, fmt.Errorf("%s revision %d: %w", r.path, r.revision, err)
+		}
+		raw, compressed, codec := s.encodeText(content)
+
+		if _, err := s.conn.ExecContext(ctx, `
+			UPDATE vault_note_revisions
+			SET raw_content = ?2, content_codec = ?3, compressed_content = ?4
+			WHERE id = ?1
+		`, r.id, raw, codec, compressed); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// resealData rewrites the data column of a content table, keeping the
+// compression each row was stored with
+func (s *SQLite) resealData(ctx context.Context, table, key string) (int64, error) {
+	rows, err := s.conn.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s, data, codec FROM %s WHERE data IS NOT NULL", key, table),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	type content struct {
+		hash, codec string
+		data        []byte
+	}
+	var contents []content
+	for rows.Next() {
+		var c content
+		if err := rows.Scan(&c.hash, &c.data, &c.codec); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		contents = append(contents, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET data = ?2, codec = ?3 WHERE %s = ?1", table, key)
+
+	var n int64
+	for _, c := range contents {
+		data, codec, err := s.resealBytes(c.codec, c.data)
+		if err != nil {
+			return n, fmt.Errorf("content %s: %w", c.hash, err)
+		}
+		if _, err := s.conn.ExecContext(ctx, update, c.hash, data, codec); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// sqliteNow returns the current time in UTC, so stored times compare as text
+func sqliteNow() time.Time {
+	return time.Now().UTC()
+}
+
+// newID returns a new row id
+func newID() string {
+	return uuid.New().String()
+}
+
+// stringList stores a list of strings as a JSON array in a TEXT column. It
+// is also how paths are passed to json_each, SQLite's stand-in for ANY.
+type stringList []string
+
+// Value implements driver.Valuer
+func (l stringList) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal([]string(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (l *stringList) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into a string list", src)
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// sqliteTime scans a time that SQLite returns as text, as it does for
+// expressions and compound queries, which have no declared column type. NULL
+// leaves the time zero.
+type sqliteTime struct {
+	t *time.Time
+}
+
+// Scan implements sql.Scanner
+func (st sqliteTime) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		*st.t = v
+		return nil
+	case string:
+		t, err := time.Parse(sqliteTimeLayout, v)
+		if err != nil {
+			return err
+		}
+		*st.t = t
+		return nil
+	case []byte:
+		return st.Scan(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into a time", src)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build cgo
+
+package db
+
+import _ "github.com/mattn/go-sqlite3"
+
+// sqliteDriver is the C SQLite library, in builds with cgo enabled
+const sqliteDriver = "sqlite3"
+
+// sqliteDSN opens path with foreign keys on, waiting for locks and with a
+// write-ahead log
+func sqliteDSN(path string) string {
+	return path + "?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL"
+}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// revisionColumns are the columns read by scanRevision
+const revisionColumns = `
+	id, note_id, path, revision, raw_content, content_codec,
+	compressed_content, content_hash, synced_by, synced_at, replaced_at,
+	deleted
+`
+
+// scanRevision scans a single revision row, returning nil if there is none
+func (s *SQLite) scanRevision(row interface{ Scan(...any) error }) (*VaultNoteRevision, error) {
+	r := &VaultNoteRevision{}
+	var raw *string
+	var codec string
+	var compressed []byte
+	err := row.Scan(
+		&r.ID, &r.NoteID, &r.Path, &r.Revision, &raw, &codec, &compressed,
+		&r.ContentHash, &r.SyncedBy, &r.SyncedAt, &r.ReplacedAt, &r.Deleted,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.RawContent, err = s.decodeText(codec, raw, compressed); err != nil {
+		return nil, fmt.Errorf("%s revision %d: %w", r.Path, r.Revision, err)
+	}
+	return r, nil
+}
+
+// GetNoteRevisions returns all stored revisions of a note, newest first
+func (s *SQLite) GetNoteRevisions(ctx context.Context, path string) ([]*VaultNoteRevision, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT`+revisionColumns+`
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = ?1)
+		ORDER BY revision DESC
+	`, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*VaultNoteRevision
+	for rows.Next() {
+		r, err := s.scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
+}
+
+// GetNoteRevision returns a single revision of a note, or nil if it doesn't exist
+func (s *SQLite) GetNoteRevision(ctx context.Context, path string, revision int) (*VaultNoteRevision, error) {
+	return s.scanRevision(s.conn.QueryRowContext(ctx, `
+		SELECT`+revisionColumns+`
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = ?1)
+			AND revision = ?2
+	`, path, revision))
+}
+
+// GetNoteRevisionAt returns the revision of a note that was current at the
+// given time, or nil if no stored revision covers it
+func (s *SQLite) GetNoteRevisionAt(ctx context.Context, path string, at time.Time) (*VaultNoteRevision, error) {
+	return s.scanRevision(s.conn.QueryRowContext(ctx, `
+		SELECT`+revisionColumns+`
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = ?1)
+			AND replaced_at > ?2 AND (synced_at IS NULL OR synced_at <= ?2)
+		ORDER BY revision
+		LIMIT 1
+	`, path, at.UTC()))
+}
+
+// GetNoteRevisionByHash returns the most recent revision of a note with the
+// given content hash, or nil if there is none
+func (s *SQLite) GetNoteRevisionByHash(ctx context.Context, path, hash string) (*VaultNoteRevision, error) {
+	return s.scanRevision(s.conn.QueryRowContext(ctx, `
+		SELECT`+revisionColumns+`
+		FROM vault_note_revisions
+		WHERE note_id = (SELECT id FROM vault_notes WHERE path = ?1)
+			AND content_hash = ?2
+		ORDER BY revision DESC
+		LIMIT 1
+	`, path, hash))
+}
+
+// PruneNoteRevisions deletes revisions beyond the newest keep per note and
+// revisions replaced longer than maxAge ago. A zero limit is not applied.
+func (s *SQLite) PruneNoteRevisions(ctx context.Context, keep int, maxAge time.Duration) (int64, error) {
+	if keep <= 0 && maxAge <= 0 {
+		return 0, nil
+	}
+
+	var cutoff *time.Time
+	if maxAge > 0 {
+		t := sqliteNow().Add(-maxAge)
+		cutoff = &t
+	}
+
+	res, err := s.conn.ExecContext(ctx, `
+		DELETE FROM vault_note_revisions
+		WHERE id IN (
+			SELECT id FROM (
+				SELECT id, replaced_at,
+					row_number() OVER (PARTITION BY note_id ORDER BY revision DESC) AS n
+				FROM vault_note_revisions
+			) r
+			WHERE (?1 > 0 AND r.n > ?1) OR r.replaced_at < ?2
+		)
+	`, keep, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetTrash returns all deleted notes and attachments, most recently deleted first
+func (s *SQLite) GetTrash(ctx context.Context) ([]*TrashedFile, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT path, TRUE, content_hash, file_size_bytes, deleted_at, deleted_by
+		FROM vault_notes WHERE deleted_at IS NOT NULL
+		UNION ALL
+		SELECT path, FALSE, content_hash, file_size_bytes, deleted_at, deleted_by
+		FROM vault_attachments WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, path
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*TrashedFile
+	for rows.Next() {
+		f := &TrashedFile{}
+		if err := rows.Scan(
+			&f.Path, &f.IsNote, &f.ContentHash, &f.FileSizeBytes, sqliteTime{&f.DeletedAt}, &f.DeletedBy,
+		); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// RestoreFromTrash makes deleted files live again. The restoring device is
+// recorded as their last writer.
+func (s *SQLite) RestoreFromTrash(ctx context.Context, paths []string, restoredBy string) (int64, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	var restored int64
+	for _, table := range []string{"vault_notes", "vault_attachments"} {
+		res, err := s.conn.ExecContext(ctx, `
+			UPDATE `+table+` SET
+				deleted_at = NULL,
+				deleted_by = NULL,
+				synced_by = ?2,
+				synced_at = ?3
+			WHERE path IN (SELECT value FROM json_each(?1)) AND deleted_at IS NOT NULL
+		`, stringList(paths), restoredBy, sqliteNow())
+		if err != nil {
+			return restored, fmt.Errorf("failed to restore files: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		restored += n
+	}
+
+	return restored, nil
+}
+
+// PurgeTrash permanently deletes files from the trash, along with the
+// revision history of purged notes and content no attachment uses any more
+func (s *SQLite) PurgeTrash(ctx context.Context, paths []string) (int64, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM vault_notes
+		WHERE path IN (SELECT value FROM json_each(?1)) AND deleted_at IS NOT NULL
+		RETURNING id
+	`, stringList(paths))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge notes: %w", err)
+	}
+
+	var notes []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		notes = append(notes, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to purge notes: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM vault_note_revisions WHERE note_id IN (SELECT value FROM json_each(?1))",
+		stringList(notes),
+	); err != nil {
+		return 0, fmt.Errorf("failed to purge revisions: %w", err)
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM vault_attachments
+		WHERE path IN (SELECT value FROM json_each(?1)) AND deleted_at IS NOT NULL
+	`, stringList(paths))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge attachments: %w", err)
+	}
+	attachments, _ := res.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, sqlitePruneBlobsSQL); err != nil {
+		return 0, fmt.Errorf("failed to purge blobs: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, sqlitePruneChunksSQL, sqliteNow().Add(-chunkGracePeriod)); err != nil {
+		return 0, fmt.Errorf("failed to purge chunks: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return int64(len(notes)) + attachments, nil
+}
+
+// InsertConflict records a conflict between local and remote edits
+func (s *SQLite) InsertConflict(ctx context.Context, c *VaultConflict) error {
+	_, err := s.conn.ExecContext(ctx, `
+		INSERT INTO vault_conflicts (
+			id, path, conflict_path, device, remote_device, base_hash,
+			local_hash, remote_hash, detected_at
+		) VALUES (
+			?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9
+		)
+	`,
+		uuid.New(), c.Path, c.ConflictPath, c.Device, c.RemoteDevice, c.BaseHash,
+		c.LocalHash, c.RemoteHash, sqliteNow(),
+	)
+	return err
+}
+
+// GetUnresolvedConflicts returns all conflicts whose copy still exists, newest first
+func (s *SQLite) GetUnresolvedConflicts(ctx context.Context) ([]*VaultConflict, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT id, path, conflict_path, device, remote_device, base_hash,
+			local_hash, remote_hash, detected_at, resolved_at
+		FROM vault_conflicts
+		WHERE resolved_at IS NULL
+		ORDER BY detected_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []*VaultConflict
+	for rows.Next() {
+		c := &VaultConflict{}
+		if err := rows.Scan(
+			&c.ID, &c.Path, &c.ConflictPath, &c.Device, &c.RemoteDevice,
+			&c.BaseHash, &c.LocalHash, &c.RemoteHash, &c.DetectedAt, &c.ResolvedAt,
+		); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, c)
+	}
+
+	return conflicts, rows.Err()
+}
+
+// ResolveConflicts marks conflicts as resolved once their conflict copies are deleted
+func (s *SQLite) ResolveConflicts(ctx context.Context, conflictPaths []string) error {
+	_, err := s.conn.ExecContext(ctx, `
+		UPDATE vault_conflicts SET resolved_at = ?2
+		WHERE conflict_path IN (SELECT value FROM json_each(?1)) AND resolved_at IS NULL
+	`, stringList(conflictPaths), sqliteNow())
+	return err
+}
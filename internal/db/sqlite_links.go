@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const sqliteInsertLinkSQL = `
+	INSERT INTO vault_links (
+		id, source_note_id, target, link_type, anchor, alias, position, line,
+		target_note_id, target_attachment_id
+	)
+	SELECT ?2, id, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10
+	FROM vault_notes WHERE path = ?1
+`
+
+const sqliteInsertExternalLinkSQL = `
+	INSERT INTO vault_external_links (
+		id, source_note_id, url, host, alias, position, line
+	)
+	SELECT ?2, id, ?3, ?4, ?5, ?6, ?7
+	FROM vault_notes WHERE path = ?1
+`
+
+// sqliteLinkTargetsAtSQL selects the link targets at the paths given as ?1,
+// as linkTargetsAtSQL does
+const sqliteLinkTargetsAtSQL = `
+	SELECT id, path, TRUE, aliases FROM vault_notes
+	WHERE deleted_at IS NULL AND path IN (SELECT value FROM json_each(?1))
+	UNION ALL
+	SELECT id, path, FALSE, NULL FROM vault_attachments
+	WHERE deleted_at IS NULL AND path IN (SELECT value FROM json_each(?1))
+`
+
+// replaceLinks replaces the links of a note with note.Links and
+// note.ExternalLinks
+func (s *SQLite) replaceLinks(ctx context.Context, tx *sql.Tx, note *VaultNote) error {
+	for _, table := range []string{"vault_links", "vault_external_links"} {
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM `+table+`
+			WHERE source_note_id = (SELECT id FROM vault_notes WHERE path = ?1)
+		`, note.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, link := range note.Links {
+		target, anchor, alias := s.sealLink(link)
+		var targetNote, targetAttachment *string
+		if link.TargetNoteID != nil {
+			id := link.TargetNoteID.String()
+			targetNote = &id
+		}
+		if link.TargetAttachmentID != nil {
+			id := link.TargetAttachmentID.String()
+			targetAttachment = &id
+		}
+		if _, err := tx.ExecContext(ctx, sqliteInsertLinkSQL,
+			note.Path, newID(), target, link.LinkType, anchor, alias,
+			link.Position, link.Line, targetNote, targetAttachment,
+		); err != nil {
+			return err
+		}
+	}
+
+	for _, link := range note.ExternalLinks {
+		url, host, alias := s.sealExternalLink(link)
+		if _, err := tx.ExecContext(ctx, sqliteInsertExternalLinkSQL,
+			note.Path, newID(), url, host, alias, link.Position, link.Line,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLinkTargets returns the notes and attachments outside the trash, which
+// links resolve to
+func (s *SQLite) GetLinkTargets(ctx context.Context) ([]*LinkTarget, error) {
+	return s.queryLinkTargets(ctx, linkTargetsSQL)
+}
+
+// GetLinkTargetsAt returns the notes and attachments outside the trash at
+// the given paths
+func (s *SQLite) GetLinkTargetsAt(ctx context.Context, paths []string) ([]*LinkTarget, error) {
+	return s.queryLinkTargets(ctx, sqliteLinkTargetsAtSQL, stringList(paths))
+}
+
+// queryLinkTargets returns the link targets selected by a query
+func (s *SQLite) queryLinkTargets(ctx context.Context, query string, args ...any) ([]*LinkTarget, error) {
+	rows, err := s.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []*LinkTarget
+	for rows.Next() {
+		t := &LinkTarget{}
+		if err := rows.Scan(&t.ID, &t.Path, &t.IsNote, (*stringList)(&t.Aliases)); err != nil {
+			return nil, err
+		}
+		if t.Aliases, err = s.openStrings(t.Aliases); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Path, err)
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, rows.Err()
+}
+
+// GetLinks returns the links of every note outside the trash
+func (s *SQLite) GetLinks(ctx context.Context) ([]*VaultLink, error) {
+	return s.queryLinks(ctx, linksSQL)
+}
+
+// GetUnresolvedLinks returns the links of every note outside the trash that
+// don't resolve to a file
+func (s *SQLite) GetUnresolvedLinks(ctx context.Context) ([]*VaultLink, error) {
+	return s.queryLinks(ctx, unresolvedLinksSQL)
+}
+
+// queryLinks returns the links selected by a query on linkColumns
+func (s *SQLite) queryLinks(ctx context.Context, query string) ([]*VaultLink, error) {
+	rows, err := s.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []*VaultLink
+	for rows.Next() {
+		link, err := s.scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// SetLinkTargets records the note or attachment each link resolves to, or
+// that it is unresolved
+func (s *SQLite) SetLinkTargets(ctx context.Context, links []*VaultLink) error {
+	if len(links) == 0 {
+		return nil
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, link := range links {
+		var targetNote, targetAttachment *string
+		if link.TargetNoteID != nil {
+			id := link.TargetNoteID.String()
+			targetNote = &id
+		}
+		if link.TargetAttachmentID != nil {
+			id := link.TargetAttachmentID.String()
+			targetAttachment = &id
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE vault_links SET target_note_id = ?2, target_attachment_id = ?3
+			WHERE id = ?1
+		`, link.ID.String(), targetNote, targetAttachment); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// resealLinks rewrites the text of every link. The rows are read before any
+// is written, as the store has a single connection.
+func (s *SQLite) resealLinks(ctx context.Context) (int64, error) {
+	links, err := s.queryLinks(ctx, "SELECT"+linkColumns+"FROM vault_links l JOIN vault_notes n ON n.id = l.source_note_id")
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, link := range links {
+		target, anchor, alias := s.sealLink(link)
+		if _, err := s.conn.ExecContext(ctx, `
+			UPDATE vault_links SET target = ?2, anchor = ?3, alias = ?4
+			WHERE id = ?1
+		`, link.ID.String(), target, anchor, alias); err != nil {
+			return n, fmt.Errorf("%s: %w", link.SourcePath, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// resealExternalLinks rewrites the text of every external link
+func (s *SQLite) resealExternalLinks(ctx context.Context) (int64, error) {
+	rows, err := s.conn.QueryContext(ctx, "SELECT id, url, host, alias FROM vault_external_links")
+	if err != nil {
+		return 0, err
+	}
+
+	var links []*VaultExternalLink
+	for rows.Next() {
+		link := &VaultExternalLink{}
+		if err := rows.Scan(&link.ID, &link.URL, &link.Host, &link.Alias); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		links = append(links, link)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, link := range links {
+		if err := s.openExternalLink(link); err != nil {
+			return n, err
+		}
+		url, host, alias := s.sealExternalLink(link)
+		if _, err := s.conn.ExecContext(ctx, `
+			UPDATE vault_external_links SET url = ?2, host = ?3, alias = ?4
+			WHERE id = ?1
+		`, link.ID.String(), url, host, alias); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
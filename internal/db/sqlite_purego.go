@@ -0,0 +1,16 @@
+//go:build !cgo
+
+package db
+
+import _ "modernc.org/sqlite"
+
+// sqliteDriver is SQLite translated to Go, in builds without cgo such as
+// cross-compiled releases
+const sqliteDriver = "sqlite"
+
+// sqliteDSN opens path with foreign keys on, waiting for locks and with a
+// write-ahead log. Times are written in sqliteTimeLayout, like the cgo driver.
+func sqliteDSN(path string) string {
+	return "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)" +
+		"&_pragma=journal_mode(WAL)&_time_format=sqlite"
+}
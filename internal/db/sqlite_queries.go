@@ -0,0 +1,756 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The SQLite queries mirror those of DB, with numbered parameters so they
+// can be repeated, json_each in place of ANY, and times passed in from Go.
+
+const sqliteUpsertNoteSQL = `
+	INSERT INTO vault_notes (
+		path, filename, title, tags, aliases, created_at, modified_at,
+		publish, frontmatter, body, raw_content, content_hash,
+		file_size_bytes, outgoing_links, synced_by, content_codec,
+		compressed_content, file_mode, file_modified_at, id, synced_at
+	) VALUES (
+		?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16,
+		?17, ?18, ?19, ?20, ?21
+	)
+	ON CONFLICT (path) DO UPDATE SET
+		filename = excluded.filename,
+		title = excluded.title,
+		tags = excluded.tags,
+		aliases = excluded.aliases,
+		created_at = excluded.created_at,
+		modified_at = excluded.modified_at,
+		publish = excluded.publish,
+		frontmatter = excluded.frontmatter,
+		body = excluded.body,
+		raw_content = excluded.raw_content,
+		content_codec = excluded.content_codec,
+		compressed_content = excluded.compressed_content,
+		content_hash = excluded.content_hash,
+		file_size_bytes = excluded.file_size_bytes,
+		outgoing_links = excluded.outgoing_links,
+		file_mode = COALESCE(excluded.file_mode, vault_notes.file_mode),
+		file_modified_at = excluded.file_modified_at,
+		synced_by = excluded.synced_by,
+		synced_at = excluded.synced_at,
+		deleted_at = NULL,
+		deleted_by = NULL
+`
+
+const sqliteUpsertAttachmentSQL = `
+	INSERT INTO vault_attachments (
+		path, filename, extension, mime_type, file_size_bytes,
+		content_hash, synced_by, modified_at, file_mode, id, synced_at
+	) VALUES (
+		?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11
+	)
+	ON CONFLICT (path) DO UPDATE SET
+		filename = excluded.filename,
+		extension = excluded.extension,
+		mime_type = excluded.mime_type,
+		file_size_bytes = excluded.file_size_bytes,
+		content_hash = excluded.content_hash,
+		modified_at = excluded.modified_at,
+		file_mode = COALESCE(excluded.file_mode, vault_attachments.file_mode),
+		synced_by = excluded.synced_by,
+		synced_at = excluded.synced_at,
+		deleted_at = NULL,
+		deleted_by = NULL
+`
+
+const sqliteInsertBlobSQL = `
+	INSERT INTO vault_blobs (content_hash, data, codec, size_bytes, storage_key, created_at)
+	VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+	ON CONFLICT (content_hash) DO NOTHING
+`
+
+// sqlitePruneBlobsSQL deletes unused blobs stored in the database, as
+// pruneBlobsSQL does
+const sqlitePruneBlobsSQL = `
+	DELETE FROM vault_blobs AS b WHERE storage_key IS NULL AND` + unusedBlobsSQL
+
+// sqlitePruneChunksSQL deletes chunks no blob uses that were stored before
+// the time given as ?1, as pruneChunksSQL does
+const sqlitePruneChunksSQL = `
+	DELETE FROM vault_chunks AS c
+	WHERE c.created_at < ?1
+		AND NOT EXISTS (
+			SELECT 1 FROM vault_blob_chunks bc WHERE bc.chunk_hash = c.chunk_hash
+		)
+`
+
+// chunkGracePeriod is how long unused chunks are kept, as they may belong
+// to an upload that hasn't stored its blob yet
+const chunkGracePeriod = time.Hour
+
+// sqliteNoteArgs converts the parameters returned by noteArgs to the types
+// SQLite stores: lists become JSON arrays and the frontmatter becomes text
+func sqliteNoteArgs(args []any) []any {
+	for i, arg := range args {
+		if list, ok := arg.([]string); ok {
+			args[i] = stringList(list)
+		}
+	}
+	args[8] = string(args[8].([]byte))
+	return args
+}
+
+// scanNote scans a single note row selected with noteColumns, returning nil
+// if there is none
+func (s *SQLite) scanNote(row interface{ Scan(...any) error }) (*VaultNote, error) {
+	note := &VaultNote{}
+	var frontmatterJSON []byte
+	var raw *string
+	var codec string
+	var compressed []byte
+
+	err := row.Scan(
+		&note.ID, &note.Path, &note.Filename, &note.Title, (*stringList)(&note.Tags),
+		(*stringList)(&note.Aliases), &note.CreatedAt, &note.ModifiedAt, &note.Publish,
+		&frontmatterJSON, &note.Body, &raw, &codec, &compressed,
+		&note.ContentHash, &note.FileSizeBytes, &note.SyncedAt, &note.SyncedBy,
+		(*stringList)(&note.OutgoingLinks), &note.FileMode, &note.FileModTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loadNote(note, codec, raw, compressed, frontmatterJSON); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// queryNotes returns the notes selected by a query on noteColumns
+func (s *SQLite) queryNotes(ctx context.Context, query string, args ...any) ([]*VaultNote, error) {
+	rows, err := s.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []*VaultNote
+	for rows.Next() {
+		note, err := s.scanNote(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+
+	return notes, rows.Err()
+}
+
+// UpsertNote inserts or updates a note, replacing its links
+func (s *SQLite) UpsertNote(ctx context.Context, note *VaultNote) error {
+	return s.UpsertNotes(ctx, []*VaultNote{note})
+}
+
+// UpsertNotes inserts or updates several notes and their links in a single
+// transaction
+func (s *SQLite) UpsertNotes(ctx context.Context, notes []*VaultNote) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := sqliteNow()
+	for _, note := range notes {
+		args, err := s.noteArgs(note)
+		if err != nil {
+			return fmt.Errorf("%s: %w", note.Path, err)
+		}
+		args = append(sqliteNoteArgs(args), newID(), now)
+		if _, err := tx.ExecContext(ctx, sqliteUpsertNoteSQL, args...); err != nil {
+			return fmt.Errorf("%s: %w", note.Path, err)
+		}
+		if err := s.replaceLinks(ctx, tx, note); err != nil {
+			return fmt.Errorf("%s: %w", note.Path, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpsertAttachment inserts or updates an attachment
+func (s *SQLite) UpsertAttachment(ctx context.Context, att *VaultAttachment) error {
+	return s.UpsertAttachments(ctx, []*VaultAttachment{att})
+}
+
+// UpsertAttachments inserts or updates several attachments in a single
+// transaction. Content already stored under the same hash is not stored again.
+func (s *SQLite) UpsertAttachments(ctx context.Context, atts []*VaultAttachment) error {
+	if len(atts) == 0 {
+		return nil
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hashes := make([]string, len(atts))
+	for i, att := range atts {
+		hashes[i] = att.ContentHash
+	}
+	missing, err := missingSQLiteBlobs(ctx, tx, hashes)
+	if err != nil {
+		return fmt.Errorf("failed to check stored blobs: %w", err)
+	}
+
+	now := sqliteNow()
+	for _, att := range atts {
+		if !missing[att.ContentHash] {
+			continue
+		}
+		switch {
+		case att.StorageKey != nil:
+			_, err = tx.ExecContext(ctx, sqliteInsertBlobSQL, att.ContentHash, nil, s.externalCodec(), att.FileSizeBytes, att.StorageKey, now)
+		case att.Data != nil:
+			data, codec := s.encodeData(att.Data, att.MimeType)
+			_, err = tx.ExecContext(ctx, sqliteInsertBlobSQL, att.ContentHash, data, codec, int64(len(att.Data)), nil, now)
+		default:
+			return fmt.Errorf("%s: content %s is not stored and no data was given", att.Path, att.ContentHash)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", att.Path, err)
+		}
+		delete(missing, att.ContentHash)
+	}
+	for _, att := range atts {
+		args := append(attachmentArgs(att), newID(), now)
+		if _, err := tx.ExecContext(ctx, sqliteUpsertAttachmentSQL, args...); err != nil {
+			return fmt.Errorf("%s: %w", att.Path, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// missingSQLiteBlobs returns the set of hashes that have no stored blob
+func missingSQLiteBlobs(ctx context.Context, tx *sql.Tx, hashes []string) (map[string]bool, error) {
+	missing := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		missing[hash] = true
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT content_hash FROM vault_blobs WHERE content_hash IN (SELECT value FROM json_each(?1))",
+		stringList(hashes),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		delete(missing, hash)
+	}
+
+	return missing, rows.Err()
+}
+
+// HasBlob reports whether content with the given hash is stored, in the
+// database or the external store
+func (s *SQLite) HasBlob(ctx context.Context, hash string) (bool, error) {
+	var n int
+	err := s.conn.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM vault_blobs WHERE content_hash = ?1", hash,
+	).Scan(&n)
+	return n > 0, err
+}
+
+// DeleteNote moves a note to the trash, recording the device that deleted it
+func (s *SQLite) DeleteNote(ctx context.Context, path, deletedBy string) error {
+	return s.BatchDeleteNotes(ctx, []string{path}, deletedBy)
+}
+
+// DeleteAttachment moves an attachment to the trash, recording the device that deleted it
+func (s *SQLite) DeleteAttachment(ctx context.Context, path, deletedBy string) error {
+	return s.BatchDeleteAttachments(ctx, []string{path}, deletedBy)
+}
+
+// BatchDeleteNotes moves multiple notes to the trash by path
+func (s *SQLite) BatchDeleteNotes(ctx context.Context, paths []string, deletedBy string) error {
+	return s.trash(ctx, "vault_notes", paths, deletedBy)
+}
+
+// BatchDeleteAttachments moves multiple attachments to the trash by path
+func (s *SQLite) BatchDeleteAttachments(ctx context.Context, paths []string, deletedBy string) error {
+	return s.trash(ctx, "vault_attachments", paths, deletedBy)
+}
+
+// trash moves the live rows of a table at the given paths to the trash
+func (s *SQLite) trash(ctx context.Context, table string, paths []string, deletedBy string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	_, err := s.conn.ExecContext(ctx, `
+		UPDATE `+table+` SET deleted_at = ?3, deleted_by = ?2
+		WHERE path IN (SELECT value FROM json_each(?1)) AND deleted_at IS NULL
+	`, stringList(paths), deletedBy, sqliteNow())
+	return err
+}
+
+// MoveNote changes the path of a note, keeping its id and history. A note in
+// the trash at the new path is purged to make room. It returns false if there
+// is no note at the old path.
+func (s *SQLite) MoveNote(ctx context.Context, oldPath, newPath, filename, movedBy string) (bool, error) {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM vault_note_revisions WHERE note_id IN (
+			SELECT id FROM vault_notes WHERE path = ?1 AND deleted_at IS NOT NULL
+		)
+	`, newPath); err != nil {
+		return false, err
+	}
+
+	moved, err := moveSQLiteRow(ctx, tx, "vault_notes", oldPath, newPath, filename, movedBy)
+	if err != nil {
+		return false, err
+	}
+
+	return moved, tx.Commit()
+}
+
+// MoveAttachment changes the path of an attachment, keeping its id. An
+// attachment in the trash at the new path is purged to make room. It returns
+// false if there is no attachment at the old path.
+func (s *SQLite) MoveAttachment(ctx context.Context, oldPath, newPath, filename, movedBy string) (bool, error) {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	moved, err := moveSQLiteRow(ctx, tx, "vault_attachments", oldPath, newPath, filename, movedBy)
+	if err != nil {
+		return false, err
+	}
+
+	return moved, tx.Commit()
+}
+
+// moveSQLiteRow purges a trashed row at newPath and moves the live row at
+// oldPath there
+func moveSQLiteRow(ctx context.Context, tx *sql.Tx, table, oldPath, newPath, filename, movedBy string) (bool, error) {
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM "+table+" WHERE path = ?1 AND deleted_at IS NOT NULL",
+		newPath,
+	); err != nil {
+		return false, err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE `+table+` SET
+			path = ?2,
+			filename = ?3,
+			synced_by = ?4,
+			synced_at = ?5
+		WHERE path = ?1 AND deleted_at IS NULL
+	`, oldPath, newPath, filename, movedBy, sqliteNow())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetNoteByPath retrieves a note by its path
+func (s *SQLite) GetNoteByPath(ctx context.Context, path string) (*VaultNote, error) {
+	return s.scanNote(s.conn.QueryRowContext(ctx,
+		"SELECT"+noteColumns+"FROM vault_notes WHERE path = ?1 AND deleted_at IS NULL",
+		path,
+	))
+}
+
+// GetAttachmentByPath retrieves an attachment by its path. Its content is
+// not loaded; use ReadBlob with its hash, or the blob store with its storage
+// key.
+func (s *SQLite) GetAttachmentByPath(ctx context.Context, path string) (*VaultAttachment, error) {
+	att := &VaultAttachment{}
+
+	err := s.conn.QueryRowContext(ctx, `
+		SELECT a.id, a.path, a.filename, a.extension, a.mime_type, a.file_size_bytes,
+			a.content_hash, b.storage_key, COALESCE(b.codec, 'none'), a.synced_at, a.synced_by,
+			a.modified_at, a.file_mode
+		FROM vault_attachments a
+		LEFT JOIN vault_blobs b ON b.content_hash = a.content_hash
+		WHERE a.path = ?1 AND a.deleted_at IS NULL
+	`, path).Scan(
+		&att.ID, &att.Path, &att.Filename, &att.Extension, &att.MimeType,
+		&att.FileSizeBytes, &att.ContentHash, &att.StorageKey, &att.StorageCodec,
+		&att.SyncedAt, &att.SyncedBy, &att.ModifiedAt, &att.FileMode,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return att, nil
+}
+
+// GetNoteHash returns the content hash of a note, or "" if it doesn't exist
+func (s *SQLite) GetNoteHash(ctx context.Context, path string) (string, error) {
+	return s.hash(ctx, "vault_notes", path)
+}
+
+// GetAttachmentHash returns the content hash of an attachment, or "" if it doesn't exist
+func (s *SQLite) GetAttachmentHash(ctx context.Context, path string) (string, error) {
+	return s.hash(ctx, "vault_attachments", path)
+}
+
+// hash returns the content hash of the live row of a table at path, or ""
+func (s *SQLite) hash(ctx context.Context, table, path string) (string, error) {
+	var hash string
+	err := s.conn.QueryRowContext(ctx,
+		"SELECT content_hash FROM "+table+" WHERE path = ?1 AND deleted_at IS NULL", path,
+	).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// GetAllNoteHashes returns a map of path -> content_hash for all notes
+func (s *SQLite) GetAllNoteHashes(ctx context.Context) (map[string]string, error) {
+	return s.pathHashes(ctx, "SELECT path, content_hash FROM vault_notes WHERE deleted_at IS NULL")
+}
+
+// GetAllAttachmentHashes returns a map of path -> content_hash for all attachments
+func (s *SQLite) GetAllAttachmentHashes(ctx context.Context) (map[string]string, error) {
+	return s.pathHashes(ctx, "SELECT path, content_hash FROM vault_attachments WHERE deleted_at IS NULL")
+}
+
+// pathHashes returns the path and content hash pairs selected by a query
+func (s *SQLite) pathHashes(ctx context.Context, query string) (map[string]string, error) {
+	rows, err := s.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			return nil, err
+		}
+		hashes[path] = hash
+	}
+
+	return hashes, rows.Err()
+}
+
+// GetAllFileSizes returns a map of path -> file_size_bytes for all notes and attachments
+func (s *SQLite) GetAllFileSizes(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT path, COALESCE(file_size_bytes, 0) FROM vault_notes WHERE deleted_at IS NULL
+		UNION ALL
+		SELECT path, COALESCE(file_size_bytes, 0) FROM vault_attachments WHERE deleted_at IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var path string
+		var size int64
+		if err := rows.Scan(&path, &size); err != nil {
+			return nil, err
+		}
+		sizes[path] = size
+	}
+
+	return sizes, rows.Err()
+}
+
+// GetChangedSince returns the paths of files that were last synced at or
+// after a given time
+func (s *SQLite) GetChangedSince(ctx context.Context, since time.Time) (map[string]bool, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT path FROM vault_notes WHERE deleted_at IS NULL AND synced_at >= ?1
+		UNION ALL
+		SELECT path FROM vault_attachments WHERE deleted_at IS NULL AND synced_at >= ?1
+	`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths[path] = true
+	}
+
+	return paths, rows.Err()
+}
+
+// PutChunks stores chunks of attachment content. Chunks that are already
+// stored are skipped. The MIME type of the attachment decides whether the
+// chunks are compressed.
+func (s *SQLite) PutChunks(ctx context.Context, chunks []Chunk, mimeType *string) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hashes[i] = chunk.Hash
+	}
+	rows, err := tx.QueryContext(ctx,
+		"SELECT chunk_hash FROM vault_chunks WHERE chunk_hash IN (SELECT value FROM json_each(?1))",
+		stringList(hashes),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to check stored chunks: %w", err)
+	}
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[hash] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check stored chunks: %w", err)
+	}
+
+	now := sqliteNow()
+	for _, chunk := range chunks {
+		if stored[chunk.Hash] {
+			continue
+		}
+		data, codec := s.encodeData(chunk.Data, mimeType)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO vault_chunks (chunk_hash, data, codec, size_bytes, created_at)
+			VALUES (?1, ?2, ?3, ?4, ?5)
+			ON CONFLICT (chunk_hash) DO NOTHING
+		`, chunk.Hash, data, codec, len(chunk.Data), now); err != nil {
+			return err
+		}
+		stored[chunk.Hash] = true
+	}
+
+	return tx.Commit()
+}
+
+// PutChunkedBlob records the content with the given hash as the given
+// chunks, in order. The chunks must have been stored with PutChunks.
+func (s *SQLite) PutChunkedBlob(ctx context.Context, hash string, size int64, chunks []string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO vault_blobs (content_hash, size_bytes, chunk_count, created_at)
+		VALUES (?1, ?2, ?3, ?4)
+		ON CONFLICT (content_hash) DO NOTHING
+	`, hash, size, len(chunks), sqliteNow())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil // Stored by an earlier upload
+	}
+
+	for i, chunk := range chunks {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO vault_blob_chunks (content_hash, seq, chunk_hash) VALUES (?1, ?2, ?3)",
+			hash, i, chunk,
+		); err != nil {
+			return fmt.Errorf("failed to store chunk list: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReadBlob writes the content stored in the database under a hash to w, one
+// chunk at a time
+func (s *SQLite) ReadBlob(ctx context.Context, hash string, w io.Writer) error {
+	var data []byte
+	var codec string
+	var storageKey *string
+	var chunkCount *int
+	err := s.conn.QueryRowContext(ctx,
+		"SELECT data, codec, storage_key, chunk_count FROM vault_blobs WHERE content_hash = ?1", hash,
+	).Scan(&data, &codec, &storageKey, &chunkCount)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("content %s is missing from the database", hash)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case chunkCount != nil:
+	case data != nil:
+		data, err := s.decodeBytes(codec, data)
+		if err != nil {
+			return fmt.Errorf("content %s: %w", hash, err)
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		return fmt.Errorf("content %s is in the external blob store", hash)
+	}
+
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT c.data, c.codec
+		FROM vault_blob_chunks bc
+		JOIN vault_chunks c ON c.chunk_hash = bc.chunk_hash
+		WHERE bc.content_hash = ?1
+		ORDER BY bc.seq
+	`, hash)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	var chunk []byte
+	for rows.Next() {
+		if err := rows.Scan(&chunk, &codec); err != nil {
+			return err
+		}
+		chunk, err := s.decodeBytes(codec, chunk)
+		if err != nil {
+			return fmt.Errorf("content %s: %w", hash, err)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n != *chunkCount {
+		return fmt.Errorf("content %s is incomplete: found %d of %d chunks", hash, n, *chunkCount)
+	}
+	return nil
+}
+
+// PruneBlobs deletes blobs stored in the database that no attachment refers
+// to any more, and the chunks no blob uses
+func (s *SQLite) PruneBlobs(ctx context.Context) (int64, error) {
+	res, err := s.conn.ExecContext(ctx, sqlitePruneBlobsSQL)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if _, err := s.conn.ExecContext(ctx, sqlitePruneChunksSQL, sqliteNow().Add(-chunkGracePeriod)); err != nil {
+		return n, fmt.Errorf("failed to prune chunks: %w", err)
+	}
+	return n, nil
+}
+
+// GetExternalBlobs returns all content kept in the external blob store
+func (s *SQLite) GetExternalBlobs(ctx context.Context) ([]ExternalBlob, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT content_hash, storage_key, codec, size_bytes
+		FROM vault_blobs WHERE storage_key IS NOT NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []ExternalBlob
+	for rows.Next() {
+		var b ExternalBlob
+		if err := rows.Scan(&b.Hash, &b.StorageKey, &b.Codec, &b.Size); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+
+	return blobs, rows.Err()
+}
+
+// MoveExternalBlob records that content in the external blob store was
+// stored again under a new key, with the codec this device writes
+func (s *SQLite) MoveExternalBlob(ctx context.Context, hash, storageKey string) error {
+	_, err := s.conn.ExecContext(ctx,
+		"UPDATE vault_blobs SET storage_key = ?2, codec = ?3 WHERE content_hash = ?1",
+		hash, storageKey, s.externalCodec(),
+	)
+	return err
+}
+
+// PruneExternalBlobs deletes the rows of unused blobs in the external store
+// and returns their storage keys, so the caller can delete the content
+func (s *SQLite) PruneExternalBlobs(ctx context.Context) ([]string, error) {
+	rows, err := s.conn.QueryContext(ctx, `
+		DELETE FROM vault_blobs AS b WHERE storage_key IS NOT NULL AND`+unusedBlobsSQL+`
+		RETURNING storage_key
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
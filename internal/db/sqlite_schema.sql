@@ -0,0 +1,186 @@
+-- Schema of a local SQLite store. It mirrors the Postgres tables after all
+-- migrations: ids are UUID strings, lists are JSON arrays and times are
+-- UTC timestamps.
+
+CREATE TABLE IF NOT EXISTS vault_notes (
+    id TEXT PRIMARY KEY,
+    path TEXT UNIQUE NOT NULL CHECK (path GLOB '[^/]*.md'),
+    filename TEXT NOT NULL,
+    title TEXT,
+    tags TEXT,
+    aliases TEXT,
+    created_at TIMESTAMP,
+    modified_at TIMESTAMP,
+    publish BOOLEAN DEFAULT FALSE,
+    frontmatter TEXT DEFAULT '{}',
+    body TEXT,
+    raw_content TEXT,
+    content_codec TEXT NOT NULL DEFAULT 'none',
+    compressed_content BLOB,
+    content_hash TEXT NOT NULL,
+    file_size_bytes INTEGER,
+    outgoing_links TEXT,
+    file_mode INTEGER,
+    file_modified_at TIMESTAMP,
+    synced_at TIMESTAMP,
+    synced_by TEXT,
+    deleted_at TIMESTAMP,
+    deleted_by TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_notes_hash ON vault_notes (content_hash);
+
+CREATE TABLE IF NOT EXISTS vault_blobs (
+    content_hash TEXT PRIMARY KEY,
+    data BLOB,
+    codec TEXT NOT NULL DEFAULT 'none',
+    size_bytes INTEGER NOT NULL,
+    storage_key TEXT,
+    chunk_count INTEGER,
+    created_at TIMESTAMP,
+    CHECK (data IS NOT NULL OR storage_key IS NOT NULL OR chunk_count IS NOT NULL)
+);
+
+CREATE TABLE IF NOT EXISTS vault_chunks (
+    chunk_hash TEXT PRIMARY KEY,
+    data BLOB NOT NULL,
+    codec TEXT NOT NULL DEFAULT 'none',
+    size_bytes INTEGER NOT NULL,
+    created_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS vault_blob_chunks (
+    content_hash TEXT NOT NULL REFERENCES vault_blobs (content_hash) ON DELETE CASCADE,
+    seq INTEGER NOT NULL,
+    chunk_hash TEXT NOT NULL REFERENCES vault_chunks (chunk_hash),
+    PRIMARY KEY (content_hash, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_blob_chunks_chunk ON vault_blob_chunks (chunk_hash);
+
+CREATE TABLE IF NOT EXISTS vault_attachments (
+    id TEXT PRIMARY KEY,
+    path TEXT UNIQUE NOT NULL,
+    filename TEXT NOT NULL,
+    extension TEXT,
+    mime_type TEXT,
+    file_size_bytes INTEGER,
+    content_hash TEXT NOT NULL REFERENCES vault_blobs (content_hash),
+    modified_at TIMESTAMP,
+    file_mode INTEGER,
+    synced_at TIMESTAMP,
+    synced_by TEXT,
+    deleted_at TIMESTAMP,
+    deleted_by TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_hash ON vault_attachments (content_hash);
+
+CREATE TABLE IF NOT EXISTS vault_links (
+    id TEXT PRIMARY KEY,
+    source_note_id TEXT NOT NULL REFERENCES vault_notes (id) ON DELETE CASCADE,
+    target TEXT NOT NULL,
+    link_type TEXT NOT NULL DEFAULT 'wikilink',
+    anchor TEXT,
+    alias TEXT,
+    position INTEGER,
+    line INTEGER,
+    target_note_id TEXT REFERENCES vault_notes (id) ON DELETE SET NULL,
+    target_attachment_id TEXT REFERENCES vault_attachments (id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_links_source ON vault_links (source_note_id);
+CREATE INDEX IF NOT EXISTS idx_links_target_note ON vault_links (target_note_id);
+CREATE INDEX IF NOT EXISTS idx_links_target_attachment ON vault_links (target_attachment_id);
+
+CREATE TABLE IF NOT EXISTS vault_external_links (
+    id TEXT PRIMARY KEY,
+    source_note_id TEXT NOT NULL REFERENCES vault_notes (id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    host TEXT,
+    alias TEXT,
+    position INTEGER,
+    line INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_external_links_source ON vault_external_links (source_note_id);
+CREATE INDEX IF NOT EXISTS idx_external_links_host ON vault_external_links (host);
+
+CREATE TABLE IF NOT EXISTS vault_conflicts (
+    id TEXT PRIMARY KEY,
+    path TEXT NOT NULL,
+    conflict_path TEXT NOT NULL,
+    device TEXT,
+    remote_device TEXT,
+    base_hash TEXT,
+    local_hash TEXT NOT NULL,
+    remote_hash TEXT NOT NULL,
+    detected_at TIMESTAMP,
+    resolved_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_conflicts_conflict_path ON vault_conflicts (conflict_path);
+
+CREATE TABLE IF NOT EXISTS vault_note_revisions (
+    id TEXT PRIMARY KEY,
+    note_id TEXT,
+    path TEXT NOT NULL,
+    revision INTEGER NOT NULL,
+    raw_content TEXT,
+    content_codec TEXT NOT NULL DEFAULT 'none',
+    compressed_content BLOB,
+    content_hash TEXT NOT NULL,
+    synced_by TEXT,
+    synced_at TIMESTAMP,
+    replaced_at TIMESTAMP,
+    deleted BOOLEAN DEFAULT FALSE,
+    UNIQUE (note_id, revision)
+);
+
+CREATE INDEX IF NOT EXISTS idx_note_revisions_hash ON vault_note_revisions (note_id, content_hash);
+
+CREATE TABLE IF NOT EXISTS vault_keys (
+    fingerprint TEXT PRIMARY KEY,
+    created_at TIMESTAMP,
+    created_by TEXT,
+    retired_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_keys_active ON vault_keys (retired_at IS NULL) WHERE retired_at IS NULL;
+
+-- Keep the version of a note that an edit replaces, as archive_note_revision
+-- does in Postgres. Soft deletes keep the content in place, so only edits and
+-- purges of live rows are archived.
+CREATE TRIGGER IF NOT EXISTS vault_notes_archive_update
+AFTER UPDATE OF content_hash ON vault_notes
+WHEN OLD.content_hash <> NEW.content_hash
+BEGIN
+    INSERT INTO vault_note_revisions (
+        id, note_id, path, revision, raw_content, content_codec,
+        compressed_content, content_hash, synced_by, synced_at, replaced_at,
+        deleted
+    )
+    SELECT lower(hex(randomblob(16))), OLD.id, OLD.path,
+        COALESCE(MAX(revision), 0) + 1, OLD.raw_content, OLD.content_codec,
+        OLD.compressed_content, OLD.content_hash, OLD.synced_by, OLD.synced_at,
+        strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'), OLD.deleted_at IS NOT NULL
+    FROM vault_note_revisions
+    WHERE note_id = OLD.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS vault_notes_archive_delete
+AFTER DELETE ON vault_notes
+WHEN OLD.deleted_at IS NULL
+BEGIN
+    INSERT INTO vault_note_revisions (
+        id, note_id, path, revision, raw_content, content_codec,
+        compressed_content, content_hash, synced_by, synced_at, replaced_at,
+        deleted
+    )
+    SELECT lower(hex(randomblob(16))), OLD.id, OLD.path,
+        COALESCE(MAX(revision), 0) + 1, OLD.raw_content, OLD.content_codec,
+        OLD.compressed_content, OLD.content_hash, OLD.synced_by, OLD.synced_at,
+        strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'), TRUE
+    FROM vault_note_revisions
+    WHERE note_id = OLD.id;
+END;
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+)
+
+func openTestSQLite(t *testing.T) *SQLite {
+	t.Helper()
+	s, err := OpenSQLite(context.Background(), &config.DatabaseConfig{
+		Driver:      config.DriverSQLite,
+		Path:        filepath.Join(t.TempDir(), "vault.db"),
+		Compression: CodecZstd,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSQLiteNoteRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := openTestSQLite(t)
+	s.SetCipher(testCipher(t), nil)
+
+	title := "Diary"
+	device := "laptop"
+	note := &VaultNote{
+		Path:          "Journal/Diary.md",
+		Filename:      "Diary.md",
+		Title:         &title,
+		Tags:          []string{"private", "daily"},
+		Frontmatter:   map[string]interface{}{"mood": "good"},
+		Body:          "Dear diary",
+		RawContent:    "---\nmood: good\n---\nDear diary",
+		ContentHash:   "h1",
+		SyncedBy:      &device,
+		OutgoingLinks: []string{"Other note"},
+		Links:         []*VaultLink{{Target: "Other note", LinkType: LinkTypeWiki, Alias: &device}},
+		ExternalLinks: []*VaultExternalLink{{URL: "https://example.com/diary"}},
+	}
+	if err := s.UpsertNote(ctx, note); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetNoteByPath(ctx, note.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got.Title != title || got.Body != note.Body || got.RawContent != note.RawContent ||
+		!reflect.DeepEqual(got.Tags, note.Tags) ||
+		!reflect.DeepEqual(got.OutgoingLinks, note.OutgoingLinks) ||
+		!reflect.DeepEqual(got.Frontmatter, note.Frontmatter) {
+		t.Errorf("stored note = %+v, want %+v", got, note)
+	}
+
+	links, err := s.GetLinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Target != "Other note" || *links[0].Alias != device ||
+		links[0].SourceNoteID != got.ID || links[0].SourcePath != note.Path {
+		t.Errorf("stored links = %+v, want the note's link", links)
+	}
+
+	var url string
+	if err := s.conn.QueryRowContext(ctx, "SELECT url FROM vault_external_links").Scan(&url); err != nil {
+		t.Fatal(err)
+	}
+	if url == "https://example.com/diary" {
+		t.Error("external link stored in plaintext")
+	}
+	if url, err = s.openString(url); err != nil || url != "https://example.com/diary" {
+		t.Errorf("stored external link = %q, %v", url, err)
+	}
+
+	// Paths are checked the way the Postgres schema checks them
+	for _, path := range []string{"/abs.md", "note.MD", "note.txt"} {
+		if err := s.UpsertNote(ctx, &VaultNote{Path: path, Filename: path, ContentHash: "h"}); err == nil {
+			t.Errorf("UpsertNote(%q) succeeded, want a check violation", path)
+		}
+	}
+}
+
+func TestSQLiteRevisionsAndTrash(t *testing.T) {
+	ctx := context.Background()
+	s := openTestSQLite(t)
+
+	note := &VaultNote{Path: "a.md", Filename: "a.md", RawContent: "one", ContentHash: "h1"}
+	for _, content := range []string{"one", "two", "three"} {
+		note.RawContent, note.ContentHash = content, "h-"+content
+		if err := s.UpsertNote(ctx, note); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteNote(ctx, "a.md", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := s.GetNoteRevisions(ctx, "a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, r := range revisions {
+		contents = append(contents, r.RawContent)
+	}
+	// The trashed note keeps its last version
+	if want := []string{"two", "one"}; !reflect.DeepEqual(contents, want) {
+		t.Fatalf("revisions = %v, want %v", contents, want)
+	}
+
+	if n, err := s.PruneNoteRevisions(ctx, 1, 0); err != nil || n != 1 {
+		t.Errorf("PruneNoteRevisions = %d, %v, want 1 pruned", n, err)
+	}
+
+	if n, err := s.PurgeTrash(ctx, []string{"a.md"}); err != nil || n != 1 {
+		t.Fatalf("PurgeTrash = %d, %v, want 1 purged", n, err)
+	}
+	var left int
+	if err := s.conn.QueryRowContext(ctx, "SELECT count(*) FROM vault_note_revisions").Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d revisions left after purging the note", left)
+	}
+}
+
+func TestSQLiteBlobsSharedAndPruned(t *testing.T) {
+	ctx := context.Background()
+	s := openTestSQLite(t)
+
+	blobs := func() int {
+		t.Helper()
+		var n int
+		if err := s.conn.QueryRowContext(ctx, "SELECT count(*) FROM vault_blobs").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	prune := func(want int) {
+		t.Helper()
+		if _, err := s.PruneBlobs(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := blobs(); n != want {
+			t.Errorf("%d blobs left after pruning, want %d", n, want)
+		}
+	}
+
+	// Attachments with the same content share one blob
+	data := []byte("same picture")
+	for _, path := range []string{"a.png", "copy/a.png"} {
+		att := &VaultAttachment{
+			Path: path, Filename: "a.png", FileSizeBytes: int64(len(data)),
+			ContentHash: "h-picture", Data: data,
+		}
+		if err := s.UpsertAttachment(ctx, att); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := blobs(); n != 1 {
+		t.Fatalf("%d blobs for two attachments with the same content, want 1", n)
+	}
+
+	// The blob outlives every reference but the last, including attachments
+	// in the trash, which can still be restored
+	if err := s.DeleteAttachment(ctx, "a.png", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PurgeTrash(ctx, []string{"a.png"}); err != nil {
+		t.Fatal(err)
+	}
+	prune(1)
+	var buf bytes.Buffer
+	if err := s.ReadBlob(ctx, "h-picture", &buf); err != nil || buf.String() != string(data) {
+		t.Errorf("blob after removing one attachment = %q, %v", buf.String(), err)
+	}
+
+	if err := s.DeleteAttachment(ctx, "copy/a.png", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	prune(1)
+
+	if _, err := s.PurgeTrash(ctx, []string{"copy/a.png"}); err != nil {
+		t.Fatal(err)
+	}
+	prune(0)
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
+)
+
+// Store is the storage the sync engine and commands read and write a vault
+// through. DB keeps the vault in Postgres, shared by every device; SQLite
+// keeps it in a local file.
+type Store interface {
+	// Close releases the store's connections
+	Close()
+	// MaxConns returns how many operations the store serves in parallel
+	MaxConns() int
+	// Reachable reports whether the store answers within a few seconds
+	Reachable(ctx context.Context) bool
+	// Listen delivers changes made by other devices until ctx is cancelled
+	Listen(ctx context.Context) <-chan Change
+	GetStatus(ctx context.Context) (*SyncStatus, error)
+
+	SetCipher(cipher *crypt.Cipher, plaintext []string)
+	Cipher() *crypt.Cipher
+	GetKeyFingerprint(ctx context.Context) (string, error)
+	ClaimKeyFingerprint(ctx context.Context, fingerprint, device string) (string, error)
+	SetKeyFingerprint(ctx context.Context, fingerprint, device string) error
+	Reseal(ctx context.Context) (int64, error)
+
+	UpsertNote(ctx context.Context, note *VaultNote) error
+	UpsertNotes(ctx context.Context, notes []*VaultNote) error
+	DeleteNote(ctx context.Context, path, deletedBy string) error
+	BatchDeleteNotes(ctx context.Context, paths []string, deletedBy string) error
+	MoveNote(ctx context.Context, oldPath, newPath, filename, movedBy string) (bool, error)
+	GetNoteByPath(ctx context.Context, path string) (*VaultNote, error)
+	GetNoteHash(ctx context.Context, path string) (string, error)
+	GetAllNoteHashes(ctx context.Context) (map[string]string, error)
+
+	GetLinkTargets(ctx context.Context) ([]*LinkTarget, error)
+	GetLinkTargetsAt(ctx context.Context, paths []string) ([]*LinkTarget, error)
+	GetLinks(ctx context.Context) ([]*VaultLink, error)
+	GetUnresolvedLinks(ctx context.Context) ([]*VaultLink, error)
+	SetLinkTargets(ctx context.Context, links []*VaultLink) error
+
+	UpsertAttachment(ctx context.Context, att *VaultAttachment) error
+	UpsertAttachments(ctx context.Context, atts []*VaultAttachment) error
+	DeleteAttachment(ctx context.Context, path, deletedBy string) error
+	BatchDeleteAttachments(ctx context.Context, paths []string, deletedBy string) error
+	MoveAttachment(ctx context.Context, oldPath, newPath, filename, movedBy string) (bool, error)
+	GetAttachmentByPath(ctx context.Context, path string) (*VaultAttachment, error)
+	GetAttachmentHash(ctx context.Context, path string) (string, error)
+	GetAllAttachmentHashes(ctx context.Context) (map[string]string, error)
+
+	GetAllFileSizes(ctx context.Context) (map[string]int64, error)
+	GetChangedSince(ctx context.Context, since time.Time) (map[string]bool, error)
+
+	HasBlob(ctx context.Context, hash string) (bool, error)
+	PutChunks(ctx context.Context, chunks []Chunk, mimeType *string) error
+	PutChunkedBlob(ctx context.Context, hash string, size int64, chunks []string) error
+	ReadBlob(ctx context.Context, hash string, w io.Writer) error
+	PruneBlobs(ctx context.Context) (int64, error)
+	GetExternalBlobs(ctx context.Context) ([]ExternalBlob, error)
+	MoveExternalBlob(ctx context.Context, hash, storageKey string) error
+	PruneExternalBlobs(ctx context.Context) ([]string, error)
+
+	GetNoteRevisions(ctx context.Context, path string) ([]*VaultNoteRevision, error)
+	GetNoteRevision(ctx context.Context, path string, revision int) (*VaultNoteRevision, error)
+	GetNoteRevisionAt(ctx context.Context, path string, at time.Time) (*VaultNoteRevision, error)
+	GetNoteRevisionByHash(ctx context.Context, path, hash string) (*VaultNoteRevision, error)
+	PruneNoteRevisions(ctx context.Context, keep int, maxAge time.Duration) (int64, error)
+
+	GetTrash(ctx context.Context) ([]*TrashedFile, error)
+	RestoreFromTrash(ctx context.Context, paths []string, restoredBy string) (int64, error)
+	PurgeTrash(ctx context.Context, paths []string) (int64, error)
+
+	InsertConflict(ctx context.Context, c *VaultConflict) error
+	GetUnresolvedConflicts(ctx context.Context) ([]*VaultConflict, error)
+	ResolveConflicts(ctx context.Context, conflictPaths []string) error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLite)(nil)
+)
+
+// NewStore opens the store of the configured driver and checks that it is
+// reachable
+func NewStore(ctx context.Context, cfg *config.DatabaseConfig) (Store, error) {
+	if cfg.Driver == config.DriverSQLite {
+		return openSQLiteStore(ctx, cfg)
+	}
+	db, err := New(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenStore opens the store of the configured driver. A Postgres store
+// connects as connections are needed, so this succeeds while it is down.
+func OpenStore(ctx context.Context, cfg *config.DatabaseConfig) (Store, error) {
+	if cfg.Driver == config.DriverSQLite {
+		return openSQLiteStore(ctx, cfg)
+	}
+	db, err := Open(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openSQLiteStore opens a SQLite store, returning a nil Store on error
+func openSQLiteStore(ctx context.Context, cfg *config.DatabaseConfig) (Store, error) {
+	s, err := OpenSQLite(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
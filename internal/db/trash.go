@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// GetTrash returns all deleted notes and attachments, most recently deleted first
+func (db *DB) GetTrash(ctx context.Context) ([]*TrashedFile, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT path, TRUE, content_hash, file_size_bytes, deleted_at, deleted_by
+		FROM vault_notes WHERE deleted_at IS NOT NULL
+		UNION ALL
+		SELECT path, FALSE, content_hash, file_size_bytes, deleted_at, deleted_by
+		FROM vault_attachments WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, path
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*TrashedFile
+	for rows.Next() {
+		f := &TrashedFile{}
+		if err := rows.Scan(
+			&f.Path, &f.IsNote, &f.ContentHash, &f.FileSizeBytes, &f.DeletedAt, &f.DeletedBy,
+		); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// RestoreFromTrash makes deleted files live again. The restoring device is
+// recorded as their last writer.
+func (db *DB) RestoreFromTrash(ctx context.Context, paths []string, restoredBy string) (int64, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	notes, err := db.Pool.Exec(ctx, `
+		UPDATE vault_notes SET
+			deleted_at = NULL,
+			deleted_by = NULL,
+			synced_by = $2,
+			synced_at = NOW()
+		WHERE path = ANY($1) AND deleted_at IS NOT NULL
+	`, paths, restoredBy)
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore notes: %w", err)
+	}
+
+	attachments, err := db.Pool.Exec(ctx, `
+		UPDATE vault_attachments SET
+			deleted_at = NULL,
+			deleted_by = NULL,
+			synced_by = $2,
+			synced_at = NOW()
+		WHERE path = ANY($1) AND deleted_at IS NOT NULL
+	`, paths, restoredBy)
+	if err != nil {
+		return notes.RowsAffected(), fmt.Errorf("failed to restore attachments: %w", err)
+	}
+
+	return notes.RowsAffected() + attachments.RowsAffected(), nil
+}
+
+// PurgeTrash permanently deletes files from the trash, along with the
+// revision history of purged notes and content no attachment uses any more
+func (db *DB) PurgeTrash(ctx context.Context, paths []string) (int64, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		DELETE FROM vault_notes
+		WHERE path = ANY($1) AND deleted_at IS NOT NULL
+		RETURNING id
+	`, paths)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge notes: %w", err)
+	}
+
+	var notes []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		notes = append(notes, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to purge notes: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx,
+		"DELETE FROM vault_note_revisions WHERE note_id = ANY($1)",
+		notes,
+	); err != nil {
+		return 0, fmt.Errorf("failed to purge revisions: %w", err)
+	}
+
+	tag, err := tx.Exec(ctx, `
+		DELETE FROM vault_attachments
+		WHERE path = ANY($1) AND deleted_at IS NOT NULL
+	`, paths)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge attachments: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, pruneBlobsSQL); err != nil {
+		return 0, fmt.Errorf("failed to purge blobs: %w", err)
+	}
+	if _, err := tx.Exec(ctx, pruneChunksSQL); err != nil {
+		return 0, fmt.Errorf("failed to purge chunks: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return int64(len(notes)) + tag.RowsAffected(), nil
+}
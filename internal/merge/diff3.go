@@ -0,0 +1,169 @@
+package merge
+
+import (
+	"strings"
+)
+
+// maxLCSCells bounds the size of the LCS table so pathological inputs fall
+// back to a conflict instead of exhausting memory
+const maxLCSCells = 4_000_000
+
+// Lines performs a diff3-style merge of two versions of a text against their
+// common base. Changes to different regions are combined; if both sides
+// changed the same region differently, ok is false and merged is empty.
+func Lines(base, local, remote string) (merged string, ok bool) {
+	b, l, r := splitLines(base), splitLines(local), splitLines(remote)
+
+	ml, ok := matchLines(b, l)
+	if !ok {
+		return "", false
+	}
+	mr, ok := matchLines(b, r)
+	if !ok {
+		return "", false
+	}
+
+	var out strings.Builder
+	i, j, k := 0, 0, 0
+
+	for {
+		// Copy lines unchanged on both sides
+		n := 0
+		for i+n < len(b) && ml[i+n] == j+n && mr[i+n] == k+n {
+			n++
+		}
+		if n > 0 {
+			writeLines(&out, b[i:i+n])
+			i, j, k = i+n, j+n, k+n
+			continue
+		}
+
+		// Find the next base line kept by both sides
+		o := i
+		for o < len(b) && (ml[o] < 0 || mr[o] < 0) {
+			o++
+		}
+
+		var nextJ, nextK int
+		if o == len(b) {
+			nextJ, nextK = len(l), len(r)
+		} else {
+			nextJ, nextK = ml[o], mr[o]
+		}
+
+		chunk, ok := mergeChunk(b[i:o], l[j:nextJ], r[k:nextK])
+		if !ok {
+			return "", false
+		}
+		writeLines(&out, chunk)
+
+		if o == len(b) {
+			break
+		}
+		i, j, k = o, nextJ, nextK
+	}
+
+	return out.String(), true
+}
+
+// mergeChunk resolves a region where at least one side differs from the base
+func mergeChunk(base, local, remote []string) ([]string, bool) {
+	switch {
+	case equalLines(local, base):
+		return remote, true
+	case equalLines(remote, base):
+		return local, true
+	case equalLines(local, remote):
+		return local, true
+	default:
+		return nil, false
+	}
+}
+
+// matchLines returns, for each line of a, the index of the matching line in b
+// according to their longest common subsequence, or -1 if it was removed
+func matchLines(a, b []string) ([]int, bool) {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+
+	// Common prefix and suffix need no LCS table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		match[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		match[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma) == 0 || len(mb) == 0 {
+		return match, true
+	}
+	if (len(ma)+1)*(len(mb)+1) > maxLCSCells {
+		return nil, false
+	}
+
+	// lcs[x][y] is the LCS length of ma[x:] and mb[y:]
+	cols := len(mb) + 1
+	lcs := make([]int, (len(ma)+1)*cols)
+	for x := len(ma) - 1; x >= 0; x-- {
+		for y := len(mb) - 1; y >= 0; y-- {
+			if ma[x] == mb[y] {
+				lcs[x*cols+y] = lcs[(x+1)*cols+y+1] + 1
+			} else {
+				lcs[x*cols+y] = max(lcs[(x+1)*cols+y], lcs[x*cols+y+1])
+			}
+		}
+	}
+
+	for x, y := 0, 0; x < len(ma) && y < len(mb); {
+		switch {
+		case ma[x] == mb[y]:
+			match[prefix+x] = prefix + y
+			x++
+			y++
+		case lcs[(x+1)*cols+y] >= lcs[x*cols+y+1]:
+			x++
+		default:
+			y++
+		}
+	}
+
+	return match, true
+}
+
+// splitLines splits text into lines, keeping line endings
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func writeLines(sb *strings.Builder, lines []string) {
+	for _, line := range lines {
+		sb.WriteString(line)
+	}
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
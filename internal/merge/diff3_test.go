@@ -0,0 +1,133 @@
+package merge
+
+import (
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		local    string
+		remote   string
+		expected string
+		ok       bool
+	}{
+		{
+			name:     "no changes",
+			base:     "a\nb\nc\n",
+			local:    "a\nb\nc\n",
+			remote:   "a\nb\nc\n",
+			expected: "a\nb\nc\n",
+			ok:       true,
+		},
+		{
+			name:     "only local changed",
+			base:     "a\nb\nc\n",
+			local:    "a\nB\nc\n",
+			remote:   "a\nb\nc\n",
+			expected: "a\nB\nc\n",
+			ok:       true,
+		},
+		{
+			name:     "only remote changed",
+			base:     "a\nb\nc\n",
+			local:    "a\nb\nc\n",
+			remote:   "a\nb\nC\n",
+			expected: "a\nb\nC\n",
+			ok:       true,
+		},
+		{
+			name:     "different regions",
+			base:     "one\ntwo\nthree\nfour\nfive\n",
+			local:    "ONE\ntwo\nthree\nfour\nfive\n",
+			remote:   "one\ntwo\nthree\nfour\nFIVE\n",
+			expected: "ONE\ntwo\nthree\nfour\nFIVE\n",
+			ok:       true,
+		},
+		{
+			name:     "insertions in different places",
+			base:     "a\nb\nc\n",
+			local:    "start\na\nb\nc\n",
+			remote:   "a\nb\nc\nend\n",
+			expected: "start\na\nb\nc\nend\n",
+			ok:       true,
+		},
+		{
+			name:     "deletion and edit elsewhere",
+			base:     "a\nb\nc\nd\n",
+			local:    "a\nc\nd\n",
+			remote:   "a\nb\nc\nD\n",
+			expected: "a\nc\nD\n",
+			ok:       true,
+		},
+		{
+			name:     "same change on both sides",
+			base:     "a\nb\nc\n",
+			local:    "a\nX\nc\n",
+			remote:   "a\nX\nc\n",
+			expected: "a\nX\nc\n",
+			ok:       true,
+		},
+		{
+			name:   "overlapping edits",
+			base:   "a\nb\nc\n",
+			local:  "a\nlocal\nc\n",
+			remote: "a\nremote\nc\n",
+			ok:     false,
+		},
+		{
+			name:   "adjacent edits",
+			base:   "a\nb\n",
+			local:  "A\nb\n",
+			remote: "a\nB\n",
+			ok:     false,
+		},
+		{
+			name:   "different insertions at the same place",
+			base:   "a\nb\n",
+			local:  "a\nlocal\nb\n",
+			remote: "a\nremote\nb\n",
+			ok:     false,
+		},
+		{
+			name:     "missing trailing newline",
+			base:     "a\nb\nc",
+			local:    "A\nb\nc",
+			remote:   "a\nb\nc\nd",
+			expected: "A\nb\nc\nd",
+			ok:       true,
+		},
+		{
+			name:     "empty base",
+			base:     "",
+			local:    "same\n",
+			remote:   "same\n",
+			expected: "same\n",
+			ok:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, ok := Lines(tt.base, tt.local, tt.remote)
+			if ok != tt.ok {
+				t.Fatalf("expected ok=%v, got %v (result %q)", tt.ok, ok, result)
+			}
+			if ok && result != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	lines := splitLines("a\nb\nc")
+	if len(lines) != 3 || lines[0] != "a\n" || lines[2] != "c" {
+		t.Errorf("unexpected split: %q", lines)
+	}
+
+	if lines := splitLines(""); len(lines) != 0 {
+		t.Errorf("expected no lines for empty string, got %q", lines)
+	}
+}
@@ -0,0 +1,249 @@
+package merge
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/vonshlovens/obsync-pg/internal/parser"
+)
+
+// Note merges two versions of a markdown note against their common base.
+// Frontmatter is merged key by key, so edits to different fields (e.g. tags on
+// one device, a custom status field on another) combine cleanly. The body is
+// merged line by line. Versions are compared with LF line endings, and the
+// merged note has the line endings of the local version. ok is false if the
+// versions conflict.
+func Note(base, local, remote string) (merged string, ok bool) {
+	crlf := strings.Contains(local, "\r\n")
+	base, local, remote = toLF(base), toLF(local), toLF(remote)
+
+	baseFM, baseBody, _ := parser.SplitFrontmatter(base)
+	localFM, localBody, localFound := parser.SplitFrontmatter(local)
+	remoteFM, remoteBody, remoteFound := parser.SplitFrontmatter(remote)
+
+	body, ok := Lines(baseBody, localBody, remoteBody)
+	if !ok {
+		return "", false
+	}
+
+	var fm string
+	var found bool
+	switch {
+	case localFM == remoteFM && localFound == remoteFound:
+		fm, found = localFM, localFound
+	case localFM == baseFM:
+		fm, found = remoteFM, remoteFound
+	case remoteFM == baseFM:
+		fm, found = localFM, localFound
+	default:
+		fm, ok = Frontmatter(baseFM, localFM, remoteFM)
+		if !ok {
+			return "", false
+		}
+		found = fm != ""
+	}
+
+	if found {
+		body = "---\n" + fm + "\n---\n" + body
+	}
+	if crlf {
+		body = strings.ReplaceAll(body, "\n", "\r\n")
+	}
+	return body, true
+}
+
+// toLF converts CRLF line endings to LF
+func toLF(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// Frontmatter merges three versions of raw YAML frontmatter key by key. A key
+// changed (or added, or removed) on only one side takes that side's value.
+// A list of plain values, such as tags or aliases, changed on both sides is
+// merged as a set: items added on either side are kept, and items removed on
+// either side dropped. Any other key changed differently on both sides is a
+// conflict. Keys keep the order of the local version, with keys added
+// remotely appended.
+func Frontmatter(base, local, remote string) (merged string, ok bool) {
+	baseKeys, ok := parseMapping(base)
+	if !ok {
+		return "", false
+	}
+	localKeys, ok := parseMapping(local)
+	if !ok {
+		return "", false
+	}
+	remoteKeys, ok := parseMapping(remote)
+	if !ok {
+		return "", false
+	}
+
+	out := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	add := func(pair *keyValue) {
+		if pair != nil {
+			out.Content = append(out.Content, pair.key, pair.value)
+		}
+	}
+
+	for _, key := range localKeys.order {
+		pair, ok := mergeKey(baseKeys.pairs[key], localKeys.pairs[key], remoteKeys.pairs[key])
+		if !ok {
+			return "", false
+		}
+		add(pair)
+	}
+	for _, key := range remoteKeys.order {
+		if _, seen := localKeys.pairs[key]; seen {
+			continue
+		}
+		pair, ok := mergeKey(baseKeys.pairs[key], nil, remoteKeys.pairs[key])
+		if !ok {
+			return "", false
+		}
+		add(pair)
+	}
+
+	if len(out.Content) == 0 {
+		return "", true
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(out); err != nil {
+		return "", false
+	}
+	enc.Close()
+
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), true
+}
+
+// keyValue is a single frontmatter entry with its decoded value for comparison
+type keyValue struct {
+	key   *yaml.Node
+	value *yaml.Node
+	data  interface{}
+}
+
+type mapping struct {
+	order []string
+	pairs map[string]*keyValue
+}
+
+// parseMapping decodes frontmatter into its top-level entries
+func parseMapping(content string) (*mapping, bool) {
+	m := &mapping{pairs: make(map[string]*keyValue)}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return nil, false
+	}
+	if len(doc.Content) == 0 {
+		return m, true // Empty frontmatter
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, false
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		var data interface{}
+		if err := value.Decode(&data); err != nil {
+			return nil, false
+		}
+
+		m.order = append(m.order, key.Value)
+		m.pairs[key.Value] = &keyValue{key: key, value: value, data: data}
+	}
+
+	return m, true
+}
+
+// mergeKey chooses the merged value of a single key; nil means the key is absent
+func mergeKey(base, local, remote *keyValue) (*keyValue, bool) {
+	switch {
+	case sameValue(local, remote):
+		return local, true
+	case sameValue(local, base):
+		return remote, true
+	case sameValue(remote, base):
+		return local, true
+	default:
+		return mergeList(base, local, remote)
+	}
+}
+
+// mergeList merges a list of plain values changed on both sides as a set.
+// Local items come first, in their order, followed by the remote additions.
+func mergeList(base, local, remote *keyValue) (*keyValue, bool) {
+	if local == nil || remote == nil || !isPlainList(local.value) || !isPlainList(remote.value) {
+		return nil, false
+	}
+	var baseItems []*yaml.Node
+	if base != nil {
+		if !isPlainList(base.value) {
+			return nil, false
+		}
+		baseItems = base.value.Content
+	}
+	inBase, inLocal, inRemote := itemSet(baseItems), itemSet(local.value.Content), itemSet(remote.value.Content)
+
+	out := &yaml.Node{Kind: yaml.SequenceNode, Tag: local.value.Tag, Style: local.value.Style}
+	kept := make(map[string]bool)
+	keep := func(item *yaml.Node) {
+		if !kept[item.Value] {
+			kept[item.Value] = true
+			out.Content = append(out.Content, item)
+		}
+	}
+	for _, item := range local.value.Content {
+		if !inBase[item.Value] || inRemote[item.Value] {
+			keep(item)
+		}
+	}
+	for _, item := range remote.value.Content {
+		if !inBase[item.Value] && !inLocal[item.Value] {
+			keep(item)
+		}
+	}
+
+	var data interface{}
+	if err := out.Decode(&data); err != nil {
+		return nil, false
+	}
+	return &keyValue{key: local.key, value: out, data: data}, true
+}
+
+// isPlainList reports whether a value is a list of scalars
+func isPlainList(n *yaml.Node) bool {
+	if n.Kind != yaml.SequenceNode {
+		return false
+	}
+	for _, item := range n.Content {
+		if item.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
+
+func itemSet(items []*yaml.Node) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item.Value] = true
+	}
+	return set
+}
+
+func sameValue(a, b *keyValue) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return reflect.DeepEqual(a.data, b.data)
+}
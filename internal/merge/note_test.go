@@ -0,0 +1,131 @@
+package merge
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFrontmatter_DifferentKeys(t *testing.T) {
+	base := "title: Plan\nstatus: draft\ntags:\n  - work"
+	local := "title: Plan\nstatus: done\ntags:\n  - work"
+	remote := "title: Plan\nstatus: draft\ntags:\n  - work\n  - urgent"
+
+	result, ok := Frontmatter(base, local, remote)
+	if !ok {
+		t.Fatal("expected frontmatter to merge")
+	}
+
+	expected := "title: Plan\nstatus: done\ntags:\n  - work\n  - urgent"
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
+
+func TestFrontmatter_AddedAndRemovedKeys(t *testing.T) {
+	base := "title: Plan\nowner: me"
+	local := "title: Plan\nowner: me\npriority: 1"
+	remote := "title: Plan"
+
+	result, ok := Frontmatter(base, local, remote)
+	if !ok {
+		t.Fatal("expected frontmatter to merge")
+	}
+
+	expected := "title: Plan\npriority: 1"
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
+
+func TestFrontmatter_Conflict(t *testing.T) {
+	base := "status: draft"
+	local := "status: done"
+	remote := "status: blocked"
+
+	if _, ok := Frontmatter(base, local, remote); ok {
+		t.Error("expected conflicting values to fail")
+	}
+}
+
+func TestFrontmatter_Lists(t *testing.T) {
+	base := "tags:\n  - work\n  - old\naliases: [Plan]"
+	local := "tags:\n  - work\n  - old\n  - urgent\naliases: [Plan, The plan]"
+	remote := "tags:\n  - work\n  - q3\naliases: [Project plan]"
+
+	result, ok := Frontmatter(base, local, remote)
+	if !ok {
+		t.Fatal("expected lists to merge")
+	}
+
+	expected := "tags:\n  - work\n  - urgent\n  - q3\naliases: [The plan, Project plan]"
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
+
+func TestFrontmatter_InvalidYAML(t *testing.T) {
+	if _, ok := Frontmatter("a: 1", "a: [", "a: 2"); ok {
+		t.Error("expected invalid YAML to fail")
+	}
+}
+
+func TestNote(t *testing.T) {
+	base := "---\ntitle: Plan\nstatus: draft\n---\n# Plan\n\nFirst line\nSecond line\n"
+	local := "---\ntitle: Plan\nstatus: done\n---\n# Plan\n\nFirst line edited\nSecond line\n"
+	remote := "---\ntitle: Plan\nstatus: draft\npriority: high\n---\n# Plan\n\nFirst line\nSecond line\nThird line\n"
+
+	result, ok := Note(base, local, remote)
+	if !ok {
+		t.Fatal("expected note to merge")
+	}
+
+	expected := "---\ntitle: Plan\nstatus: done\npriority: high\n---\n# Plan\n\nFirst line edited\nSecond line\nThird line\n"
+	if result != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
+
+func TestNote_OneSideFrontmatter(t *testing.T) {
+	base := "---\ntags: [a]\n---\nBody\n"
+	local := "---\ntags: [a]\n---\nBody edited\n"
+	remote := "---\ntags: [a, b]\n---\nBody\n"
+
+	result, ok := Note(base, local, remote)
+	if !ok {
+		t.Fatal("expected note to merge")
+	}
+
+	// Untouched frontmatter is kept verbatim
+	if !strings.HasPrefix(result, "---\ntags: [a, b]\n---\n") {
+		t.Errorf("expected remote frontmatter to be kept verbatim, got %q", result)
+	}
+	if !strings.HasSuffix(result, "Body edited\n") {
+		t.Errorf("expected local body, got %q", result)
+	}
+}
+
+func TestNote_BodyConflict(t *testing.T) {
+	base := "Line\n"
+	local := "Local line\n"
+	remote := "Remote line\n"
+
+	if _, ok := Note(base, local, remote); ok {
+		t.Error("expected overlapping body edits to conflict")
+	}
+}
+
+func TestNote_CRLF(t *testing.T) {
+	base := "---\r\ntags: [a]\r\nstatus: draft\r\n---\r\nLine\r\n"
+	local := "---\r\ntags: [a, b]\r\nstatus: draft\r\n---\r\nLine\r\n"
+	remote := "---\ntags: [a, c]\nstatus: done\n---\nLine\nMore\n"
+
+	result, ok := Note(base, local, remote)
+	if !ok {
+		t.Fatal("expected note to merge")
+	}
+
+	expected := "---\r\ntags: [a, b, c]\r\nstatus: done\r\n---\r\nLine\r\nMore\r\n"
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
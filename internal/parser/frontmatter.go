@@ -86,15 +86,12 @@ func ParseFrontmatter(content string) (*Frontmatter, string, error) {
 		Extra: make(map[string]interface{}),
 	}
 
-	match := frontmatterRegex.FindStringSubmatch(content)
-	if match == nil {
+	yamlContent, body, found := SplitFrontmatter(content)
+	if !found {
 		// No frontmatter found
 		return fm, content, nil
 	}
 
-	yamlContent := match[1]
-	body := content[len(match[0]):]
-
 	// First, parse into raw struct for known fields
 	var raw rawFrontmatter
 	if err := yaml.Unmarshal([]byte(yamlContent), &raw); err != nil {
@@ -139,6 +136,15 @@ func ParseFrontmatter(content string) (*Frontmatter, string, error) {
 	return fm, body, nil
 }
 
+// SplitFrontmatter separates the raw YAML frontmatter from the body of a note
+func SplitFrontmatter(content string) (yamlContent string, body string, found bool) {
+	match := frontmatterRegex.FindStringSubmatch(content)
+	if match == nil {
+		return "", content, false
+	}
+	return match[1], content[len(match[0]):], true
+}
+
 // normalizeStringArray converts string or []string or []interface{} to []string
 func normalizeStringArray(v interface{}) []string {
 	if v == nil {
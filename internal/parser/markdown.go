@@ -1,35 +1,53 @@
 package parser
 
 import (
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 	"unicode/utf8"
-)
-
-var (
-	// wikiLinkRegex matches [[Page Name]] and [[Page Name|Alias]]
-	wikiLinkRegex = regexp.MustCompile(`\[\[([^\]|]+)(?:\|[^\]]+)?\]\]`)
-
-	// inlineTagRegex matches #tag-name (but not #123 or inside code blocks)
-	inlineTagRegex = regexp.MustCompile(`(?:^|[^&\w])#([a-zA-Z][a-zA-Z0-9_/-]*)`)
-
-	// codeBlockRegex matches fenced code blocks
-	codeBlockRegex = regexp.MustCompile("(?s)```.*?```")
 
-	// inlineCodeRegex matches inline code
-	inlineCodeRegex = regexp.MustCompile("`[^`]+`")
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
 )
 
+// urlSchemeRegex matches the scheme of an external URL, such as https: or
+// mailto:
+var urlSchemeRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]+:`)
+
 // ParsedNote represents a fully parsed markdown note
 type ParsedNote struct {
 	Frontmatter   *Frontmatter
 	Body          string
 	RawContent    string
-	OutgoingLinks []string
+	OutgoingLinks []string // Distinct targets of the links to files in the vault
+	Links         []Link   // Every link, in order, with its position
 	InlineTags    []string
+	Document      ast.Node // Markdown AST of Body, whose positions are byte offsets in Body
+}
+
+// LinkKind is the syntax a link is written in
+type LinkKind string
+
+// Kinds of links
+const (
+	LinkWiki     LinkKind = "wikilink" // [[Note]]
+	LinkMarkdown LinkKind = "markdown" // [text](Note.md)
+	LinkEmbed    LinkKind = "embed"    // ![[image.png]] or ![alt](image.png)
+	LinkExternal LinkKind = "external" // A URL outside the vault
+)
+
+// Link is a link in a note, as written. Targets of markdown links are
+// URL-decoded; external URLs are kept as they are, in Target.
+type Link struct {
+	Kind   LinkKind
+	Target string // Path or name of the linked file, without the anchor; empty for a link within the note
+	Anchor string // Heading, or ^block id, after the #
+	Alias  string // Display text: after the | of a wikilink, or the text of a markdown link
+	Offset int    // Byte offset in the note's raw content
+	Line   int    // Line in the note's raw content, from 1
 }
 
 // Parser handles parsing of markdown notes
@@ -64,11 +82,10 @@ func (p *Parser) ParseContent(content string, path string) (*ParsedNote, error)
 	note.Frontmatter = fm
 	note.Body = body
 
-	// Extract wikilinks from body
-	note.OutgoingLinks = extractWikiLinks(body)
-
-	// Extract inline tags from body (excluding code blocks)
-	note.InlineTags = extractInlineTags(body)
+	// Extract links and inline tags from the AST of the body, leaving out
+	// code, comments and math. Links are positioned in the raw content.
+	note.Document, note.Links, note.InlineTags = parseMarkdown(content, len(content)-len(body))
+	note.OutgoingLinks = linkTargets(note.Links)
 
 	// If title not in frontmatter, try to use filename
 	if fm.Title == nil || *fm.Title == "" {
@@ -80,52 +97,181 @@ func (p *Parser) ParseContent(content string, path string) (*ParsedNote, error)
 	return note, nil
 }
 
-// extractWikiLinks finds all [[wikilinks]] in the content
-func extractWikiLinks(content string) []string {
-	matches := wikiLinkRegex.FindAllStringSubmatch(content, -1)
+// extractLinkTargets returns the distinct targets of the links in content
+func extractLinkTargets(content string) []string {
+	return linkTargets(extractLinks(content, 0))
+}
+
+// extractLinks finds all links in content from the byte offset start
+func extractLinks(content string, start int) []Link {
+	_, links, _ := parseMarkdown(content, start)
+	return links
+}
+
+// parseMarkdown parses content from the byte offset start, and collects its
+// links and distinct tags in one walk of the AST. Nothing is collected from
+// code, HTML, comments or math, whose content isn't parsed.
+func parseMarkdown(content string, start int) (ast.Node, []Link, []string) {
+	source := []byte(content[start:])
+	doc := markdown.Parse(text.NewReader(source))
+
+	var links []Link
+	var tags []string
 	seen := make(map[string]bool)
-	var links []string
-
-	for _, match := range matches {
-		if len(match) > 1 {
-			link := strings.TrimSpace(match[1])
-			// Handle nested paths and anchors
-			// [[folder/page#heading]] -> folder/page
-			if idx := strings.Index(link, "#"); idx != -1 {
-				link = link[:idx]
+
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		var link Link
+		pos := n.Pos()
+		switch n := n.(type) {
+		case *WikiLink:
+			link = wikiLink(n.Embed, string(n.Destination), string(n.Alias))
+		case *ast.Link:
+			if len(n.Destination) == 0 {
+				return ast.WalkContinue, nil
 			}
-			link = strings.TrimSpace(link)
+			link = markdownLink(false, plainText(n, source), string(n.Destination))
+		case *ast.Image:
+			if len(n.Destination) == 0 {
+				return ast.WalkSkipChildren, nil
+			}
+			link = markdownLink(true, plainText(n, source), string(n.Destination))
+		case *ast.AutoLink:
+			target := string(n.URL(source))
+			if n.AutoLinkType == ast.AutoLinkEmail && !strings.HasPrefix(strings.ToLower(target), "mailto:") {
+				target = "mailto:" + target
+			}
+			link = Link{Kind: LinkExternal, Target: target}
+			// A bare URL is parsed from the space or markup before it
+			if strings.IndexByte(" *_~(", source[pos]) >= 0 {
+				pos++
+			}
+		case *Tag:
+			tag := strings.ToLower(string(n.Name))
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+			return ast.WalkContinue, nil
+		default:
+			return ast.WalkContinue, nil
+		}
 
-			if link != "" && !seen[link] {
-				seen[link] = true
-				links = append(links, link)
+		link.Offset = start + pos
+		links = append(links, link)
+		return ast.WalkContinue, nil
+	})
+
+	// Lines are counted once, as links are in order
+	line, lineStart := 1, 0
+	for i := range links {
+		line += strings.Count(content[lineStart:links[i].Offset], "\n")
+		lineStart = links[i].Offset
+		links[i].Line = line
+	}
+
+	return doc, links, tags
+}
+
+// plainText returns the text of a node's children, such as the text of a
+// link, without its markup
+func plainText(n ast.Node, source []byte) string {
+	var b strings.Builder
+	_ = ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch c := c.(type) {
+		case *ast.Text:
+			b.Write(c.Value(source))
+			if c.SoftLineBreak() || c.HardLineBreak() {
+				b.WriteByte(' ')
 			}
+		case *ast.String:
+			b.Write(c.Value)
+		case *WikiLink:
+			b.Write(c.Destination)
+		case *Tag:
+			b.WriteByte('#')
+			b.Write(c.Name)
 		}
+		return ast.WalkContinue, nil
+	})
+	return strings.TrimSpace(b.String())
+}
+
+// wikiLink builds the link of [[folder/page#heading|alias]]
+func wikiLink(embed bool, target, alias string) Link {
+	kind := LinkWiki
+	if embed {
+		kind = LinkEmbed
 	}
+	target, anchor, _ := strings.Cut(target, "#")
+	return Link{
+		Kind:   kind,
+		Target: strings.TrimSpace(target),
+		Anchor: strings.TrimSpace(anchor),
+		Alias:  strings.TrimSpace(alias),
+	}
+}
 
-	return links
+// markdownLink builds the link of [text](target). A target in the vault is
+// URL-encoded, as in [text](My%20Note.md#Some%20heading), or written in
+// angle brackets.
+func markdownLink(embed bool, text, target string) Link {
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+	text = strings.TrimSpace(text)
+	if urlSchemeRegex.MatchString(target) {
+		return Link{Kind: LinkExternal, Target: target, Alias: text}
+	}
+
+	kind := LinkMarkdown
+	if embed {
+		kind = LinkEmbed
+	}
+	target, anchor, _ := strings.Cut(target, "#")
+	return Link{
+		Kind:   kind,
+		Target: unescapeURL(target),
+		Anchor: unescapeURL(anchor),
+		Alias:  text,
+	}
 }
 
-// extractInlineTags finds all #tags in the content, excluding code blocks
-func extractInlineTags(content string) []string {
-	// Remove code blocks to avoid matching tags in code
-	cleanContent := codeBlockRegex.ReplaceAllString(content, "")
-	cleanContent = inlineCodeRegex.ReplaceAllString(cleanContent, "")
+// unescapeURL decodes a URL-encoded path, or returns it as it is if it
+// isn't validly encoded
+func unescapeURL(s string) string {
+	if decoded, err := url.PathUnescape(s); err == nil {
+		return decoded
+	}
+	return s
+}
 
-	matches := inlineTagRegex.FindAllStringSubmatch(cleanContent, -1)
+// linkTargets returns the distinct targets of links to files in the vault,
+// leaving out links within the note and external URLs
+func linkTargets(links []Link) []string {
 	seen := make(map[string]bool)
-	var tags []string
+	var targets []string
 
-	for _, match := range matches {
-		if len(match) > 1 {
-			tag := strings.ToLower(strings.TrimSpace(match[1]))
-			if tag != "" && !seen[tag] {
-				seen[tag] = true
-				tags = append(tags, tag)
-			}
+	for _, link := range links {
+		if link.Kind == LinkExternal {
+			continue
+		}
+		if link.Target != "" && !seen[link.Target] {
+			seen[link.Target] = true
+			targets = append(targets, link.Target)
 		}
 	}
 
+	return targets
+}
+
+// extractInlineTags finds all #tags in the content, excluding code blocks
+func extractInlineTags(content string) []string {
+	_, _, tags := parseMarkdown(content, 0)
 	return tags
 }
 
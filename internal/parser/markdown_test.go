@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -49,7 +50,7 @@ func TestExtractWikiLinks(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := extractWikiLinks(tt.content)
+			result := extractLinkTargets(tt.content)
 			if len(result) != len(tt.expected) {
 				t.Errorf("expected %d links, got %d: %v", len(tt.expected), len(result), result)
 				return
@@ -63,6 +64,98 @@ func TestExtractWikiLinks(t *testing.T) {
 	}
 }
 
+func TestExtractLinks(t *testing.T) {
+	content := "---\ntitle: T\n---\nSee [[Folder/Page#Heading|shown]]\nand [[#Local]], [[Page#^block]]"
+	_, body, err := ParseFrontmatter(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links := extractLinks(content, len(content)-len(body))
+	expected := []Link{
+		{Kind: LinkWiki, Target: "Folder/Page", Anchor: "Heading", Alias: "shown", Offset: 21, Line: 4},
+		{Kind: LinkWiki, Target: "", Anchor: "Local", Offset: 55, Line: 5},
+		{Kind: LinkWiki, Target: "Page", Anchor: "^block", Offset: 67, Line: 5},
+	}
+	if len(links) != len(expected) {
+		t.Fatalf("expected %d links, got %d: %+v", len(expected), len(links), links)
+	}
+	for i, link := range links {
+		if link != expected[i] {
+			t.Errorf("expected link %+v, got %+v", expected[i], link)
+		}
+	}
+}
+
+func TestExtractLinkKinds(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected Link
+	}{
+		{
+			name:     "embed",
+			content:  "![[photo.png|300]]",
+			expected: Link{Kind: LinkEmbed, Target: "photo.png", Alias: "300"},
+		},
+		{
+			name:     "markdown link",
+			content:  "[the plan](Projects/My%20Plan.md#Next%20steps)",
+			expected: Link{Kind: LinkMarkdown, Target: "Projects/My Plan.md", Anchor: "Next steps", Alias: "the plan"},
+		},
+		{
+			name:     "markdown link in angle brackets with title",
+			content:  `[plan](<My Plan.md> "Title")`,
+			expected: Link{Kind: LinkMarkdown, Target: "My Plan.md", Alias: "plan"},
+		},
+		{
+			name:     "markdown image",
+			content:  "![alt](img/photo%201.png)",
+			expected: Link{Kind: LinkEmbed, Target: "img/photo 1.png", Alias: "alt"},
+		},
+		{
+			name:     "external markdown link",
+			content:  "[docs](https://example.com/a%20b?q=1#top)",
+			expected: Link{Kind: LinkExternal, Target: "https://example.com/a%20b?q=1#top", Alias: "docs"},
+		},
+		{
+			name:     "autolink",
+			content:  "<mailto:me@example.com>",
+			expected: Link{Kind: LinkExternal, Target: "mailto:me@example.com"},
+		},
+		{
+			name:     "wikilink in a table",
+			content:  "| [[Page\\|shown]] |\n| --- |",
+			expected: Link{Kind: LinkWiki, Target: "Page", Alias: "shown", Offset: 2},
+		},
+		{
+			name:     "bare www URL",
+			content:  "Go to www.example.com",
+			expected: Link{Kind: LinkExternal, Target: "http://www.example.com", Offset: 6},
+		},
+		{
+			name:     "bare URL",
+			content:  "See https://example.com/page.",
+			expected: Link{Kind: LinkExternal, Target: "https://example.com/page", Offset: 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links := extractLinks(tt.content, 0)
+			tt.expected.Line = 1
+			if len(links) != 1 || links[0] != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, links)
+			}
+		})
+	}
+
+	targets := extractLinkTargets("[[a]] [b](b.md) ![[c.png]] https://example.com")
+	if expected := []string{"a", "b.md", "c.png"}; !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected targets %v, got %v", expected, targets)
+	}
+}
+
 func TestExtractInlineTags(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -239,3 +332,45 @@ func TestIsValidUTF8(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMarkdownSkipsCode(t *testing.T) {
+	content := "~~~\n#fenced [[Fenced]]\n~~~\n\n" +
+		"    #indented [[Indented]]\n\n" +
+		"<!-- #html [[Html]] -->\n\n" +
+		"Text %% #comment [[Comment]] %% and <!-- [[Inline]] --> here\n\n" +
+		"%%\n#block-comment [[Block]]\n%%\n\n" +
+		"$$\n\\#math [[Math]]\n$$\n\n" +
+		"Inline $x^2 [[Dollar]]$ costs $5 and $10 #kept\n\n" +
+		"See `[[Code]]` and [[Real]] #real\n"
+
+	_, links, tags := parseMarkdown(content, 0)
+	var targets []string
+	for _, link := range links {
+		targets = append(targets, link.Target)
+	}
+	if expected := []string{"Real"}; !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected links %v, got %v", expected, targets)
+	}
+	if expected := []string{"kept", "real"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+}
+
+func TestParseMarkdownCallout(t *testing.T) {
+	content := "> [!Warning]- Read [[Later]]\n> about #risk\n"
+
+	doc, links, tags := parseMarkdown(content, 0)
+	callout, ok := doc.FirstChild().(*Callout)
+	if !ok {
+		t.Fatalf("expected a callout, got %s", doc.FirstChild().Kind())
+	}
+	if callout.CalloutType != "warning" || callout.Fold != "-" {
+		t.Errorf("expected a folded warning, got %q %q", callout.CalloutType, callout.Fold)
+	}
+	if len(links) != 1 || links[0].Target != "Later" || links[0].Offset != 19 {
+		t.Errorf("expected the link to Later, got %+v", links)
+	}
+	if expected := []string{"risk"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+}
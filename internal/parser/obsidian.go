@@ -0,0 +1,435 @@
+package parser
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	gmparser "github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdown parses CommonMark with GitHub's extensions, footnotes and
+// Obsidian's syntax. It keeps no state between parses, so notes can be
+// parsed concurrently.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote, obsidian{}),
+).Parser()
+
+// obsidian adds the syntax Obsidian has on top of markdown: [[wikilinks]]
+// and ![[embeds]], #tags, %%comments%%, $math$ and > [!note] callouts
+type obsidian struct{}
+
+// Extend implements goldmark.Extender
+func (obsidian) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		gmparser.WithBlockParsers(
+			util.Prioritized(&fencedBlockParser{fence: []byte("%%"), node: newCommentBlock}, 690),
+			util.Prioritized(&fencedBlockParser{fence: []byte("$$"), node: newMathBlock}, 695),
+		),
+		gmparser.WithInlineParsers(
+			util.Prioritized(commentParser{}, 90),
+			util.Prioritized(mathParser{}, 95),
+			// Before the link parser, which would take [[Page]] for [Page]
+			util.Prioritized(wikiLinkParser{}, 199),
+			util.Prioritized(tagParser{}, 600),
+		),
+		gmparser.WithASTTransformers(
+			util.Prioritized(calloutTransformer{}, 100),
+		),
+	)
+}
+
+// Kinds of the Obsidian nodes
+var (
+	KindWikiLink     = ast.NewNodeKind("WikiLink")
+	KindTag          = ast.NewNodeKind("Tag")
+	KindComment      = ast.NewNodeKind("Comment")
+	KindCommentBlock = ast.NewNodeKind("CommentBlock")
+	KindMath         = ast.NewNodeKind("Math")
+	KindMathBlock    = ast.NewNodeKind("MathBlock")
+	KindCallout      = ast.NewNodeKind("Callout")
+)
+
+// WikiLink is a [[Page#heading|alias]] link, or an ![[embed]]
+type WikiLink struct {
+	ast.BaseInline
+	Embed       bool
+	Destination []byte // Before the |, with the anchor
+	Alias       []byte // After the |
+}
+
+// Kind implements ast.Node
+func (n *WikiLink) Kind() ast.NodeKind { return KindWikiLink }
+
+// Dump implements ast.Node
+func (n *WikiLink) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{
+		"Embed":       boolString(n.Embed),
+		"Destination": string(n.Destination),
+		"Alias":       string(n.Alias),
+	}, nil)
+}
+
+// Tag is an inline #tag
+type Tag struct {
+	ast.BaseInline
+	Name []byte // Without the #, as written
+}
+
+// Kind implements ast.Node
+func (n *Tag) Kind() ast.NodeKind { return KindTag }
+
+// Dump implements ast.Node
+func (n *Tag) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Name": string(n.Name)}, nil)
+}
+
+// Comment is a %%comment%% within a paragraph. Obsidian doesn't render it,
+// so nothing in it is parsed.
+type Comment struct{ ast.BaseInline }
+
+// Kind implements ast.Node
+func (n *Comment) Kind() ast.NodeKind { return KindComment }
+
+// Dump implements ast.Node
+func (n *Comment) Dump(source []byte, level int) { ast.DumpHelper(n, source, level, nil, nil) }
+
+// Math is inline $LaTeX$
+type Math struct{ ast.BaseInline }
+
+// Kind implements ast.Node
+func (n *Math) Kind() ast.NodeKind { return KindMath }
+
+// Dump implements ast.Node
+func (n *Math) Dump(source []byte, level int) { ast.DumpHelper(n, source, level, nil, nil) }
+
+// fencedBlock is the base of the blocks between a pair of fences, whose
+// lines are kept as they are
+type fencedBlock struct {
+	ast.BaseBlock
+	closed bool // The closing fence was on the opening line
+}
+
+// IsRaw implements ast.Node
+func (n *fencedBlock) IsRaw() bool { return true }
+
+func (n *fencedBlock) fenced() *fencedBlock { return n }
+
+// CommentBlock is a %% comment of whole lines
+type CommentBlock struct{ fencedBlock }
+
+func newCommentBlock() fencedNode { return &CommentBlock{} }
+
+// Kind implements ast.Node
+func (n *CommentBlock) Kind() ast.NodeKind { return KindCommentBlock }
+
+// Dump implements ast.Node
+func (n *CommentBlock) Dump(source []byte, level int) { ast.DumpHelper(n, source, level, nil, nil) }
+
+// MathBlock is a $$ block of LaTeX
+type MathBlock struct{ fencedBlock }
+
+func newMathBlock() fencedNode { return &MathBlock{} }
+
+// Kind implements ast.Node
+func (n *MathBlock) Kind() ast.NodeKind { return KindMathBlock }
+
+// Dump implements ast.Node
+func (n *MathBlock) Dump(source []byte, level int) { ast.DumpHelper(n, source, level, nil, nil) }
+
+// Callout is a blockquote starting with [!type], which Obsidian renders as a
+// callout box. Its children are those of the blockquote, the title line
+// included.
+type Callout struct {
+	ast.BaseBlock
+	CalloutType string // Lowercased, such as note or warning
+	Fold        string // + if it starts expanded, - if collapsed, or empty if it doesn't fold
+}
+
+// Kind implements ast.Node
+func (n *Callout) Kind() ast.NodeKind { return KindCallout }
+
+// Dump implements ast.Node
+func (n *Callout) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{
+		"CalloutType": n.CalloutType,
+		"Fold":        n.Fold,
+	}, nil)
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+type fencedNode interface {
+	ast.Node
+	fenced() *fencedBlock
+}
+
+// fencedBlockParser parses the blocks from a line starting with fence to the
+// next line with it, such as %% comments and $$ math
+type fencedBlockParser struct {
+	fence []byte
+	node  func() fencedNode
+}
+
+func (b *fencedBlockParser) Trigger() []byte {
+	return b.fence[:1]
+}
+
+func (b *fencedBlockParser) Open(parent ast.Node, reader text.Reader, pc gmparser.Context) (ast.Node, gmparser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockIndent()
+	if !bytes.HasPrefix(line[pos:], b.fence) {
+		return nil, gmparser.NoChildren
+	}
+	start := pos + len(b.fence)
+	rest := line[start:]
+
+	node := b.node()
+	if end := bytes.Index(rest, b.fence); end >= 0 {
+		// Closed on the same line, which makes it a block only if nothing
+		// follows; otherwise it is inline, within a paragraph
+		if !util.IsBlank(rest[end+len(b.fence):]) {
+			return nil, gmparser.NoChildren
+		}
+		node.fenced().closed = true
+		rest = rest[:end]
+	}
+	if !util.IsBlank(rest) {
+		node.Lines().Append(text.NewSegment(segment.Start+start, segment.Start+start+len(rest)))
+	}
+	reader.AdvanceToEOL()
+	return node, gmparser.NoChildren
+}
+
+func (b *fencedBlockParser) Continue(node ast.Node, reader text.Reader, pc gmparser.Context) gmparser.State {
+	if node.(fencedNode).fenced().closed {
+		return gmparser.Close
+	}
+
+	line, segment := reader.PeekLine()
+	if end := bytes.Index(line, b.fence); end >= 0 {
+		node.Lines().Append(segment.WithStop(segment.Start + end))
+		reader.AdvanceToEOL()
+		return gmparser.Close
+	}
+	node.Lines().Append(segment)
+	reader.AdvanceToEOL()
+	return gmparser.Continue | gmparser.NoChildren
+}
+
+func (b *fencedBlockParser) Close(node ast.Node, reader text.Reader, pc gmparser.Context) {}
+
+func (b *fencedBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (b *fencedBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// commentParser parses %%comments%% within a paragraph, which may span lines
+type commentParser struct{}
+
+func (commentParser) Trigger() []byte {
+	return []byte{'%'}
+}
+
+func (commentParser) Parse(parent ast.Node, block text.Reader, pc gmparser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	if !bytes.HasPrefix(line, []byte("%%")) {
+		return nil
+	}
+	if !skipSpan(block, []byte("%%"), nil) {
+		return nil
+	}
+	return &Comment{}
+}
+
+// mathParser parses $inline$ and $$display$$ math within a paragraph. Like
+// Obsidian, a single $ opens math only if it isn't followed by a space, and
+// closes it only if it isn't preceded by one or followed by a digit, so
+// amounts such as $5 and $10 stay text.
+type mathParser struct{}
+
+func (mathParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+func (mathParser) Parse(parent ast.Node, block text.Reader, pc gmparser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	if bytes.HasPrefix(line, []byte("$$")) {
+		if !skipSpan(block, []byte("$$"), nil) {
+			return nil
+		}
+		return &Math{}
+	}
+
+	if len(line) < 2 || util.IsSpace(line[1]) {
+		return nil
+	}
+	closes := func(line []byte, i int) bool {
+		return i > 0 && !util.IsSpace(line[i-1]) && (i+1 >= len(line) || !isDigit(line[i+1]))
+	}
+	if !skipSpan(block, []byte("$"), closes) {
+		return nil
+	}
+	return &Math{}
+}
+
+// skipSpan advances block past a span from the delim it is at to the next
+// one for which closes, if given, is true. If the span isn't closed within
+// the paragraph, it leaves block where it was and returns false.
+func skipSpan(block text.Reader, delim []byte, closes func(line []byte, i int) bool) bool {
+	l, pos := block.Position()
+	block.Advance(len(delim))
+	for {
+		line, _ := block.PeekLine()
+		if line == nil {
+			block.SetPosition(l, pos)
+			return false
+		}
+		for i := 0; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+				continue
+			}
+			if bytes.HasPrefix(line[i:], delim) && (closes == nil || closes(line, i)) {
+				block.Advance(i + len(delim))
+				return true
+			}
+		}
+		block.AdvanceLine()
+	}
+}
+
+// wikiLinkParser parses [[Page#heading|alias]] and ![[embed]], which end on
+// the line they start on
+type wikiLinkParser struct{}
+
+func (wikiLinkParser) Trigger() []byte {
+	return []byte{'!', '['}
+}
+
+func (wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc gmparser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	node := &WikiLink{}
+	open := 2
+	if line[0] == '!' {
+		node.Embed = true
+		open = 3
+	}
+	if !bytes.HasPrefix(line[open-2:], []byte("[[")) {
+		return nil
+	}
+	end := bytes.Index(line[open:], []byte("]]"))
+	if end <= 0 {
+		return nil
+	}
+	inner := line[open : open+end]
+	if bytes.ContainsAny(inner, "[]") {
+		return nil
+	}
+
+	// A | escaped as \| in a table cell still separates the alias
+	if i := bytes.IndexByte(inner, '|'); i >= 0 {
+		node.Destination, node.Alias = bytes.TrimSuffix(inner[:i], []byte(`\`)), inner[i+1:]
+	} else {
+		node.Destination = inner
+	}
+	node.SetPos(segment.Start)
+	block.Advance(open + end + 2)
+	return node
+}
+
+// tagParser parses #tags. Like Obsidian, a tag is made of letters, digits,
+// _, - and /, with at least one that isn't a digit, and isn't part of a
+// word or an HTML entity such as &#123;.
+type tagParser struct{}
+
+func (tagParser) Trigger() []byte {
+	return []byte{'#'}
+}
+
+func (tagParser) Parse(parent ast.Node, block text.Reader, pc gmparser.Context) ast.Node {
+	if r := block.PrecendingCharacter(); r == '&' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return nil
+	}
+
+	line, _ := block.PeekLine()
+	end, digits := 1, true
+	for end < len(line) {
+		r, size := utf8.DecodeRune(line[end:])
+		if !isTagRune(r) {
+			break
+		}
+		if !unicode.IsDigit(r) {
+			digits = false
+		}
+		end += size
+	}
+	if end == 1 || digits {
+		return nil
+	}
+
+	node := &Tag{Name: line[1:end]}
+	block.Advance(end)
+	return node
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '/'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// calloutRegex matches the [!type] a callout starts with, and how it folds
+var calloutRegex = regexp.MustCompile(`^\s*\[!([^\]\s]+)\]([+-]?)`)
+
+// calloutTransformer replaces the blockquotes that are callouts with a
+// Callout node
+type calloutTransformer struct{}
+
+func (calloutTransformer) Transform(doc *ast.Document, reader text.Reader, pc gmparser.Context) {
+	var quotes []*ast.Blockquote
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if q, ok := n.(*ast.Blockquote); ok && entering {
+			quotes = append(quotes, q)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, q := range quotes {
+		p, ok := q.FirstChild().(*ast.Paragraph)
+		if !ok || p.Lines().Len() == 0 {
+			continue
+		}
+		first := p.Lines().At(0)
+		m := calloutRegex.FindSubmatch(first.Value(reader.Source()))
+		if m == nil {
+			continue
+		}
+
+		callout := &Callout{CalloutType: strings.ToLower(string(m[1])), Fold: string(m[2])}
+		callout.SetPos(q.Pos())
+		for child := q.FirstChild(); child != nil; {
+			next := child.NextSibling()
+			callout.AppendChild(callout, child)
+			child = next
+		}
+		q.Parent().ReplaceChild(q.Parent(), q, callout)
+	}
+}
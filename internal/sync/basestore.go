@@ -0,0 +1,102 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// BaseStore keeps the content of notes as of their last sync, keyed by
+// content hash, so concurrent edits can be merged against their common base
+type BaseStore struct {
+	dir string
+}
+
+// NewBaseStore creates the base store of a vault, a directory next to
+// stateFile if the vault has one, or in the config directory
+func NewBaseStore(vaultPath, stateFile string) (*BaseStore, error) {
+	dir, err := stateFilePath(vaultPath, stateFile, "base", "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &BaseStore{dir: dir}, nil
+}
+
+// path returns the file holding the given hash, sharded by its first two characters
+func (b *BaseStore) path(hash string) string {
+	return filepath.Join(b.dir, hash[:2], hash)
+}
+
+// Has reports whether content for the hash is stored
+func (b *BaseStore) Has(hash string) bool {
+	_, err := os.Stat(b.path(hash))
+	return err == nil
+}
+
+// Put stores content under its hash
+func (b *BaseStore) Put(hash string, content []byte) error {
+	if b.Has(hash) {
+		return nil
+	}
+
+	path := b.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a crash never leaves a truncated base.
+	// Each writer gets its own temp file since uploads run in parallel.
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns the content stored for a hash. It returns an error satisfying
+// os.IsNotExist if the content is missing or doesn't match its hash.
+func (b *BaseStore) Get(hash string) ([]byte, error) {
+	content, err := os.ReadFile(b.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	if HashContent(content) != hash {
+		os.Remove(b.path(hash))
+		return nil, os.ErrNotExist
+	}
+	return content, nil
+}
+
+// Prune removes all stored content whose hash is not in keep
+func (b *BaseStore) Prune(keep map[string]bool) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(b.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if !keep[d.Name()] {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
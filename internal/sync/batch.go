@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+// maxBatchBytes caps the size of the files in one batch, so a batch of large
+// notes isn't held in memory all at once. Attachment content is streamed.
+const maxBatchBytes = 32 * 1024 * 1024
+
+// batchPaths splits paths into batches of at most size paths and maxBytes
+// bytes. A file larger than maxBytes gets a batch of its own.
+func batchPaths(paths []string, sizes map[string]int64, size int, maxBytes int64) [][]string {
+	size = max(1, size)
+
+	var batches [][]string
+	var current []string
+	var currentBytes int64
+	for _, relPath := range paths {
+		n := sizes[relPath]
+		if len(current) > 0 && (len(current) >= size || currentBytes+n > maxBytes) {
+			batches = append(batches, current)
+			current, currentBytes = nil, 0
+		}
+		current = append(current, relPath)
+		currentBytes += n
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// uploadBatch reads a batch of files and writes them to the database with one
+// round trip per table. If a table's batch fails, its files are retried one
+// at a time so a single bad file doesn't hold back the rest. Files that still
+// fail are added to the retry queue.
+func (e *Engine) uploadBatch(ctx context.Context, paths []string, hashes map[string]string) {
+	if err := e.recheckKey(ctx); err != nil {
+		slog.Error("failed to sync files", "count", len(paths), "error", err)
+		for _, relPath := range paths {
+			e.queueRetry(relPath, RetryUpload, err)
+		}
+		return
+	}
+
+	var notes, attachments, skipped []*upload
+	for _, relPath := range paths {
+		up, err := e.readUpload(relPath, hashes[relPath])
+		if err == nil {
+			err = e.storeContent(ctx, up)
+		}
+		if err != nil {
+			slog.Error("failed to sync file", "path", relPath, "error", err)
+			e.queueRetry(relPath, RetryUpload, err)
+			continue
+		}
+
+		switch {
+		case up.note != nil:
+			notes = append(notes, up)
+		case up.attachment != nil:
+			attachments = append(attachments, up)
+		default:
+			skipped = append(skipped, up)
+		}
+	}
+
+	e.resolveLinks(ctx, slices.Concat(notes, attachments)...)
+
+	if len(notes) > 0 {
+		rows := make([]*db.VaultNote, len(notes))
+		for i, up := range notes {
+			rows[i] = up.note
+		}
+		e.finishBatch(ctx, notes, e.db.UpsertNotes(ctx, rows))
+	}
+
+	if len(attachments) > 0 {
+		rows := make([]*db.VaultAttachment, len(attachments))
+		for i, up := range attachments {
+			rows[i] = up.attachment
+		}
+		e.finishBatch(ctx, attachments, e.db.UpsertAttachments(ctx, rows))
+	}
+	e.addLinkTargets(ctx, slices.Concat(notes, attachments)...)
+
+	// Attachments over the size limit are tracked without being uploaded
+	for _, up := range skipped {
+		e.finishUpload(up)
+	}
+}
+
+// finishBatch records the state of a written batch, or falls back to
+// uploading its files one at a time if the batch failed
+func (e *Engine) finishBatch(ctx context.Context, uploads []*upload, err error) {
+	if err == nil {
+		for _, up := range uploads {
+			e.finishUpload(up)
+		}
+		return
+	}
+
+	slog.Warn("batch upload failed, uploading files one at a time", "count", len(uploads), "error", err)
+	for _, up := range uploads {
+		if up.note != nil {
+			err = e.db.UpsertNote(ctx, up.note)
+		} else {
+			err = e.db.UpsertAttachment(ctx, up.attachment)
+		}
+		if err != nil {
+			slog.Error("failed to sync file", "path", up.relPath, "error", err)
+			e.queueRetry(up.relPath, RetryUpload, err)
+			continue
+		}
+		e.finishUpload(up)
+	}
+}
@@ -0,0 +1,40 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatchPaths(t *testing.T) {
+	sizes := map[string]int64{
+		"a.md": 10, "b.md": 10, "c.md": 10, "d.md": 10, "e.md": 10,
+		"big.png": 500, "small.png": 20,
+	}
+
+	tests := []struct {
+		name     string
+		paths    []string
+		size     int
+		maxBytes int64
+		want     [][]string
+	}{
+		{"empty", nil, 100, 1000, nil},
+		{"one batch", []string{"a.md", "b.md"}, 100, 1000, [][]string{{"a.md", "b.md"}}},
+		{"split by count", []string{"a.md", "b.md", "c.md", "d.md", "e.md"}, 2, 1000,
+			[][]string{{"a.md", "b.md"}, {"c.md", "d.md"}, {"e.md"}}},
+		{"split by bytes", []string{"a.md", "b.md", "c.md"}, 100, 25,
+			[][]string{{"a.md", "b.md"}, {"c.md"}}},
+		{"oversized file alone", []string{"a.md", "big.png", "small.png"}, 100, 100,
+			[][]string{{"a.md"}, {"big.png"}, {"small.png"}}},
+		{"zero batch size", []string{"a.md", "b.md"}, 0, 1000, [][]string{{"a.md"}, {"b.md"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := batchPaths(tt.paths, sizes, tt.size, tt.maxBytes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batchPaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/db"
+	"github.com/vonshlovens/obsync-pg/internal/merge"
+)
+
+// syncAction is the operation needed to bring a path in sync
+type syncAction int
+
+const (
+	actionNone         syncAction = iota
+	actionUpload                  // changed locally
+	actionDownload                // changed remotely
+	actionDeleteRemote            // deleted locally
+	actionDeleteLocal             // deleted remotely
+	actionConflict                // changed on both sides
+)
+
+func (a syncAction) String() string {
+	switch a {
+	case actionNone:
+		return "none"
+	case actionUpload:
+		return "upload"
+	case actionDownload:
+		return "download"
+	case actionDeleteRemote:
+		return "delete-remote"
+	case actionDeleteLocal:
+		return "delete-local"
+	case actionConflict:
+		return "conflict"
+	default:
+		return "unknown"
+	}
+}
+
+// decideAction performs a three-way comparison of the local and remote hashes
+// against the base hash recorded when the file was last synced. An empty hash
+// means the file doesn't exist on that side (or, for base, was never synced).
+func decideAction(base, local, remote string) syncAction {
+	switch {
+	case local == remote:
+		return actionNone
+	case local == base:
+		if remote == "" {
+			return actionDeleteLocal
+		}
+		return actionDownload
+	case remote == base:
+		if local == "" {
+			return actionDeleteRemote
+		}
+		return actionUpload
+	case local == "":
+		// Deleted here but edited remotely: keep the edit
+		return actionDownload
+	case remote == "":
+		// Deleted remotely but edited here: keep the edit
+		return actionUpload
+	default:
+		return actionConflict
+	}
+}
+
+// conflictCopyPath returns the path used to keep this device's version of a
+// conflicting file, e.g. "Note (conflict from laptop 2026-10-16).md". A
+// counter is appended if that name is already taken.
+func conflictCopyPath(relPath, device string, t time.Time, exists func(string) bool) string {
+	ext := filepath.Ext(relPath)
+	stem := strings.TrimSuffix(relPath, ext)
+	label := fmt.Sprintf("conflict from %s %s", device, t.Format("2006-01-02"))
+
+	candidate := fmt.Sprintf("%s (%s)%s", stem, label, ext)
+	for n := 2; exists(candidate); n++ {
+		candidate = fmt.Sprintf("%s (%s %d)%s", stem, label, n, ext)
+	}
+	return candidate
+}
+
+// resolveConflict handles a file edited on two devices. Notes are merged
+// against their base version when the edits don't overlap. Otherwise both
+// versions are kept: the local version is saved as a conflict copy and the
+// remote version takes the original path. The conflict is recorded so it
+// can be listed by status.
+func (e *Engine) resolveConflict(ctx context.Context, relPath, base, local, remote string) error {
+	absPath := filepath.Join(e.config.VaultPath, relPath)
+
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to read local version: %w", err)
+	}
+
+	if isNotePath(relPath) && base != "" && e.config.Sync.AutoMerge {
+		merged, err := e.mergeNote(ctx, relPath, base, data)
+		if err != nil || merged {
+			return err
+		}
+	}
+
+	conflictPath := conflictCopyPath(relPath, e.config.DeviceName, time.Now(), func(p string) bool {
+		_, err := os.Stat(filepath.Join(e.config.VaultPath, p))
+		return err == nil
+	})
+
+	// Save our version under the conflict name first so nothing is lost
+	if err := writeVaultFile(filepath.Join(e.config.VaultPath, conflictPath), data); err != nil {
+		return err
+	}
+
+	remoteDevice, err := e.downloadFile(ctx, relPath)
+	if err != nil {
+		return err
+	}
+
+	if err := e.uploadFile(ctx, conflictPath, HashContent(data)); err != nil {
+		return fmt.Errorf("failed to upload conflict copy: %w", err)
+	}
+
+	conflict := &db.VaultConflict{
+		Path:         relPath,
+		ConflictPath: conflictPath,
+		Device:       &e.config.DeviceName,
+		RemoteDevice: remoteDevice,
+		LocalHash:    local,
+		RemoteHash:   remote,
+	}
+	if base != "" {
+		conflict.BaseHash = &base
+	}
+	if err := e.db.InsertConflict(ctx, conflict); err != nil {
+		slog.Error("failed to record conflict", "path", relPath, "error", err)
+	}
+
+	slog.Warn("conflicting changes, kept both versions",
+		"path", relPath,
+		"conflict_path", conflictPath)
+	return nil
+}
+
+// mergeNote attempts a three-way merge of a note edited on both sides. It
+// returns false if the base version is unavailable or the edits overlap.
+func (e *Engine) mergeNote(ctx context.Context, relPath, base string, local []byte) (bool, error) {
+	baseContent, ok := e.baseContent(ctx, relPath, base)
+	if !ok {
+		slog.Debug("base version unavailable, cannot merge", "path", relPath)
+		return false, nil
+	}
+
+	note, err := e.db.GetNoteByPath(ctx, relPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to get note: %w", err)
+	}
+	if note == nil {
+		return false, nil
+	}
+
+	merged, ok := merge.Note(string(baseContent), string(local), note.RawContent)
+	if !ok {
+		slog.Debug("overlapping edits, cannot merge", "path", relPath)
+		return false, nil
+	}
+
+	mergedData := []byte(merged)
+	mergedHash := HashContent(mergedData)
+	if mergedHash == note.ContentHash {
+		// Local edits were already contained in the remote version
+		return true, e.writeRemoteFile(relPath, mergedData, mergedHash, fileMeta{})
+	}
+
+	if err := writeVaultFile(filepath.Join(e.config.VaultPath, relPath), mergedData); err != nil {
+		return false, err
+	}
+
+	// The remote version becomes the base, so a failed upload is retried as a local change
+	if err := e.bases.Put(note.ContentHash, []byte(note.RawContent)); err != nil {
+		slog.Warn("failed to store base version", "path", relPath, "error", err)
+	}
+	if err := e.recordFileState(relPath, note.ContentHash); err != nil {
+		return true, err
+	}
+
+	if err := e.uploadFile(ctx, relPath, mergedHash); err != nil {
+		return true, fmt.Errorf("failed to upload merged note: %w", err)
+	}
+
+	slog.Info("merged concurrent changes", "path", relPath)
+	return true, nil
+}
@@ -0,0 +1,75 @@
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecideAction(t *testing.T) {
+	tests := []struct {
+		name                string
+		base, local, remote string
+		expected            syncAction
+	}{
+		{"in sync", "a", "a", "a", actionNone},
+		{"both deleted", "a", "", "", actionNone},
+		{"never synced, identical", "", "a", "a", actionNone},
+		{"changed locally", "a", "b", "a", actionUpload},
+		{"changed remotely", "a", "a", "b", actionDownload},
+		{"deleted locally", "a", "", "a", actionDeleteRemote},
+		{"deleted remotely", "a", "a", "", actionDeleteLocal},
+		{"changed on both sides", "a", "b", "c", actionConflict},
+		{"same change on both sides", "a", "b", "b", actionNone},
+		{"deleted locally, changed remotely", "a", "", "b", actionDownload},
+		{"changed locally, deleted remotely", "a", "b", "", actionUpload},
+		{"new local file", "", "a", "", actionUpload},
+		{"new remote file", "", "", "a", actionDownload},
+		{"never synced, different", "", "a", "b", actionConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := decideAction(tt.base, tt.local, tt.remote)
+			if result != tt.expected {
+				t.Errorf("decideAction(%q, %q, %q) = %v, want %v",
+					tt.base, tt.local, tt.remote, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConflictCopyPath(t *testing.T) {
+	date := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	none := func(string) bool { return false }
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"Note.md", "Note (conflict from laptop 2026-10-16).md"},
+		{"folder/Note.md", "folder/Note (conflict from laptop 2026-10-16).md"},
+		{"images/photo.png", "images/photo (conflict from laptop 2026-10-16).png"},
+		{"Makefile", "Makefile (conflict from laptop 2026-10-16)"},
+	}
+
+	for _, tt := range tests {
+		result := conflictCopyPath(tt.path, "laptop", date, none)
+		if result != tt.expected {
+			t.Errorf("conflictCopyPath(%q) = %q, want %q", tt.path, result, tt.expected)
+		}
+	}
+}
+
+func TestConflictCopyPath_Taken(t *testing.T) {
+	date := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	taken := map[string]bool{
+		"Note (conflict from laptop 2026-10-16).md":   true,
+		"Note (conflict from laptop 2026-10-16 2).md": true,
+	}
+
+	result := conflictCopyPath("Note.md", "laptop", date, func(p string) bool { return taken[p] })
+	expected := "Note (conflict from laptop 2026-10-16 3).md"
+	if result != expected {
+		t.Errorf("conflictCopyPath with taken names = %q, want %q", result, expected)
+	}
+}
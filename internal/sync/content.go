@@ -0,0 +1,220 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/vonshlovens/obsync-pg/internal/chunker"
+	"github.com/vonshlovens/obsync-pg/internal/config"
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+// chunkBatchBytes caps the chunk data sent to the database in one round
+// trip, and so the memory an attachment upload needs
+const chunkBatchBytes = 16 * 1024 * 1024
+
+// storeContent uploads the content of an attachment before its row is
+// written, unless content with the same hash is already stored. Large files
+// are streamed from disk rather than read into memory.
+func (e *Engine) storeContent(ctx context.Context, up *upload) error {
+	att := up.attachment
+	if att == nil || att.Data != nil {
+		return nil // Notes and inline content are written with the row
+	}
+
+	stored, err := e.db.HasBlob(ctx, att.ContentHash)
+	if err != nil {
+		return fmt.Errorf("failed to check stored blobs: %w", err)
+	}
+	if stored {
+		slog.Debug("attachment content already stored", "path", up.relPath, "hash", att.ContentHash[:8])
+		return nil
+	}
+
+	if att.StorageKey != nil {
+		return e.storeExternal(ctx, up)
+	}
+	return e.storeChunks(ctx, up)
+}
+
+// storeChunks splits an attachment into content-defined chunks and stores
+// the chunks the database doesn't have yet. The blob is only recorded once
+// all its chunks are stored and the file still has the expected hash.
+func (e *Engine) storeChunks(ctx context.Context, up *upload) error {
+	att := up.attachment
+
+	f, err := os.Open(filepath.Join(e.config.VaultPath, up.relPath))
+	if err != nil {
+		return fmt.Errorf("failed to read attachment: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	c := chunker.New(io.TeeReader(f, h))
+
+	var hashes []string
+	var pending []db.Chunk
+	var pendingBytes int
+	var size int64
+	flush := func() error {
+		err := e.db.PutChunks(ctx, pending, att.MimeType)
+		pending, pendingBytes = pending[:0], 0
+		if err != nil {
+			return fmt.Errorf("failed to store chunks: %w", err)
+		}
+		return nil
+	}
+
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read attachment: %w", err)
+		}
+
+		chunk := db.Chunk{Hash: HashContent(data), Data: bytes.Clone(data)}
+		hashes = append(hashes, chunk.Hash)
+		pending = append(pending, chunk)
+		pendingBytes += len(data)
+		size += int64(len(data))
+
+		if pendingBytes >= chunkBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if size != att.FileSizeBytes || hex.EncodeToString(h.Sum(nil)) != att.ContentHash {
+		return fmt.Errorf("file changed while being uploaded")
+	}
+
+	if err := e.db.PutChunkedBlob(ctx, att.ContentHash, size, hashes); err != nil {
+		return fmt.Errorf("failed to store attachment content: %w", err)
+	}
+
+	slog.Debug("stored attachment content", "path", up.relPath, "chunks", len(hashes))
+	return nil
+}
+
+// downloadAttachment writes the content of an attachment to the vault,
+// streaming it from a local file with the same content, the external blob
+// store or the database
+func (e *Engine) downloadAttachment(ctx context.Context, att *db.VaultAttachment) error {
+	meta := fileMeta{modTime: att.ModifiedAt, mode: att.FileMode}
+
+	// Copied or moved attachments are already in the vault under another path
+	if src := e.localCopy(att.ContentHash); src != "" {
+		err := e.writeStreamed(att.Path, att.ContentHash, meta, func(w io.Writer) error {
+			return copyFile(w, src)
+		})
+		if err == nil {
+			return nil
+		}
+		slog.Debug("local copy of attachment changed, downloading it", "path", att.Path, "copy", src, "error", err)
+	}
+
+	return e.writeStreamed(att.Path, att.ContentHash, meta, func(w io.Writer) error {
+		if att.StorageKey != nil {
+			return e.copyExternal(ctx, *att.StorageKey, att.StorageCodec, w)
+		}
+		if err := e.db.ReadBlob(ctx, att.ContentHash, w); err != nil {
+			return fmt.Errorf("failed to get attachment content: %w", err)
+		}
+		return nil
+	})
+}
+
+// localCopy returns the path of a vault file last synced with the given
+// hash, or "" if there is none
+func (e *Engine) localCopy(hash string) string {
+	for _, relPath := range e.state.GetAllPaths() {
+		if st := e.state.GetFileState(relPath); st == nil || st.Hash != hash {
+			continue
+		}
+		absPath := filepath.Join(e.config.VaultPath, relPath)
+		if _, err := os.Stat(absPath); err == nil {
+			return absPath
+		}
+	}
+	return ""
+}
+
+// writeStreamed writes content produced by write to a vault file. The
+// content goes to a temporary file in the state directory and is checked
+// against its hash first, so a failed download never replaces the file.
+func (e *Engine) writeStreamed(relPath, hash string, meta fileMeta, write func(w io.Writer) error) error {
+	stateDir, err := config.GetStateDir()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(stateDir, "download-*")
+	if err != nil {
+		return fmt.Errorf("failed to create download file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Chmod(0644) // Like files written by writeVaultFile
+
+	h := sha256.New()
+	if err := write(io.MultiWriter(tmp, h)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write download file: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != hash {
+		return fmt.Errorf("downloaded content has hash %s, expected %s", got[:8], hash[:8])
+	}
+
+	absPath := filepath.Join(e.config.VaultPath, relPath)
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := moveFile(tmp.Name(), absPath); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	e.applyFileMeta(absPath, meta)
+	return e.recordFileState(relPath, hash)
+}
+
+// copyFile writes the content of a file to w
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// moveFile renames src to dst, copying it if they are on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+)
+
+func newContentTestEngine(t *testing.T) *Engine {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("APPDATA", t.TempDir())
+
+	return &Engine{
+		config: &config.Config{VaultPath: t.TempDir()},
+		state:  &StateTracker{state: &SyncState{Files: make(map[string]*FileState)}},
+		bases:  &BaseStore{dir: t.TempDir()},
+	}
+}
+
+func TestWriteStreamed(t *testing.T) {
+	e := newContentTestEngine(t)
+	content := []byte("attachment content")
+	hash := HashContent(content)
+
+	absPath := filepath.Join(e.config.VaultPath, "files", "a.png")
+	if err := writeVaultFile(absPath, []byte("previous")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Content with the wrong hash never replaces the file
+	err := e.writeStreamed("files/a.png", hash, fileMeta{}, func(w io.Writer) error {
+		_, err := w.Write([]byte("corrupted"))
+		return err
+	})
+	if err == nil {
+		t.Fatal("writeStreamed with the wrong content succeeded")
+	}
+	if got, _ := os.ReadFile(absPath); string(got) != "previous" {
+		t.Errorf("file = %q after a failed download, want it unchanged", got)
+	}
+	if e.state.GetFileState("files/a.png") != nil {
+		t.Error("failed download recorded a state")
+	}
+
+	err = e.writeStreamed("files/a.png", hash, fileMeta{}, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(absPath); string(got) != string(content) {
+		t.Errorf("file = %q, want %q", got, content)
+	}
+	if st := e.state.GetFileState("files/a.png"); st == nil || st.Hash != hash {
+		t.Errorf("state = %+v, want hash %s", st, hash[:8])
+	}
+}
+
+func TestWriteStreamedRestoresMetadata(t *testing.T) {
+	e := newContentTestEngine(t)
+	e.config.Sync.PreserveMode = true
+	content := []byte("script")
+	hash := HashContent(content)
+
+	modTime := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	mode := int32(0750)
+	err := e.writeStreamed("bin/run.sh", hash, fileMeta{modTime: &modTime, mode: &mode}, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(e.config.VaultPath, "bin", "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), modTime)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0750 {
+		t.Errorf("mode = %v, want 0750", info.Mode().Perm())
+	}
+
+	// The restored mtime is recorded, so the next scan doesn't rehash the file
+	st := e.state.GetFileState("bin/run.sh")
+	if st == nil || !st.Unchanged(info.ModTime(), info.Size(), time.Now()) {
+		t.Errorf("state = %+v, want it to match the restored file", st)
+	}
+}
+
+func TestLocalCopy(t *testing.T) {
+	e := newContentTestEngine(t)
+	content := []byte("image")
+	hash := HashContent(content)
+
+	if got := e.localCopy(hash); got != "" {
+		t.Errorf("localCopy with no tracked files = %q", got)
+	}
+
+	// Tracked but deleted since
+	e.state.SetFileState("gone.png", &FileState{Hash: hash})
+	if got := e.localCopy(hash); got != "" {
+		t.Errorf("localCopy of a deleted file = %q", got)
+	}
+
+	absPath := filepath.Join(e.config.VaultPath, "copy.png")
+	if err := writeVaultFile(absPath, content); err != nil {
+		t.Fatal(err)
+	}
+	e.state.SetFileState("copy.png", &FileState{Hash: hash})
+	if got := e.localCopy(hash); got != absPath {
+		t.Errorf("localCopy = %q, want %q", got, absPath)
+	}
+}
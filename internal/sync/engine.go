@@ -3,18 +3,20 @@ package sync
 import (
 	"context"
 	"fmt"
-	"io/fs"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
-	"github.com/schollz/progressbar/v3"
 
+	"github.com/vonshlovens/obsync-pg/internal/blobstore"
 	"github.com/vonshlovens/obsync-pg/internal/config"
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
 	"github.com/vonshlovens/obsync-pg/internal/db"
 	"github.com/vonshlovens/obsync-pg/internal/parser"
 	"github.com/vonshlovens/obsync-pg/internal/watcher"
@@ -22,43 +24,120 @@ import (
 
 // Engine handles file synchronization logic
 type Engine struct {
-	db              *db.DB
-	config          *config.Config
-	state           *StateTracker
-	parser          *parser.Parser
-	retryQueue      map[string]int // path -> retry count
-	maxBinarySize   int64
+	db            db.Store
+	config        *config.Config
+	state         *StateTracker
+	bases         *BaseStore
+	parser        *parser.Parser
+	retries       *RetryQueue
+	outbox        *Outbox
+	store         blobstore.Store // nil without an external blob store
+	cipher        *crypt.Cipher   // nil unless encryption is enabled
+	maxBinarySize int64
+	externalSize  int64 // Attachments larger than this go to the blob store
+
+	allowMassDelete bool
+	paranoid        bool
+	keyChecked      atomic.Bool // The vault's key matched since the last full sync
+	links           linkGraph
 }
 
 // NewEngine creates a new sync engine
-func NewEngine(database *db.DB, cfg *config.Config) (*Engine, error) {
-	state, err := NewStateTracker(cfg.VaultPath)
+func NewEngine(database db.Store, cfg *config.Config) (*Engine, error) {
+	state, err := NewStateTracker(cfg.VaultPath, cfg.StateFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create state tracker: %w", err)
 	}
 
+	bases, err := NewBaseStore(cfg.VaultPath, cfg.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create base store: %w", err)
+	}
+
+	retryDelay := time.Duration(cfg.Sync.RetryDelayMs) * time.Millisecond
+	retries, err := NewRetryQueue(cfg.VaultPath, cfg.StateFile, retryDelay, cfg.Sync.RetryAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load retry queue: %w", err)
+	}
+
+	outbox, err := NewOutbox(cfg.VaultPath, cfg.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %w", err)
+	}
+
+	store, err := blobstore.New(cfg.BlobStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob store: %w", err)
+	}
+
+	cipher, err := crypt.Load(cfg.Encryption, cfg.Database.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption key: %w", err)
+	}
+	database.SetCipher(cipher, cfg.Encryption.Plaintext)
+
+	externalSizeMB := cfg.BlobStore.MinSizeMB
+	if externalSizeMB <= 0 {
+		externalSizeMB = cfg.Sync.MaxBinarySizeMB
+	}
+
 	return &Engine{
 		db:            database,
 		config:        cfg,
 		state:         state,
+		bases:         bases,
 		parser:        parser.NewParser(),
-		retryQueue:    make(map[string]int),
+		retries:       retries,
+		outbox:        outbox,
+		store:         store,
+		cipher:        cipher,
 		maxBinarySize: int64(cfg.Sync.MaxBinarySizeMB) * 1024 * 1024,
+		externalSize:  int64(externalSizeMB) * 1024 * 1024,
 	}, nil
 }
 
+// SetAllowMassDelete lets FullReconcile delete files beyond the mass-delete limits
+func (e *Engine) SetAllowMassDelete(allow bool) {
+	e.allowMassDelete = allow
+}
+
+// SetParanoid makes the engine hash every file instead of trusting an
+// unchanged modification time and size
+func (e *Engine) SetParanoid(paranoid bool) {
+	e.paranoid = paranoid
+}
+
 // SyncFile syncs a single file based on event type
 func (e *Engine) SyncFile(ctx context.Context, relPath string, eventType watcher.EventType) error {
 	start := time.Now()
 
+	if err := e.checkKey(ctx); err != nil {
+		return err
+	}
+
+	var err error
 	switch eventType {
 	case watcher.EventDelete:
-		return e.RemoveFile(ctx, relPath)
+		// Untracked files were never uploaded, or were just removed by a remote delete
+		if e.state.GetFileState(relPath) == nil {
+			slog.Debug("untracked file deleted, skipping", "path", relPath)
+			return nil
+		}
+		err = e.syncPath(ctx, relPath)
 	case watcher.EventCreate, watcher.EventModify:
-		return e.upsertFile(ctx, relPath)
+		err = e.upsertFile(ctx, relPath)
 	default:
 		return nil
 	}
+	if err != nil {
+		op := RetryUpload
+		if eventType == watcher.EventDelete {
+			op = RetryDelete
+		}
+		e.queueRetry(relPath, op, err)
+		return err
+	}
+	e.retries.Done(relPath)
 
 	slog.Debug("sync completed", "path", relPath, "duration_ms", time.Since(start).Milliseconds())
 	return nil
@@ -98,34 +177,184 @@ func (e *Engine) upsertFile(ctx context.Context, relPath string) error {
 		return nil
 	}
 
-	// Determine file type and sync accordingly
-	if strings.HasSuffix(strings.ToLower(relPath), ".md") {
-		if err := e.syncNote(ctx, relPath, absPath, hash, info.Size()); err != nil {
-			return err
+	// Another device may have changed the file since our last sync
+	remote, err := e.remoteHash(ctx, relPath)
+	if err != nil {
+		return err
+	}
+
+	return e.apply(ctx, relPath, e.baseHash(relPath), hash, remote)
+}
+
+// syncPath compares a file's local and remote versions and syncs whichever side changed
+func (e *Engine) syncPath(ctx context.Context, relPath string) error {
+	local, err := e.localHash(relPath)
+	if err != nil {
+		return err
+	}
+
+	remote, err := e.remoteHash(ctx, relPath)
+	if err != nil {
+		return err
+	}
+
+	return e.apply(ctx, relPath, e.baseHash(relPath), local, remote)
+}
+
+// apply carries out the three-way decision for a path
+func (e *Engine) apply(ctx context.Context, relPath, base, local, remote string) error {
+	switch decideAction(base, local, remote) {
+	case actionUpload:
+		return e.uploadFile(ctx, relPath, local)
+	case actionDownload:
+		_, err := e.downloadFile(ctx, relPath)
+		return err
+	case actionDeleteRemote:
+		return e.RemoveFile(ctx, relPath)
+	case actionDeleteLocal:
+		return e.deleteLocalFile(relPath)
+	case actionConflict:
+		return e.resolveConflict(ctx, relPath, base, local, remote)
+	default:
+		// Both sides agree; make sure the state does too
+		if local == "" {
+			e.state.RemoveFileState(relPath)
+			return nil
+		}
+		if base != local {
+			return e.recordFileState(relPath, local)
+		}
+		return nil
+	}
+}
+
+// upload is a vault file read and ready to be written to the database
+type upload struct {
+	relPath    string
+	hash       string // Of the content that was read
+	info       os.FileInfo
+	readAt     time.Time
+	note       *db.VaultNote       // Set for notes
+	attachment *db.VaultAttachment // Set for attachments within the size limit
+	newTarget  bool                // Not yet in the link index
+}
+
+// uploadFile pushes a local file to the database and records its state
+func (e *Engine) uploadFile(ctx context.Context, relPath, hash string) error {
+	if err := e.recheckKey(ctx); err != nil {
+		return err
+	}
+
+	up, err := e.readUpload(relPath, hash)
+	if err != nil {
+		return err
+	}
+	if err := e.storeContent(ctx, up); err != nil {
+		return err
+	}
+	e.resolveLinks(ctx, up)
+
+	switch {
+	case up.note != nil:
+		err = e.db.UpsertNote(ctx, up.note)
+	case up.attachment != nil:
+		err = e.db.UpsertAttachment(ctx, up.attachment)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.finishUpload(up)
+
+	// Links to a file that is new resolve once it is in the database
+	e.addLinkTargets(ctx, up)
+	e.relink(ctx)
+	return nil
+}
+
+// readUpload reads a vault file and builds the row to upload. The hash is
+// that of the content actually read, in case the file changed since it was
+// hashed.
+func (e *Engine) readUpload(relPath, hash string) (*upload, error) {
+	absPath := filepath.Join(e.config.VaultPath, relPath)
+
+	readAt := time.Now()
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	up := &upload{relPath: relPath, hash: hash, info: info, readAt: readAt}
+
+	// Determine file type and read accordingly
+	if isNotePath(relPath) {
+		up.note, err = e.readNote(relPath, absPath, info.Size())
+		if up.note != nil {
+			up.hash = up.note.ContentHash
 		}
 	} else {
-		if err := e.syncAttachment(ctx, relPath, absPath, hash, info.Size()); err != nil {
-			return err
+		up.attachment, err = e.readAttachment(relPath, absPath, info.Size())
+		if up.attachment != nil {
+			up.hash = up.attachment.ContentHash
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Restored when the file is downloaded on another device
+	if up.note != nil {
+		modified := info.ModTime()
+		up.note.FileModTime = &modified
+		up.note.FileMode = e.fileMode(info)
+	}
+	if up.attachment != nil {
+		modified := info.ModTime()
+		up.attachment.ModifiedAt = &modified
+		up.attachment.FileMode = e.fileMode(info)
+	}
+
+	// A file still being written would be recorded with the wrong metadata
+	after, err := os.Stat(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size() {
+		return nil, fmt.Errorf("file changed while being read")
+	}
+
+	if up.hash != hash {
+		slog.Debug("file changed since it was hashed", "path", relPath)
+	}
+	return up, nil
+}
+
+// finishUpload records the state of a file once it has been uploaded
+func (e *Engine) finishUpload(up *upload) {
+	// Keep the synced content as the base for future merges
+	if up.note != nil {
+		content := []byte(up.note.RawContent)
+		if err := e.bases.Put(HashContent(content), content); err != nil {
+			slog.Warn("failed to store base version", "path", up.relPath, "error", err)
 		}
 	}
 
 	// Update state
-	e.state.SetFileState(relPath, &FileState{
-		Hash:         hash,
-		LastSynced:   time.Now(),
-		LastModified: info.ModTime(),
-		SizeBytes:    info.Size(),
+	e.state.SetFileState(up.relPath, &FileState{
+		Hash:         up.hash,
+		LastSynced:   up.readAt,
+		LastModified: up.info.ModTime(),
+		SizeBytes:    up.info.Size(),
 	})
 
-	slog.Info("file synced", "path", relPath, "hash", hash[:8])
-	return nil
+	slog.Info("file synced", "path", up.relPath, "hash", up.hash[:8])
 }
 
-// syncNote parses and syncs a markdown note
-func (e *Engine) syncNote(ctx context.Context, relPath, absPath, hash string, size int64) error {
+// readNote parses a markdown note into its database row
+func (e *Engine) readNote(relPath, absPath string, size int64) (*db.VaultNote, error) {
 	parsed, err := e.parser.ParseFile(absPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse note: %w", err)
+		return nil, fmt.Errorf("failed to parse note: %w", err)
 	}
 
 	// Get file timestamps
@@ -142,8 +371,9 @@ func (e *Engine) syncNote(ctx context.Context, relPath, absPath, hash string, si
 	// Merge tags
 	allTags := parser.MergeTags(parsed.Frontmatter.Tags, parsed.InlineTags)
 
-	// Build note struct
-	note := &db.VaultNote{
+	links, external := noteLinks(parsed.Links)
+
+	return &db.VaultNote{
 		Path:          relPath,
 		Filename:      filepath.Base(relPath),
 		Title:         parsed.Frontmatter.Title,
@@ -155,33 +385,44 @@ func (e *Engine) syncNote(ctx context.Context, relPath, absPath, hash string, si
 		Frontmatter:   parsed.Frontmatter.Extra,
 		Body:          parsed.Body,
 		RawContent:    parsed.RawContent,
-		ContentHash:   hash,
+		ContentHash:   HashString(parsed.RawContent),
 		FileSizeBytes: size,
+		SyncedBy:      &e.config.DeviceName,
 		OutgoingLinks: parsed.OutgoingLinks,
-	}
-
-	return e.db.UpsertNote(ctx, note)
+		Links:         links,
+		ExternalLinks: external,
+	}, nil
 }
 
-// syncAttachment syncs a binary/attachment file
-func (e *Engine) syncAttachment(ctx context.Context, relPath, absPath, hash string, size int64) error {
+// readAttachment builds the database row of an attachment. Its content is
+// not read into memory but streamed by storeContent. It returns nil if the
+// file is too large to sync.
+func (e *Engine) readAttachment(relPath, absPath string, size int64) (*db.VaultAttachment, error) {
+	external := e.external(relPath, size)
+
 	// Skip if too large
-	if size > e.maxBinarySize {
-		slog.Warn("attachment too large, skipping",
+	if !external && size > e.maxBinarySize {
+		slog.Warn("attachment too large, skipping; configure blob_store to sync it",
 			"path", relPath,
 			"size_mb", size/(1024*1024),
 			"max_mb", e.config.Sync.MaxBinarySizeMB)
-		return nil
+		return nil, nil
 	}
 
-	// Read file content
-	data, err := os.ReadFile(absPath)
+	hash, err := HashFile(absPath)
 	if err != nil {
-		return fmt.Errorf("failed to read attachment: %w", err)
+		return nil, fmt.Errorf("failed to hash attachment: %w", err)
 	}
 
 	// Detect mime type
-	mimeType := http.DetectContentType(data)
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	mimeType := http.DetectContentType(head[:n])
 	ext := filepath.Ext(relPath)
 
 	att := &db.VaultAttachment{
@@ -191,25 +432,34 @@ func (e *Engine) syncAttachment(ctx context.Context, relPath, absPath, hash stri
 		MimeType:      &mimeType,
 		FileSizeBytes: size,
 		ContentHash:   hash,
-		Data:          data,
+		SyncedBy:      &e.config.DeviceName,
 	}
-
-	return e.db.UpsertAttachment(ctx, att)
+	if external {
+		key := e.storageKey(hash)
+		att.StorageKey = &key
+	}
+	return att, nil
 }
 
-// RemoveFile removes a file from the database
+// RemoveFile moves a file to the trash in the database
 func (e *Engine) RemoveFile(ctx context.Context, relPath string) error {
-	if strings.HasSuffix(strings.ToLower(relPath), ".md") {
-		if err := e.db.DeleteNote(ctx, relPath); err != nil {
+	if isNotePath(relPath) {
+		if err := e.db.DeleteNote(ctx, relPath, e.config.DeviceName); err != nil {
 			return err
 		}
 	} else {
-		if err := e.db.DeleteAttachment(ctx, relPath); err != nil {
+		if err := e.db.DeleteAttachment(ctx, relPath, e.config.DeviceName); err != nil {
 			return err
 		}
 	}
 
+	// Deleting a conflict copy resolves its conflict
+	if err := e.db.ResolveConflicts(ctx, []string{relPath}); err != nil {
+		slog.Warn("failed to resolve conflicts", "path", relPath, "error", err)
+	}
+
 	e.state.RemoveFileState(relPath)
+	e.linksChanged()
 	slog.Info("file removed", "path", relPath)
 	return nil
 }
@@ -219,270 +469,260 @@ func (e *Engine) FullReconcile(ctx context.Context) error {
 	slog.Info("starting full reconciliation")
 	start := time.Now()
 
-	// Collect all local files
-	var localFiles []string
-	localHashes := make(map[string]string)
-
-	err := filepath.WalkDir(e.config.VaultPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return nil // Skip errors
-		}
-
-		relPath, _ := filepath.Rel(e.config.VaultPath, path)
-		relPath = filepath.ToSlash(relPath)
-
-		if e.shouldIgnore(relPath) {
-			if d.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		if d.IsDir() {
-			return nil
-		}
-
-		localFiles = append(localFiles, relPath)
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to walk vault: %w", err)
+	// The key may have been rotated since the last check
+	e.keyChecked.Store(false)
+	if err := e.checkKey(ctx); err != nil {
+		return err
 	}
 
-	// Get DB hashes
-	dbNoteHashes, err := e.db.GetAllNoteHashes(ctx)
+	plan, err := e.PlanSync(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get note hashes: %w", err)
+		return err
 	}
 
-	dbAttachHashes, err := e.db.GetAllAttachmentHashes(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get attachment hashes: %w", err)
+	if plan.Blocked != nil {
+		slog.Error("REFUSING TO DELETE FILES: too many files are missing from the vault",
+			"count", plan.Blocked.Count,
+			"tracked", plan.Blocked.Tracked,
+			"vault", e.config.VaultPath)
 	}
+	e.state.SetBlockedDeletes(plan.Blocked)
 
-	// Merge DB hashes
-	dbHashes := make(map[string]string)
-	for k, v := range dbNoteHashes {
-		dbHashes[k] = v
-	}
-	for k, v := range dbAttachHashes {
-		dbHashes[k] = v
-	}
-
-	// Compute local hashes and find files to sync
-	var toSync []string
-
-	bar := progressbar.NewOptions(len(localFiles),
-		progressbar.OptionSetDescription("Scanning files"),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetWidth(40),
-		progressbar.OptionClearOnFinish(),
-	)
+	// Links are resolved again on every full sync, to pick up changes
+	// made while no device was running
+	e.linksChanged()
 
-	for _, relPath := range localFiles {
-		bar.Add(1)
-
-		absPath := filepath.Join(e.config.VaultPath, relPath)
-		hash, err := HashFile(absPath)
-		if err != nil {
-			slog.Warn("failed to hash file", "path", relPath, "error", err)
-			continue
-		}
-		localHashes[relPath] = hash
-
-		// Check if file needs sync
-		if dbHash, exists := dbHashes[relPath]; !exists || dbHash != hash {
-			toSync = append(toSync, relPath)
-		}
+	if err := e.ExecutePlan(ctx, plan); err != nil {
+		return err
 	}
-	bar.Finish()
 
-	// Find files to delete from DB (exist in DB but not locally)
-	var toDelete []string
-	for dbPath := range dbHashes {
-		if _, exists := localHashes[dbPath]; !exists {
-			toDelete = append(toDelete, dbPath)
-		}
-	}
+	// Everything that didn't fail again was handled by this sync
+	e.retries.DoneBefore(start)
 
-	// Sync changed/new files
-	if len(toSync) > 0 {
-		bar = progressbar.NewOptions(len(toSync),
-			progressbar.OptionSetDescription("Syncing files"),
-			progressbar.OptionShowCount(),
-			progressbar.OptionSetWidth(40),
-		)
-
-		for _, relPath := range toSync {
-			if err := e.upsertFile(ctx, relPath); err != nil {
-				slog.Error("failed to sync file", "path", relPath, "error", err)
-				// Add to retry queue
-				e.retryQueue[relPath] = 0
-			}
-			bar.Add(1)
-		}
-		bar.Finish()
-	}
-
-	// Delete removed files
-	if len(toDelete) > 0 {
-		var notesToDelete, attachmentsToDelete []string
-		for _, path := range toDelete {
-			if strings.HasSuffix(strings.ToLower(path), ".md") {
-				notesToDelete = append(notesToDelete, path)
-			} else {
-				attachmentsToDelete = append(attachmentsToDelete, path)
-			}
-		}
-
-		if len(notesToDelete) > 0 {
-			if err := e.db.BatchDeleteNotes(ctx, notesToDelete); err != nil {
-				slog.Error("failed to batch delete notes", "error", err)
-			}
-		}
-		if len(attachmentsToDelete) > 0 {
-			if err := e.db.BatchDeleteAttachments(ctx, attachmentsToDelete); err != nil {
-				slog.Error("failed to batch delete attachments", "error", err)
-			}
-		}
-
-		for _, path := range toDelete {
-			e.state.RemoveFileState(path)
-		}
-
-		slog.Info("deleted removed files", "count", len(toDelete))
-	}
+	e.pruneBases()
+	e.PruneRevisions(ctx)
+	e.PruneBlobs(ctx)
 
 	// Update state
 	e.state.SetLastFullSync(time.Now())
-	if err := e.state.Save(); err != nil {
+	if err := e.SaveState(); err != nil {
 		slog.Warn("failed to save state", "error", err)
 	}
 
+	deleted := plan.Count(OpDelete)
+	if plan.Blocked != nil {
+		deleted = 0
+	}
 	slog.Info("full reconciliation completed",
-		"synced", len(toSync),
-		"deleted", len(toDelete),
+		"synced", plan.Count(OpCreate)+plan.Count(OpUpdate),
+		"moved", plan.Count(OpMove),
+		"downloaded", plan.Count(OpDownload),
+		"conflicts", plan.Count(OpConflict),
+		"deleted", deleted,
+		"removed_local", plan.Count(OpRemoveLocal),
 		"duration_s", time.Since(start).Seconds())
 
+	if plan.Blocked != nil {
+		return fmt.Errorf("%w: %d of %d files are missing from %s; check that the vault is available, then run 'obsync-pg sync --allow-mass-delete' to delete them",
+			ErrMassDelete, plan.Blocked.Count, plan.Blocked.Tracked, e.config.VaultPath)
+	}
 	return nil
 }
 
-// PullFromDB downloads files from database to local vault (for new device setup)
-func (e *Engine) PullFromDB(ctx context.Context) error {
+// PullFromDB downloads files from database to local vault (for new device setup).
+// opts limits the pull to some of the files and decides what happens to
+// local files changed since the last sync; by default they are kept.
+func (e *Engine) PullFromDB(ctx context.Context, opts PullOptions) error {
 	slog.Info("pulling files from database to local vault")
 	start := time.Now()
 
-	// Get all notes
-	notes, err := e.db.GetAllNotes(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get notes: %w", err)
+	if err := e.checkKey(ctx); err != nil {
+		return err
 	}
 
-	// Get all attachments
-	attachments, err := e.db.GetAllAttachments(ctx)
+	plan, err := e.PlanPull(ctx, opts)
 	if err != nil {
-		return fmt.Errorf("failed to get attachments: %w", err)
+		return err
 	}
 
-	totalFiles := len(notes) + len(attachments)
-	if totalFiles == 0 {
-		slog.Info("no files in database to pull")
+	if len(plan.Entries) == 0 && len(plan.record) == 0 {
+		slog.Info("no files to pull")
 		return nil
 	}
 
-	bar := progressbar.NewOptions(totalFiles,
-		progressbar.OptionSetDescription("Pulling files"),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetWidth(40),
-	)
+	if err := e.ExecutePlan(ctx, plan); err != nil {
+		return err
+	}
 
-	// Write notes
-	for _, note := range notes {
-		absPath := filepath.Join(e.config.VaultPath, note.Path)
+	if err := e.SaveState(); err != nil {
+		slog.Warn("failed to save state", "error", err)
+	}
 
-		// Check if file already exists with same hash
-		if existingHash, err := HashFile(absPath); err == nil && existingHash == note.ContentHash {
-			bar.Add(1)
-			continue
-		}
+	slog.Info("pull completed",
+		"downloaded", plan.Count(OpDownload)+plan.Count(OpBackup),
+		"backed_up", plan.Count(OpBackup),
+		"conflicts", plan.Count(OpConflict),
+		"kept_local", plan.Count(OpKeepLocal),
+		"duration_s", time.Since(start).Seconds())
 
-		// Create directory if needed
-		dir := filepath.Dir(absPath)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			slog.Error("failed to create directory", "dir", dir, "error", err)
-			bar.Add(1)
-			continue
-		}
+	return nil
+}
 
-		// Write file
-		if err := os.WriteFile(absPath, []byte(note.RawContent), 0644); err != nil {
-			slog.Error("failed to write note", "path", note.Path, "error", err)
-		} else {
-			slog.Info("pulled note", "path", note.Path)
-		}
-		bar.Add(1)
+// RetryFailed retries the failed operations that are due. Each path is
+// compared again on both sides, so a retry does whatever is needed now.
+func (e *Engine) RetryFailed(ctx context.Context) {
+	defer e.relink(ctx)
+
+	if err := e.checkKey(ctx); err != nil {
+		slog.Warn("not retrying failed operations", "error", err)
+		return
 	}
 
-	// Write attachments
-	for _, att := range attachments {
-		absPath := filepath.Join(e.config.VaultPath, att.Path)
+	for _, entry := range e.retries.Due(time.Now()) {
+		if ctx.Err() != nil {
+			return
+		}
 
-		// Check if file already exists with same hash
-		if existingHash, err := HashFile(absPath); err == nil && existingHash == att.ContentHash {
-			bar.Add(1)
+		if e.shouldIgnore(entry.Path) {
+			e.retries.Done(entry.Path)
 			continue
 		}
 
-		// Create directory if needed
-		dir := filepath.Dir(absPath)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			slog.Error("failed to create directory", "dir", dir, "error", err)
-			bar.Add(1)
+		if err := e.syncPath(ctx, entry.Path); err != nil {
+			slog.Warn("retry failed", "path", entry.Path, "op", entry.Op, "attempt", entry.Attempts, "error", err)
+			e.queueRetry(entry.Path, entry.Op, err)
 			continue
 		}
 
-		// Write file
-		if err := os.WriteFile(absPath, att.Data, 0644); err != nil {
-			slog.Error("failed to write attachment", "path", att.Path, "error", err)
-		} else {
-			slog.Info("pulled attachment", "path", att.Path)
-		}
-		bar.Add(1)
+		e.retries.Done(entry.Path)
+		slog.Info("retry succeeded", "path", entry.Path, "op", entry.Op)
 	}
+}
 
-	bar.Finish()
+// queueRetry records a failed operation so it is retried later
+func (e *Engine) queueRetry(relPath string, op RetryOp, cause error) {
+	if e.retries.Fail(relPath, op, cause, time.Now()) {
+		slog.Error("giving up on file after repeated failures",
+			"path", relPath,
+			"op", op,
+			"error", cause)
+	}
+}
 
-	slog.Info("pull completed",
-		"notes", len(notes),
-		"attachments", len(attachments),
-		"duration_s", time.Since(start).Seconds())
+// RetryQueue returns the failed operations waiting to be retried
+func (e *Engine) RetryQueue() *RetryQueue {
+	return e.retries
+}
 
-	return nil
+// getAllHashes returns a map of path -> content_hash for all notes and attachments
+func (e *Engine) getAllHashes(ctx context.Context) (map[string]string, error) {
+	dbNoteHashes, err := e.db.GetAllNoteHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get note hashes: %w", err)
+	}
+
+	dbAttachHashes, err := e.db.GetAllAttachmentHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment hashes: %w", err)
+	}
+
+	// Merge DB hashes
+	dbHashes := make(map[string]string, len(dbNoteHashes)+len(dbAttachHashes))
+	for k, v := range dbNoteHashes {
+		dbHashes[k] = v
+	}
+	for k, v := range dbAttachHashes {
+		dbHashes[k] = v
+	}
+
+	return dbHashes, nil
 }
 
-// RetryFailed retries failed sync operations
-func (e *Engine) RetryFailed(ctx context.Context) {
-	maxRetries := e.config.Sync.RetryAttempts
+// remoteHash returns the content hash of a file in the database, or "" if it doesn't exist
+func (e *Engine) remoteHash(ctx context.Context, relPath string) (string, error) {
+	var hash string
+	var err error
+	if isNotePath(relPath) {
+		hash, err = e.db.GetNoteHash(ctx, relPath)
+	} else {
+		hash, err = e.db.GetAttachmentHash(ctx, relPath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get remote hash: %w", err)
+	}
+	return hash, nil
+}
 
-	for path, count := range e.retryQueue {
-		if count >= maxRetries {
-			slog.Error("max retries exceeded", "path", path)
-			delete(e.retryQueue, path)
-			continue
+// localHash returns the content hash of a vault file, or "" if it doesn't exist
+func (e *Engine) localHash(relPath string) (string, error) {
+	absPath := filepath.Join(e.config.VaultPath, relPath)
+
+	info, err := os.Stat(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
 		}
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	if hash, ok := e.cachedHash(relPath, info.ModTime(), info.Size()); ok {
+		return hash, nil
+	}
 
-		e.retryQueue[path] = count + 1
-		if err := e.upsertFile(ctx, path); err != nil {
-			slog.Warn("retry failed", "path", path, "attempt", count+1, "error", err)
-		} else {
-			delete(e.retryQueue, path)
-			slog.Info("retry succeeded", "path", path)
+	hash, err := HashFile(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
 		}
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hash, nil
+}
+
+// cachedHash returns the hash recorded at the last sync if the file's mtime
+// and size show it hasn't changed since, so it needn't be read again
+func (e *Engine) cachedHash(relPath string, modTime time.Time, size int64) (string, bool) {
+	if e.paranoid {
+		return "", false
+	}
+	st := e.state.GetFileState(relPath)
+	if !st.Unchanged(modTime, size, time.Now()) {
+		return "", false
 	}
+	return st.Hash, true
 }
 
-// SaveState persists the current state to disk
+// baseHash returns the hash recorded at the last sync, or "" if the file was never synced
+func (e *Engine) baseHash(relPath string) string {
+	if st := e.state.GetFileState(relPath); st != nil {
+		return st.Hash
+	}
+	return ""
+}
+
+// pruneBases drops stored base versions no longer referenced by the state
+func (e *Engine) pruneBases() {
+	keep := make(map[string]bool)
+	for _, relPath := range e.state.GetAllPaths() {
+		if st := e.state.GetFileState(relPath); st != nil {
+			keep[st.Hash] = true
+		}
+	}
+
+	removed, err := e.bases.Prune(keep)
+	if err != nil {
+		slog.Warn("failed to prune base versions", "error", err)
+		return
+	}
+	if removed > 0 {
+		slog.Debug("pruned base versions", "count", removed)
+	}
+}
+
+// SaveState persists the current state and retry queue to disk
 func (e *Engine) SaveState() error {
+	if err := e.retries.Save(); err != nil {
+		return err
+	}
 	return e.state.Save()
 }
 
@@ -515,7 +755,12 @@ func (e *Engine) shouldIgnore(relPath string) bool {
 	return false
 }
 
+// isNotePath reports whether a path is a markdown note
+func isNotePath(relPath string) bool {
+	return strings.HasSuffix(strings.ToLower(relPath), ".md")
+}
+
 // GetPendingRetries returns count of files pending retry
 func (e *Engine) GetPendingRetries() int {
-	return len(e.retryQueue)
+	return e.retries.Len()
 }
@@ -0,0 +1,705 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/config"
+	"github.com/vonshlovens/obsync-pg/internal/db"
+	"github.com/vonshlovens/obsync-pg/internal/watcher"
+)
+
+// newTestStore opens a SQLite store in a temporary directory
+func newTestStore(t *testing.T) *db.SQLite {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("APPDATA", t.TempDir())
+
+	store, err := db.OpenSQLite(context.Background(), &config.DatabaseConfig{
+		Driver: config.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "vault.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+// newTestDevice returns an engine syncing a new, empty vault with store
+func newTestDevice(t *testing.T, store db.Store, name string) *Engine {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.VaultPath = t.TempDir()
+	cfg.DeviceName = name
+	cfg.Sync.AutoMerge = false
+
+	e, err := NewEngine(store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func writeTestFile(t *testing.T, e *Engine, relPath, content string) {
+	t.Helper()
+	if err := writeVaultFile(filepath.Join(e.config.VaultPath, relPath), []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, e *Engine, relPath string) (string, bool) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(e.config.VaultPath, relPath))
+	if os.IsNotExist(err) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), true
+}
+
+func TestReconcileAndPull(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "Notes/a.md", "---\ntags: [x]\n---\n# A\nSee [[b]]\n")
+	writeTestFile(t, laptop, "b.md", "# B\n")
+	writeTestFile(t, laptop, "img/photo.png", strings.Repeat("\x89PNG", 1000))
+
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	note, err := store.GetNoteByPath(ctx, "Notes/a.md")
+	if err != nil || note == nil {
+		t.Fatalf("GetNoteByPath = %v, %v", note, err)
+	}
+	if len(note.Tags) != 1 || note.Tags[0] != "x" || note.SyncedBy == nil || *note.SyncedBy != "laptop" {
+		t.Errorf("stored note = tags %v, synced by %v", note.Tags, note.SyncedBy)
+	}
+
+	desktop := newTestDevice(t, store, "desktop")
+	if err := desktop.PullFromDB(ctx, PullOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, relPath := range []string{"Notes/a.md", "b.md", "img/photo.png"} {
+		want, _ := readTestFile(t, laptop, relPath)
+		if got, ok := readTestFile(t, desktop, relPath); got != want {
+			t.Errorf("%s on the second device = %q (exists %v), want %q", relPath, got, ok, want)
+		}
+	}
+
+	// Nothing is left to do on either device
+	for _, e := range []*Engine{laptop, desktop} {
+		plan, err := e.PlanSync(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Entries) != 0 {
+			t.Errorf("%s: plan after sync = %+v, want it empty", e.config.DeviceName, plan.Entries)
+		}
+	}
+}
+
+func TestReconcileEdit(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "first")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	desktop := newTestDevice(t, store, "desktop")
+	if err := desktop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, laptop, "a.md", "second")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := desktop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readTestFile(t, desktop, "a.md"); got != "second" {
+		t.Errorf("a.md on the second device = %q, want the edit", got)
+	}
+
+	// The replaced version is kept in the history
+	revisions, err := store.GetNoteRevisions(ctx, "a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].RawContent != "first" {
+		t.Errorf("revisions = %+v, want the first version", revisions)
+	}
+}
+
+func TestReconcileDelete(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "a")
+	writeTestFile(t, laptop, "b.md", "b")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	desktop := newTestDevice(t, store, "desktop")
+	if err := desktop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(laptop.config.VaultPath, "a.md")); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := store.GetTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Path != "a.md" || *trash[0].DeletedBy != "laptop" {
+		t.Fatalf("trash = %+v, want a.md deleted by laptop", trash)
+	}
+
+	if err := desktop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readTestFile(t, desktop, "a.md"); ok {
+		t.Error("a.md still exists on the second device")
+	}
+	if _, ok := readTestFile(t, desktop, "b.md"); !ok {
+		t.Error("b.md was removed from the second device")
+	}
+
+	// A restore brings it back everywhere
+	if err := desktop.RestoreFromTrash(ctx, []string{"a.md"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readTestFile(t, desktop, "a.md"); got != "a" {
+		t.Errorf("restored a.md = %q", got)
+	}
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readTestFile(t, laptop, "a.md"); got != "a" {
+		t.Errorf("a.md on the first device after the restore = %q", got)
+	}
+}
+
+func TestReconcileRestoreAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "a")
+	writeTestFile(t, laptop, "b.md", "b")
+	writeTestFile(t, laptop, "c.md", "c")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(laptop.config.VaultPath, "a.md")); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing the same content back restores the file rather than matching
+	// its tombstone
+	writeTestFile(t, laptop, "a.md", "a")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := readTestFile(t, laptop, "a.md"); !ok || got != "a" {
+		t.Fatalf("a.md after the restore = %q, %v", got, ok)
+	}
+	note, err := store.GetNoteByPath(ctx, "a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note == nil {
+		t.Fatal("a.md was not uploaded again")
+	}
+	trash, err := store.GetTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 0 {
+		t.Errorf("trash = %+v, want empty", trash)
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "a")
+	writeTestFile(t, laptop, "b.md", "b")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a, err := store.GetNoteByPath(ctx, "a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.GetNoteByPath(ctx, "b.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rename := func(oldPath, newPath, content string) *db.VaultNote {
+		t.Helper()
+		if err := os.Remove(filepath.Join(laptop.config.VaultPath, oldPath)); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, laptop, newPath, content)
+		if err := laptop.RenameFile(ctx, oldPath, newPath); err != nil {
+			t.Fatal(err)
+		}
+		if old, err := store.GetNoteByPath(ctx, oldPath); err != nil || old != nil {
+			t.Fatalf("%s after the rename = %+v, %v", oldPath, old, err)
+		}
+		note, err := store.GetNoteByPath(ctx, newPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if note == nil {
+			t.Fatalf("%s was not synced", newPath)
+		}
+		return note
+	}
+
+	// The same content keeps the row
+	if got := rename("a.md", "c.md", "a"); got.ID != a.ID {
+		t.Errorf("c.md id = %s, want %s", got.ID, a.ID)
+	}
+
+	// Other content is a new file, and the old one goes to the trash
+	if got := rename("b.md", "d.md", "d"); got.ID == b.ID {
+		t.Error("d.md took over the id of b.md")
+	}
+	trash, err := store.GetTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Path != "b.md" {
+		t.Errorf("trash = %+v, want b.md", trash)
+	}
+}
+
+func TestReconcileMassDelete(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	e := newTestDevice(t, store, "laptop")
+	e.config.Sync.MassDeleteCount = 2
+	for _, name := range []string{"a.md", "b.md", "c.md", "d.md"} {
+		writeTestFile(t, e, name, name)
+	}
+	if err := e.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.md", "b.md", "c.md"} {
+		os.Remove(filepath.Join(e.config.VaultPath, name))
+	}
+	if err := e.FullReconcile(ctx); !errors.Is(err, ErrMassDelete) {
+		t.Fatalf("FullReconcile = %v, want ErrMassDelete", err)
+	}
+	hashes, err := store.GetAllNoteHashes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 4 {
+		t.Errorf("%d notes in the store after a blocked sync, want 4", len(hashes))
+	}
+
+	e.SetAllowMassDelete(true)
+	if err := e.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, _ = store.GetAllNoteHashes(ctx); len(hashes) != 1 {
+		t.Errorf("%d notes in the store, want 1", len(hashes))
+	}
+}
+
+func TestReconcileConflict(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "base")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	desktop := newTestDevice(t, store, "desktop")
+	if err := desktop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, laptop, "a.md", "laptop edit")
+	writeTestFile(t, desktop, "a.md", "desktop edit")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := desktop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := readTestFile(t, desktop, "a.md"); got != "laptop edit" {
+		t.Errorf("a.md = %q, want the version synced first", got)
+	}
+	conflicts, err := store.GetUnresolvedConflicts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("conflicts = %+v, want one", conflicts)
+	}
+	if got, _ := readTestFile(t, desktop, conflicts[0].ConflictPath); got != "desktop edit" {
+		t.Errorf("conflict copy %s = %q, want the local edit", conflicts[0].ConflictPath, got)
+	}
+}
+
+func TestPullKeepsLocalChanges(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "synced")
+	writeTestFile(t, laptop, "b.md", "synced")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	desktop := newTestDevice(t, store, "desktop")
+	if err := desktop.PullFromDB(ctx, PullOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, laptop, "b.md", "remote edit")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, desktop, "a.md", "local edit")
+
+	if err := desktop.PullFromDB(ctx, PullOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readTestFile(t, desktop, "a.md"); got != "local edit" {
+		t.Errorf("a.md = %q, want the local edit kept", got)
+	}
+	if got, _ := readTestFile(t, desktop, "b.md"); got != "remote edit" {
+		t.Errorf("b.md = %q, want the remote edit", got)
+	}
+
+	if err := desktop.PullFromDB(ctx, PullOptions{Overwrite: OverwriteForce}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readTestFile(t, desktop, "a.md"); got != "synced" {
+		t.Errorf("a.md = %q after a forced pull, want the database version", got)
+	}
+}
+
+func TestPullRestoresNoteModTime(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "---\nmodified: 2020-01-02\n---\n# A\n")
+	modTime := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(laptop.config.VaultPath, "a.md"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file keeps its own time, not the date in its frontmatter
+	desktop := newTestDevice(t, store, "desktop")
+	if err := desktop.PullFromDB(ctx, PullOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(desktop.config.VaultPath, "a.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), modTime)
+	}
+}
+
+func TestApplyRemoteChange(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Store: newTestStore(t)}
+
+	laptop := newTestDevice(t, store, "laptop")
+	desktop := newTestDevice(t, store, "desktop")
+	change := func(op, path, oldPath, content string) db.Change {
+		c := db.Change{Table: "vault_notes", Op: op, Path: path, OldPath: oldPath}
+		if content != "" {
+			c.ContentHash = HashString(content)
+		}
+		return c
+	}
+	apply := func(e *Engine, c db.Change) {
+		t.Helper()
+		if err := e.ApplyRemoteChange(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Insert
+	writeTestFile(t, laptop, "a.md", "# A\n")
+	if err := laptop.SyncFile(ctx, "a.md", watcher.EventCreate); err != nil {
+		t.Fatal(err)
+	}
+	apply(desktop, change(db.ChangeInsert, "a.md", "", "# A\n"))
+	if got, _ := readTestFile(t, desktop, "a.md"); got != "# A\n" {
+		t.Fatalf("a.md after the insert = %q", got)
+	}
+
+	// The device's own changes come back to it, and are left alone, even
+	// with a local edit that the watcher hasn't reported yet
+	writeTestFile(t, laptop, "a.md", "# A\nmore\n")
+	reads := store.noteReads
+	apply(laptop, change(db.ChangeInsert, "a.md", "", "# A\n"))
+	if store.noteReads != reads {
+		t.Error("own insert was downloaded again")
+	}
+	note, err := store.GetNoteByPath(ctx, "a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.RawContent != "# A\n" {
+		t.Errorf("own insert synced a.md again: %q", note.RawContent)
+	}
+
+	// Update
+	if err := laptop.SyncFile(ctx, "a.md", watcher.EventModify); err != nil {
+		t.Fatal(err)
+	}
+	apply(desktop, change(db.ChangeUpdate, "a.md", "", "# A\nmore\n"))
+	if got, _ := readTestFile(t, desktop, "a.md"); got != "# A\nmore\n" {
+		t.Fatalf("a.md after the update = %q", got)
+	}
+
+	// Rename
+	if err := os.Rename(
+		filepath.Join(laptop.config.VaultPath, "a.md"), filepath.Join(laptop.config.VaultPath, "b.md"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.RenameFile(ctx, "a.md", "b.md"); err != nil {
+		t.Fatal(err)
+	}
+	rename := change(db.ChangeRename, "b.md", "a.md", "# A\nmore\n")
+	apply(desktop, rename)
+	if _, ok := readTestFile(t, desktop, "a.md"); ok {
+		t.Error("a.md still exists after the rename")
+	}
+	if got, _ := readTestFile(t, desktop, "b.md"); got != "# A\nmore\n" {
+		t.Fatalf("b.md after the rename = %q", got)
+	}
+	if desktop.state.GetFileState("a.md") != nil || desktop.state.GetFileState("b.md") == nil {
+		t.Error("sync state was not moved with the file")
+	}
+
+	reads = store.noteReads
+	apply(laptop, rename)
+	if got, _ := readTestFile(t, laptop, "b.md"); got != "# A\nmore\n" || store.noteReads != reads {
+		t.Errorf("own rename was applied again: b.md = %q", got)
+	}
+
+	// Delete
+	if err := os.Remove(filepath.Join(laptop.config.VaultPath, "b.md")); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.SyncFile(ctx, "b.md", watcher.EventDelete); err != nil {
+		t.Fatal(err)
+	}
+	apply(desktop, change(db.ChangeDelete, "b.md", "", ""))
+	if _, ok := readTestFile(t, desktop, "b.md"); ok {
+		t.Error("b.md still exists after the delete")
+	}
+	apply(laptop, change(db.ChangeDelete, "b.md", "", ""))
+
+	conflicts, err := store.GetUnresolvedConflicts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts = %+v, want none", conflicts)
+	}
+}
+
+func TestReconcileLinks(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	e := newTestDevice(t, store, "laptop")
+	writeTestFile(t, e, "a.md", "See [[Later#Part|the plan]], [[b]] and [b](b.md) on https://example.com\n")
+	writeTestFile(t, e, "b.md", "---\naliases: [Bee]\n---\n[[Bee]]\n")
+	if err := e.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := func() map[string]string {
+		t.Helper()
+		links, err := store.GetLinks(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := store.GetLinkTargets(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := make(map[string]string)
+		for _, f := range files {
+			paths[f.ID.String()] = f.Path
+		}
+		resolved := make(map[string]string)
+		for _, link := range links {
+			key := link.SourcePath + " -> " + link.Target
+			if link.TargetNoteID != nil {
+				resolved[key] = paths[link.TargetNoteID.String()]
+			} else {
+				resolved[key] = ""
+			}
+		}
+		return resolved
+	}
+
+	got := targets()
+	want := map[string]string{"a.md -> Later": "", "a.md -> b": "b.md", "a.md -> b.md": "b.md", "b.md -> Bee": "b.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("links = %v, want %v", got, want)
+	}
+
+	// The unresolved link resolves once its target is created
+	writeTestFile(t, e, "Later.md", "# Part\n")
+	if err := e.HandleEvent(ctx, watcher.FileEvent{Path: "Later.md", EventType: watcher.EventCreate}); err != nil {
+		t.Fatal(err)
+	}
+	if got := targets()["a.md -> Later"]; got != "Later.md" {
+		t.Errorf("link to the new note resolves to %q", got)
+	}
+
+	// Links between notes uploaded one after the other resolve as soon as
+	// the second is uploaded
+	writeTestFile(t, e, "c.md", "[[d]]\n")
+	writeTestFile(t, e, "d.md", "# D\n")
+	for _, p := range []string{"c.md", "d.md"} {
+		if err := e.SyncFile(ctx, p, watcher.EventCreate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := targets()["c.md -> d"]; got != "d.md" {
+		t.Errorf("link to the note uploaded after it resolves to %q", got)
+	}
+
+	// And is unresolved again when it is deleted
+	os.Remove(filepath.Join(e.config.VaultPath, "Later.md"))
+	if err := e.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := targets()["a.md -> Later"]; got != "" {
+		t.Errorf("link to the deleted note resolves to %q", got)
+	}
+}
+
+// countingStore counts the loads of every stored link, and of single notes
+// as they are downloaded
+type countingStore struct {
+	db.Store
+	linkLoads, noteReads int
+}
+
+func (s *countingStore) GetLinks(ctx context.Context) ([]*db.VaultLink, error) {
+	s.linkLoads++
+	return s.Store.GetLinks(ctx)
+}
+
+func (s *countingStore) GetNoteByPath(ctx context.Context, path string) (*db.VaultNote, error) {
+	s.noteReads++
+	return s.Store.GetNoteByPath(ctx, path)
+}
+
+func TestUploadResolvesLinksToNewFile(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Store: newTestStore(t)}
+
+	e := newTestDevice(t, store, "laptop")
+	writeTestFile(t, e, "a.md", "[[b]], [[Bee]] and [[c]]\n")
+	if err := e.SyncFile(ctx, "a.md", watcher.EventCreate); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new file resolves the links to its name and aliases without
+	// resolving every link again
+	writeTestFile(t, e, "b.md", "---\naliases: [Bee]\n---\n# B\n")
+	if err := e.SyncFile(ctx, "b.md", watcher.EventCreate); err != nil {
+		t.Fatal(err)
+	}
+	if store.linkLoads != 0 {
+		t.Errorf("links loaded %d times, want none", store.linkLoads)
+	}
+
+	links, err := store.GetLinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.GetNoteByPath(ctx, "b.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		resolved := link.TargetNoteID != nil && *link.TargetNoteID == b.ID
+		if want := link.Target != "c"; resolved != want {
+			t.Errorf("link to %s resolved = %v, want %v", link.Target, resolved, want)
+		}
+	}
+}
+
+func TestUploadAfterKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	laptop := newTestDevice(t, store, "laptop")
+	writeTestFile(t, laptop, "a.md", "# A\n")
+	if err := laptop.FullReconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another device encrypts the vault while the laptop's daemon runs
+	if err := store.SetKeyFingerprint(ctx, "new-key", "phone"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, laptop, "a.md", "# A\nEdited\n")
+	if err := laptop.SyncFile(ctx, "a.md", watcher.EventModify); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+	note, err := store.GetNoteByPath(ctx, "a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(note.RawContent, "Edited") {
+		t.Error("the edit was uploaded after the key was rotated")
+	}
+}
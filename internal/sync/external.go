@@ -0,0 +1,174 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vonshlovens/obsync-pg/internal/blobstore"
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+// external reports whether an attachment's content goes to the external
+// blob store rather than the database
+func (e *Engine) external(relPath string, size int64) bool {
+	if e.store == nil {
+		return false
+	}
+	if size > e.externalSize {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(relPath))
+	for _, want := range e.config.BlobStore.Extensions {
+		if ext != "" && ext == strings.ToLower("."+strings.TrimPrefix(want, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// storeExternal uploads the content of an attachment to the external blob store
+func (e *Engine) storeExternal(ctx context.Context, up *upload) error {
+	att := up.attachment
+
+	f, err := os.Open(filepath.Join(e.config.VaultPath, up.relPath))
+	if err != nil {
+		return fmt.Errorf("failed to read attachment: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = &verifyingReader{r: f, h: sha256.New(), size: att.FileSizeBytes, want: att.ContentHash}
+	size := att.FileSizeBytes
+	if e.cipher != nil {
+		sealed := e.sealReader(r)
+		defer sealed.Close()
+		r, size = sealed, crypt.SealedSize(size)
+	}
+	if err := e.store.Put(ctx, *att.StorageKey, r, size); err != nil {
+		return fmt.Errorf("failed to upload to blob store: %w", err)
+	}
+
+	slog.Info("uploaded attachment to blob store", "path", up.relPath, "key", *att.StorageKey)
+	return nil
+}
+
+// copyExternal writes the content stored in the external blob store under
+// key to w, decrypting it if its codec says it is encrypted
+func (e *Engine) copyExternal(ctx context.Context, key, codec string, w io.Writer) error {
+	if e.store == nil {
+		return fmt.Errorf("attachment is in the external blob store, but no blob_store is configured")
+	}
+
+	rc, err := e.store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to download from blob store: %w", err)
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if codec == db.CodecAESGCM {
+		if e.cipher == nil {
+			return db.ErrEncrypted
+		}
+		if r, err = e.cipher.NewReader(rc); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to download from blob store: %w", err)
+	}
+	return nil
+}
+
+// storageKey returns the key content with the given hash is stored under in
+// the external blob store. Encrypted content is stored under a key naming
+// the encryption key, so a key rotation can write the re-encrypted copy
+// before removing the old one.
+func (e *Engine) storageKey(hash string) string {
+	key := blobstore.Key(hash)
+	if e.cipher != nil {
+		key += ".enc-" + e.cipher.Fingerprint()[:8]
+	}
+	return key
+}
+
+// sealReader returns a reader of the content of r encrypted with the
+// current key. It must be closed if it isn't read to the end.
+func (e *Engine) sealReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := e.cipher.NewWriter(pw)
+		if err == nil {
+			_, err = io.Copy(w, r)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// pruneExternal deletes content in the external blob store that no
+// attachment uses any more
+func (e *Engine) pruneExternal(ctx context.Context) {
+	if e.store == nil {
+		return // Keep the rows until a store is configured to delete the content from
+	}
+
+	keys, err := e.db.PruneExternalBlobs(ctx)
+	if err != nil {
+		slog.Warn("failed to prune external blobs", "error", err)
+		return
+	}
+	for _, key := range keys {
+		if err := e.store.Delete(ctx, key); err != nil {
+			slog.Warn("failed to delete unused blob from blob store", "key", key, "error", err)
+		}
+	}
+	if len(keys) > 0 {
+		slog.Debug("pruned external blobs", "count", len(keys))
+	}
+}
+
+// verifyingReader fails the upload of a file that no longer has the hash
+// it was recorded with. The check runs when the expected size has been
+// read, before the store sees the end of the content.
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	n    int64
+	size int64
+	want string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if remaining := v.size - v.n; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if len(p) == 0 {
+		return 0, io.EOF
+	}
+
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+
+	if v.n == v.size && hex.EncodeToString(v.h.Sum(nil)) != v.want {
+		return n, fmt.Errorf("file changed while being uploaded")
+	}
+	if err == io.EOF && v.n < v.size {
+		return n, fmt.Errorf("file changed while being uploaded")
+	}
+	return n, err
+}
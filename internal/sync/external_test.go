@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/vonshlovens/obsync-pg/internal/blobstore"
+	"github.com/vonshlovens/obsync-pg/internal/config"
+)
+
+func TestExternal(t *testing.T) {
+	store, err := blobstore.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{BlobStore: config.BlobStoreConfig{Extensions: []string{"mp4", ".PDF"}}}
+	e := &Engine{config: cfg, store: store, externalSize: 1000}
+
+	tests := []struct {
+		path string
+		size int64
+		want bool
+	}{
+		{"image.png", 10, false},
+		{"image.png", 1000, false},
+		{"image.png", 1001, true},
+		{"video.mp4", 10, true},
+		{"Video.MP4", 10, true},
+		{"paper.pdf", 10, true},
+		{"mp4", 10, false},
+	}
+	for _, tt := range tests {
+		if got := e.external(tt.path, tt.size); got != tt.want {
+			t.Errorf("external(%q, %d) = %v, want %v", tt.path, tt.size, got, tt.want)
+		}
+	}
+
+	// Without a store everything stays in the database
+	e.store = nil
+	if e.external("video.mp4", 5000) {
+		t.Error("external without a blob store = true")
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	content := "attachment content"
+	hash := HashString(content)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"unchanged", content, false},
+		{"modified", "attachment CONTENT", true},
+		{"truncated", "attachment", true},
+		// The recorded content is uploaded; the rest is synced as a new version
+		{"appended", content + " and more", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &verifyingReader{
+				r:    strings.NewReader(tt.content),
+				h:    sha256.New(),
+				size: int64(len(content)),
+				want: hash,
+			}
+			got, err := io.ReadAll(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != content {
+				t.Errorf("read %q, want %q", got, content)
+			}
+		})
+	}
+}
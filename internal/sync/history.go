@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// RestoreNote writes a previous version of a note back into the vault and
+// syncs it, so the restored content becomes the current version everywhere.
+// The version it replaces is kept as a new revision.
+func (e *Engine) RestoreNote(ctx context.Context, relPath string, content []byte) error {
+	if !isNotePath(relPath) {
+		return fmt.Errorf("not a note: %s", relPath)
+	}
+	if err := e.checkKey(ctx); err != nil {
+		return err
+	}
+	defer e.relink(ctx)
+
+	// Sync pending changes first so unsynced local edits end up in the history too
+	if err := e.syncPath(ctx, relPath); err != nil {
+		return err
+	}
+
+	if err := writeVaultFile(filepath.Join(e.config.VaultPath, relPath), content); err != nil {
+		return err
+	}
+
+	if err := e.uploadFile(ctx, relPath, HashContent(content)); err != nil {
+		return err
+	}
+
+	slog.Info("restored note", "path", relPath, "hash", HashContent(content)[:8])
+	return nil
+}
+
+// PruneRevisions removes note revisions outside the configured retention
+func (e *Engine) PruneRevisions(ctx context.Context) {
+	keep := e.config.History.KeepRevisions
+	maxAge := time.Duration(e.config.History.MaxAgeDays) * 24 * time.Hour
+
+	removed, err := e.db.PruneNoteRevisions(ctx, keep, maxAge)
+	if err != nil {
+		slog.Warn("failed to prune note revisions", "error", err)
+		return
+	}
+	if removed > 0 {
+		slog.Debug("pruned note revisions", "count", removed)
+	}
+}
+
+// PruneBlobs removes attachment content no longer used by any attachment
+func (e *Engine) PruneBlobs(ctx context.Context) {
+	removed, err := e.db.PruneBlobs(ctx)
+	if err != nil {
+		slog.Warn("failed to prune attachment blobs", "error", err)
+	} else if removed > 0 {
+		slog.Debug("pruned attachment blobs", "count", removed)
+	}
+
+	e.pruneExternal(ctx)
+}
+
+// baseContent returns the content of a note as of its last sync. It falls
+// back to the revision history if the local copy of the base is missing.
+func (e *Engine) baseContent(ctx context.Context, relPath, hash string) ([]byte, bool) {
+	if content, err := e.bases.Get(hash); err == nil {
+		return content, true
+	}
+
+	rev, err := e.db.GetNoteRevisionByHash(ctx, relPath, hash)
+	if err != nil || rev == nil {
+		return nil, false
+	}
+	return []byte(rev.RawContent), true
+}
@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/vonshlovens/obsync-pg/internal/crypt"
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+// ErrWrongKey is returned when the configured encryption key isn't the key
+// the vault is encrypted with. Nothing is written to the database then, so a
+// misconfigured device can't store content no other device can read.
+var ErrWrongKey = errors.New("encryption key does not match the vault")
+
+// shortFingerprint is the part of a key fingerprint shown to users
+func shortFingerprint(fp string) string {
+	if len(fp) > 16 {
+		return fp[:16]
+	}
+	return fp
+}
+
+// VerifyKey compares the configured encryption key with the key the vault
+// is encrypted with. It returns the fingerprint stored in the database, or ""
+// if no device has encrypted the vault yet.
+func (e *Engine) VerifyKey(ctx context.Context) (string, error) {
+	stored, err := e.db.GetKeyFingerprint(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get key fingerprint: %w", err)
+	}
+
+	switch {
+	case stored == "":
+		return "", nil
+	case e.cipher == nil:
+		return stored, fmt.Errorf("%w: the vault is encrypted, but encryption is not enabled in the config", ErrWrongKey)
+	case stored != e.cipher.Fingerprint():
+		return stored, fmt.Errorf("%w: configured key %s, vault key %s",
+			ErrWrongKey, shortFingerprint(e.cipher.Fingerprint()), shortFingerprint(stored))
+	}
+	return stored, nil
+}
+
+// checkKey makes sure the vault is encrypted with the configured key before
+// anything is synced. The first device to sync with encryption enabled
+// registers its key. A match is remembered until the next full sync, or
+// the next upload, which calls recheckKey.
+func (e *Engine) checkKey(ctx context.Context) error {
+	if e.keyChecked.Load() {
+		return nil
+	}
+
+	stored, err := e.VerifyKey(ctx)
+	if err != nil {
+		return err
+	}
+	if stored == "" && e.cipher != nil {
+		claimed, err := e.db.ClaimKeyFingerprint(ctx, e.cipher.Fingerprint(), e.config.DeviceName)
+		if err != nil {
+			return fmt.Errorf("failed to register encryption key: %w", err)
+		}
+		// Another device registered a different key at the same time
+		if claimed != e.cipher.Fingerprint() {
+			return fmt.Errorf("%w: configured key %s, vault key %s",
+				ErrWrongKey, shortFingerprint(e.cipher.Fingerprint()), shortFingerprint(claimed))
+		}
+		slog.Info("registered encryption key", "fingerprint", shortFingerprint(claimed))
+	}
+
+	e.keyChecked.Store(true)
+	return nil
+}
+
+// recheckKey checks the vault's key again, even if it matched before. It runs
+// before every upload, so a daemon that was running while another device
+// rotated the key stops writing content sealed with the retired key.
+func (e *Engine) recheckKey(ctx context.Context) error {
+	e.keyChecked.Store(false)
+	return e.checkKey(ctx)
+}
+
+// RotateKey re-encrypts the vault with the configured key. old is the key the
+// vault is encrypted with now; it may be nil when the vault isn't encrypted
+// yet, which makes RotateKey encrypt an existing plaintext vault. Other
+// devices stop syncing until their config has the new key. An interrupted
+// rotation can be run again with the same keys.
+func (e *Engine) RotateKey(ctx context.Context, old *crypt.Cipher) error {
+	if e.cipher == nil {
+		return fmt.Errorf("encryption is not enabled in the config")
+	}
+
+	stored, err := e.db.GetKeyFingerprint(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get key fingerprint: %w", err)
+	}
+	if stored != "" && stored != e.cipher.Fingerprint() && (old == nil || old.Fingerprint() != stored) {
+		return fmt.Errorf("%w: the old key must be the vault key %s", ErrWrongKey, shortFingerprint(stored))
+	}
+	if old != nil {
+		e.cipher.Accept(old)
+	}
+
+	// Switch the fingerprint first: running daemons check it before their
+	// next upload and stop there. One that was already uploading may still
+	// write a file with the old key, which running the rotation again fixes.
+	if err := e.db.SetKeyFingerprint(ctx, e.cipher.Fingerprint(), e.config.DeviceName); err != nil {
+		return fmt.Errorf("failed to set key fingerprint: %w", err)
+	}
+	e.keyChecked.Store(true)
+
+	rows, err := e.db.Reseal(ctx)
+	if err != nil {
+		return err
+	}
+	blobs, err := e.resealExternal(ctx)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("re-encrypted vault",
+		"fingerprint", shortFingerprint(e.cipher.Fingerprint()),
+		"rows", rows,
+		"external_blobs", blobs)
+	return nil
+}
+
+// resealExternal re-encrypts the content in the external blob store. Each
+// blob is written under a new key before the old object is removed.
+func (e *Engine) resealExternal(ctx context.Context) (int, error) {
+	blobs, err := e.db.GetExternalBlobs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list external blobs: %w", err)
+	}
+	if len(blobs) > 0 && e.store == nil {
+		return 0, fmt.Errorf("%d attachments are in the external blob store, but no blob_store is configured", len(blobs))
+	}
+
+	n := 0
+	for _, b := range blobs {
+		key := e.storageKey(b.Hash)
+		if b.StorageKey == key && b.Codec == db.CodecAESGCM {
+			continue
+		}
+
+		if err := e.resealBlob(ctx, b, key); err != nil {
+			return n, fmt.Errorf("failed to re-encrypt %s: %w", b.StorageKey, err)
+		}
+		if b.StorageKey != key {
+			if err := e.store.Delete(ctx, b.StorageKey); err != nil {
+				slog.Warn("failed to delete old blob", "key", b.StorageKey, "error", err)
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// resealBlob copies a blob to key, encrypted with the current key
+func (e *Engine) resealBlob(ctx context.Context, b db.ExternalBlob, key string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(e.copyExternal(ctx, b.StorageKey, b.Codec, pw))
+	}()
+	sealed := e.sealReader(pr)
+	defer sealed.Close()
+	defer pr.Close()
+
+	if err := e.store.Put(ctx, key, sealed, crypt.SealedSize(b.Size)); err != nil {
+		return err
+	}
+	return e.db.MoveExternalBlob(ctx, b.Hash, key)
+}
@@ -0,0 +1,369 @@
+package sync
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/vonshlovens/obsync-pg/internal/db"
+	"github.com/vonshlovens/obsync-pg/internal/parser"
+)
+
+// linkGraph keeps the resolved targets of the links in the database up to
+// date. Links are resolved as their note is uploaded. A new file is added to
+// the index once it is written, and resolves the unresolved links to its
+// name. Moving or removing files, or changing aliases, can change what other
+// notes' links resolve to, so it marks the graph stale and relink resolves
+// every link again.
+type linkGraph struct {
+	mu    sync.Mutex
+	index *linkIndex // nil until loaded, or after other devices changed files
+	stale bool
+}
+
+// linkIndex finds the file a link resolves to, the way Obsidian does
+type linkIndex struct {
+	byPath  map[string]*db.LinkTarget   // By lowercased path
+	byName  map[string][]*db.LinkTarget // By lowercased name, without .md for notes
+	byAlias map[string][]*db.LinkTarget // Notes by lowercased alias
+}
+
+func newLinkIndex(targets []*db.LinkTarget) *linkIndex {
+	ix := &linkIndex{
+		byPath:  make(map[string]*db.LinkTarget, len(targets)),
+		byName:  make(map[string][]*db.LinkTarget, len(targets)),
+		byAlias: make(map[string][]*db.LinkTarget),
+	}
+	for _, t := range targets {
+		ix.add(t)
+	}
+	return ix
+}
+
+// add indexes a file by its path, name and aliases
+func (ix *linkIndex) add(t *db.LinkTarget) {
+	key := strings.ToLower(t.Path)
+	ix.byPath[key] = t
+	name := path.Base(key)
+	if t.IsNote {
+		name = strings.TrimSuffix(name, ".md")
+	}
+	ix.byName[name] = append(ix.byName[name], t)
+	for _, alias := range t.Aliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		ix.byAlias[alias] = append(ix.byAlias[alias], t)
+	}
+}
+
+// linkName returns the key of byName a link to target looks up
+func linkName(target string) string {
+	key := strings.TrimPrefix(strings.ToLower(target), "/")
+	return strings.TrimSuffix(path.Base(key), ".md")
+}
+
+// resolve returns the file a link in the note at sourcePath resolves to, or
+// nil. Names match regardless of case. A link resolves to, in order:
+//   - the note itself, for a link to a heading or block within it
+//   - the path relative to the note's folder, which is the only option for a
+//     link starting with ./ or ../
+//   - the path from the root of the vault
+//   - the file with that name whose path ends in the link, with the shortest
+//     path if there are several
+//   - the note with that alias, with the shortest path if there are several
+func (ix *linkIndex) resolve(sourcePath, target string) *db.LinkTarget {
+	if target == "" {
+		return ix.byPath[strings.ToLower(sourcePath)]
+	}
+
+	relative := path.Join(path.Dir(sourcePath), target)
+	if strings.HasPrefix(target, "./") || strings.HasPrefix(target, "../") {
+		return ix.lookupPath(relative)
+	}
+	if t := ix.lookupPath(relative); t != nil {
+		return t
+	}
+	if t := ix.lookupPath(strings.TrimPrefix(target, "/")); t != nil {
+		return t
+	}
+
+	key := strings.TrimPrefix(strings.ToLower(target), "/")
+	var candidates []*db.LinkTarget
+	for _, t := range ix.byName[linkName(target)] {
+		p := strings.ToLower(t.Path)
+		if t.IsNote && !strings.HasSuffix(key, ".md") {
+			p = strings.TrimSuffix(p, ".md")
+		}
+		if p == key || strings.HasSuffix(p, "/"+key) {
+			candidates = append(candidates, t)
+		}
+	}
+	if t := shortestPath(candidates); t != nil {
+		return t
+	}
+
+	return shortestPath(ix.byAlias[strings.ToLower(target)])
+}
+
+// lookupPath returns the file at a path, or the note at it with .md added
+func (ix *linkIndex) lookupPath(p string) *db.LinkTarget {
+	p = strings.ToLower(p)
+	if t, ok := ix.byPath[p]; ok {
+		return t
+	}
+	return ix.byPath[p+".md"]
+}
+
+// shortestPath returns the target with the shortest path, the first in
+// alphabetical order if there are several
+func shortestPath(targets []*db.LinkTarget) *db.LinkTarget {
+	if len(targets) == 0 {
+		return nil
+	}
+	return slices.MinFunc(targets, func(a, b *db.LinkTarget) int {
+		return cmp.Or(cmp.Compare(len(a.Path), len(b.Path)), cmp.Compare(a.Path, b.Path))
+	})
+}
+
+// setTarget points a link at what it resolves to in ix, and reports whether
+// that changed
+func (ix *linkIndex) setTarget(link *db.VaultLink, sourcePath string) bool {
+	var note, attachment *uuid.UUID
+	if t := ix.resolve(sourcePath, link.Target); t != nil {
+		id := t.ID
+		if t.IsNote {
+			note = &id
+		} else {
+			attachment = &id
+		}
+	}
+
+	if sameID(note, link.TargetNoteID) && sameID(attachment, link.TargetAttachmentID) {
+		return false
+	}
+	link.TargetNoteID, link.TargetAttachmentID = note, attachment
+	return true
+}
+
+func sameID(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// noteLinks converts the links parsed from a note to rows of vault_links,
+// and its external URLs to rows of vault_external_links
+func noteLinks(links []parser.Link) ([]*db.VaultLink, []*db.VaultExternalLink) {
+	var rows []*db.VaultLink
+	var external []*db.VaultExternalLink
+	for _, link := range links {
+		if link.Kind == parser.LinkExternal {
+			external = append(external, externalLink(link))
+			continue
+		}
+
+		row := &db.VaultLink{
+			Target:   link.Target,
+			LinkType: string(link.Kind),
+			Position: &link.Offset,
+			Line:     &link.Line,
+		}
+		if link.Anchor != "" {
+			row.Anchor = &link.Anchor
+		}
+		if link.Alias != "" {
+			row.Alias = &link.Alias
+		}
+		rows = append(rows, row)
+	}
+	return rows, external
+}
+
+// externalLink converts an external URL to its row, with the host it is on
+func externalLink(link parser.Link) *db.VaultExternalLink {
+	row := &db.VaultExternalLink{
+		URL:      link.Target,
+		Position: &link.Offset,
+		Line:     &link.Line,
+	}
+	if u, err := url.Parse(link.Target); err == nil && u.Hostname() != "" {
+		host := strings.ToLower(u.Hostname())
+		row.Host = &host
+	}
+	if link.Alias != "" {
+		row.Alias = &link.Alias
+	}
+	return row
+}
+
+// resolveLinks resolves the links of the notes about to be uploaded, and
+// marks the files the index doesn't know yet for addLinkTargets. A note
+// whose aliases changed may be the target of other notes' links, so it makes
+// the graph stale.
+func (e *Engine) resolveLinks(ctx context.Context, ups ...*upload) {
+	g := &e.links
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.index == nil {
+		targets, err := e.db.GetLinkTargets(ctx)
+		if err != nil {
+			// Uploaded unresolved, and resolved by the next relink
+			slog.Warn("failed to load link targets", "error", err)
+			g.stale = true
+			return
+		}
+		g.index = newLinkIndex(targets)
+	}
+
+	for _, up := range ups {
+		known := g.index.byPath[strings.ToLower(up.relPath)]
+		up.newTarget = known == nil
+		if up.note == nil {
+			continue
+		}
+		if known != nil && !slices.Equal(known.Aliases, up.note.Aliases) {
+			g.stale = true
+		}
+		for _, link := range up.note.Links {
+			g.index.setTarget(link, up.relPath)
+		}
+	}
+}
+
+// addLinkTargets adds the new files among the written uploads to the index,
+// and resolves the stored links left unresolved that may point at them.
+// Links that already resolve elsewhere keep their target until the next
+// relink. Failures leave the graph stale, for relink to resolve every link.
+func (e *Engine) addLinkTargets(ctx context.Context, ups ...*upload) {
+	var paths []string
+	for _, up := range ups {
+		if up.newTarget {
+			paths = append(paths, up.relPath)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	g := &e.links
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stale || g.index == nil {
+		// Resolved by the next relink, or by the device that changed files
+		return
+	}
+
+	targets, err := e.db.GetLinkTargetsAt(ctx, paths)
+	if err != nil {
+		slog.Warn("failed to load link targets", "error", err)
+		g.stale = true
+		return
+	}
+	if len(targets) == 0 {
+		return
+	}
+	links, err := e.db.GetUnresolvedLinks(ctx)
+	if err != nil {
+		slog.Warn("failed to load links", "error", err)
+		g.stale = true
+		return
+	}
+
+	// Names and aliases the new files can be linked by
+	added := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, t := range targets {
+		g.index.add(t)
+		added[strings.ToLower(t.Path)] = true
+		names[linkName(t.Path)] = true
+		for _, alias := range t.Aliases {
+			names[strings.ToLower(strings.TrimSpace(alias))] = true
+		}
+	}
+
+	var changed []*db.VaultLink
+	for _, link := range links {
+		match := names[linkName(link.Target)] || names[strings.ToLower(link.Target)]
+		if link.Target == "" {
+			match = added[strings.ToLower(link.SourcePath)] // Within the note itself
+		}
+		if match && g.index.setTarget(link, link.SourcePath) {
+			changed = append(changed, link)
+		}
+	}
+	if err := e.db.SetLinkTargets(ctx, changed); err != nil {
+		slog.Warn("failed to update link targets", "error", err)
+		g.stale = true
+		return
+	}
+	if len(changed) > 0 {
+		slog.Info("links resolved", "changed", len(changed), "total", len(links))
+	}
+}
+
+// linksChanged marks the graph stale after files were moved, removed or
+// restored
+func (e *Engine) linksChanged() {
+	e.links.mu.Lock()
+	e.links.stale = true
+	e.links.mu.Unlock()
+}
+
+// forgetLinkTargets drops the cached link targets after another device
+// changed files. That device resolves the stored links again itself.
+func (e *Engine) forgetLinkTargets() {
+	e.links.mu.Lock()
+	e.links.index = nil
+	e.links.mu.Unlock()
+}
+
+// relink resolves every stored link again if the graph is stale, and
+// records the links whose target changed. Links to files that didn't exist
+// when they were written resolve here once the file is created. Failures
+// are logged and leave the graph stale, to be tried again.
+func (e *Engine) relink(ctx context.Context) {
+	g := &e.links
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.stale {
+		return
+	}
+
+	targets, err := e.db.GetLinkTargets(ctx)
+	if err != nil {
+		slog.Warn("failed to load link targets", "error", err)
+		return
+	}
+	links, err := e.db.GetLinks(ctx)
+	if err != nil {
+		slog.Warn("failed to load links", "error", err)
+		return
+	}
+
+	index := newLinkIndex(targets)
+	var changed []*db.VaultLink
+	for _, link := range links {
+		if index.setTarget(link, link.SourcePath) {
+			changed = append(changed, link)
+		}
+	}
+	if err := e.db.SetLinkTargets(ctx, changed); err != nil {
+		slog.Warn("failed to update link targets", "error", err)
+		return
+	}
+
+	g.index, g.stale = index, false
+	if len(changed) > 0 {
+		slog.Info("links resolved", "changed", len(changed), "total", len(links))
+	}
+}
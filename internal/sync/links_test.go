@@ -0,0 +1,49 @@
+package sync
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+func TestLinkIndexResolve(t *testing.T) {
+	var targets []*db.LinkTarget
+	add := func(path string, isNote bool, aliases ...string) {
+		targets = append(targets, &db.LinkTarget{ID: uuid.New(), Path: path, IsNote: isNote, Aliases: aliases})
+	}
+	add("Note.md", true)
+	add("Work/Note.md", true)
+	add("Work/Plan.md", true, "Roadmap")
+	add("Archive/Old/Plan.md", true)
+	add("Archive/Plan.md", true)
+	add("img/photo.png", false)
+	ix := newLinkIndex(targets)
+
+	tests := []struct {
+		source, target, want string
+	}{
+		{"Work/Plan.md", "", "Work/Plan.md"},
+		{"Work/Plan.md", "Note", "Work/Note.md"}, // Same folder first
+		{"Other.md", "Note", "Note.md"},
+		{"Other.md", "note.md", "Note.md"},
+		{"Other.md", "Plan", "Work/Plan.md"}, // Shortest path
+		{"Other.md", "Old/Plan", "Archive/Old/Plan.md"},
+		{"Archive/Old/x.md", "../Plan", "Archive/Plan.md"},
+		{"Other.md", "photo.png", "img/photo.png"},
+		{"Other.md", "roadmap", "Work/Plan.md"},
+		{"Other.md", "Missing", ""},
+		{"Other.md", "ects/Plan", ""},
+		{"Other.md", "./Plan", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if target := ix.resolve(tt.source, tt.target); target != nil {
+			got = target.Path
+		}
+		if got != tt.want {
+			t.Errorf("[[%s]] in %s resolves to %q, want %q", tt.target, tt.source, got, tt.want)
+		}
+	}
+}
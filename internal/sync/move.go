@@ -0,0 +1,227 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+// RenameFile handles a file moved within the vault. If its content is
+// unchanged, the database row is moved in place so the file keeps its id and
+// history. Otherwise the old path is deleted and the new path uploaded as usual.
+func (e *Engine) RenameFile(ctx context.Context, oldPath, newPath string) error {
+	if err := e.checkKey(ctx); err != nil {
+		return err
+	}
+	if err := e.renameFile(ctx, oldPath, newPath); err != nil {
+		// Retries sync each path on its own, as a delete and an upload
+		e.queueRetry(oldPath, RetrySync, err)
+		e.queueRetry(newPath, RetrySync, err)
+		return err
+	}
+	e.retries.Done(oldPath)
+	e.retries.Done(newPath)
+	return nil
+}
+
+func (e *Engine) renameFile(ctx context.Context, oldPath, newPath string) error {
+	if e.shouldIgnore(newPath) {
+		// Moved out of the synced part of the vault
+		if e.state.GetFileState(oldPath) == nil {
+			return nil
+		}
+		return e.syncPath(ctx, oldPath)
+	}
+	if e.shouldIgnore(oldPath) || e.state.GetFileState(oldPath) == nil {
+		return e.upsertFile(ctx, newPath)
+	}
+
+	hash, err := e.localHash(newPath)
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		// Gone again already
+		return e.syncPath(ctx, oldPath)
+	}
+
+	moved, err := e.moveRow(ctx, oldPath, newPath, hash)
+	if err != nil || moved {
+		return err
+	}
+
+	if err := e.syncPath(ctx, oldPath); err != nil {
+		return err
+	}
+	return e.upsertFile(ctx, newPath)
+}
+
+// moveRow moves the database row of a tracked file to its new path. It
+// returns false if the move can't be done in place, because the content no
+// longer matches the last sync, the file changes type or either path was
+// changed on another device. A create the watcher paired with an unrelated
+// rename is then kept apart from the renamed file.
+func (e *Engine) moveRow(ctx context.Context, oldPath, newPath, hash string) (bool, error) {
+	if isNotePath(oldPath) != isNotePath(newPath) {
+		return false, nil
+	}
+
+	base := e.baseHash(oldPath)
+	if hash != base {
+		return false, nil
+	}
+	if remote, err := e.remoteHash(ctx, oldPath); err != nil || remote != base {
+		return false, err
+	}
+	if remote, err := e.remoteHash(ctx, newPath); err != nil || remote != "" {
+		return false, err
+	}
+
+	filename := filepath.Base(newPath)
+
+	var moved bool
+	var err error
+	if isNotePath(newPath) {
+		moved, err = e.db.MoveNote(ctx, oldPath, newPath, filename, e.config.DeviceName)
+	} else {
+		moved, err = e.db.MoveAttachment(ctx, oldPath, newPath, filename, e.config.DeviceName)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to move file: %w", err)
+	}
+	if !moved {
+		return false, nil
+	}
+
+	e.moveFileState(oldPath, newPath)
+	e.linksChanged()
+
+	// Renaming a conflict copy counts as dealing with it
+	if err := e.db.ResolveConflicts(ctx, []string{oldPath}); err != nil {
+		slog.Warn("failed to resolve conflicts", "path", oldPath, "error", err)
+	}
+
+	slog.Info("file moved", "from", oldPath, "to", newPath)
+
+	// Fields derived from the name (title, MIME type) need updating
+	if filepath.Base(oldPath) != filename {
+		if err := e.uploadFile(ctx, newPath, hash); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// moveFileState transfers the sync state of a file to its new path
+func (e *Engine) moveFileState(oldPath, newPath string) {
+	st := e.state.GetFileState(oldPath)
+	if st == nil {
+		return
+	}
+	moved := *st
+	e.state.RemoveFileState(oldPath)
+	e.state.SetFileState(newPath, &moved)
+}
+
+// applyRemoteMove applies a file moved on another device by renaming the
+// local file. If the local file was edited or the new path is taken, the
+// move is applied as a delete and a change instead.
+func (e *Engine) applyRemoteMove(ctx context.Context, change db.Change) error {
+	oldPath, newPath := change.OldPath, change.Path
+
+	// Our own moves come back as notifications too
+	if e.state.GetFileState(oldPath) == nil && e.state.GetFileState(newPath) != nil {
+		return nil
+	}
+	e.forgetLinkTargets()
+
+	base := e.baseHash(oldPath)
+	local, err := e.localHash(oldPath)
+	if err != nil {
+		return err
+	}
+	target, err := e.localHash(newPath)
+	if err != nil {
+		return err
+	}
+
+	if base != "" && local == base && change.ContentHash == base && target == "" &&
+		!e.shouldIgnore(oldPath) && !e.shouldIgnore(newPath) {
+		absNew := filepath.Join(e.config.VaultPath, newPath)
+		if err := os.MkdirAll(filepath.Dir(absNew), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+
+		// Move the state first so the watcher's rename is recognised as ours
+		e.moveFileState(oldPath, newPath)
+		if err := os.Rename(filepath.Join(e.config.VaultPath, oldPath), absNew); err != nil {
+			e.moveFileState(newPath, oldPath)
+			return fmt.Errorf("failed to move file: %w", err)
+		}
+
+		slog.Info("moved file moved remotely", "from", oldPath, "to", newPath)
+		return nil
+	}
+
+	if err := e.applyRemote(ctx, oldPath, ""); err != nil {
+		return err
+	}
+	return e.applyRemote(ctx, newPath, change.ContentHash)
+}
+
+// pairMoves matches files that disappeared (old path -> last synced hash)
+// with new files (path -> hash) holding the same content, and returns the
+// matches as old path -> new path. A file with the same name is preferred
+// when several have the same content. Empty files are never paired.
+func pairMoves(removed, added map[string]string) map[string]string {
+	byHash := make(map[string][]string)
+	for path, hash := range added {
+		byHash[hash] = append(byHash[hash], path)
+	}
+	for _, paths := range byHash {
+		sort.Strings(paths)
+	}
+
+	oldPaths := make([]string, 0, len(removed))
+	for path := range removed {
+		oldPaths = append(oldPaths, path)
+	}
+	sort.Strings(oldPaths)
+
+	empty := HashContent(nil)
+	moves := make(map[string]string)
+	used := make(map[string]bool)
+
+	for _, oldPath := range oldPaths {
+		hash := removed[oldPath]
+		if hash == empty {
+			continue
+		}
+
+		best := ""
+		for _, candidate := range byHash[hash] {
+			if used[candidate] || isNotePath(candidate) != isNotePath(oldPath) {
+				continue
+			}
+			if best == "" {
+				best = candidate
+			}
+			if filepath.Base(candidate) == filepath.Base(oldPath) {
+				best = candidate
+				break
+			}
+		}
+
+		if best != "" {
+			moves[oldPath] = best
+			used[best] = true
+		}
+	}
+
+	return moves
+}
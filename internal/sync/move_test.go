@@ -0,0 +1,69 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPairMoves(t *testing.T) {
+	empty := HashContent(nil)
+
+	tests := []struct {
+		name    string
+		removed map[string]string
+		added   map[string]string
+		want    map[string]string
+	}{
+		{
+			name:    "moved to folder",
+			removed: map[string]string{"Note.md": "h1"},
+			added:   map[string]string{"Archive/Note.md": "h1"},
+			want:    map[string]string{"Note.md": "Archive/Note.md"},
+		},
+		{
+			name:    "renamed",
+			removed: map[string]string{"Draft.md": "h1", "img.png": "h2"},
+			added:   map[string]string{"Final.md": "h1", "assets/img.png": "h2"},
+			want:    map[string]string{"Draft.md": "Final.md", "img.png": "assets/img.png"},
+		},
+		{
+			name:    "content differs",
+			removed: map[string]string{"Note.md": "h1"},
+			added:   map[string]string{"Other.md": "h2"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "prefers same name",
+			removed: map[string]string{"a/Note.md": "h1"},
+			added:   map[string]string{"b/Copy.md": "h1", "c/Note.md": "h1"},
+			want:    map[string]string{"a/Note.md": "c/Note.md"},
+		},
+		{
+			name:    "duplicates pair once",
+			removed: map[string]string{"a/x.md": "h1", "a/y.md": "h1"},
+			added:   map[string]string{"b/x.md": "h1"},
+			want:    map[string]string{"a/x.md": "b/x.md"},
+		},
+		{
+			name:    "note to attachment",
+			removed: map[string]string{"Note.md": "h1"},
+			added:   map[string]string{"Note.txt": "h1"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "empty files",
+			removed: map[string]string{"a.md": empty},
+			added:   map[string]string{"b.md": empty},
+			want:    map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pairMoves(tt.removed, tt.added)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pairMoves() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
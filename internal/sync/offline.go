@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/watcher"
+)
+
+// ErrOffline is returned when the database became unreachable during an operation
+var ErrOffline = errors.New("database unreachable")
+
+// HandleEvent syncs a debounced watcher event
+func (e *Engine) HandleEvent(ctx context.Context, event watcher.FileEvent) error {
+	defer e.relink(ctx)
+
+	if event.EventType == watcher.EventRename {
+		return e.RenameFile(ctx, event.OldPath, event.Path)
+	}
+	return e.SyncFile(ctx, event.Path, event.EventType)
+}
+
+// Journal records a watcher event in the outbox, to be replayed once the
+// database is reachable again
+func (e *Engine) Journal(event watcher.FileEvent) error {
+	at := event.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return e.outbox.Append(OutboxEntry{
+		Path:    event.Path,
+		OldPath: event.OldPath,
+		Event:   event.EventType,
+		Time:    at,
+	})
+}
+
+// PendingOffline returns the number of changes journaled while offline
+func (e *Engine) PendingOffline() int {
+	return e.outbox.Len()
+}
+
+// ReplayOutbox syncs the changes journaled while offline, in order, and
+// clears the outbox. Files that fail to sync go to the retry queue; if the
+// database becomes unreachable again the outbox is kept and ErrOffline
+// returned, so the whole outbox is replayed next time.
+func (e *Engine) ReplayOutbox(ctx context.Context) error {
+	entries, err := e.outbox.Entries()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	slog.Info("replaying changes made while offline", "count", len(entries))
+	for _, entry := range entries {
+		event := watcher.FileEvent{
+			Path:      entry.Path,
+			OldPath:   entry.OldPath,
+			EventType: entry.Event,
+			Timestamp: entry.Time,
+		}
+		if err := e.HandleEvent(ctx, event); err != nil {
+			if !e.db.Reachable(ctx) {
+				return fmt.Errorf("%w: %v", ErrOffline, err)
+			}
+			slog.Error("sync failed", "path", entry.Path, "error", err)
+		}
+	}
+
+	if err := e.SaveState(); err != nil {
+		slog.Warn("failed to save state", "error", err)
+	}
+	return e.outbox.Clear()
+}
@@ -0,0 +1,125 @@
+package sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/watcher"
+)
+
+// OutboxEntry is a local change journaled while the database was unreachable
+type OutboxEntry struct {
+	Path    string            `json:"path"`
+	OldPath string            `json:"old_path,omitempty"`
+	Event   watcher.EventType `json:"event"`
+	Time    time.Time         `json:"time"`
+}
+
+// Outbox is an append-only journal of local changes made while offline,
+// kept next to the state file of its vault. Every entry is flushed to disk before Append
+// returns, so changes survive a crash or a shutdown while offline.
+type Outbox struct {
+	filePath string
+	mu       sync.Mutex
+}
+
+// NewOutbox opens the outbox of a vault, kept next to stateFile if the vault
+// has one
+func NewOutbox(vaultPath, stateFile string) (*Outbox, error) {
+	filePath, err := stateFilePath(vaultPath, stateFile, "outbox", ".jsonl")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Outbox{filePath: filePath}, nil
+}
+
+// Append journals a change
+func (o *Outbox) Append(entry OutboxEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f, err := os.OpenFile(o.filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Start a new line after an entry truncated by a crash
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Entries returns the journaled changes in the order they were made.
+// Entries truncated by a crash during Append are skipped.
+func (o *Outbox) Entries() ([]OutboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f, err := os.Open(o.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []OutboxEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry OutboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("skipping invalid outbox entry", "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	return entries, nil
+}
+
+// Clear removes all entries once they have been replayed
+func (o *Outbox) Clear() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := os.Remove(o.filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Len returns the number of journaled changes
+func (o *Outbox) Len() int {
+	entries, err := o.Entries()
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
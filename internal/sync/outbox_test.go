@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/watcher"
+)
+
+func TestOutbox(t *testing.T) {
+	o := &Outbox{filePath: filepath.Join(t.TempDir(), "outbox.jsonl")}
+
+	entries, err := o.Entries()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("empty outbox: entries = %v, err = %v", entries, err)
+	}
+
+	now := time.Now()
+	appended := []OutboxEntry{
+		{Path: "a.md", Event: watcher.EventModify, Time: now},
+		{Path: "b.md", OldPath: "a.md", Event: watcher.EventRename, Time: now},
+		{Path: "c.png", Event: watcher.EventDelete, Time: now},
+	}
+	for _, entry := range appended {
+		if err := o.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err = o.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(appended) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(appended))
+	}
+	for i, entry := range entries {
+		want := appended[i]
+		if entry.Path != want.Path || entry.OldPath != want.OldPath || entry.Event != want.Event || !entry.Time.Equal(want.Time) {
+			t.Errorf("entry %d = %+v, want %+v", i, entry, want)
+		}
+	}
+
+	if err := o.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if o.Len() != 0 {
+		t.Errorf("Len() = %d after Clear, want 0", o.Len())
+	}
+}
+
+func TestOutbox_TruncatedEntry(t *testing.T) {
+	o := &Outbox{filePath: filepath.Join(t.TempDir(), "outbox.jsonl")}
+
+	if err := o.Append(OutboxEntry{Path: "a.md", Event: watcher.EventCreate}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of an append leaves half a line
+	f, err := os.OpenFile(o.filePath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"path":"b.m`)
+	f.Close()
+
+	if err := o.Append(OutboxEntry{Path: "c.md", Event: watcher.EventCreate}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := o.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Path != "a.md" || entries[1].Path != "c.md" {
+		t.Errorf("entries = %+v, want a.md and c.md", entries)
+	}
+}
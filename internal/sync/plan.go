@@ -0,0 +1,573 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+// PlanOp is the kind of change a plan entry makes
+type PlanOp string
+
+const (
+	OpCreate      PlanOp = "create"       // upload a new file
+	OpUpdate      PlanOp = "update"       // upload a changed file
+	OpMove        PlanOp = "move"         // move a file's row to its new path
+	OpDownload    PlanOp = "download"     // write the database version to the vault
+	OpBackup      PlanOp = "backup"       // save the local file as .bak, then download
+	OpConflict    PlanOp = "conflict"     // changed on both sides
+	OpDelete      PlanOp = "delete"       // move a file to the database trash
+	OpRemoveLocal PlanOp = "remove-local" // remove a file deleted on another device
+	OpKeepLocal   PlanOp = "keep-local"   // local changes left for the next sync
+)
+
+// PlanOps lists the operations in the order they are carried out
+var PlanOps = []PlanOp{
+	OpMove, OpCreate, OpUpdate, OpDownload, OpBackup, OpConflict, OpDelete, OpRemoveLocal, OpKeepLocal,
+}
+
+// PlanEntry is a single change in a plan
+type PlanEntry struct {
+	Op      PlanOp `json:"op"`
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+	Bytes   int64  `json:"bytes"` // Data transferred
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Plan lists the changes a sync or pull will make. Computing it doesn't
+// touch the database or the vault, so it doubles as a dry run; executing
+// the same plan keeps the preview and the actual sync from diverging.
+type Plan struct {
+	Entries []PlanEntry     `json:"entries"`
+	Blocked *BlockedDeletes `json:"blocked_deletes,omitempty"`
+
+	// Hashes the plan was computed from, by path
+	base, local, remote map[string]string
+
+	// Paths whose sync state needs updating, without any transfer
+	record []string
+}
+
+func newPlan() *Plan {
+	return &Plan{
+		base:   make(map[string]string),
+		local:  make(map[string]string),
+		remote: make(map[string]string),
+	}
+}
+
+// add records an entry along with the hashes it was decided on
+func (p *Plan) add(entry PlanEntry, base, local, remote string) {
+	p.Entries = append(p.Entries, entry)
+	p.base[entry.Path] = base
+	p.local[entry.Path] = local
+	p.remote[entry.Path] = remote
+}
+
+// Count returns the number of entries with the given operation
+func (p *Plan) Count(op PlanOp) int {
+	return len(p.paths(op))
+}
+
+// Bytes returns the data transferred by entries with the given operation
+func (p *Plan) Bytes(op PlanOp) int64 {
+	var total int64
+	for _, entry := range p.Entries {
+		if entry.Op == op {
+			total += entry.Bytes
+		}
+	}
+	return total
+}
+
+// paths returns the paths of entries with the given operation
+func (p *Plan) paths(op PlanOp) []string {
+	var paths []string
+	for _, entry := range p.Entries {
+		if entry.Op == op {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths
+}
+
+// sort orders entries by operation, then path
+func (p *Plan) sort() {
+	order := make(map[PlanOp]int, len(PlanOps))
+	for i, op := range PlanOps {
+		order[op] = i
+	}
+	sort.Slice(p.Entries, func(i, j int) bool {
+		a, b := p.Entries[i], p.Entries[j]
+		if a.Op != b.Op {
+			return order[a.Op] < order[b.Op]
+		}
+		return a.Path < b.Path
+	})
+}
+
+// PlanSync compares the vault, the database and the last synced state and
+// returns the changes a full sync would make
+func (e *Engine) PlanSync(ctx context.Context) (*Plan, error) {
+	localHashes, localSizes, unreadable, err := e.scanVault(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dbHashes, err := e.getAllHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSizes, err := e.db.GetAllFileSizes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file sizes: %w", err)
+	}
+
+	trash, err := e.db.GetTrash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deleted files: %w", err)
+	}
+	tombstones := make(map[string]*db.TrashedFile, len(trash))
+	for _, f := range trash {
+		tombstones[f.Path] = f
+	}
+
+	// Compare every known path against the state of its last sync
+	paths := make(map[string]bool)
+	for relPath := range localHashes {
+		paths[relPath] = true
+	}
+	for relPath := range dbHashes {
+		paths[relPath] = true
+	}
+	for _, relPath := range e.state.GetAllPaths() {
+		paths[relPath] = true
+	}
+
+	plan := newPlan()
+	removed := make(map[string]string) // deleted locally -> last synced hash
+	added := make(map[string]string)   // new locally -> hash
+	deletes := 0
+
+	for relPath := range paths {
+		if unreadable[relPath] {
+			continue
+		}
+
+		local, remote := localHashes[relPath], dbHashes[relPath]
+
+		// Ignored files are removed from the database
+		if e.shouldIgnore(relPath) {
+			if remote != "" {
+				plan.add(PlanEntry{Op: OpDelete, Path: relPath, Reason: "ignored"}, "", local, remote)
+				deletes++
+			}
+			continue
+		}
+
+		base := e.baseHash(relPath)
+
+		// An untracked file matching a tombstone was deleted on another device,
+		// rather than created here
+		if base == "" && remote == "" && local != "" && e.deletedElsewhere(relPath, local, tombstones[relPath]) {
+			base = local
+		}
+
+		switch decideAction(base, local, remote) {
+		case actionUpload:
+			if base == "" && remote == "" {
+				added[relPath] = local
+				continue // May turn out to be a move
+			}
+			op := OpUpdate
+			if remote == "" {
+				op = OpCreate
+			}
+			plan.add(PlanEntry{Op: op, Path: relPath, Bytes: localSizes[relPath]}, base, local, remote)
+		case actionDownload:
+			plan.add(PlanEntry{Op: OpDownload, Path: relPath, Bytes: dbSizes[relPath]}, base, local, remote)
+		case actionDeleteRemote:
+			removed[relPath] = base
+		case actionDeleteLocal:
+			plan.add(PlanEntry{Op: OpRemoveLocal, Path: relPath}, base, local, remote)
+		case actionConflict:
+			plan.add(PlanEntry{Op: OpConflict, Path: relPath, Bytes: localSizes[relPath] + dbSizes[relPath]}, base, local, remote)
+		default:
+			if base != local {
+				plan.record = append(plan.record, relPath)
+				plan.base[relPath], plan.local[relPath], plan.remote[relPath] = base, local, remote
+			}
+		}
+	}
+
+	// Files that disappeared from one path and appeared unchanged at another were moved
+	moves := pairMoves(removed, added)
+	for oldPath, newPath := range moves {
+		plan.add(PlanEntry{Op: OpMove, Path: newPath, OldPath: oldPath}, "", added[newPath], "")
+		plan.base[oldPath] = removed[oldPath]
+		delete(removed, oldPath)
+		delete(added, newPath)
+	}
+	for relPath, local := range added {
+		plan.add(PlanEntry{Op: OpCreate, Path: relPath, Bytes: localSizes[relPath]}, "", local, "")
+	}
+	for relPath, base := range removed {
+		plan.add(PlanEntry{Op: OpDelete, Path: relPath}, base, "", base)
+		deletes++
+	}
+
+	// Refuse to delete a large part of the vault, e.g. when its drive isn't mounted
+	tracked := max(e.state.FileCount(), len(dbHashes))
+	if !e.allowMassDelete && exceedsDeleteLimit(deletes, tracked,
+		e.config.Sync.MassDeleteCount, e.config.Sync.MassDeletePercent) {
+		plan.Blocked = &BlockedDeletes{Count: deletes, Tracked: tracked, DetectedAt: time.Now()}
+		for i := range plan.Entries {
+			if plan.Entries[i].Op == OpDelete {
+				plan.Entries[i].Reason = "blocked: too many files missing"
+			}
+		}
+	}
+
+	plan.sort()
+	return plan, nil
+}
+
+// deletedElsewhere reports whether a local file this device doesn't track is
+// the copy another device deleted. A file this device deleted itself, or one
+// written after the deletion, was restored by the user and is uploaded again.
+func (e *Engine) deletedElsewhere(relPath, local string, tombstone *db.TrashedFile) bool {
+	if tombstone == nil || tombstone.ContentHash != local {
+		return false
+	}
+	if tombstone.DeletedBy != nil && *tombstone.DeletedBy == e.config.DeviceName {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(e.config.VaultPath, relPath))
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().After(tombstone.DeletedAt)
+}
+
+// PlanPull returns the changes needed to bring the files selected by opts up
+// to date with the database. Files changed locally since the last sync are
+// handled according to the overwrite policy.
+func (e *Engine) PlanPull(ctx context.Context, opts PullOptions) (*Plan, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	dbHashes, err := e.getAllHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSizes, err := e.db.GetAllFileSizes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file sizes: %w", err)
+	}
+
+	var changed map[string]bool
+	if !opts.Since.IsZero() {
+		if changed, err = e.db.GetChangedSince(ctx, opts.Since); err != nil {
+			return nil, fmt.Errorf("failed to get changed files: %w", err)
+		}
+	}
+
+	plan := newPlan()
+	for relPath, remote := range dbHashes {
+		if !opts.selects(relPath, changed) {
+			continue
+		}
+
+		local, err := e.localHash(relPath)
+		if err != nil {
+			slog.Warn("failed to hash file", "path", relPath, "error", err)
+			continue
+		}
+		base := e.baseHash(relPath)
+
+		action := decideAction(base, local, remote)
+		if op, reason, ok := pullEntry(action, opts.Overwrite); ok {
+			var bytes int64
+			if op != OpKeepLocal {
+				bytes = dbSizes[relPath]
+			}
+			plan.add(PlanEntry{Op: op, Path: relPath, Bytes: bytes, Reason: reason}, base, local, remote)
+		} else if base != local {
+			plan.record = append(plan.record, relPath)
+			plan.base[relPath], plan.local[relPath], plan.remote[relPath] = base, local, remote
+		}
+	}
+
+	plan.sort()
+	return plan, nil
+}
+
+// ExecutePlan carries out a plan. Failures of individual files are logged
+// and don't stop the rest of the plan. Deletions are skipped if the plan was
+// blocked by the mass-delete safeguard. Links are resolved again at the end,
+// if the plan added, moved or removed files.
+func (e *Engine) ExecutePlan(ctx context.Context, plan *Plan) error {
+	if err := e.checkKey(ctx); err != nil {
+		return err
+	}
+	defer e.relink(ctx)
+
+	// Paths that are already in sync only need their state updated
+	for _, relPath := range plan.record {
+		if err := e.apply(ctx, relPath, plan.base[relPath], plan.local[relPath], plan.remote[relPath]); err != nil {
+			slog.Warn("failed to update state", "path", relPath, "error", err)
+			e.queueRetry(relPath, RetrySync, err)
+		}
+	}
+
+	var toDelete []string
+	if plan.Blocked == nil {
+		toDelete = plan.paths(OpDelete)
+	}
+
+	// Move files in place, or fall back to an upload and a delete
+	for _, entry := range plan.Entries {
+		if entry.Op != OpMove {
+			continue
+		}
+		moved, err := e.moveRow(ctx, entry.OldPath, entry.Path, plan.local[entry.Path])
+		if err != nil {
+			slog.Error("failed to move file", "from", entry.OldPath, "to", entry.Path, "error", err)
+		}
+		if !moved {
+			if err := e.uploadFile(ctx, entry.Path, plan.local[entry.Path]); err != nil {
+				slog.Error("failed to sync file", "path", entry.Path, "error", err)
+				e.queueRetry(entry.Path, RetryUpload, err)
+			}
+			if plan.Blocked == nil {
+				toDelete = append(toDelete, entry.OldPath)
+			}
+		}
+	}
+
+	// Sync changed/new files in parallel batches
+	toSync := append(plan.paths(OpCreate), plan.paths(OpUpdate)...)
+	if len(toSync) > 0 {
+		bar := progressbar.NewOptions(len(toSync),
+			progressbar.OptionSetDescription("Syncing files"),
+			progressbar.OptionShowCount(),
+			progressbar.OptionSetWidth(40),
+		)
+
+		sizes := make(map[string]int64, len(toSync))
+		for _, entry := range plan.Entries {
+			sizes[entry.Path] = entry.Bytes
+		}
+
+		batches := batchPaths(toSync, sizes, e.config.Sync.BatchSize, maxBatchBytes)
+		forEach(ctx, batches, e.uploadWorkers(), func(batch []string) {
+			e.uploadBatch(ctx, batch, plan.local)
+			bar.Add(len(batch))
+		})
+		bar.Finish()
+	}
+
+	// Download files changed on other devices
+	if toDownload := plan.paths(OpDownload); len(toDownload) > 0 {
+		bar := progressbar.NewOptions(len(toDownload),
+			progressbar.OptionSetDescription("Downloading files"),
+			progressbar.OptionShowCount(),
+			progressbar.OptionSetWidth(40),
+		)
+
+		for _, relPath := range toDownload {
+			if _, err := e.downloadFile(ctx, relPath); err != nil {
+				slog.Error("failed to download file", "path", relPath, "error", err)
+				e.queueRetry(relPath, RetryDownload, err)
+			}
+			bar.Add(1)
+		}
+		bar.Finish()
+	}
+
+	// Save local changes before replacing them
+	for _, relPath := range plan.paths(OpBackup) {
+		bakPath, err := e.backupFile(relPath)
+		if err != nil {
+			slog.Error("failed to back up file, keeping it", "path", relPath, "error", err)
+			continue
+		}
+		if _, err := e.downloadFile(ctx, relPath); err != nil {
+			slog.Error("failed to download file", "path", relPath, "error", err)
+			e.queueRetry(relPath, RetryDownload, err)
+			continue
+		}
+		slog.Info("replaced local changes, kept a backup", "path", relPath, "backup", bakPath)
+	}
+
+	// Keep both versions of files changed on both sides
+	for _, relPath := range plan.paths(OpConflict) {
+		if err := e.resolveConflict(ctx, relPath, plan.base[relPath], plan.local[relPath], plan.remote[relPath]); err != nil {
+			slog.Error("failed to resolve conflict", "path", relPath, "error", err)
+			e.queueRetry(relPath, RetrySync, err)
+		}
+	}
+
+	// Delete removed files
+	if len(toDelete) > 0 {
+		var notesToDelete, attachmentsToDelete []string
+		for _, path := range toDelete {
+			if isNotePath(path) {
+				notesToDelete = append(notesToDelete, path)
+			} else {
+				attachmentsToDelete = append(attachmentsToDelete, path)
+			}
+		}
+
+		// Failed deletes keep their state, so a retry still sees them as deleted locally
+		var deleted []string
+		if len(notesToDelete) > 0 {
+			if err := e.db.BatchDeleteNotes(ctx, notesToDelete, e.config.DeviceName); err != nil {
+				slog.Error("failed to batch delete notes", "error", err)
+				for _, path := range notesToDelete {
+					e.queueRetry(path, RetryDelete, err)
+				}
+			} else {
+				deleted = append(deleted, notesToDelete...)
+			}
+		}
+		if len(attachmentsToDelete) > 0 {
+			if err := e.db.BatchDeleteAttachments(ctx, attachmentsToDelete, e.config.DeviceName); err != nil {
+				slog.Error("failed to batch delete attachments", "error", err)
+				for _, path := range attachmentsToDelete {
+					e.queueRetry(path, RetryDelete, err)
+				}
+			} else {
+				deleted = append(deleted, attachmentsToDelete...)
+			}
+		}
+		if len(deleted) > 0 {
+			if err := e.db.ResolveConflicts(ctx, deleted); err != nil {
+				slog.Warn("failed to resolve conflicts", "error", err)
+			}
+
+			e.linksChanged()
+			for _, path := range deleted {
+				e.state.RemoveFileState(path)
+			}
+
+			slog.Info("moved removed files to trash", "count", len(deleted))
+		}
+	}
+
+	// Remove files deleted on other devices
+	for _, relPath := range plan.paths(OpRemoveLocal) {
+		if err := e.deleteLocalFile(relPath); err != nil {
+			slog.Error("failed to remove file", "path", relPath, "error", err)
+			e.queueRetry(relPath, RetryDelete, err)
+		}
+	}
+
+	for _, relPath := range plan.paths(OpKeepLocal) {
+		slog.Warn("local file has unsynced changes, keeping it", "path", relPath)
+	}
+
+	return nil
+}
+
+// scanVault hashes every file in the vault that isn't ignored. Files that
+// can't be read are reported separately so they aren't mistaken for deletions.
+func (e *Engine) scanVault(ctx context.Context) (hashes map[string]string, sizes map[string]int64, unreadable map[string]bool, err error) {
+	var localFiles []string
+	sizes = make(map[string]int64)
+	modTimes := make(map[string]time.Time)
+
+	err = filepath.WalkDir(e.config.VaultPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Skip errors
+		}
+
+		relPath, _ := filepath.Rel(e.config.VaultPath, path)
+		relPath = filepath.ToSlash(relPath)
+
+		if e.shouldIgnore(relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		if info, err := d.Info(); err == nil {
+			sizes[relPath] = info.Size()
+			modTimes[relPath] = info.ModTime()
+		}
+		localFiles = append(localFiles, relPath)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to walk vault: %w", err)
+	}
+
+	hashes = make(map[string]string, len(localFiles))
+	unreadable = make(map[string]bool)
+	var mu sync.Mutex
+
+	bar := progressbar.NewOptions(len(localFiles),
+		progressbar.OptionSetDescription("Scanning files"),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetWidth(40),
+		progressbar.OptionClearOnFinish(),
+		progressbar.OptionSetWriter(os.Stderr), // Keep stdout clean for dry-run plans
+	)
+
+	var reused atomic.Int64
+	forEach(ctx, localFiles, e.hashWorkers(), func(relPath string) {
+		defer bar.Add(1)
+
+		// Files whose mtime and size haven't changed since the last sync aren't read
+		var err error
+		modTime, statted := modTimes[relPath]
+		hash, cached := "", false
+		if statted {
+			hash, cached = e.cachedHash(relPath, modTime, sizes[relPath])
+		}
+		if cached {
+			reused.Add(1)
+		} else {
+			hash, err = HashFile(filepath.Join(e.config.VaultPath, relPath))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			slog.Warn("failed to hash file", "path", relPath, "error", err)
+			unreadable[relPath] = true
+			return
+		}
+		hashes[relPath] = hash
+	})
+	bar.Finish()
+
+	// Files skipped by a cancelled scan would look deleted
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	slog.Debug("scanned vault", "files", len(localFiles), "unchanged", reused.Load())
+
+	return hashes, sizes, unreadable, nil
+}
@@ -0,0 +1,36 @@
+package sync
+
+import "testing"
+
+func TestPlanSortAndCount(t *testing.T) {
+	plan := newPlan()
+	plan.add(PlanEntry{Op: OpDelete, Path: "old.md"}, "h1", "", "h1")
+	plan.add(PlanEntry{Op: OpUpdate, Path: "b.md", Bytes: 20}, "h2", "h3", "h2")
+	plan.add(PlanEntry{Op: OpCreate, Path: "new.md", Bytes: 5}, "", "h4", "")
+	plan.add(PlanEntry{Op: OpUpdate, Path: "a.md", Bytes: 10}, "h5", "h6", "h5")
+	plan.add(PlanEntry{Op: OpMove, Path: "to.md", OldPath: "from.md"}, "", "h7", "")
+	plan.sort()
+
+	want := []string{"to.md", "new.md", "a.md", "b.md", "old.md"}
+	if len(plan.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(plan.Entries), len(want))
+	}
+	for i, entry := range plan.Entries {
+		if entry.Path != want[i] {
+			t.Errorf("entry %d = %s, want %s", i, entry.Path, want[i])
+		}
+	}
+
+	if got := plan.Count(OpUpdate); got != 2 {
+		t.Errorf("Count(update) = %d, want 2", got)
+	}
+	if got := plan.Bytes(OpUpdate); got != 30 {
+		t.Errorf("Bytes(update) = %d, want 30", got)
+	}
+	if got := plan.Count(OpConflict); got != 0 {
+		t.Errorf("Count(conflict) = %d, want 0", got)
+	}
+	if plan.local["a.md"] != "h6" {
+		t.Errorf("local hash of a.md = %q, want h6", plan.local["a.md"])
+	}
+}
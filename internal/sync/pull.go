@@ -0,0 +1,169 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// OverwritePolicy decides what a pull does with files changed locally since
+// the last sync
+type OverwritePolicy string
+
+const (
+	// OverwriteSkip leaves files with local changes as they are; the next
+	// sync uploads them, or keeps both versions if they changed on both sides
+	OverwriteSkip OverwritePolicy = "skip-local-changes"
+	// OverwriteBackup saves the local version next to the file as .bak,
+	// or as a conflict copy if the file changed on both sides
+	OverwriteBackup OverwritePolicy = "backup"
+	// OverwriteForce replaces local changes with the database version
+	OverwriteForce OverwritePolicy = "overwrite"
+)
+
+// OverwritePolicies lists the valid overwrite policies
+var OverwritePolicies = []OverwritePolicy{OverwriteSkip, OverwriteBackup, OverwriteForce}
+
+// File kinds a pull can be limited to
+const (
+	OnlyNotes       = "notes"
+	OnlyAttachments = "attachments"
+)
+
+// PullOptions selects the files a pull writes and how it treats local
+// changes. The zero value pulls everything and keeps local changes.
+type PullOptions struct {
+	Include   []string        // Folders or glob patterns; all files if empty
+	Since     time.Time       // Only files synced to the database since then
+	Only      string          // OnlyNotes, OnlyAttachments or "" for both
+	Overwrite OverwritePolicy // OverwriteSkip if empty
+}
+
+// Validate checks the options for values the pull doesn't know
+func (o PullOptions) Validate() error {
+	switch o.Only {
+	case "", OnlyNotes, OnlyAttachments:
+	default:
+		return fmt.Errorf("invalid file kind %q: use %q or %q", o.Only, OnlyNotes, OnlyAttachments)
+	}
+	switch o.Overwrite {
+	case "", OverwriteSkip, OverwriteBackup, OverwriteForce:
+	default:
+		return fmt.Errorf("invalid overwrite policy %q: use %q, %q or %q", o.Overwrite, OverwriteSkip, OverwriteBackup, OverwriteForce)
+	}
+	for _, pattern := range o.Include {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("invalid include pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// selects reports whether a pull with these options writes relPath. changed
+// holds the paths synced since o.Since, and is ignored if Since isn't set.
+func (o PullOptions) selects(relPath string, changed map[string]bool) bool {
+	switch o.Only {
+	case OnlyNotes:
+		if !isNotePath(relPath) {
+			return false
+		}
+	case OnlyAttachments:
+		if isNotePath(relPath) {
+			return false
+		}
+	}
+	if !o.Since.IsZero() && !changed[relPath] {
+		return false
+	}
+	return len(o.Include) == 0 || matchInclude(relPath, o.Include)
+}
+
+// matchInclude reports whether relPath is, or is inside, one of the folders,
+// or matches one of the glob patterns
+func matchInclude(relPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		if relPath == pattern || strings.HasPrefix(relPath, pattern+"/") {
+			return true
+		}
+		if ok, _ := doublestar.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pullEntry returns the plan entry for a path a pull would change, given the
+// three-way comparison and the overwrite policy. ok is false if nothing
+// needs to change.
+func pullEntry(action syncAction, policy OverwritePolicy) (op PlanOp, reason string, ok bool) {
+	switch action {
+	case actionDownload:
+		return OpDownload, "", true
+	case actionUpload:
+		switch policy {
+		case OverwriteBackup:
+			return OpBackup, "changed locally", true
+		case OverwriteForce:
+			return OpDownload, "discarding local changes", true
+		}
+		return OpKeepLocal, "changed locally", true
+	case actionDeleteRemote:
+		if policy == OverwriteBackup || policy == OverwriteForce {
+			return OpDownload, "deleted locally", true
+		}
+		return OpKeepLocal, "deleted locally", true
+	case actionConflict:
+		switch policy {
+		case OverwriteBackup:
+			return OpConflict, "", true
+		case OverwriteForce:
+			return OpDownload, "discarding local changes", true
+		}
+		return OpKeepLocal, "changed on both sides", true
+	}
+	return "", "", false
+}
+
+// backupPath returns the path a local file is saved under before a pull
+// replaces it, e.g. "Note.md.bak". A counter is appended if that name is
+// already taken.
+func backupPath(relPath string, exists func(string) bool) string {
+	candidate := relPath + ".bak"
+	for n := 2; exists(candidate); n++ {
+		candidate = fmt.Sprintf("%s.bak%d", relPath, n)
+	}
+	return candidate
+}
+
+// backupFile copies a local file to a free backup path, returning the path
+func (e *Engine) backupFile(relPath string) (string, error) {
+	bakPath := backupPath(relPath, func(p string) bool {
+		_, err := os.Stat(filepath.Join(e.config.VaultPath, p))
+		return err == nil
+	})
+
+	src, err := os.Open(filepath.Join(e.config.VaultPath, relPath))
+	if err != nil {
+		return "", fmt.Errorf("failed to read local version: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(filepath.Join(e.config.VaultPath, bakPath), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	return bakPath, nil
+}
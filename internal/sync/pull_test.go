@@ -0,0 +1,95 @@
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPullOptionsSelects(t *testing.T) {
+	changed := map[string]bool{"Projects/new.md": true, "img.png": true}
+
+	tests := []struct {
+		name string
+		opts PullOptions
+		path string
+		want bool
+	}{
+		{"everything", PullOptions{}, "a.md", true},
+		{"folder", PullOptions{Include: []string{"Projects"}}, "Projects/x/a.md", true},
+		{"folder with slash", PullOptions{Include: []string{"Projects/"}}, "Projects/a.md", true},
+		{"folder prefix only", PullOptions{Include: []string{"Projects"}}, "ProjectsOld/a.md", false},
+		{"glob", PullOptions{Include: []string{"Projects/**"}}, "Projects/a.md", true},
+		{"glob miss", PullOptions{Include: []string{"Projects/**"}}, "Daily/a.md", false},
+		{"notes", PullOptions{Only: OnlyNotes}, "img.png", false},
+		{"notes match", PullOptions{Only: OnlyNotes}, "a.MD", true},
+		{"attachments", PullOptions{Only: OnlyAttachments}, "a.md", false},
+		{"since", PullOptions{Since: time.Now()}, "Projects/new.md", true},
+		{"since miss", PullOptions{Since: time.Now()}, "Projects/old.md", false},
+		{"combined", PullOptions{Include: []string{"Projects"}, Since: time.Now(), Only: OnlyNotes}, "Projects/new.md", true},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.selects(tt.path, changed); got != tt.want {
+			t.Errorf("%s: selects(%q) = %v, want %v", tt.name, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPullOptionsValidate(t *testing.T) {
+	valid := PullOptions{Include: []string{"a/**"}, Only: OnlyNotes, Overwrite: OverwriteBackup}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	for _, opts := range []PullOptions{
+		{Only: "images"},
+		{Overwrite: "clobber"},
+		{Include: []string{"a/[b"}},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", opts)
+		}
+	}
+}
+
+func TestPullEntry(t *testing.T) {
+	tests := []struct {
+		action syncAction
+		policy OverwritePolicy
+		want   PlanOp
+	}{
+		{actionDownload, OverwriteSkip, OpDownload},
+		{actionUpload, "", OpKeepLocal},
+		{actionUpload, OverwriteSkip, OpKeepLocal},
+		{actionUpload, OverwriteBackup, OpBackup},
+		{actionUpload, OverwriteForce, OpDownload},
+		{actionDeleteRemote, OverwriteSkip, OpKeepLocal},
+		{actionDeleteRemote, OverwriteBackup, OpDownload},
+		{actionConflict, OverwriteSkip, OpKeepLocal},
+		{actionConflict, OverwriteBackup, OpConflict},
+		{actionConflict, OverwriteForce, OpDownload},
+	}
+	for _, tt := range tests {
+		op, _, ok := pullEntry(tt.action, tt.policy)
+		if !ok || op != tt.want {
+			t.Errorf("pullEntry(%s, %q) = %q, %v; want %q", tt.action, tt.policy, op, ok, tt.want)
+		}
+	}
+
+	if _, _, ok := pullEntry(actionNone, OverwriteForce); ok {
+		t.Error("pullEntry(none) returned an entry")
+	}
+}
+
+func TestBackupPath(t *testing.T) {
+	taken := map[string]bool{}
+	exists := func(p string) bool { return taken[p] }
+
+	if got := backupPath("Notes/a.md", exists); got != "Notes/a.md.bak" {
+		t.Errorf("backupPath = %q", got)
+	}
+	taken["Notes/a.md.bak"] = true
+	taken["Notes/a.md.bak2"] = true
+	if got := backupPath("Notes/a.md", exists); got != "Notes/a.md.bak3" {
+		t.Errorf("backupPath with existing backups = %q", got)
+	}
+}
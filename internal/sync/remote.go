@@ -0,0 +1,201 @@
+package sync
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vonshlovens/obsync-pg/internal/db"
+)
+
+// ApplyRemoteChange writes a change made by another device to the local vault.
+// Files that were also edited locally are handled as conflicts.
+func (e *Engine) ApplyRemoteChange(ctx context.Context, change db.Change) error {
+	if change.Op != db.ChangeResync {
+		if err := e.checkKey(ctx); err != nil {
+			return err
+		}
+	}
+	defer e.relink(ctx)
+
+	switch change.Op {
+	case db.ChangeResync:
+		// Notifications were lost while the listener was disconnected
+		return e.FullReconcile(ctx)
+	case db.ChangeRename:
+		return e.applyRemoteMove(ctx, change)
+	case db.ChangeDelete:
+		return e.applyRemote(ctx, change.Path, "")
+	default:
+		return e.applyRemote(ctx, change.Path, change.ContentHash)
+	}
+}
+
+// applyRemote brings a path in line with a new remote hash ("" if deleted)
+func (e *Engine) applyRemote(ctx context.Context, relPath, remote string) error {
+	if e.shouldIgnore(relPath) {
+		return nil
+	}
+
+	// Our own uploads come back as notifications too
+	base := e.baseHash(relPath)
+	if remote == base {
+		return nil
+	}
+	e.forgetLinkTargets()
+
+	local, err := e.localHash(relPath)
+	if err != nil {
+		return err
+	}
+
+	return e.apply(ctx, relPath, base, local, remote)
+}
+
+// downloadFile writes the database version of a file to the vault and
+// returns the device that last wrote it
+func (e *Engine) downloadFile(ctx context.Context, relPath string) (*string, error) {
+	if !isNotePath(relPath) {
+		att, err := e.db.GetAttachmentByPath(ctx, relPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get attachment: %w", err)
+		}
+		if att == nil {
+			return nil, nil // Deleted in the meantime
+		}
+		if err := e.downloadAttachment(ctx, att); err != nil {
+			return nil, err
+		}
+		slog.Info("downloaded file", "path", relPath, "hash", att.ContentHash[:8])
+		return att.SyncedBy, nil
+	}
+
+	note, err := e.db.GetNoteByPath(ctx, relPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get note: %w", err)
+	}
+	if note == nil {
+		return nil, nil
+	}
+
+	// Rows written before file times were recorded fall back to the note's date
+	meta := fileMeta{modTime: cmp.Or(note.FileModTime, note.ModifiedAt), mode: note.FileMode}
+	if err := e.writeRemoteFile(relPath, []byte(note.RawContent), note.ContentHash, meta); err != nil {
+		return nil, err
+	}
+
+	slog.Info("downloaded file", "path", relPath, "hash", note.ContentHash[:8])
+	return note.SyncedBy, nil
+}
+
+// writeRemoteFile writes downloaded content to the vault. Recording the new
+// hash suppresses the watcher echo, so the file isn't uploaded again.
+func (e *Engine) writeRemoteFile(relPath string, data []byte, hash string, meta fileMeta) error {
+	absPath := filepath.Join(e.config.VaultPath, relPath)
+	if err := writeVaultFile(absPath, data); err != nil {
+		return err
+	}
+	e.applyFileMeta(absPath, meta)
+	return e.recordFileState(relPath, hash)
+}
+
+// fileMeta is the file metadata stored with a row, restored when the file
+// is downloaded. Unset fields are left as the write made them.
+type fileMeta struct {
+	modTime *time.Time
+	mode    *int32
+}
+
+// fileMode returns the permission bits of a file to store with its row, or
+// nil unless sync.preserve_mode is enabled
+func (e *Engine) fileMode(info os.FileInfo) *int32 {
+	if !e.config.Sync.PreserveMode {
+		return nil
+	}
+	mode := int32(info.Mode().Perm())
+	return &mode
+}
+
+// applyFileMeta sets the modification time and, if sync.preserve_mode is
+// enabled, the permissions of a downloaded file. It is applied before the
+// file's state is recorded, so the restored mtime is what later scans see.
+func (e *Engine) applyFileMeta(absPath string, meta fileMeta) {
+	if meta.modTime != nil {
+		if err := os.Chtimes(absPath, time.Time{}, *meta.modTime); err != nil {
+			slog.Warn("failed to set modification time", "path", absPath, "error", err)
+		}
+	}
+	if meta.mode != nil && e.config.Sync.PreserveMode {
+		if err := os.Chmod(absPath, os.FileMode(*meta.mode)&os.ModePerm); err != nil {
+			slog.Warn("failed to set permissions", "path", absPath, "error", err)
+		}
+	}
+}
+
+// deleteLocalFile removes a vault file that was deleted on another device
+func (e *Engine) deleteLocalFile(relPath string) error {
+	// Drop the state first so the watcher's delete event is not pushed back
+	prev := e.state.GetFileState(relPath)
+	e.state.RemoveFileState(relPath)
+
+	absPath := filepath.Join(e.config.VaultPath, relPath)
+	if err := os.Remove(absPath); err != nil && !os.IsNotExist(err) {
+		// Still tracked, so a retry removes it rather than uploading it again
+		if prev != nil {
+			e.state.SetFileState(relPath, prev)
+		}
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+
+	slog.Info("removed file deleted remotely", "path", relPath)
+	return nil
+}
+
+// recordFileState stores the current on-disk metadata of a file under the given hash
+func (e *Engine) recordFileState(relPath, hash string) error {
+	absPath := filepath.Join(e.config.VaultPath, relPath)
+
+	readAt := time.Now()
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	// Notes need their synced content as the base for future merges
+	if isNotePath(relPath) && !e.bases.Has(hash) {
+		if content, err := os.ReadFile(absPath); err == nil && HashContent(content) == hash {
+			if err := e.bases.Put(hash, content); err != nil {
+				slog.Warn("failed to store base version", "path", relPath, "error", err)
+			}
+		}
+	}
+
+	state := &FileState{
+		Hash:       hash,
+		LastSynced: readAt,
+		SizeBytes:  info.Size(),
+	}
+
+	// The metadata only vouches for the hash if the file still has that content
+	if current, err := HashFile(absPath); err == nil && current == hash {
+		state.LastModified = info.ModTime()
+	}
+
+	e.state.SetFileState(relPath, state)
+	return nil
+}
+
+// writeVaultFile writes data to a vault file, creating parent directories
+func writeVaultFile(absPath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.WriteFile(absPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package sync
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRetryDelay caps the backoff between retries
+const maxRetryDelay = time.Hour
+
+// RetryOp is the operation that failed
+type RetryOp string
+
+const (
+	RetryUpload   RetryOp = "upload"
+	RetryDelete   RetryOp = "delete"
+	RetryDownload RetryOp = "download"
+	RetrySync     RetryOp = "sync" // compare both sides again
+)
+
+// RetryEntry is a failed operation waiting to be retried
+type RetryEntry struct {
+	Path        string    `json:"path"`
+	Op          RetryOp   `json:"op"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	FirstFailed time.Time `json:"first_failed"`
+	LastFailed  time.Time `json:"last_failed"`
+	NextRetry   time.Time `json:"next_retry"`
+}
+
+// retryFile is the on-disk form of a RetryQueue
+type retryFile struct {
+	Pending map[string]*RetryEntry `json:"pending"`
+	Dead    map[string]*RetryEntry `json:"dead"`
+}
+
+// RetryQueue keeps failed operations across restarts, next to the state
+// file of its vault. Paths that keep failing are moved to a dead-letter list instead of
+// being dropped.
+type RetryQueue struct {
+	data       retryFile
+	filePath   string
+	baseDelay  time.Duration
+	maxRetries int
+	mu         sync.Mutex
+	dirty      bool
+}
+
+// NewRetryQueue loads the retry queue of a vault, kept next to stateFile if
+// the vault has one
+func NewRetryQueue(vaultPath, stateFile string, baseDelay time.Duration, maxRetries int) (*RetryQueue, error) {
+	filePath, err := stateFilePath(vaultPath, stateFile, "retry", ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	q := &RetryQueue{
+		filePath:   filePath,
+		baseDelay:  baseDelay,
+		maxRetries: maxRetries,
+		data: retryFile{
+			Pending: make(map[string]*RetryEntry),
+			Dead:    make(map[string]*RetryEntry),
+		},
+	}
+
+	// A missing or corrupt queue starts empty; the next full sync finds the files again
+	q.load()
+
+	return q, nil
+}
+
+// load reads the queue from disk
+func (q *RetryQueue) load() error {
+	data, err := os.ReadFile(q.filePath)
+	if err != nil {
+		return err
+	}
+
+	loaded := retryFile{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+
+	if loaded.Pending == nil {
+		loaded.Pending = make(map[string]*RetryEntry)
+	}
+	if loaded.Dead == nil {
+		loaded.Dead = make(map[string]*RetryEntry)
+	}
+
+	q.data = loaded
+	return nil
+}
+
+// Save persists the queue to disk
+func (q *RetryQueue) Save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(q.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(q.filePath, data, 0644); err != nil {
+		return err
+	}
+
+	q.dirty = false
+	return nil
+}
+
+// Fail records a failed operation and schedules its next retry. It reports
+// whether the path was moved to the dead-letter list.
+func (q *RetryQueue) Fail(relPath string, op RetryOp, cause error, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dirty = true
+
+	// Paths already given up on stay there until they sync
+	if entry, ok := q.data.Dead[relPath]; ok {
+		entry.Op = op
+		entry.LastError = cause.Error()
+		entry.LastFailed = now
+		return false
+	}
+
+	entry, ok := q.data.Pending[relPath]
+	if !ok {
+		entry = &RetryEntry{Path: relPath, FirstFailed: now}
+		q.data.Pending[relPath] = entry
+	}
+	entry.Op = op
+	entry.Attempts++
+	entry.LastError = cause.Error()
+	entry.LastFailed = now
+
+	if entry.Attempts > q.maxRetries {
+		delete(q.data.Pending, relPath)
+		entry.NextRetry = time.Time{}
+		q.data.Dead[relPath] = entry
+		return true
+	}
+
+	entry.NextRetry = now.Add(Backoff(q.baseDelay, maxRetryDelay, entry.Attempts, rand.Float64()))
+	return false
+}
+
+// Done removes a path that synced successfully from the queue and the
+// dead-letter list
+func (q *RetryQueue) Done(relPath string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, pending := q.data.Pending[relPath]
+	_, dead := q.data.Dead[relPath]
+	if !pending && !dead {
+		return
+	}
+	delete(q.data.Pending, relPath)
+	delete(q.data.Dead, relPath)
+	q.dirty = true
+}
+
+// DoneBefore removes every entry, pending or dead, that last failed before
+// the given time. A full sync that started then has handled those paths.
+func (q *RetryQueue) DoneBefore(t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, entries := range []map[string]*RetryEntry{q.data.Pending, q.data.Dead} {
+		for relPath, entry := range entries {
+			if entry.LastFailed.Before(t) {
+				delete(entries, relPath)
+				q.dirty = true
+			}
+		}
+	}
+}
+
+// Due returns the pending entries whose next retry is at or before now
+func (q *RetryQueue) Due(now time.Time) []RetryEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []RetryEntry
+	for _, entry := range q.data.Pending {
+		if !entry.NextRetry.After(now) {
+			due = append(due, *entry)
+		}
+	}
+	sortEntries(due)
+	return due
+}
+
+// Pending returns all entries waiting to be retried, by path
+func (q *RetryQueue) Pending() []RetryEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return copyEntries(q.data.Pending)
+}
+
+// Dead returns the entries that failed too often to be retried, by path
+func (q *RetryQueue) Dead() []RetryEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return copyEntries(q.data.Dead)
+}
+
+// Len returns the number of entries waiting to be retried
+func (q *RetryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.data.Pending)
+}
+
+// Backoff returns the delay before the given attempt: the base delay doubled
+// for every earlier attempt, capped at maxDelay, with the upper half
+// randomized by jitter (0 to 1) so clients don't retry in lockstep
+func Backoff(base, maxDelay time.Duration, attempt int, jitter float64) time.Duration {
+	delay := max(base, time.Millisecond)
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	return delay/2 + time.Duration(jitter*float64(delay/2))
+}
+
+func copyEntries(entries map[string]*RetryEntry) []RetryEntry {
+	list := make([]RetryEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, *entry)
+	}
+	sortEntries(list)
+	return list
+}
+
+func sortEntries(entries []RetryEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+}
@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	base := time.Second
+
+	tests := []struct {
+		attempt int
+		jitter  float64
+		want    time.Duration
+	}{
+		{1, 0, 500 * time.Millisecond},
+		{1, 0.999999, time.Second},
+		{2, 0, time.Second},
+		{3, 0, 2 * time.Second},
+		{4, 0.5, 6 * time.Second},
+		{30, 0, maxRetryDelay / 2},
+		{30, 1, maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		got := Backoff(base, maxRetryDelay, tt.attempt, tt.jitter)
+		if got.Round(time.Millisecond) != tt.want {
+			t.Errorf("Backoff(%v, %d, %v) = %v, want %v", base, tt.attempt, tt.jitter, got, tt.want)
+		}
+	}
+}
+
+func newTestRetryQueue(t *testing.T, maxRetries int) *RetryQueue {
+	return &RetryQueue{
+		filePath:   filepath.Join(t.TempDir(), "retry.json"),
+		baseDelay:  time.Second,
+		maxRetries: maxRetries,
+		data: retryFile{
+			Pending: make(map[string]*RetryEntry),
+			Dead:    make(map[string]*RetryEntry),
+		},
+	}
+}
+
+func TestRetryQueue_DeadLetter(t *testing.T) {
+	q := newTestRetryQueue(t, 2)
+	now := time.Now()
+	cause := errors.New("connection refused")
+
+	for i := 1; i <= 3; i++ {
+		dead := q.Fail("note.md", RetryUpload, cause, now)
+		if want := i == 3; dead != want {
+			t.Fatalf("failure %d: dead = %v, want %v", i, dead, want)
+		}
+	}
+
+	if q.Len() != 0 {
+		t.Errorf("pending = %d, want 0", q.Len())
+	}
+	dead := q.Dead()
+	if len(dead) != 1 || dead[0].Path != "note.md" || dead[0].Attempts != 3 || dead[0].LastError != cause.Error() {
+		t.Fatalf("dead = %+v", dead)
+	}
+
+	// Further failures update the dead entry without reviving it
+	q.Fail("note.md", RetryDelete, errors.New("timeout"), now)
+	if q.Len() != 0 || q.Dead()[0].LastError != "timeout" {
+		t.Errorf("dead entry not updated: %+v", q.Dead())
+	}
+
+	q.Done("note.md")
+	if len(q.Dead()) != 0 {
+		t.Errorf("dead = %+v after Done, want none", q.Dead())
+	}
+}
+
+func TestRetryQueue_Due(t *testing.T) {
+	q := newTestRetryQueue(t, 5)
+	now := time.Now()
+	cause := errors.New("boom")
+
+	q.Fail("a.md", RetryUpload, cause, now)
+	q.Fail("b.md", RetryUpload, cause, now)
+	q.Fail("b.md", RetryUpload, cause, now)
+
+	if due := q.Due(now); len(due) != 0 {
+		t.Errorf("due immediately: %+v", due)
+	}
+
+	// The first retry comes after at most the base delay, the second after at most twice that
+	due := q.Due(now.Add(time.Second))
+	if len(due) != 1 || due[0].Path != "a.md" {
+		t.Errorf("due after 1s = %+v, want a.md", due)
+	}
+	if due := q.Due(now.Add(2 * time.Second)); len(due) != 2 {
+		t.Errorf("due after 2s = %+v, want both", due)
+	}
+}
+
+func TestRetryQueue_DoneBefore(t *testing.T) {
+	q := newTestRetryQueue(t, 0)
+	start := time.Now()
+	cause := errors.New("boom")
+
+	q.Fail("old.md", RetryUpload, cause, start.Add(-time.Minute))
+	q.Fail("dead.md", RetryUpload, cause, start.Add(-time.Minute))
+	q.Fail("new.md", RetryUpload, cause, start.Add(time.Second))
+
+	q.DoneBefore(start)
+
+	if len(q.Dead()) != 1 || q.Dead()[0].Path != "new.md" {
+		t.Errorf("dead = %+v, want only new.md", q.Dead())
+	}
+}
+
+func TestRetryQueue_SaveLoad(t *testing.T) {
+	q := newTestRetryQueue(t, 3)
+	q.Fail("note.md", RetryDelete, errors.New("boom"), time.Now())
+	if err := q.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestRetryQueue(t, 3)
+	loaded.filePath = q.filePath
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := loaded.Pending()
+	if len(pending) != 1 || pending[0].Path != "note.md" || pending[0].Op != RetryDelete {
+		t.Errorf("pending = %+v", pending)
+	}
+}
@@ -0,0 +1,27 @@
+package sync
+
+import (
+	"errors"
+)
+
+// ErrMassDelete is returned by FullReconcile when it held back deletions
+// that exceeded the mass-delete limits
+var ErrMassDelete = errors.New("refusing to delete files")
+
+// minPercentDeletes is the number of deletions from which the percentage
+// limit always applies. Fewer deletions are only checked against it if they
+// are more than half the vault, so removing a few files from a large vault
+// isn't blocked, but emptying most of a small one is.
+const minPercentDeletes = 10
+
+// exceedsDeleteLimit reports whether deleting n of tracked files needs to be
+// confirmed. A limit of 0 is disabled.
+func exceedsDeleteLimit(n, tracked, maxCount, maxPercent int) bool {
+	if maxCount > 0 && n > maxCount {
+		return true
+	}
+	if maxPercent > 0 && (n >= minPercentDeletes || n*2 > tracked) && n*100 > tracked*maxPercent {
+		return true
+	}
+	return false
+}
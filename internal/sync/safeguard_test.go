@@ -0,0 +1,43 @@
+package sync
+
+import "testing"
+
+func TestExceedsDeleteLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		n, tracked int
+		maxCount   int
+		maxPercent int
+		want       bool
+	}{
+		{"nothing deleted", 0, 1000, 50, 25, false},
+		{"few deletions", 5, 1000, 50, 25, false},
+		{"over count", 51, 1000, 50, 25, true},
+		{"at count", 50, 1000, 50, 25, false},
+		{"over percent", 30, 100, 50, 25, true},
+		{"at percent", 25, 100, 50, 25, false},
+		{"few deletions from small vault", 1, 3, 50, 25, false},
+		{"half of small vault", 2, 4, 50, 25, false},
+		{"most of small vault", 3, 4, 50, 25, true},
+		{"most of ten files", 9, 10, 50, 25, true},
+		{"percent from ten deletions", 10, 50, 50, 25, false},
+		{"over percent from ten deletions", 10, 39, 50, 25, true},
+		{"empty vault", 40, 40, 50, 25, true},
+		{"empty small vault", 4, 4, 50, 25, true},
+		{"one file vault", 1, 1, 50, 25, true},
+		{"nothing tracked", 0, 0, 50, 25, false},
+		{"empty small vault, percent disabled", 4, 4, 50, 0, false},
+		{"count disabled", 500, 1000, 0, 90, false},
+		{"both disabled", 1000, 1000, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := exceedsDeleteLimit(tt.n, tt.tracked, tt.maxCount, tt.maxPercent)
+			if got != tt.want {
+				t.Errorf("exceedsDeleteLimit(%d, %d, %d, %d) = %v, want %v",
+					tt.n, tt.tracked, tt.maxCount, tt.maxPercent, got, tt.want)
+			}
+		})
+	}
+}
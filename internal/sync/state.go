@@ -2,15 +2,19 @@ package sync
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/vonshlovens/obsync-pg/internal/config"
 )
 
-// FileState represents the sync state of a single file
+// FileState represents the sync state of a single file. LastModified and
+// SizeBytes describe the file as it was before it was read at LastSynced; a
+// zero LastModified means they can't be trusted to skip rehashing.
 type FileState struct {
 	Hash         string    `json:"hash"`
 	LastSynced   time.Time `json:"last_synced"`
@@ -18,11 +22,48 @@ type FileState struct {
 	SizeBytes    int64     `json:"size_bytes"`
 }
 
+// racyWindow is how long before its last sync a file must have been modified
+// for its mtime to be trusted. Coarse filesystem timestamps (2s on FAT) could
+// otherwise hide an edit made just after the file was read.
+const racyWindow = 2 * time.Second
+
+// Unchanged reports whether a file with the given mtime and size still holds
+// the content recorded in the state, so it doesn't need to be hashed again
+func (fs *FileState) Unchanged(modTime time.Time, size int64, now time.Time) bool {
+	if fs == nil || fs.LastModified.IsZero() {
+		return false
+	}
+	if !modTime.Equal(fs.LastModified) || size != fs.SizeBytes {
+		return false
+	}
+
+	// The clock went back since the last sync, so timestamps can't be compared
+	if fs.LastSynced.After(now) {
+		return false
+	}
+
+	// Modified too close to the last sync to rule out a later edit in the same tick
+	return modTime.Before(fs.LastSynced.Add(-racyWindow))
+}
+
+// BlockedDeletes records a full sync that refused to delete files
+type BlockedDeletes struct {
+	Count      int       `json:"count"`
+	Tracked    int       `json:"tracked"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// stateVersion is bumped when recorded file states need to be upgraded.
+// Version 1 made file metadata trustworthy enough to skip rehashing.
+const stateVersion = 1
+
 // SyncState represents the local sync state
 type SyncState struct {
-	VaultPath    string                `json:"vault_path"`
-	LastFullSync *time.Time            `json:"last_full_sync,omitempty"`
-	Files        map[string]*FileState `json:"files"`
+	Version        int                   `json:"version,omitempty"`
+	VaultPath      string                `json:"vault_path"`
+	LastFullSync   *time.Time            `json:"last_full_sync,omitempty"`
+	BlockedDeletes *BlockedDeletes       `json:"blocked_deletes,omitempty"`
+	Files          map[string]*FileState `json:"files"`
 }
 
 // StateTracker manages local sync state
@@ -33,20 +74,43 @@ type StateTracker struct {
 	dirty    bool
 }
 
-// NewStateTracker creates a new state tracker
-func NewStateTracker(vaultPath string) (*StateTracker, error) {
+// stateFilePath returns the file a vault keeps a kind of sync state in, such
+// as its retry queue. With a state file set, it is next to it and named
+// after it, so the vault's state moves with it; otherwise it is in the
+// config directory, named after the vault's path.
+func stateFilePath(vaultPath, stateFile, kind, ext string) (string, error) {
+	if stateFile != "" {
+		name := strings.TrimSuffix(filepath.Base(stateFile), filepath.Ext(stateFile))
+		return filepath.Join(filepath.Dir(stateFile), name+"-"+kind+ext), nil
+	}
+
 	stateDir, err := config.GetStateDir()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return filepath.Join(stateDir, kind+"-"+HashString(vaultPath)[:12]+ext), nil
+}
+
+// NewStateTracker creates a new state tracker keeping its state in filePath,
+// or in a file in the config directory if filePath is empty
+func NewStateTracker(vaultPath, filePath string) (*StateTracker, error) {
+	if filePath == "" {
+		stateDir, err := config.GetStateDir()
+		if err != nil {
+			return nil, err
+		}
 
-	// Create a unique state file based on vault path hash
-	vaultHash := HashString(vaultPath)[:12]
-	filePath := filepath.Join(stateDir, "state-"+vaultHash+".json")
+		// Create a unique state file based on vault path hash
+		vaultHash := HashString(vaultPath)[:12]
+		filePath = filepath.Join(stateDir, "state-"+vaultHash+".json")
+	} else if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
 
 	st := &StateTracker{
 		filePath: filePath,
 		state: &SyncState{
+			Version:   stateVersion,
 			VaultPath: vaultPath,
 			Files:     make(map[string]*FileState),
 		},
@@ -60,6 +124,7 @@ func NewStateTracker(vaultPath string) (*StateTracker, error) {
 	// Verify vault path matches
 	if st.state.VaultPath != vaultPath {
 		st.state = &SyncState{
+			Version:   stateVersion,
 			VaultPath: vaultPath,
 			Files:     make(map[string]*FileState),
 		}
@@ -84,6 +149,16 @@ func (st *StateTracker) load() error {
 		state.Files = make(map[string]*FileState)
 	}
 
+	// Older versions recorded metadata that may not match the hash, so
+	// every file is hashed once more
+	if state.Version < stateVersion {
+		for _, fs := range state.Files {
+			fs.LastModified = time.Time{}
+		}
+		state.Version = stateVersion
+		st.dirty = true
+	}
+
 	st.state = state
 	return nil
 }
@@ -160,6 +235,24 @@ func (st *StateTracker) GetLastFullSync() *time.Time {
 	return st.state.LastFullSync
 }
 
+// SetBlockedDeletes records (or, with nil, clears) deletions held back by the mass-delete safeguard
+func (st *StateTracker) SetBlockedDeletes(b *BlockedDeletes) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if b == nil && st.state.BlockedDeletes == nil {
+		return
+	}
+	st.state.BlockedDeletes = b
+	st.dirty = true
+}
+
+// GetBlockedDeletes returns the deletions held back by the last full sync, if any
+func (st *StateTracker) GetBlockedDeletes() *BlockedDeletes {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.state.BlockedDeletes
+}
+
 // NeedsSync checks if a file needs to be synced based on hash comparison
 func (st *StateTracker) NeedsSync(path string, currentHash string) bool {
 	st.mu.RLock()
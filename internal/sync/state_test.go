@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStateUnchanged(t *testing.T) {
+	synced := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	modified := synced.Add(-time.Hour)
+	st := &FileState{Hash: "abc", LastSynced: synced, LastModified: modified, SizeBytes: 100}
+	now := synced.Add(time.Minute)
+
+	tests := []struct {
+		name    string
+		state   *FileState
+		modTime time.Time
+		size    int64
+		now     time.Time
+		want    bool
+	}{
+		{"unchanged", st, modified, 100, now, true},
+		{"untracked", nil, modified, 100, now, false},
+		{"mtime changed", st, modified.Add(time.Second), 100, now, false},
+		{"mtime changed by a nanosecond", st, modified.Add(1), 100, now, false},
+		{"size changed", st, modified, 101, now, false},
+		{"clock went back", st, modified, 100, synced.Add(-time.Minute), false},
+		{"no metadata", &FileState{Hash: "abc", LastSynced: synced, SizeBytes: 100}, time.Time{}, 100, now, false},
+		{"modified just before sync",
+			&FileState{Hash: "abc", LastSynced: synced, LastModified: synced.Add(-time.Second), SizeBytes: 100},
+			synced.Add(-time.Second), 100, now, false},
+		{"modified after sync",
+			&FileState{Hash: "abc", LastSynced: synced, LastModified: synced.Add(time.Second), SizeBytes: 100},
+			synced.Add(time.Second), 100, now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.Unchanged(tt.modTime, tt.size, tt.now); got != tt.want {
+				t.Errorf("Unchanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateFilePath(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "work.json")
+
+	got, err := stateFilePath("/vaults/work", stateFile, "retry", ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "work-retry.json"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	one, _ := stateFilePath("/vaults/one", "", "outbox", ".jsonl")
+	two, _ := stateFilePath("/vaults/two", "", "outbox", ".jsonl")
+	if one == two {
+		t.Errorf("vaults share the outbox %s", one)
+	}
+}
@@ -0,0 +1,35 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// RestoreFromTrash brings deleted files back in the database and writes them
+// to the vault
+func (e *Engine) RestoreFromTrash(ctx context.Context, paths []string) error {
+	if err := e.checkKey(ctx); err != nil {
+		return err
+	}
+
+	restored, err := e.db.RestoreFromTrash(ctx, paths, e.config.DeviceName)
+	if err != nil {
+		return fmt.Errorf("failed to restore from trash: %w", err)
+	}
+
+	e.linksChanged()
+	defer e.relink(ctx)
+
+	for _, relPath := range paths {
+		if e.shouldIgnore(relPath) {
+			continue
+		}
+		if err := e.syncPath(ctx, relPath); err != nil {
+			slog.Error("failed to restore file", "path", relPath, "error", err)
+		}
+	}
+
+	slog.Info("restored files from trash", "count", restored)
+	return nil
+}
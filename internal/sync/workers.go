@@ -0,0 +1,44 @@
+package sync
+
+import (
+	"context"
+	"sync"
+)
+
+// forEach calls fn for every item on up to workers goroutines and waits for
+// them to finish. Items not yet started when ctx is cancelled are skipped.
+func forEach[T any](ctx context.Context, items []T, workers int, fn func(item T)) {
+	workers = max(1, min(workers, len(items)))
+
+	jobs := make(chan T)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				fn(item)
+			}
+		}()
+	}
+
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// hashWorkers returns how many files are hashed in parallel
+func (e *Engine) hashWorkers() int {
+	return max(1, e.config.Sync.Workers)
+}
+
+// uploadWorkers returns how many batches are uploaded in parallel. Every
+// upload holds a database connection, so it never exceeds the connection pool.
+func (e *Engine) uploadWorkers() int {
+	return max(1, min(e.config.Sync.Workers, e.db.MaxConns()))
+}
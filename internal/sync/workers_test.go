@@ -0,0 +1,69 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+	var paths []string
+	for i := range 100 {
+		paths = append(paths, fmt.Sprintf("note-%d.md", i))
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	var running, peak atomic.Int32
+
+	forEach(context.Background(), paths, 4, func(relPath string) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+
+		mu.Lock()
+		seen[relPath]++
+		mu.Unlock()
+	})
+
+	if len(seen) != len(paths) {
+		t.Fatalf("visited %d paths, want %d", len(seen), len(paths))
+	}
+	for relPath, n := range seen {
+		if n != 1 {
+			t.Errorf("%s visited %d times", relPath, n)
+		}
+	}
+	if peak.Load() > 4 {
+		t.Errorf("ran %d workers at once, want at most 4", peak.Load())
+	}
+}
+
+func TestForEach_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls atomic.Int32
+	forEach(ctx, []string{"a.md", "b.md", "c.md"}, 2, func(string) {
+		calls.Add(1)
+	})
+
+	if calls.Load() != 0 {
+		t.Errorf("ran %d paths after cancellation, want 0", calls.Load())
+	}
+}
+
+func TestForEach_NoPaths(t *testing.T) {
+	forEach(context.Background(), nil, 4, func(string) {
+		t.Error("fn called without paths")
+	})
+}
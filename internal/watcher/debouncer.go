@@ -33,6 +33,7 @@ func (e EventType) String() string {
 // FileEvent represents a debounced file event
 type FileEvent struct {
 	Path      string
+	OldPath   string // Previous path of a renamed file
 	EventType EventType
 	Timestamp time.Time
 }
@@ -79,8 +80,44 @@ func (d *Debouncer) Add(path string, eventType EventType) {
 	default:
 	}
 
+	d.add(path, eventType, "")
+}
+
+// AddRename adds a file moved from oldPath to newPath. Pending events for
+// the old path are folded into the rename.
+func (d *Debouncer) AddRename(oldPath, newPath string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	select {
+	case <-d.stopCh:
+		return
+	default:
+	}
+
+	if pending, exists := d.events[oldPath]; exists {
+		pending.timer.Stop()
+		delete(d.events, oldPath)
+
+		switch pending.event.EventType {
+		case EventCreate:
+			// Never reported under its old name, so it's simply a new file
+			d.add(newPath, EventCreate, "")
+			return
+		case EventRename:
+			// Moved twice: report a single move from the original path
+			oldPath = pending.event.OldPath
+		}
+	}
+
+	d.add(newPath, EventRename, oldPath)
+}
+
+// add queues an event; d.mu must be held
+func (d *Debouncer) add(path string, eventType EventType, oldPath string) {
 	event := FileEvent{
 		Path:      path,
+		OldPath:   oldPath,
 		EventType: eventType,
 		Timestamp: time.Now(),
 	}
@@ -92,10 +129,21 @@ func (d *Debouncer) Add(path string, eventType EventType) {
 
 		// Coalesce event types
 		// DELETE always wins (file is gone)
+		// RENAME + DELETE = DELETE of both paths
+		// RENAME + CREATE/MODIFY = RENAME (moved file modified)
 		// CREATE + MODIFY = CREATE (new file modified)
 		// MODIFY + MODIFY = MODIFY
 		if eventType == EventDelete {
+			if pending.event.EventType == EventRename {
+				d.add(pending.event.OldPath, EventDelete, "")
+				pending.event.OldPath = ""
+			}
 			pending.event.EventType = EventDelete
+		} else if eventType == EventRename {
+			pending.event.EventType = EventRename
+			pending.event.OldPath = oldPath
+		} else if pending.event.EventType == EventRename {
+			// Keep as RENAME
 		} else if pending.event.EventType == EventCreate && eventType == EventModify {
 			// Keep as CREATE
 		} else if pending.event.EventType != EventDelete {
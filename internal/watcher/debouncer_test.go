@@ -144,6 +144,93 @@ func TestDebouncer_Flush(t *testing.T) {
 	}
 }
 
+func TestDebouncer_Rename(t *testing.T) {
+	d := NewDebouncer(50)
+	defer d.Stop()
+
+	d.AddRename("old.md", "new.md")
+	d.Add("new.md", EventModify)
+
+	select {
+	case event := <-d.Events():
+		if event.EventType != EventRename {
+			t.Errorf("expected EventRename, got %v", event.EventType)
+		}
+		if event.Path != "new.md" || event.OldPath != "old.md" {
+			t.Errorf("expected old.md -> new.md, got %q -> %q", event.OldPath, event.Path)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Error("timed out waiting for event")
+	}
+}
+
+func TestDebouncer_RenameChain(t *testing.T) {
+	d := NewDebouncer(50)
+	defer d.Stop()
+
+	d.AddRename("a.md", "b.md")
+	d.AddRename("b.md", "c.md")
+
+	select {
+	case event := <-d.Events():
+		if event.EventType != EventRename || event.OldPath != "a.md" || event.Path != "c.md" {
+			t.Errorf("expected rename a.md -> c.md, got %v %q -> %q", event.EventType, event.OldPath, event.Path)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Error("timed out waiting for event")
+	}
+
+	if d.PendingCount() != 0 {
+		t.Errorf("expected 0 pending, got %d", d.PendingCount())
+	}
+}
+
+func TestDebouncer_RenameNewFile(t *testing.T) {
+	d := NewDebouncer(50)
+	defer d.Stop()
+
+	// A file created and renamed before it was reported is just a new file
+	d.Add("Untitled.md", EventCreate)
+	d.AddRename("Untitled.md", "Meeting.md")
+
+	select {
+	case event := <-d.Events():
+		if event.EventType != EventCreate || event.Path != "Meeting.md" {
+			t.Errorf("expected create of Meeting.md, got %v %q", event.EventType, event.Path)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Error("timed out waiting for event")
+	}
+}
+
+func TestDebouncer_RenameThenDelete(t *testing.T) {
+	d := NewDebouncer(50)
+	defer d.Stop()
+
+	d.AddRename("old.md", "new.md")
+	d.Add("new.md", EventDelete)
+
+	received := make(map[string]EventType)
+	timeout := time.After(300 * time.Millisecond)
+
+loop:
+	for {
+		select {
+		case event := <-d.Events():
+			received[event.Path] = event.EventType
+			if len(received) == 2 {
+				break loop
+			}
+		case <-timeout:
+			break loop
+		}
+	}
+
+	if received["old.md"] != EventDelete || received["new.md"] != EventDelete {
+		t.Errorf("expected deletes of both paths, got %v", received)
+	}
+}
+
 func TestEventType_String(t *testing.T) {
 	tests := []struct {
 		event    EventType
@@ -6,11 +6,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
 	"github.com/fsnotify/fsnotify"
 )
 
+// renameWindow is how long the old name of a renamed file waits for the
+// create event of its new name before it is treated as a delete
+const renameWindow = 100 * time.Millisecond
+
 // Watcher monitors a directory for file changes
 type Watcher struct {
 	rootPath       string
@@ -19,6 +25,15 @@ type Watcher struct {
 	ignorePatterns []string
 	includePatterns []string
 	stopCh         chan struct{}
+
+	renameMu      sync.Mutex
+	pendingRename *pendingRename
+}
+
+// pendingRename is the old name of a file that was just renamed
+type pendingRename struct {
+	path  string
+	timer *time.Timer
 }
 
 // NewWatcher creates a new file watcher
@@ -146,13 +161,26 @@ func (w *Watcher) handleEvent(event fsnotify.Event, relPath string) {
 
 	switch {
 	case event.Has(fsnotify.Create):
+		// A create right after a rename is taken as the new name of the
+		// renamed file. The engine only keeps the file's identity if the
+		// content is what it last synced.
+		oldPath, renamed := w.takeRename()
+
 		// If it's a new directory, add it to watcher
 		if statErr == nil && info.IsDir() {
 			if err := w.addRecursive(event.Name); err != nil {
 				slog.Warn("failed to add new directory", "path", event.Name, "error", err)
 			}
+			if renamed {
+				w.renameTree(oldPath, relPath)
+			}
 			return // Don't emit events for directories
 		}
+
+		if renamed {
+			w.debouncer.AddRename(oldPath, relPath)
+			return
+		}
 		w.debouncer.Add(relPath, EventCreate)
 
 	case event.Has(fsnotify.Write):
@@ -165,14 +193,80 @@ func (w *Watcher) handleEvent(event fsnotify.Event, relPath string) {
 		w.debouncer.Add(relPath, EventDelete)
 
 	case event.Has(fsnotify.Rename):
-		// Rename is treated as delete (the new name will trigger a create)
-		w.debouncer.Add(relPath, EventDelete)
+		// The new name arrives as a create; until then this may be a delete
+		w.startRename(relPath)
 
 	case event.Has(fsnotify.Chmod):
 		// Ignore chmod events
 	}
 }
 
+// startRename remembers the old name of a renamed file. If no create for the
+// new name follows within renameWindow, the file was moved out of the vault.
+func (w *Watcher) startRename(relPath string) {
+	w.renameMu.Lock()
+	defer w.renameMu.Unlock()
+
+	if p := w.pendingRename; p != nil {
+		if p.path == relPath {
+			return // Reported again, e.g. by the directory's own watch
+		}
+		p.timer.Stop()
+		w.debouncer.Add(p.path, EventDelete)
+	}
+
+	p := &pendingRename{path: relPath}
+	p.timer = time.AfterFunc(renameWindow, func() {
+		w.renameMu.Lock()
+		defer w.renameMu.Unlock()
+		if w.pendingRename == p {
+			w.pendingRename = nil
+			w.debouncer.Add(p.path, EventDelete)
+		}
+	})
+	w.pendingRename = p
+}
+
+// takeRename returns and clears the pending old name, if any
+func (w *Watcher) takeRename() (string, bool) {
+	w.renameMu.Lock()
+	defer w.renameMu.Unlock()
+
+	p := w.pendingRename
+	if p == nil {
+		return "", false
+	}
+	p.timer.Stop()
+	w.pendingRename = nil
+	return p.path, true
+}
+
+// renameTree reports a rename for every file in a renamed directory
+func (w *Watcher) renameTree(oldDir, newDir string) {
+	root := filepath.Join(w.rootPath, filepath.FromSlash(newDir))
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(w.rootPath, path)
+		relPath = filepath.ToSlash(relPath)
+
+		if w.shouldIgnore(relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !w.shouldInclude(relPath) {
+			return nil
+		}
+
+		w.debouncer.AddRename(oldDir+strings.TrimPrefix(relPath, newDir), relPath)
+		return nil
+	})
+}
+
 // shouldIgnore checks if a path matches any ignore pattern
 func (w *Watcher) shouldIgnore(relPath string) bool {
 	for _, pattern := range w.ignorePatterns {
@@ -0,0 +1,39 @@
+-- +goose Up
+-- Publish row changes so running daemons can apply remote edits in real time.
+-- All schemas share one channel; listeners filter on the schema field.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_vault_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    PERFORM pg_notify('obsync_changes', json_build_object(
+        'schema', TG_TABLE_SCHEMA,
+        'table', TG_TABLE_NAME,
+        'op', TG_OP,
+        'path', rec.path,
+        'content_hash', rec.content_hash
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER vault_notes_notify
+    AFTER INSERT OR UPDATE OR DELETE ON vault_notes
+    FOR EACH ROW EXECUTE FUNCTION notify_vault_change();
+
+CREATE TRIGGER vault_attachments_notify
+    AFTER INSERT OR UPDATE OR DELETE ON vault_attachments
+    FOR EACH ROW EXECUTE FUNCTION notify_vault_change();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS vault_attachments_notify ON vault_attachments;
+DROP TRIGGER IF EXISTS vault_notes_notify ON vault_notes;
+DROP FUNCTION IF EXISTS notify_vault_change();
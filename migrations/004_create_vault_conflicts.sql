@@ -0,0 +1,25 @@
+-- +goose Up
+-- Record which device last wrote each row
+ALTER TABLE vault_notes ADD COLUMN synced_by TEXT;
+ALTER TABLE vault_attachments ADD COLUMN synced_by TEXT;
+
+CREATE TABLE vault_conflicts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    path TEXT NOT NULL,                  -- path that was edited on both sides
+    conflict_path TEXT NOT NULL,         -- copy holding the losing version
+    device TEXT,                         -- device that detected the conflict
+    remote_device TEXT,                  -- device that wrote the remote version
+    base_hash TEXT,                      -- last version both sides agreed on
+    local_hash TEXT NOT NULL,
+    remote_hash TEXT NOT NULL,
+    detected_at TIMESTAMPTZ DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ              -- set when the conflict copy is deleted
+);
+
+CREATE INDEX idx_conflicts_unresolved ON vault_conflicts (detected_at DESC) WHERE resolved_at IS NULL;
+CREATE INDEX idx_conflicts_conflict_path ON vault_conflicts (conflict_path);
+
+-- +goose Down
+DROP TABLE vault_conflicts;
+ALTER TABLE vault_attachments DROP COLUMN synced_by;
+ALTER TABLE vault_notes DROP COLUMN synced_by;
@@ -0,0 +1,48 @@
+-- +goose Up
+-- Keep every version of a note that gets overwritten or deleted
+CREATE TABLE vault_note_revisions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    path TEXT NOT NULL,
+    revision INTEGER NOT NULL,           -- numbered per path, 1 = oldest
+    raw_content TEXT NOT NULL,
+    content_hash TEXT NOT NULL,
+    synced_by TEXT,                      -- device that wrote this version
+    synced_at TIMESTAMPTZ,               -- when this version was written
+    replaced_at TIMESTAMPTZ DEFAULT NOW(),
+    deleted BOOLEAN DEFAULT FALSE,       -- replaced by a delete rather than an edit
+    UNIQUE (path, revision)
+);
+
+CREATE INDEX idx_note_revisions_replaced_at ON vault_note_revisions (replaced_at);
+CREATE INDEX idx_note_revisions_hash ON vault_note_revisions (path, content_hash);
+
+-- search_path is pinned so the trigger finds this schema's table
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION archive_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_hash = NEW.content_hash THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO vault_note_revisions (
+        path, revision, raw_content, content_hash, synced_by, synced_at, deleted
+    )
+    SELECT OLD.path, COALESCE(MAX(revision), 0) + 1, OLD.raw_content,
+        OLD.content_hash, OLD.synced_by, OLD.synced_at, TG_OP = 'DELETE'
+    FROM vault_note_revisions
+    WHERE path = OLD.path;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql
+SET search_path FROM CURRENT;
+-- +goose StatementEnd
+
+CREATE TRIGGER vault_notes_archive
+    AFTER UPDATE OR DELETE ON vault_notes
+    FOR EACH ROW EXECUTE FUNCTION archive_note_revision();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS vault_notes_archive ON vault_notes;
+DROP FUNCTION IF EXISTS archive_note_revision();
+DROP TABLE vault_note_revisions;
@@ -0,0 +1,134 @@
+-- +goose Up
+-- Deleted files are kept as tombstones so they can be restored from the trash
+-- and so other devices can tell a remote delete from a file never synced
+ALTER TABLE vault_notes ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE vault_notes ADD COLUMN deleted_by TEXT;
+ALTER TABLE vault_attachments ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE vault_attachments ADD COLUMN deleted_by TEXT;
+
+CREATE INDEX idx_notes_deleted_at ON vault_notes (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_attachments_deleted_at ON vault_attachments (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Moving a row to or from the trash is published as a delete or insert.
+-- Purging a row that is already in the trash is not published at all.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_vault_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+    op TEXT := TG_OP;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        IF OLD.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        ELSIF NEW.deleted_at IS NOT NULL THEN
+            op := 'DELETE';
+        ELSIF OLD.deleted_at IS NOT NULL THEN
+            op := 'INSERT';
+        END IF;
+    END IF;
+
+    PERFORM pg_notify('obsync_changes', json_build_object(
+        'schema', TG_TABLE_SCHEMA,
+        'table', TG_TABLE_NAME,
+        'op', op,
+        'path', rec.path,
+        'content_hash', rec.content_hash
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- Soft deletes keep the content in place, so only edits and purges of live
+-- rows are archived. A revision replaced while in the trash is marked deleted.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION archive_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_hash = NEW.content_hash THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'DELETE' AND OLD.deleted_at IS NOT NULL THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO vault_note_revisions (
+        path, revision, raw_content, content_hash, synced_by, synced_at, deleted
+    )
+    SELECT OLD.path, COALESCE(MAX(revision), 0) + 1, OLD.raw_content,
+        OLD.content_hash, OLD.synced_by, OLD.synced_at,
+        TG_OP = 'DELETE' OR OLD.deleted_at IS NOT NULL
+    FROM vault_note_revisions
+    WHERE path = OLD.path;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql
+SET search_path FROM CURRENT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION archive_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_hash = NEW.content_hash THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO vault_note_revisions (
+        path, revision, raw_content, content_hash, synced_by, synced_at, deleted
+    )
+    SELECT OLD.path, COALESCE(MAX(revision), 0) + 1, OLD.raw_content,
+        OLD.content_hash, OLD.synced_by, OLD.synced_at, TG_OP = 'DELETE'
+    FROM vault_note_revisions
+    WHERE path = OLD.path;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql
+SET search_path FROM CURRENT;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_vault_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    PERFORM pg_notify('obsync_changes', json_build_object(
+        'schema', TG_TABLE_SCHEMA,
+        'table', TG_TABLE_NAME,
+        'op', TG_OP,
+        'path', rec.path,
+        'content_hash', rec.content_hash
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- Files in the trash are gone for good once the columns are dropped
+DELETE FROM vault_notes WHERE deleted_at IS NOT NULL;
+DELETE FROM vault_attachments WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS idx_attachments_deleted_at;
+DROP INDEX IF EXISTS idx_notes_deleted_at;
+ALTER TABLE vault_attachments DROP COLUMN deleted_by;
+ALTER TABLE vault_attachments DROP COLUMN deleted_at;
+ALTER TABLE vault_notes DROP COLUMN deleted_by;
+ALTER TABLE vault_notes DROP COLUMN deleted_at;
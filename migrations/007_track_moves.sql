@@ -0,0 +1,164 @@
+-- +goose Up
+-- Revisions follow their note by id, so history survives renames and moves
+ALTER TABLE vault_note_revisions ADD COLUMN note_id UUID;
+
+UPDATE vault_note_revisions r SET note_id = n.id
+FROM vault_notes n
+WHERE n.path = r.path;
+
+ALTER TABLE vault_note_revisions DROP CONSTRAINT vault_note_revisions_path_revision_key;
+ALTER TABLE vault_note_revisions ADD CONSTRAINT vault_note_revisions_note_id_revision_key UNIQUE (note_id, revision);
+DROP INDEX IF EXISTS idx_note_revisions_hash;
+CREATE INDEX idx_note_revisions_hash ON vault_note_revisions (note_id, content_hash);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION archive_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_hash = NEW.content_hash THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'DELETE' AND OLD.deleted_at IS NOT NULL THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO vault_note_revisions (
+        note_id, path, revision, raw_content, content_hash, synced_by, synced_at, deleted
+    )
+    SELECT OLD.id, OLD.path, COALESCE(MAX(revision), 0) + 1, OLD.raw_content,
+        OLD.content_hash, OLD.synced_by, OLD.synced_at,
+        TG_OP = 'DELETE' OR OLD.deleted_at IS NOT NULL
+    FROM vault_note_revisions
+    WHERE note_id = OLD.id;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql
+SET search_path FROM CURRENT;
+-- +goose StatementEnd
+
+-- A path change is published as a single RENAME carrying the old path
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_vault_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+    op TEXT := TG_OP;
+    old_path TEXT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        IF OLD.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        ELSIF NEW.deleted_at IS NOT NULL THEN
+            op := 'DELETE';
+        ELSIF OLD.deleted_at IS NOT NULL THEN
+            op := 'INSERT';
+        ELSIF OLD.path <> NEW.path THEN
+            op := 'RENAME';
+            old_path := OLD.path;
+        END IF;
+    END IF;
+
+    PERFORM pg_notify('obsync_changes', json_build_object(
+        'schema', TG_TABLE_SCHEMA,
+        'table', TG_TABLE_NAME,
+        'op', op,
+        'path', rec.path,
+        'old_path', old_path,
+        'content_hash', rec.content_hash
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_vault_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+    op TEXT := TG_OP;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        IF OLD.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        ELSIF NEW.deleted_at IS NOT NULL THEN
+            op := 'DELETE';
+        ELSIF OLD.deleted_at IS NOT NULL THEN
+            op := 'INSERT';
+        END IF;
+    END IF;
+
+    PERFORM pg_notify('obsync_changes', json_build_object(
+        'schema', TG_TABLE_SCHEMA,
+        'table', TG_TABLE_NAME,
+        'op', op,
+        'path', rec.path,
+        'content_hash', rec.content_hash
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION archive_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_hash = NEW.content_hash THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'DELETE' AND OLD.deleted_at IS NOT NULL THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO vault_note_revisions (
+        path, revision, raw_content, content_hash, synced_by, synced_at, deleted
+    )
+    SELECT OLD.path, COALESCE(MAX(revision), 0) + 1, OLD.raw_content,
+        OLD.content_hash, OLD.synced_by, OLD.synced_at,
+        TG_OP = 'DELETE' OR OLD.deleted_at IS NOT NULL
+    FROM vault_note_revisions
+    WHERE path = OLD.path;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql
+SET search_path FROM CURRENT;
+-- +goose StatementEnd
+
+ALTER TABLE vault_note_revisions DROP CONSTRAINT vault_note_revisions_note_id_revision_key;
+
+-- Revisions of moved notes go back to being numbered by their current path
+UPDATE vault_note_revisions r SET path = n.path
+FROM vault_notes n
+WHERE n.id = r.note_id;
+
+UPDATE vault_note_revisions r SET revision = numbered.n
+FROM (
+    SELECT id, row_number() OVER (PARTITION BY path ORDER BY replaced_at, revision) AS n
+    FROM vault_note_revisions
+) numbered
+WHERE numbered.id = r.id;
+
+DROP INDEX IF EXISTS idx_note_revisions_hash;
+CREATE INDEX idx_note_revisions_hash ON vault_note_revisions (path, content_hash);
+ALTER TABLE vault_note_revisions ADD CONSTRAINT vault_note_revisions_path_revision_key UNIQUE (path, revision);
+ALTER TABLE vault_note_revisions DROP COLUMN note_id;
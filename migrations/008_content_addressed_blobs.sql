@@ -0,0 +1,32 @@
+-- +goose Up
+-- Attachment content is stored once per hash and shared by every path with that content
+CREATE TABLE vault_blobs (
+    content_hash TEXT PRIMARY KEY,
+    data BYTEA NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+INSERT INTO vault_blobs (content_hash, data, size_bytes)
+SELECT DISTINCT ON (content_hash) content_hash, data, octet_length(data)
+FROM vault_attachments
+WHERE data IS NOT NULL
+ORDER BY content_hash, synced_at DESC;
+
+-- NOT VALID keeps attachments that were stored without data; every new or
+-- updated row must reference a blob
+ALTER TABLE vault_attachments
+    ADD CONSTRAINT vault_attachments_content_hash_fkey
+    FOREIGN KEY (content_hash) REFERENCES vault_blobs (content_hash) NOT VALID;
+
+ALTER TABLE vault_attachments DROP COLUMN data;
+
+-- +goose Down
+ALTER TABLE vault_attachments ADD COLUMN data BYTEA;
+
+UPDATE vault_attachments a SET data = b.data
+FROM vault_blobs b
+WHERE b.content_hash = a.content_hash;
+
+ALTER TABLE vault_attachments DROP CONSTRAINT vault_attachments_content_hash_fkey;
+DROP TABLE vault_blobs;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Content of large attachments can live in an external blob store; the row
+-- then records the key it is stored under instead of the data
+ALTER TABLE vault_blobs ALTER COLUMN data DROP NOT NULL;
+ALTER TABLE vault_blobs ADD COLUMN storage_key TEXT;
+ALTER TABLE vault_blobs ADD CONSTRAINT vault_blobs_content_check
+    CHECK (data IS NOT NULL OR storage_key IS NOT NULL);
+
+-- +goose Down
+DELETE FROM vault_attachments WHERE content_hash IN (
+    SELECT content_hash FROM vault_blobs WHERE data IS NULL
+);
+DELETE FROM vault_blobs WHERE data IS NULL;
+ALTER TABLE vault_blobs DROP CONSTRAINT vault_blobs_content_check;
+ALTER TABLE vault_blobs DROP COLUMN storage_key;
+ALTER TABLE vault_blobs ALTER COLUMN data SET NOT NULL;
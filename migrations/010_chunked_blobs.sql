@@ -0,0 +1,42 @@
+-- +goose Up
+-- Attachment content is split into content-defined chunks, stored once per
+-- chunk hash, so large files are streamed and an edit only adds the chunks
+-- that changed
+CREATE TABLE vault_chunks (
+    chunk_hash TEXT PRIMARY KEY,
+    data BYTEA NOT NULL,
+    size_bytes INTEGER NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- The chunks of a blob, in order
+CREATE TABLE vault_blob_chunks (
+    content_hash TEXT NOT NULL REFERENCES vault_blobs (content_hash) ON DELETE CASCADE,
+    seq INTEGER NOT NULL,
+    chunk_hash TEXT NOT NULL REFERENCES vault_chunks (chunk_hash),
+    PRIMARY KEY (content_hash, seq)
+);
+
+CREATE INDEX idx_blob_chunks_chunk ON vault_blob_chunks (chunk_hash);
+
+-- Blobs written before this migration keep their content in data
+ALTER TABLE vault_blobs ADD COLUMN chunk_count INTEGER;
+ALTER TABLE vault_blobs DROP CONSTRAINT vault_blobs_content_check;
+ALTER TABLE vault_blobs ADD CONSTRAINT vault_blobs_content_check
+    CHECK (data IS NOT NULL OR storage_key IS NOT NULL OR chunk_count IS NOT NULL);
+
+-- +goose Down
+UPDATE vault_blobs b SET data = COALESCE((
+    SELECT string_agg(c.data, ''::bytea ORDER BY bc.seq)
+    FROM vault_blob_chunks bc
+    JOIN vault_chunks c ON c.chunk_hash = bc.chunk_hash
+    WHERE bc.content_hash = b.content_hash
+), ''::bytea)
+WHERE chunk_count IS NOT NULL;
+
+ALTER TABLE vault_blobs DROP CONSTRAINT vault_blobs_content_check;
+ALTER TABLE vault_blobs ADD CONSTRAINT vault_blobs_content_check
+    CHECK (data IS NOT NULL OR storage_key IS NOT NULL);
+ALTER TABLE vault_blobs DROP COLUMN chunk_count;
+DROP TABLE vault_blob_chunks;
+DROP TABLE vault_chunks;
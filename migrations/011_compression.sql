@@ -0,0 +1,90 @@
+-- +goose Up
+-- Note content and attachment data can be stored compressed. The codec
+-- column says how each row was written, so rows from before compression
+-- was enabled, or from devices with it turned off, read the same way.
+ALTER TABLE vault_notes ADD COLUMN content_codec TEXT NOT NULL DEFAULT 'none';
+ALTER TABLE vault_notes ADD COLUMN compressed_content BYTEA; -- raw_content is NULL when set
+
+ALTER TABLE vault_note_revisions ADD COLUMN content_codec TEXT NOT NULL DEFAULT 'none';
+ALTER TABLE vault_note_revisions ADD COLUMN compressed_content BYTEA;
+ALTER TABLE vault_note_revisions ALTER COLUMN raw_content DROP NOT NULL;
+
+ALTER TABLE vault_blobs ADD COLUMN codec TEXT NOT NULL DEFAULT 'none';
+ALTER TABLE vault_chunks ADD COLUMN codec TEXT NOT NULL DEFAULT 'none';
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION archive_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_hash = NEW.content_hash THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'DELETE' AND OLD.deleted_at IS NOT NULL THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO vault_note_revisions (
+        note_id, path, revision, raw_content, content_codec, compressed_content,
+        content_hash, synced_by, synced_at, deleted
+    )
+    SELECT OLD.id, OLD.path, COALESCE(MAX(revision), 0) + 1, OLD.raw_content,
+        OLD.content_codec, OLD.compressed_content,
+        OLD.content_hash, OLD.synced_by, OLD.synced_at,
+        TG_OP = 'DELETE' OR OLD.deleted_at IS NOT NULL
+    FROM vault_note_revisions
+    WHERE note_id = OLD.id;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql
+SET search_path FROM CURRENT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- Compressed content can't be decompressed in SQL, and would be unreadable
+-- without its codec
+-- +goose StatementBegin
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM vault_notes WHERE content_codec <> 'none')
+        OR EXISTS (SELECT 1 FROM vault_note_revisions WHERE content_codec <> 'none')
+        OR EXISTS (SELECT 1 FROM vault_blobs WHERE codec <> 'none')
+        OR EXISTS (SELECT 1 FROM vault_chunks WHERE codec <> 'none')
+    THEN
+        RAISE EXCEPTION 'the database holds compressed content; it can''t be migrated down';
+    END IF;
+END;
+$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION archive_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_hash = NEW.content_hash THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'DELETE' AND OLD.deleted_at IS NOT NULL THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO vault_note_revisions (
+        note_id, path, revision, raw_content, content_hash, synced_by, synced_at, deleted
+    )
+    SELECT OLD.id, OLD.path, COALESCE(MAX(revision), 0) + 1, OLD.raw_content,
+        OLD.content_hash, OLD.synced_by, OLD.synced_at,
+        TG_OP = 'DELETE' OR OLD.deleted_at IS NOT NULL
+    FROM vault_note_revisions
+    WHERE note_id = OLD.id;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql
+SET search_path FROM CURRENT;
+-- +goose StatementEnd
+
+ALTER TABLE vault_note_revisions ALTER COLUMN raw_content SET NOT NULL;
+ALTER TABLE vault_note_revisions DROP COLUMN compressed_content;
+ALTER TABLE vault_note_revisions DROP COLUMN content_codec;
+ALTER TABLE vault_chunks DROP COLUMN codec;
+ALTER TABLE vault_blobs DROP COLUMN codec;
+ALTER TABLE vault_notes DROP COLUMN compressed_content;
+ALTER TABLE vault_notes DROP COLUMN content_codec;
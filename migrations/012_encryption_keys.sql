@@ -0,0 +1,16 @@
+-- +goose Up
+-- Fingerprints of the keys a vault has been encrypted with. Devices compare
+-- their key with the active one before writing, so a device with the wrong
+-- key can't write content nobody else can read.
+CREATE TABLE vault_keys (
+    fingerprint TEXT PRIMARY KEY,        -- HMAC of a fixed string under the key
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    created_by TEXT,
+    retired_at TIMESTAMPTZ               -- Set when the key was rotated out
+);
+
+-- At most one key is active
+CREATE UNIQUE INDEX idx_keys_active ON vault_keys ((TRUE)) WHERE retired_at IS NULL;
+
+-- +goose Down
+DROP TABLE vault_keys;
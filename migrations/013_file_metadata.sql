@@ -0,0 +1,11 @@
+-- +goose Up
+-- File metadata restored when files are downloaded, so a pulled vault keeps
+-- its modification times and, if enabled, permissions
+ALTER TABLE vault_notes ADD COLUMN file_mode INTEGER;            -- Permission bits, NULL if not recorded
+ALTER TABLE vault_attachments ADD COLUMN modified_at TIMESTAMPTZ;
+ALTER TABLE vault_attachments ADD COLUMN file_mode INTEGER;
+
+-- +goose Down
+ALTER TABLE vault_attachments DROP COLUMN file_mode;
+ALTER TABLE vault_attachments DROP COLUMN modified_at;
+ALTER TABLE vault_notes DROP COLUMN file_mode;
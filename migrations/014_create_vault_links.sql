@@ -0,0 +1,27 @@
+-- +goose Up
+-- The link graph: every link in a note, with the note or attachment it
+-- resolves to. Links to files that don't exist yet are kept unresolved, so
+-- they resolve once the file is created.
+CREATE TABLE vault_links (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    source_note_id UUID NOT NULL REFERENCES vault_notes (id) ON DELETE CASCADE,
+    target TEXT NOT NULL,                -- path or name as written, without the anchor
+    link_type TEXT NOT NULL DEFAULT 'wikilink',
+    anchor TEXT,                         -- heading or ^block id after the #
+    alias TEXT,                          -- display text after the |
+    position INTEGER,                    -- byte offset in the note
+    line INTEGER,                        -- line in the note, from 1
+    target_note_id UUID REFERENCES vault_notes (id) ON DELETE SET NULL,
+    target_attachment_id UUID REFERENCES vault_attachments (id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_links_source ON vault_links (source_note_id);
+CREATE INDEX idx_links_target_note ON vault_links (target_note_id);
+CREATE INDEX idx_links_target_attachment ON vault_links (target_attachment_id);
+
+-- Existing links, without positions; the next full sync resolves them
+INSERT INTO vault_links (source_note_id, target)
+SELECT id, unnest(outgoing_links) FROM vault_notes;
+
+-- +goose Down
+DROP TABLE vault_links;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- Links to URLs outside the vault, kept apart from the link graph so the
+-- sites a vault references can be audited
+CREATE TABLE vault_external_links (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    source_note_id UUID NOT NULL REFERENCES vault_notes (id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    host TEXT,                           -- lowercased host, NULL for URLs without one (mailto:)
+    alias TEXT,                          -- link text
+    position INTEGER,                    -- byte offset in the note
+    line INTEGER                         -- line in the note, from 1
+);
+
+CREATE INDEX idx_external_links_source ON vault_external_links (source_note_id);
+CREATE INDEX idx_external_links_host ON vault_external_links (host);
+
+-- +goose Down
+DROP TABLE vault_external_links;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- The modification time of a note's file, restored when it is downloaded.
+-- modified_at is the note's own date, which the frontmatter can set.
+ALTER TABLE vault_notes ADD COLUMN file_modified_at TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE vault_notes DROP COLUMN file_modified_at;